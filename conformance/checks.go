@@ -0,0 +1,212 @@
+package conformance
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/amqp"
+	"starbyte.io/core/rpc"
+	s3io "starbyte.io/core/s3"
+)
+
+type checks struct {
+	violations []string
+}
+
+func (c *checks) violate(format string, args ...any) {
+	c.violations = append(c.violations, fmt.Sprintf(format, args...))
+}
+
+func validationError(err error) string {
+	return strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// checkMessage checks the envelope headers and the body of msg against the protocol schemas, it returns
+// false when the body is not JSON.
+func (r *run) checkMessage(c *checks, msg amqp.AmqpMessage, messageType rpc.MessageType) bool {
+	headers := amqp.MessageHeaders(msg)
+	if headers[rpc.VERSION_HEADER] == "" {
+		c.violate("%s has no %s header", messageType, rpc.VERSION_HEADER)
+	} else {
+		envelope := map[string]any{}
+		for key, value := range headers {
+			envelope[key] = value
+		}
+		if err := r.schemas[rpc.ENVELOPE_SCHEMA].Validate(envelope); err != nil {
+			c.violate("%s envelope does not match its schema: %s", messageType, validationError(err))
+		}
+	}
+
+	var body any
+	if err := json.Unmarshal(msg.Payload(), &body); err != nil {
+		c.violate("%s body is not json: %s", messageType, err)
+		return false
+	}
+	schema := r.schemas[fmt.Sprintf("schema/%s.schema.json", messageType)]
+	if err := schema.Validate(body); err != nil {
+		c.violate("%s body does not match its schema: %s", messageType, validationError(err))
+	}
+	return true
+}
+
+// receive returns the next response, every response is acknowledged. It returns false after timeout.
+func (r *run) receive(ctx context.Context, c *checks, timeout time.Duration) (rpc.ProcessResponse, bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case msg, ok := <-r.responses:
+			if !ok {
+				return rpc.ProcessResponse{}, false
+			}
+			msg.Ack(false)
+			if !r.checkMessage(c, msg, rpc.PROCESS_RESPONSE) {
+				continue
+			}
+			response, err := rpc.DecodeProcessResponse(msg)
+			if err != nil {
+				c.violate("response can not be decoded: %s", err)
+				continue
+			}
+			return response, true
+		case <-deadline:
+			return rpc.ProcessResponse{}, false
+		case <-ctx.Done():
+			return rpc.ProcessResponse{}, false
+		}
+	}
+}
+
+// awaitResponse returns the response to correlationId, responses to other requests are violations.
+func (r *run) awaitResponse(ctx context.Context, c *checks, correlationId uuid.UUID) (rpc.ProcessResponse, bool) {
+	deadline := time.Now().Add(r.harness.Timeout)
+	for {
+		select {
+		case <-r.exited:
+			c.violate("worker exited while a response was expected: %v", r.exitErr)
+			return rpc.ProcessResponse{}, false
+		default:
+		}
+
+		response, ok := r.receive(ctx, c, min(time.Until(deadline), time.Second))
+		if ok && response.CorrelationId == correlationId {
+			return response, true
+		}
+		if ok {
+			c.violate("unexpected response with correlation id %s", response.CorrelationId)
+		}
+		if time.Now().After(deadline) {
+			c.violate("no response to request %s within %s", correlationId, r.harness.Timeout)
+			return rpc.ProcessResponse{}, false
+		}
+	}
+}
+
+func (r *run) request(ctx context.Context, c *checks, request rpc.ProcessRequest) bool {
+	if err := rpc.Publish(ctx, r.broker, r.step.GetReqQueueName(), request, "conformance"); err != nil {
+		c.violate("can not publish request: %s", err)
+		return false
+	}
+	return true
+}
+
+// newRequest returns a request of a new batch, step workers read records from the batch written at ResourceUri.
+func (r *run) newRequest(ctx context.Context, c *checks) (rpc.ProcessRequest, bool) {
+	request := rpc.ProcessRequest{ResultUri: r.batchUri("result"), CorrelationId: uuid.New()}
+	if r.target.Kind == INPUT {
+		return request, true
+	}
+
+	request.ResourceUri = r.batchUri("input")
+	if err := writeBatch(ctx, request.ResourceUri, r.target.Records); err != nil {
+		c.violate("can not write input batch: %s", err)
+		return request, false
+	}
+	return request, true
+}
+
+// checkBatch reads the result batch at uri, it must match its stored manifest and the manifest of the response.
+func (r *run) checkBatch(ctx context.Context, c *checks, uri string, manifest *s3io.Manifest) {
+	stored, err := s3io.ReadManifest(ctx, uri)
+	switch {
+	case err != nil:
+		c.violate("manifest of batch %s can not be read: %s", uri, err)
+	case stored == nil:
+		c.violate("batch %s has no manifest", uri)
+	case manifest == nil:
+		c.violate("response has no manifest")
+	default:
+		if err := stored.Verify(*manifest); err != nil {
+			c.violate("response manifest does not match the stored manifest: %s", err)
+		}
+	}
+
+	stream, err := s3io.Read(ctx, uri)
+	if err != nil {
+		c.violate("batch %s can not be read: %s", uri, err)
+		return
+	}
+
+	format, codec := s3io.Format(""), s3io.Codec("")
+	if stored != nil {
+		format, codec = stored.Format, stored.Codec
+	}
+	reader, err := s3io.NewRecordReader(stream, format, codec)
+	if err != nil {
+		stream.Close()
+		c.violate("batch %s can not be decoded: %s", uri, err)
+		return
+	}
+	defer reader.Close()
+
+	for count := 0; ; count++ {
+		_, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			c.violate("record %d of batch %s can not be decoded: %s", count, uri, err)
+			return
+		}
+	}
+	if stored != nil {
+		if err := reader.Verify(*stored); err != nil {
+			c.violate("batch %s does not match its manifest: %s", uri, err)
+		}
+	}
+}
+
+// writeBatch writes records as a batch with its manifest, in the default format.
+func writeBatch(ctx context.Context, uri string, records []any) error {
+	out, in := io.Pipe()
+	recordWriter, err := s3io.NewRecordWriter(in, s3io.DefaultBatchOptions)
+	if err != nil {
+		return err
+	}
+
+	manifestCh := make(chan s3io.Manifest, 1)
+	go func() {
+		var err error
+		for _, record := range records {
+			if err = recordWriter.Write(record); err != nil {
+				break
+			}
+		}
+		if closeErr := recordWriter.Close(); err == nil {
+			err = closeErr
+		}
+		manifestCh <- recordWriter.Manifest()
+		in.CloseWithError(err)
+	}()
+
+	if err := s3io.Write(ctx, uri, out); err != nil {
+		out.CloseWithError(err)
+		return err
+	}
+	return s3io.WriteManifest(ctx, uri, <-manifestCh)
+}
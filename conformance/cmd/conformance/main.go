@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"starbyte.io/conformance"
+	"starbyte.io/core/worker"
+)
+
+var defaultRecords = []any{
+	map[string]any{"id": 1, "name": "first"},
+	map[string]any{"id": 2, "name": "second"},
+	map[string]any{"id": 3, "name": "third"},
+}
+
+func main() {
+	kind := flag.String("kind", string(conformance.STEP), "kind of the worker under test, step or input")
+	timeout := flag.Duration("timeout", conformance.DEFAULT_TIMEOUT, "timeout of every wait for the worker")
+	broker := flag.String("broker", "", "broker uri, an embedded NATS JetStream server when empty")
+	storage := flag.String("storage", "", "blob store root of batches, a temporary directory when empty")
+	config := flag.String("config", "", "LIGHTBYTE_WORKER_CONFIG of the worker under test")
+	records := flag.String("records", "", "json file with an array of records written to step input batches")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] worker-command [args...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	if *kind != string(conformance.STEP) && *kind != string(conformance.INPUT) {
+		log.Fatalf("unknown worker kind %q", *kind)
+	}
+
+	target := conformance.Target{
+		Kind:    conformance.Kind(*kind),
+		Start:   conformance.Command(os.Stderr, flag.Arg(0), flag.Args()[1:]...),
+		Records: defaultRecords,
+	}
+	if *records != "" {
+		data, err := os.ReadFile(*records)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := json.Unmarshal(data, &target.Records); err != nil {
+			log.Fatalf("can not decode records: %s", err)
+		}
+	}
+
+	harness := conformance.Harness{BrokerUri: *broker, StorageUri: *storage, Timeout: *timeout, Env: map[string]string{}}
+	if *config != "" {
+		harness.Env[worker.LIGHTBYTE_WORKER_CONFIG] = *config
+	}
+
+	report, err := harness.Run(context.Background(), target)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(report)
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"starbyte.io/conformance/spec"
+)
+
+func main() {
+	root := flag.String("root", ".", "repository root")
+	output := flag.String("o", "", "output file, standard output when empty")
+	flag.Parse()
+
+	doc, err := spec.Generate(*root)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *output == "" {
+		os.Stdout.Write(doc)
+		return
+	}
+	if err := os.WriteFile(*output, doc, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
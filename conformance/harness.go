@@ -0,0 +1,260 @@
+// Package conformance drives a worker under test through the scenarios of the worker protocol,
+// on a local broker and blob store, and reports the violations of the protocol it observes.
+package conformance
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"starbyte.io/coordinator/db"
+	"starbyte.io/core/amqp"
+	"starbyte.io/core/rpc"
+	s3io "starbyte.io/core/s3"
+	"starbyte.io/core/worker"
+)
+
+const (
+	DEFAULT_TIMEOUT            = 30 * time.Second
+	DEFAULT_HEARTBEAT_INTERVAL = 200 * time.Millisecond
+	// MAX_INPUT_BATCHES bounds the requests sent to an input worker which never answers ALLDONE
+	MAX_INPUT_BATCHES = 1000
+	INSTANCE_ID       = "conformance-worker"
+)
+
+type Kind string
+
+const (
+	STEP  Kind = "step"
+	INPUT Kind = "input"
+)
+
+// Worker is a running worker under test.
+type Worker interface {
+	// Stop asks the worker to shut down like SIGTERM does
+	Stop() error
+	// Kill stops a worker which did not shut down in time
+	Kill() error
+	// Wait returns once the worker exited, with the error it exited with
+	Wait() error
+}
+
+// Target is the worker under test.
+type Target struct {
+	Kind Kind
+	// Start starts the worker with the harness environment variables
+	Start func(env map[string]string) (Worker, error)
+	// Records are written to the input batches of step workers
+	Records []any
+}
+
+// Harness runs the scenarios. Input workers must be configured with a source of at least one record.
+type Harness struct {
+	// BrokerUri is the broker the worker connects to, a NATS JetStream server is started when empty
+	BrokerUri string
+	// StorageUri is the blob store root of batches, a temporary directory when empty
+	StorageUri string
+	// Timeout bounds every wait for the worker
+	Timeout time.Duration
+	// Env is added to the environment of the worker, e.g. its LIGHTBYTE_WORKER_CONFIG
+	Env map[string]string
+}
+
+// Result lists the violations observed in a scenario.
+type Result struct {
+	Scenario   string
+	Violations []string
+}
+
+type Report struct {
+	Results []Result
+}
+
+func (report Report) Failed() bool {
+	for _, result := range report.Results {
+		if len(result.Violations) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (report Report) String() string {
+	lines := []string{}
+	for _, result := range report.Results {
+		if len(result.Violations) == 0 {
+			lines = append(lines, fmt.Sprintf("PASS %s", result.Scenario))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("FAIL %s", result.Scenario))
+		for _, violation := range result.Violations {
+			lines = append(lines, "\t"+violation)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// run is the state of a harness run, shared by the scenarios.
+type run struct {
+	harness    *Harness
+	target     Target
+	broker     amqp.Amqp
+	step       db.Step
+	storageUri string
+	responses  <-chan amqp.AmqpMessage
+	heartbeats <-chan amqp.AmqpMessage
+	schemas    map[string]*jsonschema.Schema
+	worker     Worker
+	// exited is closed once the worker exited with exitErr
+	exited  chan struct{}
+	exitErr error
+}
+
+// Run starts the worker and runs the scenarios of its kind, the error is returned when the harness itself fails.
+func (harness *Harness) Run(ctx context.Context, target Target) (Report, error) {
+	if harness.Timeout <= 0 {
+		harness.Timeout = DEFAULT_TIMEOUT
+	}
+
+	brokerUri := harness.BrokerUri
+	if brokerUri == "" {
+		dir, err := os.MkdirTemp("", "conformance-broker")
+		if err != nil {
+			return Report{}, err
+		}
+		defer os.RemoveAll(dir)
+
+		server, uri, err := startNatsServer(dir)
+		if err != nil {
+			return Report{}, err
+		}
+		defer server.Shutdown()
+		brokerUri = uri
+	}
+
+	storageUri := harness.StorageUri
+	if storageUri == "" {
+		dir, err := os.MkdirTemp("", "conformance-storage")
+		if err != nil {
+			return Report{}, err
+		}
+		defer os.RemoveAll(dir)
+		storageUri = "file://" + dir
+	}
+
+	schemas, err := compileSchemas()
+	if err != nil {
+		return Report{}, err
+	}
+
+	broker, err := amqp.NewBroker(brokerUri)
+	if err != nil {
+		return Report{}, err
+	}
+	if err := broker.Connect(ctx, brokerUri); err != nil {
+		return Report{}, err
+	}
+	defer broker.Close()
+
+	r := &run{
+		harness:    harness,
+		target:     target,
+		broker:     broker,
+		step:       db.Step{Id: uuid.New(), Name: "conformance"},
+		storageUri: storageUri,
+		schemas:    schemas,
+		exited:     make(chan struct{}),
+	}
+
+	if err := r.declareQueues(ctx); err != nil {
+		return Report{}, err
+	}
+
+	env := map[string]string{
+		worker.LIGHTBYTE_WORKER_AMQP_URI:              brokerUri,
+		worker.LIGHTBYTE_WORKER_LISTEN_QUEUE:          r.step.GetReqQueueName(),
+		worker.LIGHTBYTE_WORKER_RESPONSE_QUEUE:        r.step.GetRespQueueName(),
+		worker.LIGHTBYTE_WORKER_HEARTBEAT_QUEUE:       r.step.GetHeartbeatQueueName(),
+		worker.LIGHTBYTE_WORKER_HEARTBEAT_INTERVAL:    fmt.Sprint(DEFAULT_HEARTBEAT_INTERVAL.Milliseconds()),
+		worker.LIGHTBYTE_WORKER_STEP_ID:               r.step.Id.String(),
+		worker.LIGHTBYTE_WORKER_INSTANCE_ID:           INSTANCE_ID,
+		worker.LIGHTBYTE_WORKER_SHUTDOWN_GRACE_PERIOD: fmt.Sprint(harness.Timeout.Milliseconds() / 2),
+	}
+	for name, value := range harness.Env {
+		env[name] = value
+	}
+
+	started, err := target.Start(env)
+	if err != nil {
+		return Report{Results: []Result{{Scenario: "start", Violations: []string{fmt.Sprintf("worker does not start: %s", err)}}}}, nil
+	}
+	r.worker = started
+	go func() {
+		r.exitErr = started.Wait()
+		close(r.exited)
+	}()
+
+	report := Report{}
+	for _, scenario := range scenarios(target.Kind) {
+		checks := &checks{}
+		scenario.run(ctx, r, checks)
+		report.Results = append(report.Results, Result{Scenario: scenario.name, Violations: checks.violations})
+	}
+
+	return report, nil
+}
+
+func (r *run) declareQueues(ctx context.Context) error {
+	deadLetter := r.step.GetDeadLetterQueueName()
+	for _, queue := range []string{r.step.GetReqQueueName(), r.step.GetRespQueueName()} {
+		if err := r.broker.QueueDeclare(queue, deadLetter); err != nil {
+			return err
+		}
+	}
+	if err := r.broker.QueueDeclare(r.step.GetHeartbeatQueueName(), ""); err != nil {
+		return err
+	}
+
+	var err error
+	if r.responses, err = r.broker.Messages(ctx, r.step.GetRespQueueName()); err != nil {
+		return err
+	}
+	r.heartbeats, err = r.broker.Messages(ctx, r.step.GetHeartbeatQueueName())
+	return err
+}
+
+func compileSchemas() (map[string]*jsonschema.Schema, error) {
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+
+	names := []string{rpc.ENVELOPE_SCHEMA}
+	for _, messageType := range []rpc.MessageType{rpc.PROCESS_REQUEST, rpc.PROCESS_RESPONSE, rpc.HEARTBEAT} {
+		names = append(names, fmt.Sprintf("schema/%s.schema.json", messageType))
+	}
+
+	schemas := map[string]*jsonschema.Schema{}
+	for _, name := range names {
+		file, err := rpc.Schemas.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		err = compiler.AddResource(name, file)
+		file.Close()
+		if err != nil {
+			return nil, err
+		}
+		if schemas[name], err = compiler.Compile(name); err != nil {
+			return nil, fmt.Errorf("can not compile %s: %w", name, err)
+		}
+	}
+	return schemas, nil
+}
+
+// batchUri returns a new batch uri of the harness storage.
+func (r *run) batchUri(name string) string {
+	return s3io.JoinUri(r.storageUri, fmt.Sprintf("%s-%s%s", name, uuid.NewString(), s3io.DefaultBatchOptions.Extension()))
+}
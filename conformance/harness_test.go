@@ -0,0 +1,164 @@
+package conformance
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/amqp"
+	"starbyte.io/core/rpc"
+	"starbyte.io/core/worker"
+)
+
+type identityStep struct{}
+
+func (identityStep) Transform(record any) (any, error) {
+	return record, nil
+}
+
+type recordsInput struct {
+	count int
+}
+
+func (input recordsInput) Read(ctx context.Context, output chan<- any) error {
+	defer close(output)
+	for i := 0; i < input.count; i++ {
+		select {
+		case output <- map[string]any{"id": i}:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+	return nil
+}
+
+// contextWorker runs a worker in process, Stop cancels its context like SIGTERM.
+type contextWorker struct {
+	cancel context.CancelFunc
+	done   chan error
+}
+
+func (w *contextWorker) Stop() error { w.cancel(); return nil }
+func (w *contextWorker) Kill() error { w.cancel(); return nil }
+func (w *contextWorker) Wait() error { return <-w.done }
+
+func startInProcess(t *testing.T, run func(ctx context.Context) error) Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &contextWorker{cancel: cancel, done: make(chan error, 1)}
+	go func() { w.done <- run(ctx) }()
+	return w
+}
+
+func setEnv(t *testing.T, env map[string]string) {
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+}
+
+func expectConformance(t *testing.T, report Report) {
+	t.Helper()
+	if report.Failed() {
+		t.Errorf("expected no violations:\n%s", report)
+	}
+	if len(report.Results) == 0 {
+		t.Errorf("expected scenario results")
+	}
+}
+
+func TestStepWorkerConforms(t *testing.T) {
+	harness := Harness{Timeout: 10 * time.Second}
+	report, err := harness.Run(context.Background(), Target{
+		Kind:    STEP,
+		Records: []any{map[string]any{"id": 1}, map[string]any{"id": 2}},
+		Start: func(env map[string]string) (Worker, error) {
+			setEnv(t, env)
+			step, err := worker.NewStepWorker(identityStep{})
+			if err != nil {
+				return nil, err
+			}
+			return startInProcess(t, step.RunContext), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("harness failed: %s", err)
+	}
+	expectConformance(t, report)
+}
+
+func TestInputWorkerConforms(t *testing.T) {
+	harness := Harness{Timeout: 10 * time.Second, Env: map[string]string{worker.LIGHTBYTE_WORKER_BATCH_SIZE: "2"}}
+	report, err := harness.Run(context.Background(), Target{
+		Kind: INPUT,
+		Start: func(env map[string]string) (Worker, error) {
+			setEnv(t, env)
+			input, err := worker.NewInputWorker(recordsInput{count: 5})
+			if err != nil {
+				return nil, err
+			}
+			return startInProcess(t, input.RunContext), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("harness failed: %s", err)
+	}
+	expectConformance(t, report)
+}
+
+// TestBrokenWorkerViolates answers every request with another correlation id and without envelope.
+func TestBrokenWorkerViolates(t *testing.T) {
+	harness := Harness{Timeout: 2 * time.Second}
+	report, err := harness.Run(context.Background(), Target{
+		Kind: STEP,
+		Start: func(env map[string]string) (Worker, error) {
+			uri := env[worker.LIGHTBYTE_WORKER_AMQP_URI]
+			broker, err := amqp.NewBroker(uri)
+			if err != nil {
+				return nil, err
+			}
+			if err := broker.Connect(context.Background(), uri); err != nil {
+				return nil, err
+			}
+			return startInProcess(t, func(ctx context.Context) error {
+				defer broker.Close()
+				messages, err := broker.Messages(ctx, env[worker.LIGHTBYTE_WORKER_LISTEN_QUEUE])
+				if err != nil {
+					return err
+				}
+				for msg := range messages {
+					msg.Ack(false)
+					broker.Publish(ctx, env[worker.LIGHTBYTE_WORKER_RESPONSE_QUEUE], rpc.ProcessResponse{CorrelationId: uuid.New(), Status: rpc.OK})
+				}
+				return nil
+			}), nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("harness failed: %s", err)
+	}
+
+	if !report.Failed() {
+		t.Fatalf("expected violations:\n%s", report)
+	}
+	for _, expected := range []string{"no heartbeat", "unexpected response with correlation id", "has no " + rpc.VERSION_HEADER} {
+		if !strings.Contains(report.String(), expected) {
+			t.Errorf("expected violation %q:\n%s", expected, report)
+		}
+	}
+}
+
+func TestCommandWorker(t *testing.T) {
+	start := Command(os.Stderr, "sleep", "60")
+	w, err := start(map[string]string{"LIGHTBYTE_CONFORMANCE_TEST": "1"})
+	if err != nil {
+		t.Fatalf("can not start command: %s", err)
+	}
+	if err := w.Stop(); err != nil {
+		t.Fatalf("can not stop command: %s", err)
+	}
+	if err := w.Wait(); err == nil {
+		t.Errorf("expected the terminated command to exit with an error")
+	}
+}
@@ -0,0 +1,69 @@
+package conformance
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"github.com/nats-io/nats-server/v2/server"
+)
+
+// Command starts the worker under test as the process name with args, its environment is the
+// environment of the harness with the harness variables added. Its output is written to output.
+func Command(output io.Writer, name string, args ...string) func(env map[string]string) (Worker, error) {
+	return func(env map[string]string) (Worker, error) {
+		cmd := exec.Command(name, args...)
+		cmd.Env = os.Environ()
+		for key, value := range env {
+			cmd.Env = append(cmd.Env, key+"="+value)
+		}
+		cmd.Stdout = output
+		cmd.Stderr = output
+
+		if err := cmd.Start(); err != nil {
+			return nil, err
+		}
+		return &processWorker{cmd: cmd}, nil
+	}
+}
+
+type processWorker struct {
+	cmd *exec.Cmd
+}
+
+func (worker *processWorker) Stop() error {
+	return worker.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+func (worker *processWorker) Kill() error {
+	return worker.cmd.Process.Kill()
+}
+
+func (worker *processWorker) Wait() error {
+	return worker.cmd.Wait()
+}
+
+var errNatsNotReady = errors.New("nats server is not ready for connections")
+
+// startNatsServer starts a NATS JetStream server storing its streams in dir, on a random local port.
+func startNatsServer(dir string) (*server.Server, string, error) {
+	srv, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      server.RANDOM_PORT,
+		JetStream: true,
+		StoreDir:  dir,
+		NoSigs:    true,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	go srv.Start()
+	if !srv.ReadyForConnections(DEFAULT_TIMEOUT) {
+		srv.Shutdown()
+		return nil, "", errNatsNotReady
+	}
+	return srv, srv.ClientURL(), nil
+}
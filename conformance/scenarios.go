@@ -0,0 +1,272 @@
+package conformance
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/amqp"
+	"starbyte.io/core/rpc"
+)
+
+// MALFORMED_REQUESTS is the number of requests published by the malformed scenario.
+const MALFORMED_REQUESTS = 3
+
+type scenario struct {
+	name string
+	run  func(ctx context.Context, r *run, c *checks)
+}
+
+func scenarios(kind Kind) []scenario {
+	if kind == INPUT {
+		return []scenario{
+			{"heartbeat", checkHeartbeat},
+			{"request_response", checkInputBatch},
+			{"error", checkInputError},
+			{"malformed", checkMalformed},
+			{"all_done", checkAllDone},
+			{"termination", checkTermination},
+		}
+	}
+	return []scenario{
+		{"heartbeat", checkHeartbeat},
+		{"request_response", checkStepBatch},
+		{"error", checkStepError},
+		{"malformed", checkMalformed},
+		{"termination", checkTermination},
+	}
+}
+
+// checkHeartbeat expects a heartbeat of the worker instance.
+func checkHeartbeat(ctx context.Context, r *run, c *checks) {
+	select {
+	case msg, ok := <-r.heartbeats:
+		if !ok {
+			return
+		}
+		msg.Ack(false)
+		if !r.checkMessage(c, msg, rpc.HEARTBEAT) {
+			return
+		}
+		heartbeat, err := rpc.DecodeHeartbeat(msg)
+		if err != nil {
+			c.violate("heartbeat can not be decoded: %s", err)
+			return
+		}
+		if heartbeat.StepId != r.step.Id || heartbeat.InstanceId != INSTANCE_ID {
+			c.violate("heartbeat of step %s instance %q, expected step %s instance %q", heartbeat.StepId, heartbeat.InstanceId, r.step.Id, INSTANCE_ID)
+		}
+	case <-time.After(r.harness.Timeout):
+		c.violate("no heartbeat within %s", r.harness.Timeout)
+	case <-ctx.Done():
+	}
+}
+
+// checkStepBatch expects the records of a batch to be processed into the result batch.
+func checkStepBatch(ctx context.Context, r *run, c *checks) {
+	request, ok := r.newRequest(ctx, c)
+	if !ok || !r.request(ctx, c, request) {
+		return
+	}
+
+	response, ok := r.awaitResponse(ctx, c, request.CorrelationId)
+	if !ok {
+		return
+	}
+	if response.Status != rpc.OK {
+		c.violate("expected status %s, got %s: %s", rpc.OK, response.Status, response.Error)
+		return
+	}
+	if response.ResultUri != request.ResultUri {
+		c.violate("expected result uri %s, got %s", request.ResultUri, response.ResultUri)
+	}
+	r.checkBatch(ctx, c, request.ResultUri, response.Manifest)
+}
+
+// checkInputBatch expects the first batch of the input source.
+func checkInputBatch(ctx context.Context, r *run, c *checks) {
+	request, _ := r.newRequest(ctx, c)
+	if !r.request(ctx, c, request) {
+		return
+	}
+
+	response, ok := r.awaitResponse(ctx, c, request.CorrelationId)
+	if !ok {
+		return
+	}
+	if response.Status != rpc.OK {
+		c.violate("expected status %s for the first batch, got %s: %s", rpc.OK, response.Status, response.Error)
+		return
+	}
+	r.checkBatch(ctx, c, request.ResultUri, response.Manifest)
+}
+
+func expectError(ctx context.Context, r *run, c *checks, request rpc.ProcessRequest) {
+	if !r.request(ctx, c, request) {
+		return
+	}
+
+	response, ok := r.awaitResponse(ctx, c, request.CorrelationId)
+	if !ok {
+		return
+	}
+	if response.Status != rpc.ERROR {
+		c.violate("expected status %s, got %s", rpc.ERROR, response.Status)
+	}
+	if response.Error == "" {
+		c.violate("error response without error message")
+	}
+}
+
+// checkStepError expects an error response to a request of a batch which does not exist.
+func checkStepError(ctx context.Context, r *run, c *checks) {
+	expectError(ctx, r, c, rpc.ProcessRequest{
+		ResourceUri:   r.batchUri("missing"),
+		ResultUri:     r.batchUri("result"),
+		CorrelationId: uuid.New(),
+	})
+}
+
+// checkInputError expects an error response to a request of an unknown batch format.
+func checkInputError(ctx context.Context, r *run, c *checks) {
+	expectError(ctx, r, c, rpc.ProcessRequest{
+		ResultUri:     r.batchUri("result"),
+		CorrelationId: uuid.New(),
+		Format:        "unknown",
+	})
+}
+
+// checkMalformed expects malformed requests to be dead-lettered without response, and the
+// worker to answer the next request.
+func checkMalformed(ctx context.Context, r *run, c *checks) {
+	queue := r.step.GetReqQueueName()
+	unsupported := rpc.Envelope{Version: "2.0", Type: rpc.PROCESS_REQUEST}
+	valid, ok := r.newRequest(ctx, c)
+	if !ok {
+		return
+	}
+
+	malformed := []error{
+		amqp.PublishWithHeaders(ctx, r.broker, queue, rpc.ProcessRequest{ResultUri: r.batchUri("result"), CorrelationId: uuid.New()}, unsupported.Headers()),
+		r.broker.Publish(ctx, queue, map[string]any{"ResultUri": r.batchUri("result")}),
+		r.broker.Publish(ctx, queue, "not a request"),
+	}
+	for _, err := range malformed {
+		if err != nil {
+			c.violate("can not publish malformed request: %s", err)
+			return
+		}
+	}
+
+	if !r.request(ctx, c, valid) {
+		return
+	}
+	if response, ok := r.awaitResponse(ctx, c, valid.CorrelationId); ok && response.Status == rpc.ERROR {
+		c.violate("request after malformed requests failed: %s", response.Error)
+	}
+
+	inspector, ok := r.broker.(amqp.AmqpDeadLetterInspector)
+	if !ok {
+		return
+	}
+	deadline := time.Now().Add(r.harness.Timeout)
+	for {
+		letters, err := inspector.DeadLetters(ctx, r.step.GetDeadLetterQueueName(), MALFORMED_REQUESTS+1)
+		if err != nil {
+			c.violate("can not read dead letters: %s", err)
+			return
+		}
+		if len(letters) >= MALFORMED_REQUESTS {
+			return
+		}
+		if time.Now().After(deadline) {
+			c.violate("%d of %d malformed requests dead-lettered within %s", len(letters), MALFORMED_REQUESTS, r.harness.Timeout)
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// checkAllDone requests batches until the input worker answers ALLDONE.
+func checkAllDone(ctx context.Context, r *run, c *checks) {
+	for i := 0; i < MAX_INPUT_BATCHES; i++ {
+		request, _ := r.newRequest(ctx, c)
+		if !r.request(ctx, c, request) {
+			return
+		}
+		response, ok := r.awaitResponse(ctx, c, request.CorrelationId)
+		if !ok {
+			return
+		}
+
+		switch response.Status {
+		case rpc.ALLDONE:
+			return
+		case rpc.OK:
+			r.checkBatch(ctx, c, request.ResultUri, response.Manifest)
+		default:
+			c.violate("expected status %s or %s, got %s: %s", rpc.OK, rpc.ALLDONE, response.Status, response.Error)
+			return
+		}
+	}
+	c.violate("no %s after %d batches", rpc.ALLDONE, MAX_INPUT_BATCHES)
+}
+
+// checkTermination stops the worker while it processes a request, the worker must exit in time
+// and either answer the request or leave it queued.
+func checkTermination(ctx context.Context, r *run, c *checks) {
+	var request rpc.ProcessRequest
+	inFlight := false
+	select {
+	case <-r.exited:
+		// input workers may exit once their source is exhausted
+	default:
+		if r.target.Kind == STEP {
+			request, inFlight = r.newRequest(ctx, c)
+			inFlight = inFlight && r.request(ctx, c, request)
+		}
+		if err := r.worker.Stop(); err != nil {
+			c.violate("can not stop worker: %s", err)
+		}
+	}
+
+	select {
+	case <-r.exited:
+		if r.exitErr != nil {
+			c.violate("worker exited with error: %s", r.exitErr)
+		}
+	case <-time.After(r.harness.Timeout):
+		c.violate("worker did not exit within %s", r.harness.Timeout)
+		r.worker.Kill()
+		<-r.exited
+		return
+	}
+
+	if inFlight {
+		checkAnsweredOrQueued(ctx, r, c, request.CorrelationId)
+	}
+}
+
+func checkAnsweredOrQueued(ctx context.Context, r *run, c *checks, correlationId uuid.UUID) {
+	if response, ok := r.receive(ctx, c, time.Second); ok {
+		if response.CorrelationId != correlationId {
+			c.violate("unexpected response with correlation id %s", response.CorrelationId)
+		}
+		return
+	}
+
+	consumeCtx, cancel := context.WithTimeout(ctx, r.harness.Timeout)
+	defer cancel()
+	requests, err := r.broker.Messages(consumeCtx, r.step.GetReqQueueName())
+	if err != nil {
+		c.violate("can not consume requests: %s", err)
+		return
+	}
+	for msg := range requests {
+		msg.Ack(false)
+		if request, err := rpc.DecodeProcessRequest(msg); err == nil && request.CorrelationId == correlationId {
+			return
+		}
+	}
+	c.violate("request %s was neither answered nor requeued on shutdown", correlationId)
+}
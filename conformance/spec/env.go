@@ -0,0 +1,110 @@
+package spec
+
+import (
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const ENV_PREFIX = "LIGHTBYTE_"
+
+// EnvVar is an environment variable read by the Go worker runtime.
+type EnvVar struct {
+	Name     string
+	Package  string
+	Type     string
+	Required bool
+	// Min is the Go expression of the lowest accepted value of numbers
+	Min string
+}
+
+// ReadEnvVars collects the LIGHTBYTE_ constants declared by the Go packages in dirs, and how
+// the worker env reader reads them. Variables read with os.Getenv are strings.
+func ReadEnvVars(dirs ...string) ([]EnvVar, error) {
+	vars := map[string]*EnvVar{}
+	fset := token.NewFileSet()
+
+	for _, dir := range dirs {
+		files, err := filepath.Glob(filepath.Join(dir, "*.go"))
+		if err != nil {
+			return nil, err
+		}
+
+		parsed := []*ast.File{}
+		for _, filename := range files {
+			if strings.HasSuffix(filename, "_test.go") {
+				continue
+			}
+			file, err := parser.ParseFile(fset, filename, nil, 0)
+			if err != nil {
+				return nil, fmt.Errorf("can not parse %s: %w", filename, err)
+			}
+			parsed = append(parsed, file)
+		}
+
+		for _, file := range parsed {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.CONST {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					for _, name := range spec.(*ast.ValueSpec).Names {
+						if strings.HasPrefix(name.Name, ENV_PREFIX) {
+							vars[name.Name] = &EnvVar{Name: name.Name, Package: file.Name.Name, Type: "string"}
+						}
+					}
+				}
+			}
+		}
+
+		for _, file := range parsed {
+			ast.Inspect(file, func(node ast.Node) bool {
+				if call, ok := node.(*ast.CallExpr); ok {
+					readEnvCall(call, vars)
+				}
+				return true
+			})
+		}
+	}
+
+	result := make([]EnvVar, 0, len(vars))
+	for _, envVar := range vars {
+		result = append(result, *envVar)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result, nil
+}
+
+// readEnvCall records the type of variables read with env.<method>(name, default, min).
+func readEnvCall(call *ast.CallExpr, vars map[string]*EnvVar) {
+	selector, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || len(call.Args) == 0 {
+		return
+	}
+	if receiver, ok := selector.X.(*ast.Ident); !ok || receiver.Name != "env" {
+		return
+	}
+	name, ok := call.Args[0].(*ast.Ident)
+	if !ok || vars[name.Name] == nil {
+		return
+	}
+
+	envVar := vars[name.Name]
+	switch selector.Sel.Name {
+	case "required":
+		envVar.Required = true
+	case "int":
+		envVar.Type = "integer"
+	case "milliseconds":
+		envVar.Type = "milliseconds"
+	}
+	if len(call.Args) == 3 {
+		envVar.Min = types.ExprString(call.Args[2])
+	}
+}
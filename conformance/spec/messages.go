@@ -0,0 +1,121 @@
+package spec
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/rpc"
+)
+
+// Field is a JSON property of a message body.
+type Field struct {
+	Name        string
+	Type        string
+	Required    bool
+	Description string
+}
+
+var (
+	textMarshaler = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	timeType      = reflect.TypeOf(time.Time{})
+	uuidType      = reflect.TypeOf(uuid.UUID{})
+)
+
+// MessageFields lists the JSON properties value is marshalled with. Properties without omitempty
+// are required, descriptions are taken from the properties of schema.
+func MessageFields(value any, schema []byte) ([]Field, error) {
+	descriptions := map[string]string{}
+	if schema != nil {
+		var parsed struct {
+			Properties map[string]struct {
+				Description string `json:"description"`
+			} `json:"properties"`
+		}
+		if err := json.Unmarshal(schema, &parsed); err != nil {
+			return nil, fmt.Errorf("can not parse schema: %w", err)
+		}
+		for name, property := range parsed.Properties {
+			descriptions[name] = property.Description
+		}
+	}
+
+	fields := []Field{}
+	valueType := reflect.TypeOf(value)
+	for i := 0; i < valueType.NumField(); i++ {
+		structField := valueType.Field(i)
+		name, options, _ := strings.Cut(structField.Tag.Get("json"), ",")
+		if name == "-" || !structField.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = structField.Name
+		}
+
+		fields = append(fields, Field{
+			Name:        name,
+			Type:        jsonType(structField.Type),
+			Required:    !strings.Contains(options, "omitempty") && structField.Type.Kind() != reflect.Pointer,
+			Description: descriptions[name],
+		})
+	}
+	return fields, nil
+}
+
+func jsonType(goType reflect.Type) string {
+	switch {
+	case goType == uuidType:
+		return "string (uuid)"
+	case goType == timeType:
+		return "string (RFC 3339)"
+	case goType.Kind() == reflect.Pointer:
+		return jsonType(goType.Elem())
+	case goType.Kind() == reflect.Struct:
+		return fmt.Sprintf("object (%s)", goType.Name())
+	case goType.Implements(textMarshaler):
+		return "string"
+	}
+
+	switch goType.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Map:
+		return fmt.Sprintf("object of %s", jsonType(goType.Elem()))
+	case reflect.Slice, reflect.Array:
+		return fmt.Sprintf("array of %s", jsonType(goType.Elem()))
+	}
+	return "any"
+}
+
+// Message is a protocol message with its Go type and body schema.
+type Message struct {
+	Type   rpc.MessageType
+	Value  any
+	Schema []byte
+}
+
+func Messages() ([]Message, error) {
+	messages := []Message{
+		{Type: rpc.PROCESS_REQUEST, Value: rpc.ProcessRequest{}},
+		{Type: rpc.PROCESS_RESPONSE, Value: rpc.ProcessResponse{}},
+		{Type: rpc.HEARTBEAT, Value: rpc.Heartbeat{}},
+	}
+	for i := range messages {
+		schema, err := rpc.BodySchema(messages[i].Type)
+		if err != nil {
+			return nil, err
+		}
+		messages[i].Schema = schema
+	}
+	return messages, nil
+}
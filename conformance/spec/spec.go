@@ -0,0 +1,187 @@
+// Package spec generates the language-neutral worker protocol specification from the Go types
+// of the protocol, so the specification follows the implementation.
+package spec
+
+//go:generate go run ../cmd/protocol-spec -root ../.. -o ../PROTOCOL.md
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"starbyte.io/coordinator/db"
+	"starbyte.io/core/amqp"
+	"starbyte.io/core/rpc"
+	s3io "starbyte.io/core/s3"
+)
+
+// ENV_DIRS are the packages, relative to the repository root, whose environment variables are specified.
+var ENV_DIRS = []string{"core/worker", "core/s3"}
+
+// Generate renders the protocol specification as markdown, root is the repository root.
+func Generate(root string) ([]byte, error) {
+	dirs := make([]string, len(ENV_DIRS))
+	for i, dir := range ENV_DIRS {
+		dirs[i] = filepath.Join(root, dir)
+	}
+	envVars, err := ReadEnvVars(dirs...)
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := Messages()
+	if err != nil {
+		return nil, err
+	}
+
+	doc := &bytes.Buffer{}
+	fmt.Fprintf(doc, "# Worker protocol %s\n\n", rpc.PROTOCOL_VERSION)
+	fmt.Fprint(doc, "<!-- Generated by `go generate ./conformance/spec`, do not edit. -->\n\n")
+	fmt.Fprint(doc, OVERVIEW)
+
+	writeEnvironment(doc, envVars)
+	writeQueues(doc)
+	writeEnvelope(doc)
+	if err := writeMessages(doc, messages); err != nil {
+		return nil, err
+	}
+	if err := writeBatches(doc); err != nil {
+		return nil, err
+	}
+	fmt.Fprint(doc, BEHAVIOUR)
+
+	return doc.Bytes(), nil
+}
+
+const OVERVIEW = `A worker consumes process requests from its request queue, reads the batch named by the request from
+blob storage, writes its result batch and publishes a process response to its response queue. The coordinator
+declares the queues and publishes the requests. Input workers receive requests without an input batch and write
+the next batch of their source. The key words MUST, MUST NOT, SHOULD and MAY are to be interpreted as in RFC 2119.
+
+Run ` + "`go run ./conformance/cmd/conformance -- <worker command>`" + ` to check a worker against this specification.
+
+`
+
+func writeEnvironment(doc *bytes.Buffer, envVars []EnvVar) {
+	fmt.Fprint(doc, "## Environment\n\n")
+	fmt.Fprint(doc, "Workers are configured by environment variables, all of them with the legacy `"+ENV_PREFIX+"` prefix. ")
+	fmt.Fprint(doc, "Workers MUST read the required variables and SHOULD honor the others, durations are in milliseconds. ")
+	fmt.Fprintf(doc, "The heartbeat variables apply when `%s` is set.\n\n", "LIGHTBYTE_WORKER_HEARTBEAT_QUEUE")
+	fmt.Fprint(doc, "| Variable | Type | Required | Minimum | Package |\n|---|---|---|---|---|\n")
+	for _, envVar := range envVars {
+		required := ""
+		if envVar.Required {
+			required = "yes"
+		}
+		min := ""
+		if envVar.Min != "" {
+			min = "`" + envVar.Min + "`"
+		}
+		fmt.Fprintf(doc, "| `%s` | %s | %s | %s | %s |\n", envVar.Name, envVar.Type, required, min, envVar.Package)
+	}
+	fmt.Fprint(doc, "\n")
+}
+
+func writeQueues(doc *bytes.Buffer) {
+	step := db.Step{Id: uuid.Nil, Name: "<step name>"}
+	queueName := func(name string) string {
+		return "`" + strings.ReplaceAll(name, uuid.Nil.String(), "<step id>") + "`"
+	}
+
+	fmt.Fprint(doc, "## Queues\n\n")
+	fmt.Fprint(doc, "The coordinator declares the queues of every step, workers receive their names by environment variables ")
+	fmt.Fprint(doc, "and MUST NOT declare them.\n\n")
+	fmt.Fprint(doc, "| Queue | Name | Environment | Messages |\n|---|---|---|---|\n")
+	fmt.Fprintf(doc, "| request | %s | `LIGHTBYTE_WORKER_LISTEN_QUEUE` | %s, consumed by workers |\n", queueName(step.GetReqQueueName()), rpc.PROCESS_REQUEST)
+	fmt.Fprintf(doc, "| response | %s | `LIGHTBYTE_WORKER_RESPONSE_QUEUE` | %s, published by workers |\n", queueName(step.GetRespQueueName()), rpc.PROCESS_RESPONSE)
+	fmt.Fprintf(doc, "| heartbeat | %s | `LIGHTBYTE_WORKER_HEARTBEAT_QUEUE` | %s, published by workers |\n", queueName(step.GetHeartbeatQueueName()), rpc.HEARTBEAT)
+	fmt.Fprintf(doc, "| dead letter | %s | | rejected requests and responses |\n\n", queueName(step.GetDeadLetterQueueName()))
+	fmt.Fprint(doc, "The transport is selected by the scheme of `LIGHTBYTE_WORKER_AMQP_URI`: `amqp://` and `amqps://` for RabbitMQ, ")
+	fmt.Fprint(doc, "`nats://` and `tls://` for NATS JetStream, `postgres://` and `postgresql://` for the postgres queue table. ")
+	fmt.Fprintf(doc, "Queues deliver their ready messages by `%s`, then in publishing order; NATS JetStream ignores priorities. ", amqp.PRIORITY_HEADER)
+	fmt.Fprint(doc, "Workers SHOULD hold few unacknowledged requests, prefetched requests are not reordered.\n\n")
+}
+
+func writeEnvelope(doc *bytes.Buffer) {
+	fmt.Fprint(doc, "## Envelope\n\n")
+	fmt.Fprint(doc, "Message bodies are JSON, their envelope is carried by the message headers. ")
+	fmt.Fprintf(doc, "Receivers MUST reject messages of another major version than %s and MUST ignore unknown body properties and extension headers. ", rpc.PROTOCOL_VERSION)
+	fmt.Fprintf(doc, "Messages without `%s` are legacy %s messages. The headers are described by `core/rpc/%s`.\n\n", rpc.VERSION_HEADER, rpc.LEGACY_PROTOCOL_VERSION, rpc.ENVELOPE_SCHEMA)
+	fmt.Fprint(doc, "| Header | Value |\n|---|---|\n")
+	fmt.Fprintf(doc, "| `%s` | `major.minor`, currently `%s` |\n", rpc.VERSION_HEADER, rpc.PROTOCOL_VERSION)
+	fmt.Fprintf(doc, "| `%s` | `%s`, `%s` or `%s` |\n", rpc.TYPE_HEADER, rpc.PROCESS_REQUEST, rpc.PROCESS_RESPONSE, rpc.HEARTBEAT)
+	fmt.Fprintf(doc, "| `%s` | RFC 3339 publication time |\n", rpc.SENT_AT_HEADER)
+	fmt.Fprintf(doc, "| `%s` | identity of the publisher, the worker instance id |\n", rpc.PRODUCER_HEADER)
+	fmt.Fprintf(doc, "| `%s` | priority of a process_request from 0 to %d, set by the coordinator |\n", amqp.PRIORITY_HEADER, amqp.MAX_PRIORITY)
+	fmt.Fprintf(doc, "| `%s<name>` | extensions |\n\n", rpc.EXTENSION_HEADER_PREFIX)
+}
+
+func writeFields(doc *bytes.Buffer, fields []Field) {
+	fmt.Fprint(doc, "| Property | Type | Required | Description |\n|---|---|---|---|\n")
+	for _, field := range fields {
+		required := ""
+		if field.Required {
+			required = "yes"
+		}
+		fmt.Fprintf(doc, "| `%s` | %s | %s | %s |\n", field.Name, field.Type, required, field.Description)
+	}
+	fmt.Fprint(doc, "\n")
+}
+
+func writeMessages(doc *bytes.Buffer, messages []Message) error {
+	fmt.Fprint(doc, "## Messages\n\n")
+	for _, message := range messages {
+		fields, err := MessageFields(message.Value, message.Schema)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(doc, "### %s\n\n", message.Type)
+		fmt.Fprintf(doc, "Schema: `core/rpc/schema/%s.schema.json`.\n\n", message.Type)
+		writeFields(doc, fields)
+	}
+	fmt.Fprintf(doc, "`Status` is `%s`, `%s` or `%s`.\n\n", rpc.OK, rpc.ERROR, rpc.ALLDONE)
+	return nil
+}
+
+func writeBatches(doc *bytes.Buffer) error {
+	fmt.Fprint(doc, "## Batches\n\n")
+	fmt.Fprint(doc, "Batches are objects of the blob store, addressed by `s3://`, `file://` or `http(s)://` URIs. ")
+	fmt.Fprintf(doc, "A `%s` batch is a stream of CBOR encoded records, compressed with the codec of the request `Compression`, ", s3io.CBOR)
+	fmt.Fprintf(doc, "`%s` by default; a `%s` batch is a parquet file whose column pages are compressed with that codec. ", s3io.DefaultCompression.Codec, s3io.PARQUET)
+	fmt.Fprint(doc, "Readers detect the format and the codec from the stream when the batch has no manifest.\n\n")
+	fmt.Fprint(doc, "| Codec | Object suffix |\n|---|---|\n")
+	for _, codec := range []s3io.Codec{s3io.NONE, s3io.GZIP, s3io.ZSTD, s3io.SNAPPY, s3io.LZ4} {
+		options := s3io.BatchOptions{Format: s3io.CBOR, Compression: s3io.Compression{Codec: codec}}
+		fmt.Fprintf(doc, "| `%s` | `%s` |\n", codec, options.Extension())
+	}
+	fmt.Fprint(doc, "\n")
+
+	fields, err := MessageFields(s3io.Manifest{}, nil)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(doc, "Writers store the manifest of every batch as JSON at the batch URI with the `%s` suffix, ", s3io.MANIFEST_URI_SUFFIX)
+	fmt.Fprint(doc, "and return it in the response. `Sha256` and `CompressedSize` are computed over the stored bytes.\n\n")
+	writeFields(doc, fields)
+	return nil
+}
+
+const BEHAVIOUR = `## Behaviour
+
+1. A worker MUST publish exactly one response for every request it acknowledges, with the ` + "`CorrelationId`" + ` of the request,
+   and SHOULD acknowledge the request only once the response is published.
+2. A processed request is answered with ` + "`OK`" + `, the result batch written at ` + "`ResultUri`" + ` and its manifest.
+3. A request which can not be processed, because its batch can not be read, its options are unknown or records fail to
+   transform, is answered with ` + "`ERROR`" + ` and a non-empty ` + "`Error`" + `; the worker MUST keep consuming.
+4. An input worker answers each request with the next batch of its source. Once its source is exhausted it answers the next
+   request with ` + "`ALLDONE`" + `.
+5. A message which does not decode, misses its correlation id or result uri, or has another major version MUST be rejected
+   without requeue, so the broker dead-letters it, and MUST NOT be answered.
+6. On SIGTERM or SIGINT a worker stops consuming, finishes or requeues the request in progress and exits with status 0
+   within ` + "`LIGHTBYTE_WORKER_SHUTDOWN_GRACE_PERIOD`" + `.
+7. With ` + "`LIGHTBYTE_WORKER_HEARTBEAT_QUEUE`" + ` set, a worker publishes a heartbeat every
+   ` + "`LIGHTBYTE_WORKER_HEARTBEAT_INTERVAL`" + ` with ` + "`LIGHTBYTE_WORKER_STEP_ID`" + `, its instance id and the correlation id
+   of the request in progress.
+`
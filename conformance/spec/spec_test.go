@@ -0,0 +1,82 @@
+package spec
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"sort"
+	"testing"
+)
+
+func TestProtocolUpToDate(t *testing.T) {
+	generated, err := Generate("../..")
+	if err != nil {
+		t.Fatalf("can not generate the specification: %s", err)
+	}
+
+	current, err := os.ReadFile("../PROTOCOL.md")
+	if err != nil {
+		t.Fatalf("can not read the specification: %s", err)
+	}
+	if !bytes.Equal(generated, current) {
+		t.Errorf("PROTOCOL.md is outdated, run go generate ./conformance/spec")
+	}
+}
+
+func TestSchemasRequireGoFields(t *testing.T) {
+	messages, err := Messages()
+	if err != nil {
+		t.Fatalf("can not load messages: %s", err)
+	}
+
+	for _, message := range messages {
+		fields, err := MessageFields(message.Value, message.Schema)
+		if err != nil {
+			t.Fatalf("can not read fields of %s: %s", message.Type, err)
+		}
+		expected := []string{}
+		for _, field := range fields {
+			if field.Required {
+				expected = append(expected, field.Name)
+			}
+		}
+
+		var schema struct {
+			Required []string `json:"required"`
+		}
+		if err := json.Unmarshal(message.Schema, &schema); err != nil {
+			t.Fatalf("can not parse schema of %s: %s", message.Type, err)
+		}
+
+		sort.Strings(expected)
+		sort.Strings(schema.Required)
+		if len(expected) != len(schema.Required) {
+			t.Errorf("%s: expected required %v, schema requires %v", message.Type, expected, schema.Required)
+			continue
+		}
+		for i := range expected {
+			if expected[i] != schema.Required[i] {
+				t.Errorf("%s: expected required %v, schema requires %v", message.Type, expected, schema.Required)
+				break
+			}
+		}
+	}
+}
+
+func TestReadEnvVars(t *testing.T) {
+	envVars, err := ReadEnvVars("../../core/worker")
+	if err != nil {
+		t.Fatalf("can not read environment variables: %s", err)
+	}
+
+	byName := map[string]EnvVar{}
+	for _, envVar := range envVars {
+		byName[envVar.Name] = envVar
+	}
+	if uri := byName["LIGHTBYTE_WORKER_AMQP_URI"]; !uri.Required {
+		t.Errorf("expected LIGHTBYTE_WORKER_AMQP_URI to be required, got %+v", uri)
+	}
+	if batchSize := byName["LIGHTBYTE_WORKER_BATCH_SIZE"]; batchSize.Type != "integer" || batchSize.Min != "1" {
+		t.Errorf("expected LIGHTBYTE_WORKER_BATCH_SIZE to be an integer of at least 1, got %+v", batchSize)
+	}
+}
@@ -0,0 +1,4 @@
+alter table batch_process_log
+	drop column if exists skipped_records,
+	drop column if exists quarantined_records,
+	drop column if exists quarantine_uri;
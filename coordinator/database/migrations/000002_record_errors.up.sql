@@ -0,0 +1,4 @@
+alter table batch_process_log
+	add column if not exists skipped_records integer not null default 0,
+	add column if not exists quarantined_records integer not null default 0,
+	add column if not exists quarantine_uri varchar null default null;
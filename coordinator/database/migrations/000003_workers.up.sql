@@ -0,0 +1,11 @@
+create table if not exists workers (
+	instance_id varchar not null primary key,
+	step_id UUID not null,
+	version varchar null default null,
+	correlation_id UUID null default null,
+	started_at timestamp not null default (now() at time zone 'utc'),
+	last_seen_at timestamp not null default (now() at time zone 'utc'),
+	constraint workers_step_id_fk foreign key (step_id) references steps(step_id)
+);
+
+create index if not exists workers_step_id_last_seen_at_idx on workers (step_id, last_seen_at);
@@ -0,0 +1,6 @@
+alter table batches
+	drop column if exists record_count,
+	drop column if exists uncompressed_size,
+	drop column if exists compressed_size,
+	drop column if exists sha256,
+	drop column if exists schema;
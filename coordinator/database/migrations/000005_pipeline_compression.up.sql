@@ -0,0 +1,2 @@
+alter table pipelines
+	add column if not exists compression varchar null default null;
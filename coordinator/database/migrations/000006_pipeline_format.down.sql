@@ -0,0 +1,3 @@
+alter table pipelines
+	drop column if exists format,
+	drop column if exists batch_schema;
@@ -0,0 +1,3 @@
+alter table pipelines
+	add column if not exists format varchar null default null,
+	add column if not exists batch_schema jsonb null default null;
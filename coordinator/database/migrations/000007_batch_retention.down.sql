@@ -0,0 +1,8 @@
+drop index if exists batches_uri_idx;
+
+alter table batches
+	drop column if exists deleted_at;
+
+alter table pipelines
+	drop column if exists batch_ttl_seconds,
+	drop column if exists retention_dry_run;
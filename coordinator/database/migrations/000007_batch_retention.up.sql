@@ -0,0 +1,8 @@
+alter table pipelines
+	add column if not exists batch_ttl_seconds integer null default null,
+	add column if not exists retention_dry_run boolean not null default false;
+
+alter table batches
+	add column if not exists deleted_at timestamp null default null;
+
+create index if not exists batches_uri_idx on batches (uri);
@@ -0,0 +1,2 @@
+alter table pipelines
+	drop column if exists key_template;
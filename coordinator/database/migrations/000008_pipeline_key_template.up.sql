@@ -0,0 +1,2 @@
+alter table pipelines
+	add column if not exists key_template varchar null default null;
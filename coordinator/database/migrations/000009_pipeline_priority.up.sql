@@ -0,0 +1,2 @@
+alter table pipelines
+	add column if not exists priority smallint null default null check (priority between 0 and 9);
@@ -0,0 +1,7 @@
+alter table batch_process_log
+	drop column if exists result_uri,
+	drop column if exists record_count,
+	drop column if exists uncompressed_size,
+	drop column if exists compressed_size,
+	drop column if exists sha256,
+	drop column if exists schema;
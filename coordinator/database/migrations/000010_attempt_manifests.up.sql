@@ -0,0 +1,7 @@
+alter table batch_process_log
+	add column if not exists result_uri varchar null default null,
+	add column if not exists record_count bigint null default null,
+	add column if not exists uncompressed_size bigint null default null,
+	add column if not exists compressed_size bigint null default null,
+	add column if not exists sha256 varchar null default null,
+	add column if not exists schema JSONB null default null;
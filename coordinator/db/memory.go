@@ -0,0 +1,460 @@
+package db
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	s3io "starbyte.io/core/s3"
+)
+
+// MemoryRepository keeps batches, attempts and workers in process memory, it runs the coordinator without
+// a database. Pipelines are the ones it was created with, lookups of missing rows fail with sql.ErrNoRows.
+type MemoryRepository struct {
+	mu        sync.Mutex
+	pipelines map[uuid.UUID]*Pipeline
+	batches   []*Batch
+	attempts  []*BatchProcessLog
+	workers   map[string]*Worker
+}
+
+func NewMemoryRepository(pipelines ...*Pipeline) *MemoryRepository {
+	repo := &MemoryRepository{
+		pipelines: map[uuid.UUID]*Pipeline{},
+		workers:   map[string]*Worker{},
+	}
+	for _, pipeline := range pipelines {
+		repo.pipelines[pipeline.Id] = pipeline
+	}
+	return repo
+}
+
+func utcNow() time.Time {
+	return time.Now().UTC()
+}
+
+// step returns the step with stepId and the pipeline it belongs to.
+func (repo *MemoryRepository) step(stepId uuid.UUID) (*Step, *Pipeline) {
+	for _, pipeline := range repo.pipelines {
+		for _, step := range pipeline.Steps {
+			if step.Id == stepId {
+				return &step, pipeline
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (repo *MemoryRepository) attempt(correlationId uuid.UUID) (*BatchProcessLog, error) {
+	for _, attempt := range repo.attempts {
+		if attempt.CorrelationId == correlationId {
+			return attempt, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: attempt %s", sql.ErrNoRows, correlationId)
+}
+
+func (repo *MemoryRepository) batch(batchId uuid.UUID) (*Batch, error) {
+	for _, batch := range repo.batches {
+		if batch.BatchId == batchId {
+			return batch, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: batch %s", sql.ErrNoRows, batchId)
+}
+
+func (repo *MemoryRepository) batchByCorrelationId(correlationId uuid.UUID) (*Batch, error) {
+	attempt, err := repo.attempt(correlationId)
+	if err != nil {
+		return nil, err
+	}
+	return repo.batch(attempt.BatchId)
+}
+
+func (repo *MemoryRepository) GetMaxRetriesByCorrelationId(correlationId uuid.UUID) (*BatchRetries, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	batch, err := repo.batchByCorrelationId(correlationId)
+	if err != nil {
+		return nil, err
+	}
+
+	retries := &BatchRetries{}
+	if step, _ := repo.step(batch.StepToId); step != nil {
+		retries.MaxRetries = step.RuntimeConfig.MaxRetries
+	}
+	for _, attempt := range repo.attempts {
+		if attempt.BatchId == batch.BatchId {
+			retries.Retries++
+		}
+	}
+	return retries, nil
+}
+
+func (repo *MemoryRepository) GetResourceUriByCorrelationId(correlationId uuid.UUID) (string, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	batch, err := repo.batchByCorrelationId(correlationId)
+	if err != nil {
+		return "", err
+	}
+	return batch.Uri, nil
+}
+
+func (repo *MemoryRepository) CreateNewBatch(stepFromId *uuid.UUID, stepToId uuid.UUID, uri string) (*Batch, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	batch := &Batch{
+		BatchId:    uuid.New(),
+		IssuedAt:   utcNow(),
+		StepFromId: stepFromId,
+		StepToId:   stepToId,
+		Uri:        uri,
+	}
+	repo.batches = append(repo.batches, batch)
+
+	created := *batch
+	return &created, nil
+}
+
+func (repo *MemoryRepository) CreateNewBatchProcessAttempt(batchId uuid.UUID, correlationId uuid.UUID) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, err := repo.batch(batchId); err != nil {
+		return err
+	}
+	repo.attempts = append(repo.attempts, &BatchProcessLog{
+		BatchId:       batchId,
+		CorrelationId: correlationId,
+		StartedAt:     utcNow(),
+	})
+	return nil
+}
+
+// DeleteBatchProcessAttempt removes an attempt whose request was never published.
+func (repo *MemoryRepository) DeleteBatchProcessAttempt(correlationId uuid.UUID) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	repo.removeAttempts(func(attempt *BatchProcessLog) bool { return attempt.CorrelationId == correlationId })
+	return nil
+}
+
+func (repo *MemoryRepository) removeAttempts(remove func(*BatchProcessLog) bool) {
+	kept := repo.attempts[:0]
+	for _, attempt := range repo.attempts {
+		if !remove(attempt) {
+			kept = append(kept, attempt)
+		}
+	}
+	repo.attempts = kept
+}
+
+func (repo *MemoryRepository) SetBatchProcessStatus(correlationId uuid.UUID, state string, err string) (bool, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	attempt, _ := repo.attempt(correlationId)
+	if attempt == nil || !attempt.FinishedAt.IsZero() {
+		return false, nil
+	}
+	attempt.FinishedAt = utcNow()
+	attempt.State = state
+	attempt.Error = err
+	return true, nil
+}
+
+func (repo *MemoryRepository) SetBatchProcessRejects(correlationId uuid.UUID, skipped int, quarantined int, quarantineUri string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if attempt, _ := repo.attempt(correlationId); attempt != nil {
+		attempt.SkippedRecords = skipped
+		attempt.QuarantinedRecords = quarantined
+		attempt.QuarantineUri = nil
+		if quarantineUri != "" {
+			attempt.QuarantineUri = &quarantineUri
+		}
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) SetBatchProcessManifest(correlationId uuid.UUID, uri string, manifest *s3io.Manifest) error {
+	var schema []byte
+	if manifest.Schema != nil {
+		var err error
+		if schema, err = json.Marshal(manifest.Schema); err != nil {
+			return err
+		}
+	}
+
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if attempt, _ := repo.attempt(correlationId); attempt != nil {
+		records, uncompressed, compressed, sha256, resultUri := manifest.Records, manifest.UncompressedSize, manifest.CompressedSize, manifest.Sha256, uri
+		attempt.ResultUri, attempt.RecordCount, attempt.UncompressedSize, attempt.CompressedSize, attempt.Sha256 = &resultUri, &records, &uncompressed, &compressed, &sha256
+		attempt.Schema = schema
+	}
+	for _, batch := range repo.batches {
+		if batch.Uri == uri {
+			records, uncompressed, compressed, sha256 := manifest.Records, manifest.UncompressedSize, manifest.CompressedSize, manifest.Sha256
+			batch.RecordCount, batch.UncompressedSize, batch.CompressedSize, batch.Sha256 = &records, &uncompressed, &compressed, &sha256
+			batch.Schema = schema
+		}
+	}
+	return nil
+}
+
+func (repo *MemoryRepository) GetBatchByCorrelationId(correlationId uuid.UUID) (*Batch, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	batch, err := repo.batchByCorrelationId(correlationId)
+	if err != nil {
+		return nil, err
+	}
+	found := *batch
+	return &found, nil
+}
+
+// DiscardBatchByCorrelationId deletes the batch and its attempts and returns the batch, its object is left to the caller.
+func (repo *MemoryRepository) DiscardBatchByCorrelationId(correlationId uuid.UUID) (*Batch, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	batch, err := repo.batchByCorrelationId(correlationId)
+	if err != nil {
+		return nil, err
+	}
+
+	repo.removeAttempts(func(attempt *BatchProcessLog) bool { return attempt.BatchId == batch.BatchId })
+	for idx, other := range repo.batches {
+		if other == batch {
+			repo.batches = append(repo.batches[:idx], repo.batches[idx+1:]...)
+			break
+		}
+	}
+	return batch, nil
+}
+
+func (repo *MemoryRepository) GetPipeline(pipelineId uuid.UUID) (*Pipeline, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	pipeline, ok := repo.pipelines[pipelineId]
+	if !ok {
+		return nil, fmt.Errorf("%w: pipeline %s", sql.ErrNoRows, pipelineId)
+	}
+	found := *pipeline
+	return &found, nil
+}
+
+func (repo *MemoryRepository) SaveWorkerHeartbeat(worker *Worker) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	saved := *worker
+	saved.StartedAt = utcNow()
+	if existing, ok := repo.workers[worker.InstanceId]; ok {
+		saved.StartedAt = existing.StartedAt
+	}
+	saved.LastSeenAt = utcNow()
+	repo.workers[worker.InstanceId] = &saved
+	return nil
+}
+
+// GetLostWorkers returns workers of the pipeline which have not sent a heartbeat within timeout.
+// CorrelationId is set only when the attempt held by the worker is still unfinished.
+func (repo *MemoryRepository) GetLostWorkers(pipelineId uuid.UUID, timeout time.Duration) ([]Worker, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	workers := []Worker{}
+	for _, worker := range repo.workers {
+		_, pipeline := repo.step(worker.StepId)
+		if pipeline == nil || pipeline.Id != pipelineId || !worker.LastSeenAt.Before(utcNow().Add(-timeout)) {
+			continue
+		}
+
+		lost := *worker
+		lost.CorrelationId = nil
+		if worker.CorrelationId != nil {
+			if attempt, _ := repo.attempt(*worker.CorrelationId); attempt != nil && attempt.FinishedAt.IsZero() {
+				lost.CorrelationId = worker.CorrelationId
+			}
+		}
+		workers = append(workers, lost)
+	}
+	return workers, nil
+}
+
+func (repo *MemoryRepository) RemoveWorker(instanceId string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	delete(repo.workers, instanceId)
+	return nil
+}
+
+func (repo *MemoryRepository) GetStepsWithoutLiveWorkers(pipelineId uuid.UUID, timeout time.Duration) ([]uuid.UUID, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	pipeline, ok := repo.pipelines[pipelineId]
+	if !ok {
+		return []uuid.UUID{}, nil
+	}
+
+	live := map[uuid.UUID]bool{}
+	for _, worker := range repo.workers {
+		if !worker.LastSeenAt.Before(utcNow().Add(-timeout)) {
+			live[worker.StepId] = true
+		}
+	}
+
+	steps := []uuid.UUID{}
+	for _, step := range pipeline.Steps {
+		if !live[step.Id] {
+			steps = append(steps, step.Id)
+		}
+	}
+	return steps, nil
+}
+
+type memoryObject struct {
+	CollectableBatch
+	consumers  map[uuid.UUID]bool
+	expected   int
+	consumed   bool
+	deadLetter bool
+	processing bool
+}
+
+// GetCollectableBatches returns batch objects of the pipeline which are not needed anymore,
+// following the rules of PgRepository.GetCollectableBatches.
+func (repo *MemoryRepository) GetCollectableBatches(pipelineId uuid.UUID, ttl time.Duration) ([]CollectableBatch, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	pipeline, ok := repo.pipelines[pipelineId]
+	if !ok {
+		return []CollectableBatch{}, nil
+	}
+
+	objects := map[string]*memoryObject{}
+	order := []string{}
+	for _, batch := range repo.batches {
+		if step, owner := repo.step(batch.StepToId); step == nil || owner != pipeline || batch.DeletedAt != nil {
+			continue
+		}
+
+		object, ok := objects[batch.Uri]
+		if !ok {
+			object = &memoryObject{
+				CollectableBatch: CollectableBatch{Uri: batch.Uri, IssuedAt: batch.IssuedAt},
+				consumers:        map[uuid.UUID]bool{},
+				consumed:         true,
+			}
+			objects[batch.Uri] = object
+			order = append(order, batch.Uri)
+		}
+		if batch.IssuedAt.Before(object.IssuedAt) {
+			object.IssuedAt = batch.IssuedAt
+		}
+		if batch.CompressedSize != nil && (object.CompressedSize == nil || *batch.CompressedSize > *object.CompressedSize) {
+			size := *batch.CompressedSize
+			object.CompressedSize = &size
+		}
+
+		succeeded, pending, failed := false, false, false
+		for _, attempt := range repo.attempts {
+			if attempt.BatchId != batch.BatchId {
+				continue
+			}
+			succeeded = succeeded || attempt.State == "OK"
+			pending = pending || attempt.FinishedAt.IsZero()
+			failed = failed || attempt.State == "ERROR"
+		}
+		object.deadLetter = object.deadLetter || (!succeeded && !pending && failed)
+		object.processing = object.processing || pending
+
+		if batch.StepFromId != nil {
+			object.consumers[batch.StepToId] = true
+			object.consumed = object.consumed && succeeded
+
+			producer, _ := repo.step(*batch.StepFromId)
+			expected := 0
+			for _, step := range pipeline.Steps {
+				if producer != nil && step.Input == producer.Name {
+					expected++
+				}
+			}
+			object.expected = max(object.expected, expected)
+		}
+	}
+
+	batches := []CollectableBatch{}
+	for _, uri := range order {
+		object := objects[uri]
+		consumed := object.consumed && len(object.consumers) > 0 && len(object.consumers) == object.expected
+		expired := ttl > 0 && !object.processing && object.IssuedAt.Before(utcNow().Add(-ttl))
+		if object.deadLetter || (!consumed && !expired) {
+			continue
+		}
+
+		object.Reason = RETENTION_EXPIRED
+		if consumed {
+			object.Reason = RETENTION_CONSUMED
+		}
+		batches = append(batches, object.CollectableBatch)
+	}
+
+	sort.SliceStable(batches, func(i, j int) bool { return batches[i].IssuedAt.Before(batches[j].IssuedAt) })
+	return batches, nil
+}
+
+func (repo *MemoryRepository) MarkBatchDeleted(uri string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	deletedAt := utcNow()
+	for _, batch := range repo.batches {
+		if batch.Uri == uri {
+			batch.DeletedAt = &deletedAt
+		}
+	}
+	return nil
+}
+
+// Batches returns a copy of the batches, in creation order.
+func (repo *MemoryRepository) Batches() []Batch {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	batches := make([]Batch, 0, len(repo.batches))
+	for _, batch := range repo.batches {
+		batches = append(batches, *batch)
+	}
+	return batches
+}
+
+// Attempts returns a copy of the batch process attempts, in creation order.
+func (repo *MemoryRepository) Attempts() []BatchProcessLog {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	attempts := make([]BatchProcessLog, 0, len(repo.attempts))
+	for _, attempt := range repo.attempts {
+		attempts = append(attempts, *attempt)
+	}
+	return attempts
+}
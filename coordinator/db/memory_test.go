@@ -0,0 +1,160 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	s3io "starbyte.io/core/s3"
+)
+
+func memoryPipeline() *Pipeline {
+	return &Pipeline{
+		Id:   uuid.New(),
+		Name: "test",
+		Steps: StepConf{
+			"input":   {Id: uuid.New(), Name: "input"},
+			"extract": {Id: uuid.New(), Name: "extract", Input: "input", RuntimeConfig: RuntimeConfig{MaxRetries: 2}},
+		},
+	}
+}
+
+func TestMemoryRepositoryAttempts(t *testing.T) {
+	pipeline := memoryPipeline()
+	repo := NewMemoryRepository(pipeline)
+	input, extract := pipeline.Steps["input"].Id, pipeline.Steps["extract"].Id
+
+	batch, err := repo.CreateNewBatch(&input, extract, "mem://test/batch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, second := uuid.New(), uuid.New()
+	repo.CreateNewBatchProcessAttempt(batch.BatchId, first)
+	if finished, err := repo.SetBatchProcessStatus(first, "ERROR", "failed"); !finished || err != nil {
+		t.Errorf("running attempt not finished %v", err)
+	}
+	if finished, _ := repo.SetBatchProcessStatus(first, "OK", ""); finished {
+		t.Errorf("finished attempt finished again")
+	}
+	repo.CreateNewBatchProcessAttempt(batch.BatchId, second)
+
+	retries, err := repo.GetMaxRetriesByCorrelationId(second)
+	if err != nil || retries.MaxRetries != 2 || retries.Retries != 2 {
+		t.Errorf("wrong retries %+v %v", retries, err)
+	}
+	if uri, err := repo.GetResourceUriByCorrelationId(first); err != nil || uri != "mem://test/batch" {
+		t.Errorf("wrong resource uri %s %v", uri, err)
+	}
+
+	repo.SetBatchProcessManifest(first, "mem://test/batch", &s3io.Manifest{Records: 3, CompressedSize: 10})
+	if found, err := repo.GetBatchByCorrelationId(second); err != nil || *found.RecordCount != 3 || *found.CompressedSize != 10 {
+		t.Errorf("wrong batch %+v %v", found, err)
+	}
+	if attempt := repo.Attempts()[0]; attempt.RecordCount == nil || *attempt.RecordCount != 3 || *attempt.ResultUri != "mem://test/batch" {
+		t.Errorf("manifest not stored on the attempt %+v", attempt)
+	}
+
+	if err := repo.CreateNewBatchProcessAttempt(uuid.New(), uuid.New()); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no rows error, got %v", err)
+	}
+
+	discarded, err := repo.DiscardBatchByCorrelationId(second)
+	if err != nil || discarded.BatchId != batch.BatchId {
+		t.Errorf("wrong discarded batch %+v %v", discarded, err)
+	}
+	if len(repo.Batches()) != 0 || len(repo.Attempts()) != 0 {
+		t.Errorf("batch is not discarded %+v %+v", repo.Batches(), repo.Attempts())
+	}
+	if _, err := repo.GetBatchByCorrelationId(second); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("expected no rows error, got %v", err)
+	}
+}
+
+func TestMemoryRepositoryWorkers(t *testing.T) {
+	pipeline := memoryPipeline()
+	repo := NewMemoryRepository(pipeline)
+	input, extract := pipeline.Steps["input"].Id, pipeline.Steps["extract"].Id
+
+	batch, _ := repo.CreateNewBatch(&input, extract, "mem://test/batch")
+	running, finished := uuid.New(), uuid.New()
+	repo.CreateNewBatchProcessAttempt(batch.BatchId, running)
+	repo.CreateNewBatchProcessAttempt(batch.BatchId, finished)
+	repo.SetBatchProcessStatus(finished, "OK", "")
+
+	repo.SaveWorkerHeartbeat(&Worker{InstanceId: "busy", StepId: extract, CorrelationId: &running})
+	repo.SaveWorkerHeartbeat(&Worker{InstanceId: "done", StepId: extract, CorrelationId: &finished})
+
+	if lost, _ := repo.GetLostWorkers(pipeline.Id, time.Hour); len(lost) != 0 {
+		t.Errorf("unexpected lost workers %+v", lost)
+	}
+	if idle, _ := repo.GetStepsWithoutLiveWorkers(pipeline.Id, time.Hour); len(idle) != 1 || idle[0] != input {
+		t.Errorf("wrong idle steps %v", idle)
+	}
+
+	lost, _ := repo.GetLostWorkers(pipeline.Id, -time.Hour)
+	if len(lost) != 2 {
+		t.Fatalf("expected 2 lost workers, got %+v", lost)
+	}
+	for _, worker := range lost {
+		switch worker.InstanceId {
+		case "busy":
+			if worker.CorrelationId == nil || *worker.CorrelationId != running {
+				t.Errorf("unfinished attempt expected for %+v", worker)
+			}
+		case "done":
+			if worker.CorrelationId != nil {
+				t.Errorf("finished attempt is not reported for %+v", worker)
+			}
+		}
+	}
+
+	repo.RemoveWorker("busy")
+	if lost, _ := repo.GetLostWorkers(pipeline.Id, -time.Hour); len(lost) != 1 {
+		t.Errorf("worker is not removed %+v", lost)
+	}
+}
+
+func TestMemoryRepositoryCollectableBatches(t *testing.T) {
+	pipeline := memoryPipeline()
+	repo := NewMemoryRepository(pipeline)
+	input, extract := pipeline.Steps["input"].Id, pipeline.Steps["extract"].Id
+
+	attempt := func(uri string, states ...string) {
+		batch, _ := repo.CreateNewBatch(&input, extract, uri)
+		for _, state := range states {
+			correlationId := uuid.New()
+			repo.CreateNewBatchProcessAttempt(batch.BatchId, correlationId)
+			if state != "" {
+				repo.SetBatchProcessStatus(correlationId, state, "")
+			}
+		}
+	}
+
+	attempt("mem://test/consumed", "ERROR", "OK")
+	attempt("mem://test/pending", "")
+	attempt("mem://test/dead", "ERROR", "ERROR")
+	attempt("mem://test/unread")
+	// input batches are consumed by their producer step
+	repo.CreateNewBatch(nil, input, "mem://test/consumed")
+
+	batches, err := repo.GetCollectableBatches(pipeline.Id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batches) != 1 || batches[0].Uri != "mem://test/consumed" || batches[0].Reason != RETENTION_CONSUMED {
+		t.Errorf("wrong collectable batches %+v", batches)
+	}
+
+	// the expired batch with an attempt in flight is still read by its worker
+	batches, _ = repo.GetCollectableBatches(pipeline.Id, time.Nanosecond)
+	if len(batches) != 2 || batches[1].Uri != "mem://test/unread" || batches[1].Reason != RETENTION_EXPIRED {
+		t.Errorf("wrong collectable batches %+v", batches)
+	}
+
+	repo.MarkBatchDeleted("mem://test/consumed")
+	if batches, _ := repo.GetCollectableBatches(pipeline.Id, 0); len(batches) != 0 {
+		t.Errorf("deleted batch is collectable %+v", batches)
+	}
+}
@@ -49,25 +49,105 @@ func (s *Step) GetReqQueueName() string {
 	return fmt.Sprintf("requests_%s_%s", s.Id, s.Name)
 }
 
+func (s *Step) GetHeartbeatQueueName() string {
+	return fmt.Sprintf("heartbeats_%s_%s", s.Id, s.Name)
+}
+
+// GetDeadLetterQueueName returns the queue of requests and responses of the step which could not be processed.
+func (s *Step) GetDeadLetterQueueName() string {
+	return fmt.Sprintf("dead_letters_%s_%s", s.Id, s.Name)
+}
+
+// BatchSchema declares parquet batch columns as field -> type.
+type BatchSchema map[string]string
+
+func (s BatchSchema) Value() (driver.Value, error) {
+	if s == nil {
+		return nil, nil
+	}
+	return json.Marshal(s)
+}
+
+func (s *BatchSchema) Scan(value interface{}) error {
+	if value == nil {
+		*s = nil
+		return nil
+	}
+
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, &s)
+}
+
 type Pipeline struct {
-	Id    uuid.UUID `db:"pipeline_id"`
-	Name  string    `db:"name"`
-	Steps StepConf  `db:"steps"`
+	Id              uuid.UUID   `db:"pipeline_id"`
+	Name            string      `db:"name"`
+	Compression     *string     `db:"compression"`
+	Format          *string     `db:"format"`
+	BatchSchema     BatchSchema `db:"batch_schema"`
+	BatchTtlSeconds *int        `db:"batch_ttl_seconds"`
+	RetentionDryRun bool        `db:"retention_dry_run"`
+	KeyTemplate     *string     `db:"key_template"`
+	// Priority of the requests of the pipeline runs, from 0 to amqp.MAX_PRIORITY
+	Priority *int     `db:"priority"`
+	Steps    StepConf `db:"steps"`
 }
 
 type Batch struct {
-	BatchId    uuid.UUID  `db:"batch_id"`
-	StepFromId *uuid.UUID `db:"step_from_id"`
-	StepToId   uuid.UUID  `db:"step_to_id"`
-	IssuedAt   time.Time  `db:"issued_at"`
-	Uri        string     `db:"uri"`
+	BatchId          uuid.UUID  `db:"batch_id"`
+	StepFromId       *uuid.UUID `db:"step_from_id"`
+	StepToId         uuid.UUID  `db:"step_to_id"`
+	IssuedAt         time.Time  `db:"issued_at"`
+	Uri              string     `db:"uri"`
+	RecordCount      *int64     `db:"record_count"`
+	UncompressedSize *int64     `db:"uncompressed_size"`
+	CompressedSize   *int64     `db:"compressed_size"`
+	Sha256           *string    `db:"sha256"`
+	Schema           []byte     `db:"schema"`
+	DeletedAt        *time.Time `db:"deleted_at"`
+}
+
+const (
+	RETENTION_CONSUMED = "consumed"
+	RETENTION_EXPIRED  = "expired"
+)
+
+// CollectableBatch is a batch object which can be removed, either consumed
+// by all steps reading it or older than the pipeline batch ttl.
+type CollectableBatch struct {
+	Uri            string    `db:"uri"`
+	Reason         string    `db:"reason"`
+	IssuedAt       time.Time `db:"issued_at"`
+	CompressedSize *int64    `db:"compressed_size"`
 }
 
 type BatchProcessLog struct {
-	BatchId       uuid.UUID `db:"batch_id"`
-	CorrelationId uuid.UUID `db:"correlation_id"`
-	StartedAt     time.Time `db:"started_at"`
-	FinishedAt    time.Time `db:"finished_at"`
-	State         string    `db:"state"`
-	Error         string    `db:"error"`
+	BatchId            uuid.UUID `db:"batch_id"`
+	CorrelationId      uuid.UUID `db:"correlation_id"`
+	StartedAt          time.Time `db:"started_at"`
+	FinishedAt         time.Time `db:"finished_at"`
+	State              string    `db:"state"`
+	Error              string    `db:"error"`
+	SkippedRecords     int       `db:"skipped_records"`
+	QuarantinedRecords int       `db:"quarantined_records"`
+	QuarantineUri      *string   `db:"quarantine_uri"`
+	// the result of the attempt and its manifest, also for steps without a next step reading it
+	ResultUri        *string `db:"result_uri"`
+	RecordCount      *int64  `db:"record_count"`
+	UncompressedSize *int64  `db:"uncompressed_size"`
+	CompressedSize   *int64  `db:"compressed_size"`
+	Sha256           *string `db:"sha256"`
+	Schema           []byte  `db:"schema"`
+}
+
+type Worker struct {
+	InstanceId    string     `db:"instance_id"`
+	StepId        uuid.UUID  `db:"step_id"`
+	Version       string     `db:"version"`
+	CorrelationId *uuid.UUID `db:"correlation_id"`
+	StartedAt     time.Time  `db:"started_at"`
+	LastSeenAt    time.Time  `db:"last_seen_at"`
 }
@@ -1,11 +1,13 @@
 package db
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	s3io "starbyte.io/core/s3"
 )
 
 type BatchRetries struct {
@@ -18,10 +20,19 @@ type Repository interface {
 	GetResourceUriByCorrelationId(uuid.UUID) (string, error)
 	CreateNewBatch(*uuid.UUID, uuid.UUID, string) (*Batch, error)
 	CreateNewBatchProcessAttempt(uuid.UUID, uuid.UUID) error
-	SetBatchProcessStatus(uuid.UUID, string, string) error
+	DeleteBatchProcessAttempt(uuid.UUID) error
+	SetBatchProcessStatus(uuid.UUID, string, string) (bool, error)
+	SetBatchProcessRejects(uuid.UUID, int, int, string) error
+	SetBatchProcessManifest(uuid.UUID, string, *s3io.Manifest) error
 	GetBatchByCorrelationId(uuid.UUID) (*Batch, error)
-	DiscardBatchByCorrelationId(uuid.UUID) error
+	DiscardBatchByCorrelationId(uuid.UUID) (*Batch, error)
 	GetPipeline(uuid.UUID) (*Pipeline, error)
+	SaveWorkerHeartbeat(*Worker) error
+	GetLostWorkers(uuid.UUID, time.Duration) ([]Worker, error)
+	RemoveWorker(string) error
+	GetStepsWithoutLiveWorkers(uuid.UUID, time.Duration) ([]uuid.UUID, error)
+	GetCollectableBatches(uuid.UUID, time.Duration) ([]CollectableBatch, error)
+	MarkBatchDeleted(string) error
 }
 
 type PgRepository struct {
@@ -104,9 +115,46 @@ func (pg *PgRepository) CreateNewBatchProcessAttempt(batchId uuid.UUID, correlat
 	return err
 }
 
-func (pg *PgRepository) SetBatchProcessStatus(correlationId uuid.UUID, state string, err string) error {
-	_, dbErr := pg.conn.Exec(`update batch_process_log set finished_at=now() at time zone 'utc', state=$1, error=$2 where correlation_id = $3`, state, err, correlationId)
-	return dbErr
+// DeleteBatchProcessAttempt removes an attempt whose request was never published.
+func (pg *PgRepository) DeleteBatchProcessAttempt(correlationId uuid.UUID) error {
+	_, err := pg.conn.Exec(`delete from batch_process_log where correlation_id = $1`, correlationId)
+	return err
+}
+
+// SetBatchProcessStatus finishes a running attempt, it reports false when the attempt was finished already,
+// e.g. by the liveness check, or does not exist.
+func (pg *PgRepository) SetBatchProcessStatus(correlationId uuid.UUID, state string, err string) (bool, error) {
+	res, dbErr := pg.conn.Exec(`update batch_process_log set finished_at=now() at time zone 'utc', state=$1, error=$2 where correlation_id = $3 and finished_at is null`, state, err, correlationId)
+	if dbErr != nil {
+		return false, dbErr
+	}
+	finished, dbErr := res.RowsAffected()
+	return finished > 0, dbErr
+}
+
+func (pg *PgRepository) SetBatchProcessRejects(correlationId uuid.UUID, skipped int, quarantined int, quarantineUri string) error {
+	_, err := pg.conn.Exec(`update batch_process_log set skipped_records=$1, quarantined_records=$2, quarantine_uri=nullif($3, '') where correlation_id = $4`, skipped, quarantined, quarantineUri, correlationId)
+	return err
+}
+
+// SetBatchProcessManifest stores the manifest of the result of an attempt on the attempt and on the batches reading the result.
+func (pg *PgRepository) SetBatchProcessManifest(correlationId uuid.UUID, resultUri string, manifest *s3io.Manifest) error {
+	var schema []byte
+	if manifest.Schema != nil {
+		var err error
+		if schema, err = json.Marshal(manifest.Schema); err != nil {
+			return err
+		}
+	}
+
+	_, err := pg.conn.Exec(`update batch_process_log set result_uri=$1, record_count=$2, uncompressed_size=$3, compressed_size=$4, sha256=$5, schema=$6 where correlation_id = $7`,
+		resultUri, manifest.Records, manifest.UncompressedSize, manifest.CompressedSize, manifest.Sha256, schema, correlationId)
+	if err != nil {
+		return err
+	}
+	_, err = pg.conn.Exec(`update batches set record_count=$1, uncompressed_size=$2, compressed_size=$3, sha256=$4, schema=$5 where uri = $6`,
+		manifest.Records, manifest.UncompressedSize, manifest.CompressedSize, manifest.Sha256, schema, resultUri)
+	return err
 }
 
 func (pg *PgRepository) GetBatchByCorrelationId(correlationId uuid.UUID) (*Batch, error) {
@@ -119,21 +167,22 @@ func (pg *PgRepository) GetBatchByCorrelationId(correlationId uuid.UUID) (*Batch
 	return batch, err
 }
 
-func (pg *PgRepository) DiscardBatchByCorrelationId(correlationId uuid.UUID) error {
+// DiscardBatchByCorrelationId deletes the batch rows and returns the batch, its object is left to the caller.
+func (pg *PgRepository) DiscardBatchByCorrelationId(correlationId uuid.UUID) (*Batch, error) {
 	batch, err := pg.GetBatchByCorrelationId(correlationId)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = pg.conn.Exec(`delete from batch_process_log where batch_id = $1`, batch.BatchId)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	_, err = pg.conn.Exec(`delete from batches where batch_id = $1`, batch.BatchId)
 
-	return err
+	return batch, err
 }
 
 func (pg *PgRepository) GetPipeline(pipelineId uuid.UUID) (*Pipeline, error) {
@@ -164,3 +213,119 @@ func (pg *PgRepository) GetPipeline(pipelineId uuid.UUID) (*Pipeline, error) {
 	}
 	return pipeline, nil
 }
+
+func (pg *PgRepository) SaveWorkerHeartbeat(worker *Worker) error {
+	_, err := pg.conn.Exec(
+		`insert into workers (instance_id, step_id, version, correlation_id, started_at, last_seen_at)
+		values ($1, $2, $3, $4, now() at time zone 'utc', now() at time zone 'utc')
+		on conflict (instance_id) do update set
+			step_id = excluded.step_id,
+			version = excluded.version,
+			correlation_id = excluded.correlation_id,
+			last_seen_at = excluded.last_seen_at`,
+		worker.InstanceId, worker.StepId, worker.Version, worker.CorrelationId,
+	)
+	return err
+}
+
+// GetLostWorkers returns workers of the pipeline which have not sent a heartbeat within timeout.
+// CorrelationId is set only when the attempt held by the worker is still unfinished.
+func (pg *PgRepository) GetLostWorkers(pipelineId uuid.UUID, timeout time.Duration) ([]Worker, error) {
+	workers := []Worker{}
+	err := pg.conn.Select(&workers,
+		`select
+			w.instance_id,
+			w.step_id,
+			coalesce(w.version, '') as version,
+			case when bpl.correlation_id is not null and bpl.finished_at is null then w.correlation_id end as correlation_id,
+			w.started_at,
+			w.last_seen_at
+		from workers w
+		join steps s using(step_id)
+		left join batch_process_log bpl on bpl.correlation_id = w.correlation_id
+		where s.pipeline_id = $1
+			and w.last_seen_at < (now() at time zone 'utc') - make_interval(secs => $2)`,
+		pipelineId, timeout.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return workers, nil
+}
+
+func (pg *PgRepository) RemoveWorker(instanceId string) error {
+	_, err := pg.conn.Exec(`delete from workers where instance_id = $1`, instanceId)
+	return err
+}
+
+func (pg *PgRepository) GetStepsWithoutLiveWorkers(pipelineId uuid.UUID, timeout time.Duration) ([]uuid.UUID, error) {
+	steps := []uuid.UUID{}
+	err := pg.conn.Select(&steps,
+		`select s.step_id
+		from steps s
+		where s.pipeline_id = $1
+			and not exists (
+				select 1 from workers w
+				where w.step_id = s.step_id
+					and w.last_seen_at >= (now() at time zone 'utc') - make_interval(secs => $2))`,
+		pipelineId, timeout.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// GetCollectableBatches returns batch objects of the pipeline which are not needed anymore. An object is
+// consumed once every step reading from its producer has a batch of it with a successful attempt.
+// Objects older than ttl are collected too unless an attempt reading them is in flight, a zero ttl disables
+// expiration. Dead letters, batches whose
+// attempts all failed without a retry pending, are never collected. Final step outputs have no batches
+// and are never collected either.
+func (pg *PgRepository) GetCollectableBatches(pipelineId uuid.UUID, ttl time.Duration) ([]CollectableBatch, error) {
+	batches := []CollectableBatch{}
+	err := pg.conn.Select(&batches,
+		`with objects as (
+			select
+				b.uri,
+				min(b.issued_at) as issued_at,
+				max(b.compressed_size) as compressed_size,
+				count(distinct b.step_to_id) filter (where b.step_from_id is not null) as consumers,
+				max((select count(*) from steps c where c.input_step_id = b.step_from_id)) as expected_consumers,
+				bool_and(b.step_from_id is null or exists (
+					select 1 from batch_process_log l where l.batch_id = b.batch_id and l.state = 'OK')) as consumed,
+				bool_or(
+					not exists (
+						select 1 from batch_process_log l
+						where l.batch_id = b.batch_id and (l.state = 'OK' or l.finished_at is null))
+					and exists (
+						select 1 from batch_process_log l where l.batch_id = b.batch_id and l.state = 'ERROR')) as dead_letter,
+				bool_or(exists (
+					select 1 from batch_process_log l where l.batch_id = b.batch_id and l.finished_at is null)) as processing
+			from batches b
+			join steps s on s.step_id = b.step_to_id
+			where s.pipeline_id = $1
+				and b.deleted_at is null
+			group by b.uri)
+		select
+			uri,
+			case when consumed and consumers > 0 and consumers = expected_consumers then $3 else $4 end as reason,
+			issued_at,
+			compressed_size
+		from objects
+		where not dead_letter
+			and ((consumed and consumers > 0 and consumers = expected_consumers)
+				or (not processing and $2::float8 > 0 and issued_at < (now() at time zone 'utc') - make_interval(secs => $2::float8)))
+		order by issued_at`,
+		pipelineId, ttl.Seconds(), RETENTION_CONSUMED, RETENTION_EXPIRED,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return batches, nil
+}
+
+func (pg *PgRepository) MarkBatchDeleted(uri string) error {
+	_, err := pg.conn.Exec(`update batches set deleted_at = now() at time zone 'utc' where uri = $1`, uri)
+	return err
+}
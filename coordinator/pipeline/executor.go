@@ -4,28 +4,54 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 	"starbyte.io/coordinator/db"
 	"starbyte.io/core/amqp"
+	s3io "starbyte.io/core/s3"
 	"starbyte.io/core/utils"
 )
 
 type amqpRpcPair struct {
-	vertex db.PipelineTopologyVertex
-	req    string
-	resp   string
-	next   []*amqpRpcPair
+	vertex     db.PipelineTopologyVertex
+	req        string
+	resp       string
+	heartbeat  string
+	deadLetter string
+	next       []*amqpRpcPair
 }
 
 type PipelineExecutor struct {
-	pipeline        *db.Pipeline
-	rpcChannels     []*amqpRpcPair
-	inputRpcChannel *amqpRpcPair
-	amqpConn        amqp.Amqp
-	s3ConnStr       string
-	dbRepository    db.Repository
+	pipeline              *db.Pipeline
+	rpcChannels           []*amqpRpcPair
+	inputRpcChannel       *amqpRpcPair
+	amqpConn              amqp.Amqp
+	s3ConnStr             string
+	batchOptions          s3io.BatchOptions
+	keyTemplate           keyTemplate
+	runId                 string
+	sequences             stepSequences
+	dbRepository          db.Repository
+	heartbeatTimeout      time.Duration
+	livenessCheckInterval time.Duration
+	retentionInterval     time.Duration
+	publishBackoff        time.Duration
+	idleSteps             idleSteps
+	progress              *pipelineProgress
+	priority              int
+	scheduler             *Scheduler
+}
+
+var ErrInvalidPriority = errors.New("priority out of range")
+
+func checkPriority(priority int) error {
+	if priority < 0 || priority > amqp.MAX_PRIORITY {
+		return fmt.Errorf("%w: %d, expected 0 to %d", ErrInvalidPriority, priority, amqp.MAX_PRIORITY)
+	}
+	return nil
 }
 
 func findAllOutVertex(vertex db.PipelineTopologyVertex, edges []db.PipelineTopologyEdge) []db.PipelineTopologyVertex {
@@ -53,8 +79,17 @@ func initRpcChannels(topology *db.PipelineGraph) []*amqpRpcPair {
 	for _, node := range topology.Nodes {
 		requestAmqpQueueName := node.Step.GetReqQueueName()
 		responseAmqpQueueName := node.Step.GetRespQueueName()
+		heartbeatAmqpQueueName := node.Step.GetHeartbeatQueueName()
+		deadLetterAmqpQueueName := node.Step.GetDeadLetterQueueName()
 
-		rpcChannels = append(rpcChannels, &amqpRpcPair{vertex: node, req: requestAmqpQueueName, resp: responseAmqpQueueName, next: []*amqpRpcPair{}})
+		rpcChannels = append(rpcChannels, &amqpRpcPair{
+			vertex:     node,
+			req:        requestAmqpQueueName,
+			resp:       responseAmqpQueueName,
+			heartbeat:  heartbeatAmqpQueueName,
+			deadLetter: deadLetterAmqpQueueName,
+			next:       []*amqpRpcPair{},
+		})
 	}
 
 	for _, amqpPair := range rpcChannels {
@@ -81,6 +116,43 @@ func NewExecutor(pipeline *db.Pipeline, amqpConn amqp.Amqp, s3ConnStr string, db
 		return nil, err
 	}
 
+	if s3io.HasInlineCredentials(s3io.JoinUri(s3ConnStr, "batch")) {
+		slog.Warn("storage uri with inline credentials is deprecated, credentials are sent with every batch uri; use s3://bucket/prefix instead",
+			"Uri", s3io.RedactUri(s3io.JoinUri(s3ConnStr, "batch")),
+		)
+	}
+
+	format, compression := "", ""
+	if pipeline.Format != nil {
+		format = *pipeline.Format
+	}
+	if pipeline.Compression != nil {
+		compression = *pipeline.Compression
+	}
+
+	batchOptions, err := s3io.ParseBatchOptions(format, compression, pipeline.BatchSchema)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s: %w", pipeline.Name, err)
+	}
+
+	template := ""
+	if pipeline.KeyTemplate != nil {
+		template = *pipeline.KeyTemplate
+	}
+
+	keyTemplate, err := parseKeyTemplate(template)
+	if err != nil {
+		return nil, fmt.Errorf("pipeline %s: %w", pipeline.Name, err)
+	}
+
+	priority := 0
+	if pipeline.Priority != nil {
+		priority = *pipeline.Priority
+	}
+	if err := checkPriority(priority); err != nil {
+		return nil, fmt.Errorf("pipeline %s: %w", pipeline.Name, err)
+	}
+
 	rpcChannels := initRpcChannels(topology)
 	var inputRpcChannel *amqpRpcPair
 
@@ -92,47 +164,132 @@ func NewExecutor(pipeline *db.Pipeline, amqpConn amqp.Amqp, s3ConnStr string, db
 	}
 
 	return &PipelineExecutor{
-		pipeline:        pipeline,
-		rpcChannels:     rpcChannels,
-		amqpConn:        amqpConn,
-		inputRpcChannel: inputRpcChannel,
-		s3ConnStr:       s3ConnStr,
-		dbRepository:    dbRepository,
+		pipeline:              pipeline,
+		rpcChannels:           rpcChannels,
+		amqpConn:              amqpConn,
+		inputRpcChannel:       inputRpcChannel,
+		s3ConnStr:             s3ConnStr,
+		batchOptions:          batchOptions,
+		keyTemplate:           keyTemplate,
+		runId:                 newRunId(time.Now()),
+		dbRepository:          dbRepository,
+		heartbeatTimeout:      WORKER_HEARTBEAT_TIMEOUT,
+		livenessCheckInterval: WORKER_LIVENESS_CHECK_INTERVAL,
+		retentionInterval:     BATCH_RETENTION_INTERVAL,
+		publishBackoff:        PUBLISH_RETRY_BACKOFF,
+		idleSteps:             idleSteps{steps: map[uuid.UUID]bool{}},
+		progress:              newPipelineProgress(),
+		priority:              priority,
 	}, nil
 
 }
 
+// SetPriority overrides the priority of the pipeline for this run, e.g. to run a backfill below the
+// daily runs. It is called before Run.
+func (exec *PipelineExecutor) SetPriority(priority int) error {
+	if err := checkPriority(priority); err != nil {
+		return err
+	}
+	exec.priority = priority
+	return nil
+}
+
+// SetScheduler makes the run share the capacity of scheduler with the other runs using it. It is called before Run.
+func (exec *PipelineExecutor) SetScheduler(scheduler *Scheduler) {
+	exec.scheduler = scheduler
+}
+
 func (exec *PipelineExecutor) ensureQueueDeclared() error {
 	for _, pair := range exec.rpcChannels {
-		reqErr := exec.amqpConn.QueueDeclare(pair.req)
-		respErr := exec.amqpConn.QueueDeclare(pair.resp)
+		reqErr := exec.amqpConn.QueueDeclare(pair.req, pair.deadLetter)
+		respErr := exec.amqpConn.QueueDeclare(pair.resp, pair.deadLetter)
+		heartbeatErr := exec.amqpConn.QueueDeclare(pair.heartbeat, "")
 
-		if reqErr != nil || respErr != nil {
-			return errors.Join(reqErr, respErr)
+		if reqErr != nil || respErr != nil || heartbeatErr != nil {
+			return errors.Join(reqErr, respErr, heartbeatErr)
 		}
 	}
 	return nil
 }
 
-func (exec *PipelineExecutor) getNewResultUri() string {
-	uid := uuid.New()
-	return fmt.Sprintf("%s/%s.cbor.tar.gz", exec.s3ConnStr, uid.String())
+// DeadLetters returns up to limit dead-lettered messages of every step, by step name.
+func (exec *PipelineExecutor) DeadLetters(ctx context.Context, limit int) (map[string][]amqp.DeadLetter, error) {
+	inspector, ok := exec.amqpConn.(amqp.AmqpDeadLetterInspector)
+	if !ok {
+		return nil, errors.New("amqp connection does not support dead-letter inspection")
+	}
+
+	result := map[string][]amqp.DeadLetter{}
+	for _, pair := range exec.rpcChannels {
+		letters, err := inspector.DeadLetters(ctx, pair.deadLetter, limit)
+		if err != nil {
+			return nil, fmt.Errorf("step %s: %w", pair.vertex.Step.Name, err)
+		}
+		result[pair.vertex.Step.Name] = letters
+	}
+	return result, nil
+}
+
+// getNewResultUri returns the uri of a new batch produced by step.
+func (exec *PipelineExecutor) getNewResultUri(step db.Step) string {
+	key := exec.keyTemplate.render(keyValues{
+		pipeline:   exec.pipeline.Name,
+		pipelineId: exec.pipeline.Id,
+		run:        exec.runId,
+		step:       step.Name,
+		stepId:     step.Id,
+		seq:        exec.sequences.next(step.Id),
+		batchId:    uuid.New(),
+		issuedAt:   time.Now().UTC(),
+		ext:        exec.batchOptions.Extension(),
+	})
+	return s3io.JoinUri(exec.s3ConnStr, key)
 }
 
 func (exec *PipelineExecutor) newCorrelationId() uuid.UUID {
 	return uuid.New()
 }
 
+// Run processes the pipeline until its whole input is processed. It returns the first error which stopped
+// processing the responses of a step, the run is stopped then.
 func (exec *PipelineExecutor) Run() error {
 	if err := exec.ensureQueueDeclared(); err != nil {
 		return err
 	}
 
+	exec.progress.run = exec.scheduler.register(exec.priority)
+	defer exec.progress.run.close()
+
 	wg := &sync.WaitGroup{}
 
-	workersContext := context.Background()
+	workersContext, stopWorkers := context.WithCancelCause(context.Background())
+	defer stopWorkers(nil)
+	livenessContext, stopLiveness := context.WithCancel(workersContext)
+	defer stopLiveness()
 
-	utils.RunInWg(wg, func() { exec.executeInputProcessing(workersContext, exec.inputRpcChannel) })
+	go func() {
+		select {
+		case <-exec.Complete():
+			stopWorkers(nil)
+		case <-workersContext.Done():
+		}
+	}()
+
+	livenessWg := &sync.WaitGroup{}
+	utils.RunInWg(livenessWg, func() { exec.executeLivenessMonitoring(livenessContext) })
+
+	for _, pair := range exec.rpcChannels {
+		p := pair
+		utils.RunInWg(livenessWg, func() { exec.executeHeartbeatProcessing(livenessContext, p) })
+	}
+
+	utils.RunInWg(livenessWg, func() { exec.executeRetention(livenessContext) })
+
+	utils.RunInWg(wg, func() {
+		if err := exec.executeInputProcessing(workersContext, exec.inputRpcChannel); err != nil {
+			stopWorkers(fmt.Errorf("step %s: %w", exec.inputRpcChannel.vertex.Step.Name, err))
+		}
+	})
 
 	for _, pair := range exec.rpcChannels {
 		if pair == exec.inputRpcChannel {
@@ -142,11 +299,20 @@ func (exec *PipelineExecutor) Run() error {
 		wg.Add(1)
 		go func(p *amqpRpcPair, c context.Context) {
 			defer wg.Done()
-			exec.executeNodeProcessing(c, p)
+			if err := exec.executeNodeProcessing(c, p); err != nil {
+				stopWorkers(fmt.Errorf("step %s: %w", p.vertex.Step.Name, err))
+			}
 		}(pair, workersContext)
 	}
 
 	wg.Wait()
 
+	stopLiveness()
+	livenessWg.Wait()
+
+	// the run completed when the workers context was cancelled without cause
+	if err := context.Cause(workersContext); !errors.Is(err, context.Canceled) {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"log/slog"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// pipelineProgress follows the batch process attempts of the run. The pipeline is complete once the
+// input reported ALLDONE, every attempt has finished and no response is being processed.
+type pipelineProgress struct {
+	mu         sync.Mutex
+	attempts   map[uuid.UUID]bool
+	processing int
+	inputDone  bool
+	complete   chan struct{}
+	// run counts the attempts in flight for the scheduler of the run, if any
+	run *scheduledRun
+}
+
+func newPipelineProgress() *pipelineProgress {
+	return &pipelineProgress{attempts: map[uuid.UUID]bool{}, complete: make(chan struct{})}
+}
+
+func (p *pipelineProgress) start(correlationId uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.attempts[correlationId] {
+		p.attempts[correlationId] = true
+		p.run.started()
+	}
+}
+
+func (p *pipelineProgress) finish(correlationId uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.attempts[correlationId] {
+		delete(p.attempts, correlationId)
+		p.run.finished()
+	}
+}
+
+// begin is called before a response is processed, attempts it starts are not known yet.
+func (p *pipelineProgress) begin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.processing++
+}
+
+// end is called once a response is processed, it reports whether the pipeline has just completed.
+func (p *pipelineProgress) end(inputDone bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.processing--
+	p.inputDone = p.inputDone || inputDone
+
+	if !p.inputDone || p.processing > 0 || len(p.attempts) > 0 {
+		return false
+	}
+
+	select {
+	case <-p.complete:
+		return false
+	default:
+		close(p.complete)
+		return true
+	}
+}
+
+func (exec *PipelineExecutor) endProcessing(inputDone bool) {
+	if exec.progress.end(inputDone) {
+		slog.Info("pipeline complete", "Pipeline", exec.pipeline.Name, "Run", exec.runId)
+	}
+}
+
+// Complete returns a channel which is closed once the pipeline processed its whole input, Run returns then.
+func (exec *PipelineExecutor) Complete() <-chan struct{} {
+	return exec.progress.complete
+}
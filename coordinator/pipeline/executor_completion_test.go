@@ -0,0 +1,42 @@
+package pipeline
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestPipelineProgress(t *testing.T) {
+	progress := newPipelineProgress()
+	input, next := uuid.New(), uuid.New()
+
+	progress.start(input)
+	progress.begin()
+	progress.finish(input)
+	// the next attempt is started while the response is processed
+	progress.start(next)
+	if progress.end(false) {
+		t.Errorf("pipeline completed before the input is done")
+	}
+
+	progress.begin()
+	progress.finish(next)
+	progress.begin()
+	if progress.end(true) {
+		t.Errorf("pipeline completed while a response is processed")
+	}
+	if !progress.end(false) {
+		t.Errorf("pipeline not completed")
+	}
+
+	select {
+	case <-progress.complete:
+	default:
+		t.Errorf("complete is not closed")
+	}
+
+	progress.begin()
+	if progress.end(false) {
+		t.Errorf("pipeline completed twice")
+	}
+}
@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/coordinator/db"
+	"starbyte.io/core/rpc"
+)
+
+const (
+	WORKER_HEARTBEAT_TIMEOUT       = 30 * time.Second
+	WORKER_LIVENESS_CHECK_INTERVAL = 10 * time.Second
+)
+
+var ErrWorkerLost = errors.New("worker stopped sending heartbeats")
+
+type idleSteps struct {
+	mu    sync.RWMutex
+	steps map[uuid.UUID]bool
+}
+
+func (s *idleSteps) set(stepIds []uuid.UUID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.steps = make(map[uuid.UUID]bool, len(stepIds))
+	for _, stepId := range stepIds {
+		s.steps[stepId] = true
+	}
+}
+
+func (s *idleSteps) has(stepId uuid.UUID) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.steps[stepId]
+}
+
+func (exec *PipelineExecutor) findRpcNodePairByStepId(stepId uuid.UUID) *amqpRpcPair {
+	for _, pair := range exec.rpcChannels {
+		if pair.vertex.Step.Id == stepId {
+			return pair
+		}
+	}
+	return nil
+}
+
+// StepsWithoutConsumers returns names of the pipeline steps which had no live worker
+// at the last liveness check.
+func (exec *PipelineExecutor) StepsWithoutConsumers() []string {
+	result := []string{}
+	for _, pair := range exec.rpcChannels {
+		if exec.idleSteps.has(pair.vertex.Step.Id) {
+			result = append(result, pair.vertex.Name)
+		}
+	}
+	return result
+}
+
+func (exec *PipelineExecutor) processHeartbeat(heartbeat rpc.Heartbeat, node *amqpRpcPair) error {
+	if heartbeat.StepId != node.vertex.Step.Id {
+		slog.Warn("heartbeat step does not match queue step",
+			"InstanceId", heartbeat.InstanceId,
+			"StepId", heartbeat.StepId,
+			"Queue", node.heartbeat,
+		)
+	}
+
+	return exec.dbRepository.SaveWorkerHeartbeat(&db.Worker{
+		InstanceId:    heartbeat.InstanceId,
+		StepId:        node.vertex.Step.Id,
+		Version:       heartbeat.Version,
+		CorrelationId: heartbeat.CorrelationId,
+	})
+}
+
+func (exec *PipelineExecutor) executeHeartbeatProcessing(ctx context.Context, node *amqpRpcPair) error {
+	messages, err := exec.amqpConn.Messages(ctx, node.heartbeat)
+	if err != nil {
+		return err
+	}
+
+	for msg := range messages {
+		heartbeat, err := rpc.DecodeHeartbeat(msg)
+		if err != nil {
+			slog.Warn("dropping heartbeat", "Queue", node.heartbeat, "Error", err)
+			msg.Nack(false, false)
+			continue
+		}
+
+		if err := exec.processHeartbeat(heartbeat, node); err != nil {
+			slog.Error("failed to save worker heartbeat", "InstanceId", heartbeat.InstanceId, "Error", err)
+		}
+
+		if err := msg.Ack(false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// failLostAttempt processes the attempt of a lost worker as failed, the progress of the run counts it until it returns.
+func (exec *PipelineExecutor) failLostAttempt(ctx context.Context, correlationId uuid.UUID, node *amqpRpcPair) error {
+	exec.progress.begin()
+	defer exec.endProcessing(false)
+
+	return exec.processErrorEvent(ctx, rpc.ProcessResponse{
+		CorrelationId: correlationId,
+		Status:        rpc.ERROR,
+		Error:         ErrWorkerLost.Error(),
+	}, node)
+}
+
+func (exec *PipelineExecutor) checkWorkersLiveness(ctx context.Context) error {
+	lostWorkers, err := exec.dbRepository.GetLostWorkers(exec.pipeline.Id, exec.heartbeatTimeout)
+	if err != nil {
+		return err
+	}
+
+	for _, worker := range lostWorkers {
+		slog.Warn("worker lost", "InstanceId", worker.InstanceId, "StepId", worker.StepId, "LastSeenAt", worker.LastSeenAt)
+
+		node := exec.findRpcNodePairByStepId(worker.StepId)
+		if worker.CorrelationId != nil && node != nil {
+			if err := exec.failLostAttempt(ctx, *worker.CorrelationId, node); err != nil {
+				return err
+			}
+		}
+
+		if err := exec.dbRepository.RemoveWorker(worker.InstanceId); err != nil {
+			return err
+		}
+	}
+
+	idle, err := exec.dbRepository.GetStepsWithoutLiveWorkers(exec.pipeline.Id, exec.heartbeatTimeout)
+	if err != nil {
+		return err
+	}
+
+	exec.idleSteps.set(idle)
+	for _, stepName := range exec.StepsWithoutConsumers() {
+		slog.Warn("step has no live consumers", "Pipeline", exec.pipeline.Name, "Step", stepName)
+	}
+
+	return nil
+}
+
+func (exec *PipelineExecutor) executeLivenessMonitoring(ctx context.Context) {
+	ticker := time.NewTicker(exec.livenessCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := exec.checkWorkersLiveness(ctx); err != nil {
+				slog.Error("workers liveness check failed", "Pipeline", exec.pipeline.Name, "Error", err)
+			}
+		}
+	}
+}
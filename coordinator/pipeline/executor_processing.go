@@ -2,40 +2,99 @@ package pipeline
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
 
 	"starbyte.io/core/rpc"
+	s3io "starbyte.io/core/s3"
 )
 
+const PUBLISH_RETRIES = 3
+const PUBLISH_RETRY_BACKOFF = 200 * time.Millisecond
+
+// producer identifies the coordinator run in the envelope of its requests.
+func (exec *PipelineExecutor) producer() string {
+	return fmt.Sprintf("coordinator/%s/%s", exec.pipeline.Name, exec.runId)
+}
+
+// publish retries requests the broker did not confirm. A request may be delivered twice
+// when only its confirmation was lost, both deliveries share the correlation id.
+func (exec *PipelineExecutor) publish(ctx context.Context, queueName string, req *rpc.ProcessRequest) error {
+	backoff := exec.publishBackoff
+	for attempt := 1; ; attempt++ {
+		err := rpc.Publish(ctx, exec.amqpConn, queueName, req, exec.producer())
+		if err == nil || attempt > PUBLISH_RETRIES || ctx.Err() != nil {
+			return err
+		}
+
+		slog.Warn("failed to publish request", "Queue", queueName, "CorrelationId", req.CorrelationId, "Attempt", attempt, "Error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// publishNewBatch publishes the request of a batch created for it, the batch is removed when it can not be published.
+func (exec *PipelineExecutor) publishNewBatch(ctx context.Context, queueName string, req *rpc.ProcessRequest) error {
+	err := exec.publish(ctx, queueName, req)
+	if err != nil {
+		exec.progress.finish(req.CorrelationId)
+		_, discardErr := exec.dbRepository.DiscardBatchByCorrelationId(req.CorrelationId)
+		return errors.Join(err, discardErr)
+	}
+	return nil
+}
+
+// pumpBatchIntoInput requests the next batch of the input, once the scheduler of the run admits it.
 func (exec *PipelineExecutor) pumpBatchIntoInput(ctx context.Context, node *amqpRpcPair) error {
-	batchUri := exec.getNewResultUri()
+	if err := exec.progress.run.admit(ctx); err != nil {
+		return err
+	}
+
+	batchUri := exec.getNewResultUri(node.vertex.Step)
 	correlationId := exec.newCorrelationId()
 	req := &rpc.ProcessRequest{
 		ResultUri:     batchUri,
 		CorrelationId: correlationId,
+		Compression:   exec.batchOptions.Compression.String(),
+		Format:        string(exec.batchOptions.Format),
+		Schema:        exec.batchOptions.Schema,
+		Priority:      exec.priority,
 	}
 
 	batch, err := exec.dbRepository.CreateNewBatch(nil, node.vertex.Step.Id, batchUri)
 	if err != nil {
+		exec.progress.run.release()
 		return err
 	}
 	err = exec.dbRepository.CreateNewBatchProcessAttempt(batch.BatchId, correlationId)
 	if err != nil {
+		exec.progress.run.release()
 		return err
 	}
+	exec.progress.start(correlationId)
 
-	return exec.amqpConn.Publish(ctx, node.req, req)
+	return exec.publishNewBatch(ctx, node.req, req)
 }
 
-func (exec *PipelineExecutor) buildOkRequest(event rpc.ProcessResponse) (*rpc.ProcessRequest, error) {
+func (exec *PipelineExecutor) buildOkRequest(event rpc.ProcessResponse, next *amqpRpcPair) (*rpc.ProcessRequest, error) {
 	return &rpc.ProcessRequest{
 		ResourceUri:   event.ResultUri,
-		ResultUri:     exec.getNewResultUri(),
+		ResultUri:     exec.getNewResultUri(next.vertex.Step),
 		CorrelationId: exec.newCorrelationId(),
+		Compression:   exec.batchOptions.Compression.String(),
+		Format:        string(exec.batchOptions.Format),
+		Schema:        exec.batchOptions.Schema,
+		Priority:      exec.priority,
 	}, nil
 }
 
-func (exec *PipelineExecutor) buildErrorRequest(event rpc.ProcessResponse) (*rpc.ProcessRequest, error) {
+func (exec *PipelineExecutor) buildErrorRequest(event rpc.ProcessResponse, node *amqpRpcPair) (*rpc.ProcessRequest, error) {
 	retries, err := exec.dbRepository.GetMaxRetriesByCorrelationId(event.CorrelationId)
 	if err != nil {
 		return nil, err
@@ -49,25 +108,38 @@ func (exec *PipelineExecutor) buildErrorRequest(event rpc.ProcessResponse) (*rpc
 		}
 		return &rpc.ProcessRequest{
 			ResourceUri:   resourceUri,
-			ResultUri:     exec.getNewResultUri(),
+			ResultUri:     exec.getNewResultUri(node.vertex.Step),
 			CorrelationId: exec.newCorrelationId(),
+			Compression:   exec.batchOptions.Compression.String(),
+			Format:        string(exec.batchOptions.Format),
+			Schema:        exec.batchOptions.Schema,
+			Priority:      exec.priority,
 		}, nil
 	}
 }
 
 func (exec *PipelineExecutor) processOkEvent(ctx context.Context, event rpc.ProcessResponse, node *amqpRpcPair) error {
 
-	err := exec.dbRepository.SetBatchProcessStatus(event.CorrelationId, string(rpc.OK), "")
+	finished, err := exec.dbRepository.SetBatchProcessStatus(event.CorrelationId, string(rpc.OK), "")
 	if err != nil {
 		return err
 	}
-
-	if node.next == nil {
+	if !finished {
+		// the attempt was failed by the liveness check meanwhile and is retried already
+		slog.Warn("dropping response of a finished attempt", "CorrelationId", event.CorrelationId, "Status", event.Status)
 		return nil
 	}
+	exec.progress.finish(event.CorrelationId)
+
+	if event.SkippedRecords > 0 || event.QuarantinedRecords > 0 {
+		err = exec.dbRepository.SetBatchProcessRejects(event.CorrelationId, event.SkippedRecords, event.QuarantinedRecords, event.QuarantineUri)
+		if err != nil {
+			return err
+		}
+	}
 
 	for _, next := range node.next {
-		res, err := exec.buildOkRequest(event)
+		res, err := exec.buildOkRequest(event, next)
 		if err != nil {
 			return err
 		}
@@ -83,15 +155,25 @@ func (exec *PipelineExecutor) processOkEvent(ctx context.Context, event rpc.Proc
 		if err != nil {
 			return err
 		}
+		exec.progress.start(res.CorrelationId)
 
-		err = exec.amqpConn.Publish(ctx, next.req, res)
+		err = exec.publishNewBatch(ctx, next.req, res)
 		if err != nil {
 			return err
 		}
 	}
+
+	// the manifest is stored on the attempt, which final steps have too, and on the batches created for the next steps above
+	if event.Manifest != nil {
+		return exec.dbRepository.SetBatchProcessManifest(event.CorrelationId, event.ResultUri, event.Manifest)
+	}
 	return nil
 }
 
+// processErrorEvent retries the failed batch on the request queue of the step which failed, node,
+// until its retries are exhausted. The attempt is recorded before the request is published so
+// the response of a fast worker always finds it. Only the first response finishing an attempt retries it,
+// a worker response racing with the liveness check of the same attempt is dropped.
 func (exec *PipelineExecutor) processErrorEvent(ctx context.Context, event rpc.ProcessResponse, node *amqpRpcPair) error {
 
 	batch, err := exec.dbRepository.GetBatchByCorrelationId(event.CorrelationId)
@@ -99,42 +181,57 @@ func (exec *PipelineExecutor) processErrorEvent(ctx context.Context, event rpc.P
 		return err
 	}
 
-	err = exec.dbRepository.SetBatchProcessStatus(event.CorrelationId, string(rpc.ERROR), event.Error)
+	finished, err := exec.dbRepository.SetBatchProcessStatus(event.CorrelationId, string(rpc.ERROR), event.Error)
 	if err != nil {
 		return err
 	}
+	if !finished {
+		slog.Warn("dropping response of a finished attempt", "CorrelationId", event.CorrelationId, "Status", event.Status)
+		return nil
+	}
+	exec.progress.finish(event.CorrelationId)
 
-	if node.next == nil {
+	// input batches are not retried, the input step is pumped with a new request instead
+	if node == exec.inputRpcChannel {
 		return nil
 	}
 
-	for _, next := range node.next {
-		if next.vertex.Step.Id != batch.StepToId {
-			continue
-		}
-		res, err := exec.buildErrorRequest(event)
-		if err != nil {
-			return err
-		}
-		if res == nil {
-			return nil
-		}
-		err = exec.amqpConn.Publish(ctx, next.req, res)
-		if err != nil {
-			return err
-		}
+	res, err := exec.buildErrorRequest(event, node)
+	if err != nil {
+		return err
+	}
+	if res == nil {
+		return nil
+	}
 
-		err = exec.dbRepository.CreateNewBatchProcessAttempt(batch.BatchId, res.CorrelationId)
+	err = exec.dbRepository.CreateNewBatchProcessAttempt(batch.BatchId, res.CorrelationId)
+	if err != nil {
+		return err
+	}
+	exec.progress.start(res.CorrelationId)
 
-		if err != nil {
-			return err
-		}
+	// the batch is kept for the attempts already made, only the unpublished attempt is removed
+	if err := exec.publish(ctx, node.req, res); err != nil {
+		exec.progress.finish(res.CorrelationId)
+		return errors.Join(err, exec.dbRepository.DeleteBatchProcessAttempt(res.CorrelationId))
 	}
 	return nil
 }
 
 func (exec *PipelineExecutor) processAllDoneEvent(ctx context.Context, event rpc.ProcessResponse, node *amqpRpcPair) error {
-	return exec.dbRepository.DiscardBatchByCorrelationId(event.CorrelationId)
+	batch, err := exec.dbRepository.DiscardBatchByCorrelationId(event.CorrelationId)
+	if err != nil {
+		return err
+	}
+	exec.progress.finish(event.CorrelationId)
+
+	// the input had no records left, usually nothing was written to the batch uri
+	if batch.Uri != "" {
+		if err := deleteBatchObject(ctx, batch.Uri); err != nil {
+			slog.Warn("failed to remove discarded batch", "Uri", s3io.RedactUri(batch.Uri), "Error", err)
+		}
+	}
+	return nil
 }
 
 func (exec *PipelineExecutor) readRespEvents(ctx context.Context, queueName string) (chan rpc.ProcessResponse, error) {
@@ -148,21 +245,55 @@ func (exec *PipelineExecutor) readRespEvents(ctx context.Context, queueName stri
 	go func() {
 		defer close(resultCh)
 		for msg := range messages {
-			var rpcMsg rpc.ProcessResponse
-			err := json.Unmarshal(msg.Payload(), &rpcMsg)
+			rpcMsg, err := rpc.DecodeProcessResponse(msg)
 			if err != nil {
-				msg.Nack(false, false)
+				slog.Error("dead-lettering process response", "Queue", queueName, "Error", err)
+				msg.Reject(false)
+				continue
 			}
 
-			rpcMsg.AmqpMessage = msg
-
-			resultCh <- rpcMsg
+			select {
+			case resultCh <- rpcMsg:
+			case <-ctx.Done():
+				// the response stays unacknowledged and is delivered again
+				return
+			}
 		}
 	}()
 
 	return resultCh, nil
 }
 
+// processEvent processes a response, the progress of the run counts it until it returns, also on error.
+func (exec *PipelineExecutor) processEvent(ctx context.Context, event rpc.ProcessResponse, node *amqpRpcPair) (inputDone bool, err error) {
+	exec.progress.begin()
+	defer func() { exec.endProcessing(inputDone) }()
+
+	switch event.Status {
+	case rpc.OK:
+		err = exec.processOkEvent(ctx, event, node)
+	case rpc.ERROR:
+		err = exec.processErrorEvent(ctx, event, node)
+	case rpc.ALLDONE:
+		err = exec.processAllDoneEvent(ctx, event, node)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	isDone := event.Status == rpc.ALLDONE
+	if node == exec.inputRpcChannel && !isDone {
+		if err := exec.pumpBatchIntoInput(ctx, node); err != nil {
+			return false, err
+		}
+	}
+
+	if err := event.Ack(false); err != nil {
+		return false, err
+	}
+	return isDone && node == exec.inputRpcChannel, nil
+}
+
 func (exec *PipelineExecutor) executeNodeProcessing(ctx context.Context, node *amqpRpcPair) error {
 	events, err := exec.readRespEvents(ctx, node.resp)
 
@@ -171,22 +302,7 @@ func (exec *PipelineExecutor) executeNodeProcessing(ctx context.Context, node *a
 	}
 
 	for event := range events {
-		switch event.Status {
-		case rpc.OK:
-			if err := exec.processOkEvent(ctx, event, node); err != nil {
-				return err
-			}
-		case rpc.ERROR:
-			if err := exec.processErrorEvent(ctx, event, node); err != nil {
-				return err
-			}
-		case rpc.ALLDONE:
-			if err := exec.processAllDoneEvent(ctx, event, node); err != nil {
-				return err
-			}
-		}
-		err = event.Ack(false)
-		if err != nil {
+		if _, err := exec.processEvent(ctx, event, node); err != nil {
 			return err
 		}
 	}
@@ -205,33 +321,8 @@ func (exec *PipelineExecutor) executeInputProcessing(ctx context.Context, node *
 		return err
 	}
 
-	isDone := false
-
 	for event := range events {
-		switch event.Status {
-		case rpc.OK:
-			if err := exec.processOkEvent(ctx, event, node); err != nil {
-				return err
-			}
-		case rpc.ERROR:
-			if err := exec.processErrorEvent(ctx, event, node); err != nil {
-				return err
-			}
-		case rpc.ALLDONE:
-			isDone = true
-			if err := exec.processAllDoneEvent(ctx, event, node); err != nil {
-				return err
-			}
-		}
-
-		if !isDone {
-			if err := exec.pumpBatchIntoInput(ctx, node); err != nil {
-				return err
-			}
-		}
-
-		err = event.Ack(false)
-		if err != nil {
+		if _, err := exec.processEvent(ctx, event, node); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,106 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"starbyte.io/coordinator/db"
+	s3io "starbyte.io/core/s3"
+)
+
+const BATCH_RETENTION_INTERVAL = 5 * time.Minute
+
+// RetentionReport lists batch objects removed by a collection, or which would be removed by a dry run.
+type RetentionReport struct {
+	DryRun  bool
+	Batches []db.CollectableBatch
+	// Bytes is the stored size of the batches with a known manifest.
+	Bytes  int64
+	Failed int
+}
+
+func (exec *PipelineExecutor) batchTtl() time.Duration {
+	if exec.pipeline.BatchTtlSeconds == nil {
+		return 0
+	}
+	return time.Duration(*exec.pipeline.BatchTtlSeconds) * time.Second
+}
+
+func deleteBatchObject(ctx context.Context, uri string) error {
+	return errors.Join(s3io.Delete(ctx, uri), s3io.Delete(ctx, s3io.ManifestUri(uri)))
+}
+
+// CollectBatches removes intermediate batch objects which are consumed or expired.
+// With dryRun nothing is removed, the report lists what would be.
+func (exec *PipelineExecutor) CollectBatches(ctx context.Context, dryRun bool) (*RetentionReport, error) {
+	batches, err := exec.dbRepository.GetCollectableBatches(exec.pipeline.Id, exec.batchTtl())
+	if err != nil {
+		return nil, err
+	}
+
+	report := &RetentionReport{DryRun: dryRun, Batches: []db.CollectableBatch{}}
+	for _, batch := range batches {
+		if !dryRun {
+			err := deleteBatchObject(ctx, batch.Uri)
+			if err == nil {
+				err = exec.dbRepository.MarkBatchDeleted(batch.Uri)
+			}
+			if err != nil {
+				slog.Error("failed to remove batch", "Uri", s3io.RedactUri(batch.Uri), "Error", err)
+				report.Failed++
+				continue
+			}
+		}
+
+		report.Batches = append(report.Batches, batch)
+		if batch.CompressedSize != nil {
+			report.Bytes += *batch.CompressedSize
+		}
+	}
+
+	return report, nil
+}
+
+func (exec *PipelineExecutor) logRetentionReport(report *RetentionReport) {
+	if report.DryRun {
+		for _, batch := range report.Batches {
+			slog.Info("batch would be removed",
+				"Pipeline", exec.pipeline.Name,
+				"Uri", s3io.RedactUri(batch.Uri),
+				"Reason", batch.Reason,
+				"IssuedAt", batch.IssuedAt,
+			)
+		}
+	}
+
+	if len(report.Batches) > 0 || report.Failed > 0 {
+		slog.Info("batch retention finished",
+			"Pipeline", exec.pipeline.Name,
+			"DryRun", report.DryRun,
+			"Batches", len(report.Batches),
+			"Bytes", report.Bytes,
+			"Failed", report.Failed,
+		)
+	}
+}
+
+func (exec *PipelineExecutor) executeRetention(ctx context.Context) {
+	ticker := time.NewTicker(exec.retentionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			report, err := exec.CollectBatches(ctx, exec.pipeline.RetentionDryRun)
+			if err != nil {
+				slog.Error("batch retention failed", "Pipeline", exec.pipeline.Name, "Error", err)
+				continue
+			}
+			exec.logRetentionReport(report)
+		}
+	}
+}
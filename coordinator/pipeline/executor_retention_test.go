@@ -0,0 +1,130 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/coordinator/db"
+	"starbyte.io/core/rpc"
+	s3io "starbyte.io/core/s3"
+)
+
+func writeTestObject(t *testing.T, uri string) {
+	if err := s3io.Write(context.TODO(), uri, strings.NewReader("batch")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3io.WriteManifest(context.TODO(), uri, s3io.Manifest{Records: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func objectExists(uri string) bool {
+	reader, err := s3io.Read(context.TODO(), uri)
+	if err != nil {
+		return false
+	}
+	reader.Close()
+	return true
+}
+
+func retentionExecutor(t *testing.T, repositoryMock *RepositoryMock) *PipelineExecutor {
+	ttl := 3600
+	retained := pipeline
+	retained.BatchTtlSeconds = &ttl
+
+	executor, err := NewExecutor(&retained, nil, "mem://retention", repositoryMock)
+	if err != nil {
+		t.Fatalf("executor creation error %s", err)
+	}
+	return executor
+}
+
+func TestCollectBatches(t *testing.T) {
+	size := int64(100)
+	repositoryMock := &RepositoryMock{Collectable: []db.CollectableBatch{
+		{Uri: "mem://retention/consumed.cbor.gz", Reason: db.RETENTION_CONSUMED, CompressedSize: &size},
+		{Uri: "mem://retention/expired.cbor.gz", Reason: db.RETENTION_EXPIRED},
+		{Uri: "unknown://retention/broken.cbor.gz", Reason: db.RETENTION_EXPIRED, CompressedSize: &size},
+	}}
+	writeTestObject(t, "mem://retention/consumed.cbor.gz")
+	writeTestObject(t, "mem://retention/expired.cbor.gz")
+	writeTestObject(t, "mem://retention/final.cbor.gz")
+
+	executor := retentionExecutor(t, repositoryMock)
+
+	report, err := executor.CollectBatches(context.TODO(), false)
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	if repositoryMock.BatchTtl != time.Hour {
+		t.Errorf("wrong batch ttl %s", repositoryMock.BatchTtl)
+	}
+	if len(report.Batches) != 2 || report.Bytes != size || report.Failed != 1 {
+		t.Errorf("wrong report %+v", report)
+	}
+	if len(repositoryMock.DeletedBatches) != 2 {
+		t.Errorf("expected 2 batches marked deleted, got %v", repositoryMock.DeletedBatches)
+	}
+
+	for _, uri := range []string{"mem://retention/consumed.cbor.gz", "mem://retention/expired.cbor.gz"} {
+		if objectExists(uri) || objectExists(s3io.ManifestUri(uri)) {
+			t.Errorf("%s was not removed", uri)
+		}
+	}
+	if !objectExists("mem://retention/final.cbor.gz") {
+		t.Errorf("batch not reported as collectable was removed")
+	}
+}
+
+func TestCollectBatchesDryRun(t *testing.T) {
+	uri := "mem://retention/dry-run.cbor.gz"
+	repositoryMock := &RepositoryMock{Collectable: []db.CollectableBatch{{Uri: uri, Reason: db.RETENTION_CONSUMED}}}
+	writeTestObject(t, uri)
+
+	executor := retentionExecutor(t, repositoryMock)
+
+	report, err := executor.CollectBatches(context.TODO(), true)
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	if !report.DryRun || len(report.Batches) != 1 || report.Batches[0].Uri != uri {
+		t.Errorf("wrong report %+v", report)
+	}
+	if !objectExists(uri) || len(repositoryMock.DeletedBatches) != 0 {
+		t.Errorf("dry run removed the batch")
+	}
+}
+
+func TestCollectBatchesDbError(t *testing.T) {
+	executor, err := NewExecutor(&pipeline, nil, "mem://retention", &RepositoryErrorMock{})
+	if err != nil {
+		t.Fatalf("executor creation error %s", err)
+	}
+
+	if _, err := executor.CollectBatches(context.TODO(), false); !errors.Is(err, ErrDb) {
+		t.Errorf("expected db error, got %v", err)
+	}
+}
+
+func TestProcessAllDoneEventRemovesBatch(t *testing.T) {
+	uri := "mem://retention/all-done.cbor.gz"
+	writeTestObject(t, uri)
+
+	repositoryMock := &RepositoryMock{Discarded: &db.Batch{BatchId: uuid.New(), Uri: uri}}
+	executor := retentionExecutor(t, repositoryMock)
+
+	err := executor.processAllDoneEvent(context.TODO(), rpc.ProcessResponse{CorrelationId: uuid.New(), Status: rpc.ALLDONE}, executor.inputRpcChannel)
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	if objectExists(uri) {
+		t.Errorf("discarded batch was not removed")
+	}
+}
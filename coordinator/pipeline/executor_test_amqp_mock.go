@@ -12,13 +12,20 @@ import (
 
 type AmqpMock struct {
 	Queues []string
-	Msgs   []any
+	// DeadLetterQueues maps declared queues to their dead-letter queue
+	DeadLetterQueues map[string]string
+	Msgs             []any
+	// MsgQueues lists the queue of every message in Msgs
+	MsgQueues []string
+	// PublishErrors fails as many publishes before accepting messages
+	PublishErrors int
 }
 
 type AmqpMessageMock struct {
-	Body   []byte
-	IsAck  bool
-	IsNack bool
+	Body     []byte
+	IsAck    bool
+	IsNack   bool
+	IsReject bool
 }
 
 func (m *AmqpMessageMock) Ack(bool) error {
@@ -36,13 +43,15 @@ func (m *AmqpMessageMock) Payload() []byte {
 }
 
 func (m *AmqpMessageMock) Reject(bool) error {
+	m.IsReject = true
 	return nil
 }
 
 func NewAmqpMock() *AmqpMock {
 	return &AmqpMock{
-		Queues: []string{},
-		Msgs:   []any{},
+		Queues:           []string{},
+		DeadLetterQueues: map[string]string{},
+		Msgs:             []any{},
 	}
 }
 
@@ -50,8 +59,11 @@ func (*AmqpMock) Connect(ctx context.Context, uri string) error {
 	return nil
 }
 
-func (m *AmqpMock) QueueDeclare(queueName string) error {
+func (m *AmqpMock) QueueDeclare(queueName string, deadLetterQueue string) error {
 	m.Queues = append(m.Queues, queueName)
+	if deadLetterQueue != "" {
+		m.DeadLetterQueues[queueName] = deadLetterQueue
+	}
 	return nil
 }
 
@@ -102,12 +114,27 @@ func (*AmqpMock) Messages(ctx context.Context, queueName string) (<-chan amqp.Am
 }
 
 func (m *AmqpMock) Publish(ctx context.Context, queueName string, message any) error {
+	if m.PublishErrors > 0 {
+		m.PublishErrors--
+		return ErrAmqpTest
+	}
 	m.Msgs = append(m.Msgs, message)
+	m.MsgQueues = append(m.MsgQueues, queueName)
 	return nil
 }
 
 var ErrAmqpTest = errors.New("amqp test mock error")
 
+type DeadLetterAmqpMock struct {
+	AmqpMock
+	DeadLetterQueue map[string][]amqp.DeadLetter
+}
+
+func (m *DeadLetterAmqpMock) DeadLetters(ctx context.Context, deadLetterQueue string, limit int) ([]amqp.DeadLetter, error) {
+	letters := m.DeadLetterQueue[deadLetterQueue]
+	return letters[:min(limit, len(letters))], nil
+}
+
 type AmqpErrorMock struct {
 }
 
@@ -119,7 +146,7 @@ func (*AmqpErrorMock) Connect(ctx context.Context, uri string) error {
 	return ErrAmqpTest
 }
 
-func (m *AmqpErrorMock) QueueDeclare(queueName string) error {
+func (m *AmqpErrorMock) QueueDeclare(queueName string, deadLetterQueue string) error {
 	return ErrAmqpTest
 }
 
@@ -137,28 +164,30 @@ func (*AmqpErrorMock) Publish(ctx context.Context, queueName string, message any
 
 type AmqpMessageErrorMock struct {
 	AmqpErrorMock
+	Delivered []*AmqpMessageMock
 }
 
 func NewAmqpMessageErrorMock() *AmqpMessageErrorMock {
 	return &AmqpMessageErrorMock{}
 }
 
-func (*AmqpMessageErrorMock) Messages(ctx context.Context, queueName string) (<-chan amqp.AmqpMessage, error) {
+func (m *AmqpMessageErrorMock) Messages(ctx context.Context, queueName string) (<-chan amqp.AmqpMessage, error) {
 
-	messages := []amqp.AmqpMessage{}
-	messages = append(
-		messages,
+	m.Delivered = append(
+		m.Delivered,
 		&AmqpMessageMock{Body: []byte("not a json 1")},
 		&AmqpMessageMock{Body: []byte("not a json 2")},
 		&AmqpMessageMock{Body: []byte("not a json 3")},
+		&AmqpMessageMock{Body: []byte(`{"Status": "OK", "ResultUri": "test"}`)},
+		&AmqpMessageMock{Body: []byte(`{"CorrelationId": "` + uuid.NewString() + `", "Status": "DONE"}`)},
 	)
 
 	result := make(chan amqp.AmqpMessage, 1)
 
 	go func() {
 		defer close(result)
-		for _, m := range messages {
-			result <- m
+		for _, msg := range m.Delivered {
+			result <- msg
 		}
 	}()
 	return result, nil
@@ -179,7 +208,7 @@ func (*InputAmqpMock) Connect(ctx context.Context, uri string) error {
 	return nil
 }
 
-func (m *InputAmqpMock) QueueDeclare(queueName string) error {
+func (m *InputAmqpMock) QueueDeclare(queueName string, deadLetterQueue string) error {
 	m.Queues = append(m.Queues, queueName)
 	return nil
 }
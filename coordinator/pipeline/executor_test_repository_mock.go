@@ -2,14 +2,32 @@ package pipeline
 
 import (
 	"errors"
+	"time"
 
 	"github.com/google/uuid"
 	"starbyte.io/coordinator/db"
+	s3io "starbyte.io/core/s3"
 )
 
 type RepositoryMock struct {
-	Retries    int
-	MaxRetries int
+	Retries        int
+	MaxRetries     int
+	Heartbeats     []*db.Worker
+	LostWorkers    []db.Worker
+	RemovedWorkers []string
+	IdleSteps      []uuid.UUID
+	FailedAttempts []uuid.UUID
+	// FinishedAttempts are the attempts whose status is set, they can not be finished again
+	FinishedAttempts map[uuid.UUID]bool
+	Manifests      map[string]*s3io.Manifest
+	Discarded      *db.Batch
+	Collectable    []db.CollectableBatch
+	BatchTtl       time.Duration
+	DeletedBatches []string
+	// CreatedAttempts, DeletedAttempts and DiscardedBatches list correlation ids
+	CreatedAttempts  []uuid.UUID
+	DeletedAttempts  []uuid.UUID
+	DiscardedBatches []uuid.UUID
 }
 
 var ErrRetries = errors.New("retries error")
@@ -27,19 +45,49 @@ func (m *RepositoryMock) GetResourceUriByCorrelationId(CorrelationId uuid.UUID)
 func (m *RepositoryMock) CreateNewBatch(*uuid.UUID, uuid.UUID, string) (*db.Batch, error) {
 	return &db.Batch{BatchId: uuid.UUID{}}, nil
 }
-func (m *RepositoryMock) CreateNewBatchProcessAttempt(uuid.UUID, uuid.UUID) error {
+func (m *RepositoryMock) CreateNewBatchProcessAttempt(_ uuid.UUID, correlationId uuid.UUID) error {
+	m.CreatedAttempts = append(m.CreatedAttempts, correlationId)
 	return nil
 }
-func (m *RepositoryMock) SetBatchProcessStatus(uuid.UUID, string, string) error {
+func (m *RepositoryMock) DeleteBatchProcessAttempt(correlationId uuid.UUID) error {
+	m.DeletedAttempts = append(m.DeletedAttempts, correlationId)
+	return nil
+}
+func (m *RepositoryMock) SetBatchProcessStatus(correlationId uuid.UUID, state string, err string) (bool, error) {
+	if m.FinishedAttempts == nil {
+		m.FinishedAttempts = map[uuid.UUID]bool{}
+	}
+	if m.FinishedAttempts[correlationId] {
+		return false, nil
+	}
+	m.FinishedAttempts[correlationId] = true
+	if state == "ERROR" {
+		m.FailedAttempts = append(m.FailedAttempts, correlationId)
+	}
+	return true, nil
+}
+func (m *RepositoryMock) SetBatchProcessRejects(uuid.UUID, int, int, string) error {
+	return nil
+}
+
+func (m *RepositoryMock) SetBatchProcessManifest(correlationId uuid.UUID, uri string, manifest *s3io.Manifest) error {
+	if m.Manifests == nil {
+		m.Manifests = map[string]*s3io.Manifest{}
+	}
+	m.Manifests[uri] = manifest
 	return nil
 }
 
 func (m *RepositoryMock) GetBatchByCorrelationId(uuid.UUID) (*db.Batch, error) {
-	return nil, nil
+	return &db.Batch{BatchId: uuid.UUID{}}, nil
 }
 
-func (m *RepositoryMock) DiscardBatchByCorrelationId(uuid.UUID) error {
-	return nil
+func (m *RepositoryMock) DiscardBatchByCorrelationId(correlationId uuid.UUID) (*db.Batch, error) {
+	m.DiscardedBatches = append(m.DiscardedBatches, correlationId)
+	if m.Discarded != nil {
+		return m.Discarded, nil
+	}
+	return &db.Batch{BatchId: uuid.UUID{}}, nil
 }
 
 func (pg *RepositoryMock) GetPipeline(pipelineId uuid.UUID) (*db.Pipeline, error) {
@@ -47,6 +95,34 @@ func (pg *RepositoryMock) GetPipeline(pipelineId uuid.UUID) (*db.Pipeline, error
 	return pipeline, nil
 }
 
+func (m *RepositoryMock) SaveWorkerHeartbeat(worker *db.Worker) error {
+	m.Heartbeats = append(m.Heartbeats, worker)
+	return nil
+}
+
+func (m *RepositoryMock) GetLostWorkers(uuid.UUID, time.Duration) ([]db.Worker, error) {
+	return m.LostWorkers, nil
+}
+
+func (m *RepositoryMock) RemoveWorker(instanceId string) error {
+	m.RemovedWorkers = append(m.RemovedWorkers, instanceId)
+	return nil
+}
+
+func (m *RepositoryMock) GetStepsWithoutLiveWorkers(uuid.UUID, time.Duration) ([]uuid.UUID, error) {
+	return m.IdleSteps, nil
+}
+
+func (m *RepositoryMock) GetCollectableBatches(pipelineId uuid.UUID, ttl time.Duration) ([]db.CollectableBatch, error) {
+	m.BatchTtl = ttl
+	return m.Collectable, nil
+}
+
+func (m *RepositoryMock) MarkBatchDeleted(uri string) error {
+	m.DeletedBatches = append(m.DeletedBatches, uri)
+	return nil
+}
+
 type RepositoryErrorMock struct {
 }
 
@@ -64,21 +140,43 @@ func (m *RepositoryErrorMock) CreateNewBatch(*uuid.UUID, uuid.UUID, string) (*db
 func (m *RepositoryErrorMock) CreateNewBatchProcessAttempt(uuid.UUID, uuid.UUID) error {
 	return ErrDb
 }
-func (m *RepositoryErrorMock) SetBatchProcessStatus(uuid.UUID, string, string) error {
+func (m *RepositoryErrorMock) SetBatchProcessStatus(uuid.UUID, string, string) (bool, error) {
+	return false, ErrDb
+}
+func (m *RepositoryErrorMock) SetBatchProcessRejects(uuid.UUID, int, int, string) error {
+	return ErrDb
+}
+func (m *RepositoryErrorMock) SetBatchProcessManifest(uuid.UUID, string, *s3io.Manifest) error {
 	return ErrDb
 }
 func (m *RepositoryErrorMock) GetBatchByCorrelationId(uuid.UUID) (*db.Batch, error) {
 	return nil, ErrDb
 }
 
-func (m *RepositoryErrorMock) DiscardBatchByCorrelationId(uuid.UUID) error {
-	return ErrDb
+func (m *RepositoryErrorMock) DiscardBatchByCorrelationId(uuid.UUID) (*db.Batch, error) {
+	return nil, ErrDb
 }
 
 func (pg *RepositoryErrorMock) GetPipeline(pipelineId uuid.UUID) (*db.Pipeline, error) {
 	return nil, ErrDb
 }
 
+func (m *RepositoryErrorMock) SaveWorkerHeartbeat(*db.Worker) error {
+	return ErrDb
+}
+
+func (m *RepositoryErrorMock) GetLostWorkers(uuid.UUID, time.Duration) ([]db.Worker, error) {
+	return nil, ErrDb
+}
+
+func (m *RepositoryErrorMock) RemoveWorker(string) error {
+	return ErrDb
+}
+
+func (m *RepositoryErrorMock) GetStepsWithoutLiveWorkers(uuid.UUID, time.Duration) ([]uuid.UUID, error) {
+	return nil, ErrDb
+}
+
 type RepositoryResourceErrorMock struct {
 }
 
@@ -96,16 +194,62 @@ func (m *RepositoryResourceErrorMock) CreateNewBatch(*uuid.UUID, uuid.UUID, stri
 func (m *RepositoryResourceErrorMock) CreateNewBatchProcessAttempt(uuid.UUID, uuid.UUID) error {
 	return ErrDb
 }
-func (m *RepositoryResourceErrorMock) SetBatchProcessStatus(uuid.UUID, string, string) error {
+func (m *RepositoryResourceErrorMock) SetBatchProcessStatus(uuid.UUID, string, string) (bool, error) {
+	return false, ErrDb
+}
+func (m *RepositoryResourceErrorMock) SetBatchProcessRejects(uuid.UUID, int, int, string) error {
+	return ErrDb
+}
+func (m *RepositoryResourceErrorMock) SetBatchProcessManifest(uuid.UUID, string, *s3io.Manifest) error {
 	return ErrDb
 }
 func (m *RepositoryResourceErrorMock) GetBatchByCorrelationId(uuid.UUID) (*db.Batch, error) {
 	return nil, ErrDb
 }
-func (m *RepositoryResourceErrorMock) DiscardBatchByCorrelationId(uuid.UUID) error {
-	return ErrDb
+func (m *RepositoryResourceErrorMock) DiscardBatchByCorrelationId(uuid.UUID) (*db.Batch, error) {
+	return nil, ErrDb
 }
 
 func (pg *RepositoryResourceErrorMock) GetPipeline(pipelineId uuid.UUID) (*db.Pipeline, error) {
 	return nil, ErrDb
 }
+
+func (m *RepositoryResourceErrorMock) SaveWorkerHeartbeat(*db.Worker) error {
+	return ErrDb
+}
+
+func (m *RepositoryResourceErrorMock) GetLostWorkers(uuid.UUID, time.Duration) ([]db.Worker, error) {
+	return nil, ErrDb
+}
+
+func (m *RepositoryResourceErrorMock) RemoveWorker(string) error {
+	return ErrDb
+}
+
+func (m *RepositoryResourceErrorMock) GetStepsWithoutLiveWorkers(uuid.UUID, time.Duration) ([]uuid.UUID, error) {
+	return nil, ErrDb
+}
+
+func (m *RepositoryErrorMock) GetCollectableBatches(uuid.UUID, time.Duration) ([]db.CollectableBatch, error) {
+	return nil, ErrDb
+}
+
+func (m *RepositoryErrorMock) MarkBatchDeleted(string) error {
+	return ErrDb
+}
+
+func (m *RepositoryResourceErrorMock) GetCollectableBatches(uuid.UUID, time.Duration) ([]db.CollectableBatch, error) {
+	return nil, ErrDb
+}
+
+func (m *RepositoryResourceErrorMock) MarkBatchDeleted(string) error {
+	return ErrDb
+}
+
+func (m *RepositoryErrorMock) DeleteBatchProcessAttempt(uuid.UUID) error {
+	return ErrDb
+}
+
+func (m *RepositoryResourceErrorMock) DeleteBatchProcessAttempt(uuid.UUID) error {
+	return ErrDb
+}
@@ -0,0 +1,138 @@
+package pipeline
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DEFAULT_KEY_TEMPLATE keeps batches at the storage root as <uuid><extension>.
+const DEFAULT_KEY_TEMPLATE = "{batch_id}{ext}"
+
+var (
+	keyPlaceholderRegexp = regexp.MustCompile(`\{([a-z_]+)(?::([^}]*))?\}`)
+	seqFormatRegexp      = regexp.MustCompile(`^0?[1-9]?[0-9]?d$`)
+	unsafeKeyCharsRegexp = regexp.MustCompile(`[^A-Za-z0-9._=-]+`)
+)
+
+var keyPlaceholders = map[string]bool{
+	"pipeline":    true,
+	"pipeline_id": true,
+	"run":         true,
+	"step":        true,
+	"step_id":     true,
+	"seq":         true,
+	"batch_id":    true,
+	"date":        true,
+	"ext":         true,
+}
+
+// keyValues are the values of a single batch key.
+type keyValues struct {
+	pipeline   string
+	pipelineId uuid.UUID
+	run        string
+	step       string
+	stepId     uuid.UUID
+	seq        uint64
+	batchId    uuid.UUID
+	issuedAt   time.Time
+	ext        string
+}
+
+// keyTemplate builds batch object keys such as {pipeline}/{run}/{step}/{seq:06d}-{batch_id}{ext}.
+type keyTemplate struct {
+	template string
+}
+
+func parseKeyTemplate(template string) (keyTemplate, error) {
+	if template == "" {
+		template = DEFAULT_KEY_TEMPLATE
+	}
+
+	used := map[string]bool{}
+	for _, match := range keyPlaceholderRegexp.FindAllStringSubmatch(template, -1) {
+		name, format := match[1], match[2]
+		if !keyPlaceholders[name] {
+			return keyTemplate{}, fmt.Errorf("unknown key template placeholder {%s}", name)
+		}
+		if format != "" && (name != "seq" || !seqFormatRegexp.MatchString(format)) {
+			return keyTemplate{}, fmt.Errorf("invalid key template format {%s:%s}", name, format)
+		}
+		used[name] = true
+	}
+
+	if strings.Count(template, "{") != strings.Count(template, "}") ||
+		strings.Count(template, "{") != len(keyPlaceholderRegexp.FindAllString(template, -1)) {
+		return keyTemplate{}, fmt.Errorf("malformed key template %q", template)
+	}
+
+	// keys must not collide between batches, runs and steps
+	if !used["batch_id"] && !(used["run"] && used["step"] && used["seq"]) {
+		return keyTemplate{}, fmt.Errorf("key template %q must contain {batch_id}, or {run}, {step} and {seq}", template)
+	}
+
+	return keyTemplate{template: strings.TrimLeft(template, "/")}, nil
+}
+
+// keySegment replaces characters which would add key levels or need escaping in uris.
+func keySegment(value string) string {
+	return unsafeKeyCharsRegexp.ReplaceAllString(value, "_")
+}
+
+func (t keyTemplate) render(values keyValues) string {
+	return keyPlaceholderRegexp.ReplaceAllStringFunc(t.template, func(placeholder string) string {
+		match := keyPlaceholderRegexp.FindStringSubmatch(placeholder)
+		switch match[1] {
+		case "pipeline":
+			return keySegment(values.pipeline)
+		case "pipeline_id":
+			return values.pipelineId.String()
+		case "run":
+			return values.run
+		case "step":
+			return keySegment(values.step)
+		case "step_id":
+			return values.stepId.String()
+		case "seq":
+			if match[2] != "" {
+				return fmt.Sprintf("%"+match[2], values.seq)
+			}
+			return fmt.Sprint(values.seq)
+		case "batch_id":
+			return values.batchId.String()
+		case "date":
+			return values.issuedAt.Format("2006-01-02")
+		case "ext":
+			return values.ext
+		}
+		return placeholder
+	})
+}
+
+// newRunId names an executor run, run ids sort by their start time. The random suffix keeps the ids, and the
+// {run}/{step}/{seq} keys built from them, of runs started at the same millisecond apart.
+func newRunId(startedAt time.Time) string {
+	return startedAt.UTC().Format("20060102T150405.000Z") + "-" + uuid.NewString()[:8]
+}
+
+// stepSequences numbers batches produced by every step within a run.
+type stepSequences struct {
+	mu        sync.Mutex
+	sequences map[uuid.UUID]uint64
+}
+
+func (s *stepSequences) next(stepId uuid.UUID) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sequences == nil {
+		s.sequences = map[uuid.UUID]uint64{}
+	}
+	s.sequences[stepId]++
+	return s.sequences[stepId]
+}
@@ -0,0 +1,137 @@
+package pipeline
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func TestKeyTemplateRender(t *testing.T) {
+	template, err := parseKeyTemplate("/{pipeline}/{run}/{step}/{date}/{seq:06d}-{batch_id}{ext}")
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	batchId := uuid.New()
+	key := template.render(keyValues{
+		pipeline: "trade stats/2024",
+		run:      newRunId(time.Date(2024, 3, 4, 5, 6, 7, 0, time.FixedZone("CET", 3600))),
+		step:     "extract",
+		seq:      42,
+		batchId:  batchId,
+		issuedAt: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC),
+		ext:      ".cbor.gz",
+	})
+
+	expected := regexp.MustCompile(`^trade_stats_2024/20240304T040607\.000Z-[0-9a-f]{8}/extract/2024-03-04/000042-` + batchId.String() + `\.cbor\.gz$`)
+	if !expected.MatchString(key) {
+		t.Errorf("expected %s, got %s", expected, key)
+	}
+}
+
+func TestRunIdsOfTheSameInstantDiffer(t *testing.T) {
+	startedAt := time.Date(2024, 3, 4, 5, 6, 7, 8000000, time.UTC)
+	first, second := newRunId(startedAt), newRunId(startedAt)
+	if first == second {
+		t.Errorf("runs started at the same time share the id %s", first)
+	}
+	if !strings.HasPrefix(first, "20240304T050607.008Z-") {
+		t.Errorf("run id does not start with the start time, got %s", first)
+	}
+	if later := newRunId(startedAt.Add(time.Millisecond)); later < first || later < second {
+		t.Errorf("run ids do not sort by start time, %s before %s", later, first)
+	}
+}
+
+func TestKeyTemplateDefault(t *testing.T) {
+	template, err := parseKeyTemplate("")
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	batchId := uuid.New()
+	if key := template.render(keyValues{batchId: batchId, ext: ".parquet"}); key != batchId.String()+".parquet" {
+		t.Errorf("wrong default key %s", key)
+	}
+}
+
+func TestKeyTemplateValidation(t *testing.T) {
+	valid := []string{
+		"{batch_id}",
+		"{pipeline_id}/{step_id}/{batch_id}.cbor.gz",
+		"{run}/{step}/{seq}",
+		"{run}/{step}/{seq:d}{ext}",
+		"{run}/{step}/{seq:8d}{ext}",
+	}
+	for _, template := range valid {
+		if _, err := parseKeyTemplate(template); err != nil {
+			t.Errorf("%s: failed with error %s", template, err)
+		}
+	}
+
+	invalid := []string{
+		"{pipeline}/{step}",
+		"{run}/{seq}",
+		"{batch}/{batch_id}",
+		"{batch_id:06d}",
+		"{run}/{step}/{seq:x}",
+		"{batch_id}/{step",
+		"{batch_id}/step}",
+	}
+	for _, template := range invalid {
+		if _, err := parseKeyTemplate(template); err == nil {
+			t.Errorf("%s: expected error", template)
+		}
+	}
+}
+
+func TestStepSequences(t *testing.T) {
+	sequences := stepSequences{}
+	stepId := uuid.New()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sequences.next(stepId)
+		}()
+	}
+	wg.Wait()
+
+	if seq := sequences.next(stepId); seq != 101 {
+		t.Errorf("expected sequence 101, got %d", seq)
+	}
+	if seq := sequences.next(uuid.New()); seq != 1 {
+		t.Errorf("expected sequence 1 of another step, got %d", seq)
+	}
+}
+
+func TestGetNewResultUriKeyTemplate(t *testing.T) {
+	template := "{pipeline}/{run}/{step}/{seq:06d}-{batch_id}{ext}"
+	templated := pipeline
+	templated.KeyTemplate = &template
+
+	executor, err := NewExecutor(&templated, nil, "s3://pipeline", nil)
+	if err != nil {
+		t.Fatalf("executor creation error %s", err)
+	}
+
+	step := executor.findRpcNodePairByStepId(step1UUID).vertex.Step
+	first, second := executor.getNewResultUri(step), executor.getNewResultUri(step)
+
+	prefix := "s3://pipeline/test_pipeline/" + executor.runId + "/step1/"
+	if !strings.HasPrefix(first, prefix+"000001-") || !strings.HasPrefix(second, prefix+"000002-") || !strings.HasSuffix(first, ".cbor.gz") {
+		t.Errorf("wrong result uris %s %s", first, second)
+	}
+
+	invalid := "{pipeline}/{unknown}"
+	templated.KeyTemplate = &invalid
+	if _, err := NewExecutor(&templated, nil, "s3://pipeline", nil); err == nil {
+		t.Errorf("error expected for invalid key template")
+	}
+}
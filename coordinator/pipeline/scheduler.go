@@ -0,0 +1,186 @@
+package pipeline
+
+import (
+	"context"
+	"sync"
+)
+
+// Scheduler shares the capacity of the workers between the runs of the pipelines using it. A run waits
+// before reading the next batch of its input until fewer than capacity batch process attempts of all runs
+// are in flight. Waiting runs are admitted by priority, then the run with the fewest attempts in flight
+// first, so runs of a priority share the capacity and runs of a lower priority only use the capacity left.
+// Requests of admitted batches to the next steps are never held back, they exceed the capacity when steps fan out.
+type Scheduler struct {
+	capacity int
+
+	mu       sync.Mutex
+	inFlight int
+	waiting  []*admission
+	arrivals uint64
+}
+
+// scheduledRun counts the attempts in flight of a run, its methods do nothing on a nil run.
+type scheduledRun struct {
+	scheduler *Scheduler
+	priority  int
+	inFlight  int
+	// reserved attempts are counted on admission, before the attempt of the input batch starts
+	reserved int
+}
+
+type admission struct {
+	run     *scheduledRun
+	arrival uint64
+	ready   chan struct{}
+}
+
+// NewScheduler returns a scheduler of capacity attempts in flight, at least one.
+func NewScheduler(capacity int) *Scheduler {
+	return &Scheduler{capacity: max(capacity, 1)}
+}
+
+func (scheduler *Scheduler) register(priority int) *scheduledRun {
+	if scheduler == nil {
+		return nil
+	}
+	return &scheduledRun{scheduler: scheduler, priority: priority}
+}
+
+// InFlight returns the number of attempts in flight of all runs.
+func (scheduler *Scheduler) InFlight() int {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	return scheduler.inFlight
+}
+
+// dispatch admits waiting runs while there is capacity left. It is called with scheduler.mu held.
+func (scheduler *Scheduler) dispatch() {
+	for scheduler.inFlight < scheduler.capacity && len(scheduler.waiting) > 0 {
+		next := 0
+		for i, waiter := range scheduler.waiting {
+			if waiter.before(scheduler.waiting[next]) {
+				next = i
+			}
+		}
+
+		waiter := scheduler.waiting[next]
+		scheduler.waiting = append(scheduler.waiting[:next], scheduler.waiting[next+1:]...)
+		waiter.run.inFlight++
+		waiter.run.reserved++
+		scheduler.inFlight++
+		close(waiter.ready)
+	}
+}
+
+func (a *admission) before(b *admission) bool {
+	if a.run.priority != b.run.priority {
+		return a.run.priority > b.run.priority
+	}
+	if a.run.inFlight != b.run.inFlight {
+		return a.run.inFlight < b.run.inFlight
+	}
+	return a.arrival < b.arrival
+}
+
+// admit waits until the run may start the attempt of a new input batch, or ctx is done.
+func (run *scheduledRun) admit(ctx context.Context) error {
+	if run == nil {
+		return nil
+	}
+	scheduler := run.scheduler
+
+	scheduler.mu.Lock()
+	scheduler.arrivals++
+	waiter := &admission{run: run, arrival: scheduler.arrivals, ready: make(chan struct{})}
+	scheduler.waiting = append(scheduler.waiting, waiter)
+	scheduler.dispatch()
+	scheduler.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+	}
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	select {
+	case <-waiter.ready:
+		// admitted meanwhile, the reservation is given back
+		run.releaseLocked()
+	default:
+		for i, waiting := range scheduler.waiting {
+			if waiting == waiter {
+				scheduler.waiting = append(scheduler.waiting[:i], scheduler.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// release gives back the reservation of an admission whose attempt was never started.
+func (run *scheduledRun) release() {
+	if run == nil {
+		return
+	}
+	run.scheduler.mu.Lock()
+	defer run.scheduler.mu.Unlock()
+
+	run.releaseLocked()
+}
+
+// releaseLocked is called with scheduler.mu held, reservations given back by close are not released again.
+func (run *scheduledRun) releaseLocked() {
+	if run.reserved == 0 {
+		return
+	}
+	run.reserved--
+	run.inFlight--
+	run.scheduler.inFlight--
+	run.scheduler.dispatch()
+}
+
+// started counts an attempt of the run, attempts reserved on admission are counted already.
+func (run *scheduledRun) started() {
+	if run == nil {
+		return
+	}
+	run.scheduler.mu.Lock()
+	defer run.scheduler.mu.Unlock()
+
+	if run.reserved > 0 {
+		run.reserved--
+		return
+	}
+	run.inFlight++
+	run.scheduler.inFlight++
+}
+
+func (run *scheduledRun) finished() {
+	if run == nil {
+		return
+	}
+	run.scheduler.mu.Lock()
+	defer run.scheduler.mu.Unlock()
+
+	run.inFlight--
+	run.scheduler.inFlight--
+	run.scheduler.dispatch()
+}
+
+// close gives back the capacity of the attempts of a run which stopped before they finished.
+func (run *scheduledRun) close() {
+	if run == nil {
+		return
+	}
+	run.scheduler.mu.Lock()
+	defer run.scheduler.mu.Unlock()
+
+	run.scheduler.inFlight -= run.inFlight
+	run.inFlight = 0
+	run.reserved = 0
+	run.scheduler.dispatch()
+}
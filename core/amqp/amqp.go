@@ -2,8 +2,10 @@ package amqp
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	amqp "github.com/rabbitmq/amqp091-go"
 	"starbyte.io/core/utils"
@@ -21,6 +23,103 @@ type AmqpMessage interface {
 
 type AmqpMessageRabbitImpl struct {
 	*amqp.Delivery
+	broker  *RabbitMqAmqp
+	queue   string
+	settled func()
+}
+
+func (m *AmqpMessageRabbitImpl) Ack(multiple bool) error {
+	defer m.settle()
+	return m.Delivery.Ack(multiple)
+}
+
+// Nack with requeue publishes the message again, otherwise it is dead-lettered.
+func (m *AmqpMessageRabbitImpl) Nack(multiple bool, requeue bool) error {
+	defer m.settle()
+	if requeue {
+		return m.requeue()
+	}
+	return m.Delivery.Nack(multiple, false)
+}
+
+func (m *AmqpMessageRabbitImpl) Reject(requeue bool) error {
+	defer m.settle()
+	if requeue {
+		return m.requeue()
+	}
+	return m.Delivery.Reject(false)
+}
+
+// requeue publishes the message again with its count of lost deliveries and acks it, the broker would
+// flag a requeued message as redelivered and it would count as lost. When publishing fails the broker requeues it.
+func (m *AmqpMessageRabbitImpl) requeue() error {
+	if m.broker == nil || m.broker.DeliveryLimit <= 0 {
+		return m.Delivery.Nack(false, true)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.broker.ConfirmTimeout)
+	defer cancel()
+
+	if err := m.broker.republish(ctx, m.queue, m.Delivery, deliveryCount(m.Delivery.Headers)); err != nil {
+		return m.Delivery.Nack(false, true)
+	}
+	return m.Delivery.Ack(false)
+}
+
+func (m *AmqpMessageRabbitImpl) settle() {
+	if m.settled != nil {
+		m.settled()
+	}
+}
+
+// pendingDeliveries counts the deliveries of a consumer channel which are not acked or nacked yet,
+// closing the channel would requeue them while they are still processed.
+type pendingDeliveries struct {
+	mu      sync.Mutex
+	pending int
+	settled chan struct{}
+}
+
+func newPendingDeliveries() *pendingDeliveries {
+	return &pendingDeliveries{settled: make(chan struct{}, 1)}
+}
+
+func (deliveries *pendingDeliveries) add(msg *AmqpMessageRabbitImpl) *AmqpMessageRabbitImpl {
+	deliveries.mu.Lock()
+	deliveries.pending++
+	deliveries.mu.Unlock()
+
+	msg.settled = sync.OnceFunc(func() {
+		deliveries.mu.Lock()
+		deliveries.pending--
+		deliveries.mu.Unlock()
+
+		select {
+		case deliveries.settled <- struct{}{}:
+		default:
+		}
+	})
+	return msg
+}
+
+// wait returns once every delivery is settled, the channel is closed or done is closed.
+func (deliveries *pendingDeliveries) wait(closed chan *amqp.Error, done chan struct{}) {
+	for {
+		deliveries.mu.Lock()
+		pending := deliveries.pending
+		deliveries.mu.Unlock()
+		if pending == 0 {
+			return
+		}
+
+		select {
+		case <-deliveries.settled:
+		case <-closed:
+			return
+		case <-done:
+			return
+		}
+	}
 }
 
 func (m *AmqpMessageRabbitImpl) Payload() []byte {
@@ -29,65 +128,156 @@ func (m *AmqpMessageRabbitImpl) Payload() []byte {
 
 type Amqp interface {
 	Connect(context.Context, string) error
-	QueueDeclare(string) error
+	// QueueDeclare declares a queue, and the dead-letter queue of its rejected messages unless it is empty
+	QueueDeclare(queueName string, deadLetterQueue string) error
 	Close() error
 	Messages(context.Context, string) (<-chan AmqpMessage, error)
 	Publish(context.Context, string, any) error
 }
 
+type AmqpConnectionState interface {
+	IsConnected() bool
+}
+
+// RabbitMqAmqp reconnects when the broker connection is lost, redeclares the queues and resumes
+// consumers behind the channels returned by Messages. Publish waits for the connection to be back.
 type RabbitMqAmqp struct {
-	amqpConnection *amqp.Connection
+	Reconnect ReconnectConfig
+	// PublishChannels is the number of channels publishing concurrently
+	PublishChannels int
+	ConfirmTimeout  time.Duration
+	DeliveryLimit   int
+	// Prefetch is the number of unacknowledged messages of a consumer
+	Prefetch int
+
+	dial func(string) (connection, error)
+	uri  string
+
+	stateNotifier
+	mu         sync.Mutex
+	conn       connection
+	ready      chan struct{}
+	done       chan struct{}
+	queues     []declaredQueue
+	publishers *publisherPool
+	wg         sync.WaitGroup
 }
 
 func (broker *RabbitMqAmqp) Connect(ctx context.Context, uri string) error {
-	conn, err := amqp.Dial(uri)
+	if broker.dial == nil {
+		broker.dial = dialRabbitMq
+	}
+	if broker.Reconnect == (ReconnectConfig{}) {
+		broker.Reconnect = DefaultReconnectConfig()
+	}
+	if broker.PublishChannels <= 0 {
+		broker.PublishChannels = DEFAULT_PUBLISH_CHANNELS
+	}
+	if broker.ConfirmTimeout <= 0 {
+		broker.ConfirmTimeout = DEFAULT_CONFIRM_TIMEOUT
+	}
+	if broker.DeliveryLimit == 0 {
+		broker.DeliveryLimit = DEFAULT_DELIVERY_LIMIT
+	}
+	if broker.Prefetch <= 0 {
+		broker.Prefetch = DEFAULT_PREFETCH
+	}
 
+	conn, err := broker.dial(uri)
 	if err != nil {
-		return fmt.Errorf("can not connect to amqp broker: %e", err)
+		return fmt.Errorf("can not connect to amqp broker: %w", err)
 	}
+	closed := conn.NotifyClose(make(chan *amqp.Error, 1))
 
-	broker.amqpConnection = conn
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	broker.uri = uri
+	broker.conn = conn
+	broker.done = make(chan struct{})
+	broker.publishers = newPublisherPool(broker.PublishChannels)
+	broker.setState(ConnectionEvent{State: STATE_CONNECTED})
+	close(broker.readyLocked())
+	broker.ready = nil
+
+	broker.wg.Add(1)
+	go broker.supervise(closed)
 
 	return nil
 }
 
-func (broker *RabbitMqAmqp) QueueDeclare(queueName string) error {
-	ch, err := broker.amqpConnection.Channel()
-
+func (broker *RabbitMqAmqp) QueueDeclare(queueName string, deadLetterQueue string) error {
+	conn, err := broker.connection(context.Background())
 	if err != nil {
-		return fmt.Errorf("can not open amqp channel: %e", err)
+		return err
 	}
 
-	_, err = ch.QueueDeclare(queueName, true, false, false, false, amqp.Table{
-		"x-expires": RABBITMQ_QUEUE_EXPIRATION_TTL,
-	})
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("can not open amqp channel: %w", err)
+	}
+	defer func() { ch.Close() }()
 
+	queue := declaredQueue{name: queueName, deadLetter: deadLetterQueue}
+	err = declareQueue(ch, queue)
+	if errors.Is(err, errQueueArguments) {
+		// a previous version declared the queue with other arguments, it is purged below anyway
+		ch.Close()
+		if ch, err = conn.Channel(); err != nil {
+			return fmt.Errorf("can not open amqp channel: %w", err)
+		}
+		if _, err := ch.QueueDelete(queueName, false, false, false); err != nil {
+			return fmt.Errorf("can not delete queue: %w", err)
+		}
+		err = declareQueue(ch, queue)
+	}
 	if err != nil {
 		return err
 	}
 
+	broker.mu.Lock()
+	if !utils.In(broker.queues, queue) {
+		broker.queues = append(broker.queues, queue)
+	}
+	broker.mu.Unlock()
+
 	_, err = ch.QueuePurge(queueName, false)
 
 	return err
 }
 
 func (broker *RabbitMqAmqp) Close() error {
-	if broker.amqpConnection != nil {
-		err := broker.amqpConnection.Close()
+	broker.mu.Lock()
+	conn := broker.conn
+	broker.closeLocked(ErrClosed)
+	broker.mu.Unlock()
 
-		if err != nil {
-			return fmt.Errorf("can not close amqp broker connection: %e", err)
+	broker.wg.Wait()
+
+	if broker.publishers != nil {
+		broker.publishers.close()
+	}
+
+	if conn != nil {
+		err := conn.Close()
+
+		if err != nil && !errors.Is(err, amqp.ErrClosed) {
+			return fmt.Errorf("can not close amqp broker connection: %w", err)
 		}
 	}
 
 	return nil
 }
 
-func (broker *RabbitMqAmqp) Messages(ctx context.Context, queueName string) (<-chan AmqpMessage, error) {
-	ch, err := broker.amqpConnection.Channel()
+func consume(ctx context.Context, conn connection, queueName string, prefetch int) (channel, <-chan amqp.Delivery, error) {
+	ch, err := conn.Channel()
 
 	if err != nil {
-		return nil, fmt.Errorf("can not open amqp channel: %e", err)
+		return nil, nil, fmt.Errorf("can not open amqp channel: %w", err)
+	}
+	if err := ch.Qos(prefetch, 0, false); err != nil {
+		ch.Close()
+		return nil, nil, fmt.Errorf("can not set amqp prefetch: %w", err)
 	}
 	msgs, err := ch.ConsumeWithContext(
 		ctx,
@@ -101,37 +291,72 @@ func (broker *RabbitMqAmqp) Messages(ctx context.Context, queueName string) (<-c
 	)
 
 	if err != nil {
-		return nil, fmt.Errorf("can not consume messsages from channel: %e", err)
+		ch.Close()
+		return nil, nil, fmt.Errorf("can not consume messsages from channel: %w", err)
 	}
 
-	return utils.CastChannelWithContext[AmqpMessage, amqp.Delivery](ctx, msgs, func(record amqp.Delivery) AmqpMessage { return &AmqpMessageRabbitImpl{&record} }), nil
+	return ch, msgs, nil
 }
 
-func (broker *RabbitMqAmqp) Publish(ctx context.Context, queueName string, message any) error {
-	body, err := json.Marshal(message)
+// Messages consumes queueName until ctx is done or the broker is closed. When the connection is lost,
+// consuming resumes on the new connection; unacknowledged messages are redelivered by the broker
+// until DeliveryLimit is reached. Reject messages without requeue to dead-letter them.
+func (broker *RabbitMqAmqp) Messages(ctx context.Context, queueName string) (<-chan AmqpMessage, error) {
+	conn, err := broker.connection(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to marshal response")
+		return nil, err
 	}
 
-	ch, err := broker.amqpConnection.Channel()
-
+	ch, msgs, err := consume(ctx, conn, queueName, broker.Prefetch)
 	if err != nil {
-		return fmt.Errorf("can not open amqp channel: %e", err)
+		return nil, err
 	}
 
-	err = ch.PublishWithContext(ctx,
-		"",
-		queueName,
-		false,
-		false,
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "application/json",
-			Body:         body,
-		})
+	result := make(chan AmqpMessage)
+	go func() {
+		defer close(result)
 
-	if err != nil {
-		return fmt.Errorf("failed to publish message to queue %e", err)
-	}
-	return nil
+		for attempt := 0; ; {
+			if ch != nil {
+				attempt = 0
+				closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+				deliveries := newPendingDeliveries()
+				for msg := range msgs {
+					msg := msg
+					if broker.countRedelivery(ctx, queueName, &msg) {
+						continue
+					}
+					delivery := deliveries.add(&AmqpMessageRabbitImpl{Delivery: &msg, broker: broker, queue: queueName})
+					select {
+					case result <- delivery:
+					case <-ctx.Done():
+						delivery.Nack(false, true)
+					}
+				}
+				// a cancelled consumer keeps its channel until the deliveries being processed are settled
+				go func(ch channel) {
+					deliveries.wait(closed, broker.done)
+					ch.Close()
+				}(ch)
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			// the channel closed with the connection, or a consume on a new connection failed
+			if attempt > 0 && !broker.sleep(broker.Reconnect.backoff(attempt)) {
+				return
+			}
+			attempt++
+
+			conn, err := broker.connection(ctx)
+			if err != nil {
+				return
+			}
+			ch, msgs, _ = consume(ctx, conn, queueName, broker.Prefetch)
+		}
+	}()
+
+	return result, nil
 }
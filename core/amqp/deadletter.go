@@ -0,0 +1,182 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const DEAD_LETTER_EXCHANGE = "lightbyte.dead-letters"
+const RABBITMQ_DEAD_LETTER_EXPIRATION_TTL = 7 * 24 * 3600 * 1000 // 7 days
+
+// DEFAULT_DELIVERY_LIMIT is used by brokers without a DeliveryLimit, a negative DeliveryLimit disables the limit.
+// On every transport a message is delivered at most DeliveryLimit times, the next delivery dead-letters it.
+// Deliveries which are acked, rejected or requeued with Nack do not count as failed, so a worker shutting down
+// does not bring a request closer to the dead-letter queue; the deliveries counted are the ones lost with
+// a consumer, its connection or its lease.
+const DEFAULT_DELIVERY_LIMIT = 5
+
+// DELIVERY_COUNT_HEADER counts the lost deliveries of a message republished by the consumer. RabbitMQ only
+// flags redelivered messages and the queues are classic queues, which support priorities but ignore x-delivery-limit.
+const DELIVERY_COUNT_HEADER = "x-lightbyte-delivery-count"
+
+// DeadLetter is a message rejected by a consumer, or delivered more often than the delivery limit.
+type DeadLetter struct {
+	Queue          string
+	Reason         string
+	DeadLetteredAt time.Time
+	// Deliveries counts the deliveries of the message, without the ones requeued by consumers
+	Deliveries int
+	Body           []byte
+}
+
+type AmqpDeadLetterInspector interface {
+	// DeadLetters returns up to limit messages of deadLetterQueue without removing them.
+	DeadLetters(ctx context.Context, deadLetterQueue string, limit int) ([]DeadLetter, error)
+}
+
+// errQueueArguments is returned when a queue exists with other arguments, the broker closes the channel.
+var errQueueArguments = errors.New("queue exists with other arguments")
+
+type declaredQueue struct {
+	name       string
+	deadLetter string
+}
+
+func declareQueue(ch channel, queue declaredQueue) error {
+	args := amqp.Table{
+		"x-expires":      RABBITMQ_QUEUE_EXPIRATION_TTL,
+		"x-max-priority": MAX_PRIORITY,
+	}
+
+	if queue.deadLetter != "" {
+		if err := ch.ExchangeDeclare(DEAD_LETTER_EXCHANGE, amqp.ExchangeDirect, true, false, false, false, nil); err != nil {
+			return fmt.Errorf("can not declare dead-letter exchange: %w", err)
+		}
+		_, err := ch.QueueDeclare(queue.deadLetter, true, false, false, false, amqp.Table{
+			"x-expires": RABBITMQ_DEAD_LETTER_EXPIRATION_TTL,
+		})
+		if err != nil {
+			return fmt.Errorf("can not declare dead-letter queue: %w", err)
+		}
+		if err := ch.QueueBind(queue.deadLetter, queue.name, DEAD_LETTER_EXCHANGE, false, nil); err != nil {
+			return fmt.Errorf("can not bind dead-letter queue: %w", err)
+		}
+
+		args["x-dead-letter-exchange"] = DEAD_LETTER_EXCHANGE
+		args["x-dead-letter-routing-key"] = queue.name
+	}
+
+	_, err := ch.QueueDeclare(queue.name, true, false, false, false, args)
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) && amqpErr.Code == amqp.PreconditionFailed {
+		return fmt.Errorf("%w: %w", errQueueArguments, err)
+	}
+	return err
+}
+
+func deliveryCount(headers amqp.Table) int {
+	switch count := headers[DELIVERY_COUNT_HEADER].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	case int:
+		return count
+	}
+	return 0
+}
+
+// overDeliveryLimit reports whether a delivery dead-letters its message, deliveries includes the delivery.
+func overDeliveryLimit(deliveries int, limit int) bool {
+	return limit > 0 && deliveries > limit
+}
+
+// countRedelivery enforces the delivery limit. A redelivered message was lost by a consumer, it is
+// published again with its lost deliveries counted and acked, so it moves to the back of its queue.
+// The delivery after DeliveryLimit lost ones is dead-lettered. It returns false when msg is still to be processed.
+func (broker *RabbitMqAmqp) countRedelivery(ctx context.Context, queueName string, msg *amqp.Delivery) bool {
+	if broker.DeliveryLimit <= 0 {
+		return false
+	}
+
+	lost := deliveryCount(msg.Headers)
+	if msg.Redelivered {
+		if broker.republish(ctx, queueName, msg, lost+1) != nil {
+			return false
+		}
+		msg.Ack(false)
+		return true
+	}
+
+	if overDeliveryLimit(lost+1, broker.DeliveryLimit) {
+		msg.Reject(false)
+		return true
+	}
+	return false
+}
+
+// republish publishes msg again to queueName with lost as its count of lost deliveries.
+func (broker *RabbitMqAmqp) republish(ctx context.Context, queueName string, msg *amqp.Delivery, lost int) error {
+	headers := amqp.Table{}
+	for key, value := range msg.Headers {
+		headers[key] = value
+	}
+	headers[DELIVERY_COUNT_HEADER] = int64(lost)
+
+	return broker.publish(ctx, queueName, amqp.Publishing{
+		Headers:      headers,
+		DeliveryMode: amqp.Persistent,
+		Priority:     msg.Priority,
+		ContentType:  msg.ContentType,
+		Body:         msg.Body,
+	})
+}
+
+func newDeadLetter(delivery amqp.Delivery) DeadLetter {
+	letter := DeadLetter{
+		Deliveries: deliveryCount(delivery.Headers) + 1,
+		Body:       delivery.Body,
+	}
+
+	// the broker prepends the latest death to x-death
+	if deaths, ok := delivery.Headers["x-death"].([]any); ok && len(deaths) > 0 {
+		if death, ok := deaths[0].(amqp.Table); ok {
+			letter.Queue, _ = death["queue"].(string)
+			letter.Reason, _ = death["reason"].(string)
+			letter.DeadLetteredAt, _ = death["time"].(time.Time)
+		}
+	}
+	return letter
+}
+
+// DeadLetters gets the messages of deadLetterQueue one by one without acknowledging them.
+func (broker *RabbitMqAmqp) DeadLetters(ctx context.Context, deadLetterQueue string, limit int) ([]DeadLetter, error) {
+	conn, err := broker.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("can not open amqp channel: %w", err)
+	}
+	// closing the channel requeues the messages read
+	defer ch.Close()
+
+	letters := []DeadLetter{}
+	for len(letters) < limit && ctx.Err() == nil {
+		delivery, ok, err := ch.Get(deadLetterQueue, false)
+		if err != nil {
+			return nil, fmt.Errorf("can not read dead-letter queue: %w", err)
+		}
+		if !ok {
+			break
+		}
+		letters = append(letters, newDeadLetter(delivery))
+	}
+	return letters, ctx.Err()
+}
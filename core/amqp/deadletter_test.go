@@ -0,0 +1,168 @@
+package amqp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestQueueDeclareProvisionsDeadLetters(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+
+	if err := broker.QueueDeclare("requests", "dead_letters"); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	if err := broker.QueueDeclare("heartbeats", ""); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if len(server.exchanges) != 1 || server.exchanges[0] != DEAD_LETTER_EXCHANGE {
+		t.Errorf("wrong exchanges %v", server.exchanges)
+	}
+	if len(server.bindings) != 1 || server.bindings[0] != DEAD_LETTER_EXCHANGE+":requests->dead_letters" {
+		t.Errorf("wrong bindings %v", server.bindings)
+	}
+
+	args := server.queueArgs["requests"]
+	if args["x-dead-letter-exchange"] != DEAD_LETTER_EXCHANGE || args["x-dead-letter-routing-key"] != "requests" {
+		t.Errorf("wrong queue arguments %v", args)
+	}
+	// classic queues ignore it, the consumer counts deliveries
+	if _, ok := args["x-delivery-limit"]; ok {
+		t.Errorf("queue declared with x-delivery-limit %v", args)
+	}
+	if _, ok := server.queueArgs["dead_letters"]["x-expires"]; !ok {
+		t.Errorf("dead-letter queue does not expire")
+	}
+	if _, ok := server.queueArgs["heartbeats"]["x-dead-letter-exchange"]; ok {
+		t.Errorf("queue without dead-letter queue is dead-lettered")
+	}
+}
+
+func TestRedeliveryLimit(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig, DeliveryLimit: 3})
+
+	messages, err := broker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acknowledger := &fakeAcknowledger{}
+	queue := server.queue("requests")
+
+	queue <- amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 1, Body: []byte("first")}
+	expectMessage(t, messages, "first")
+
+	// a redelivered message is published again with its lost delivery counted
+	queue <- amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 2, Redelivered: true, Body: []byte("crashing")}
+	select {
+	case msg := <-messages:
+		delivery := msg.(*AmqpMessageRabbitImpl)
+		if string(delivery.Body) != "crashing" || deliveryCount(delivery.Delivery.Headers) != 1 {
+			t.Errorf("wrong republished message %q %v", delivery.Body, delivery.Delivery.Headers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("redelivered message not received")
+	}
+
+	// the copy of the third lost delivery is the fourth delivery, it is dead-lettered
+	queue <- amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 3, Redelivered: true, Headers: amqp.Table{DELIVERY_COUNT_HEADER: int64(2)}, Body: []byte("poison")}
+	expectRejected(t, server, "poison")
+	queue <- amqp.Delivery{Acknowledger: acknowledger, DeliveryTag: 4, Body: []byte("next")}
+	expectMessage(t, messages, "next")
+
+	acknowledger.mu.Lock()
+	defer acknowledger.mu.Unlock()
+	if len(acknowledger.acked) != 2 || acknowledger.acked[0] != 2 || acknowledger.acked[1] != 3 {
+		t.Errorf("wrong acked deliveries %v", acknowledger.acked)
+	}
+	if len(acknowledger.rejected) != 0 {
+		t.Errorf("wrong rejected deliveries %v", acknowledger.rejected)
+	}
+}
+
+func expectRejected(t *testing.T, server *fakeServer, body string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		server.mu.Lock()
+		rejected := append([]string{}, server.rejected...)
+		server.mu.Unlock()
+
+		if len(rejected) > 0 {
+			if len(rejected) != 1 || rejected[0] != body {
+				t.Errorf("expected %q to be rejected, got %v", body, rejected)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%q not rejected", body)
+		}
+	}
+}
+
+func TestRequeueIsNotCountedAsLost(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig, DeliveryLimit: 1})
+
+	messages, err := broker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a worker shutting down requeues its request, as often as it restarts
+	server.queue("requests") <- amqp.Delivery{Body: []byte("request")}
+	for i := 0; i < 3; i++ {
+		select {
+		case msg := <-messages:
+			delivery := msg.(*AmqpMessageRabbitImpl)
+			if string(delivery.Body) != "request" || deliveryCount(delivery.Delivery.Headers) != 0 {
+				t.Fatalf("wrong requeued message %q %v", delivery.Body, delivery.Delivery.Headers)
+			}
+			if err := msg.Nack(false, true); err != nil {
+				t.Fatalf("requeue failed with error %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("requeued message not received")
+		}
+	}
+	expectMessage(t, messages, "request")
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.rejected) != 0 {
+		t.Errorf("requeued message dead-lettered %v", server.rejected)
+	}
+}
+
+func TestDeadLetters(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+
+	diedAt := time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC)
+	queue := server.queue("dead_letters")
+	for _, body := range []string{"not json", "{}", "third"} {
+		queue <- amqp.Delivery{
+			Headers: amqp.Table{"x-death": []any{amqp.Table{"queue": "requests", "reason": "rejected", "time": diedAt, "count": int64(1)}}},
+			Body:    []byte(body),
+		}
+	}
+
+	letters, err := broker.DeadLetters(context.TODO(), "dead_letters", 2)
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	if len(letters) != 2 || string(letters[0].Body) != "not json" {
+		t.Fatalf("wrong dead letters %+v", letters)
+	}
+	if letters[0].Queue != "requests" || letters[0].Reason != "rejected" || !letters[0].DeadLetteredAt.Equal(diedAt) || letters[0].Deliveries != 1 {
+		t.Errorf("wrong dead letter %+v", letters[0])
+	}
+	if len(queue) != 3 {
+		t.Errorf("dead letters were removed by inspection, %d left", len(queue))
+	}
+}
@@ -0,0 +1,55 @@
+package amqp
+
+import (
+	"context"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// AmqpHeaderPublisher is implemented by transports which publish headers along with the message body.
+type AmqpHeaderPublisher interface {
+	PublishWithHeaders(ctx context.Context, queueName string, message any, headers map[string]string) error
+}
+
+// AmqpMessageHeaders is implemented by messages of transports carrying headers.
+type AmqpMessageHeaders interface {
+	Headers() map[string]string
+}
+
+// PublishWithHeaders publishes message with headers, transports without headers publish the message alone.
+func PublishWithHeaders(ctx context.Context, broker Amqp, queueName string, message any, headers map[string]string) error {
+	if publisher, ok := broker.(AmqpHeaderPublisher); ok {
+		return publisher.PublishWithHeaders(ctx, queueName, message, headers)
+	}
+	return broker.Publish(ctx, queueName, message)
+}
+
+// MessageHeaders returns the headers of msg, nil when its transport carries none.
+func MessageHeaders(msg AmqpMessage) map[string]string {
+	if withHeaders, ok := msg.(AmqpMessageHeaders); ok {
+		return withHeaders.Headers()
+	}
+	return nil
+}
+
+// Headers returns the string headers of the delivery, broker headers such as x-death are skipped.
+func (m *AmqpMessageRabbitImpl) Headers() map[string]string {
+	headers := map[string]string{}
+	for key, value := range m.Delivery.Headers {
+		if value, ok := value.(string); ok {
+			headers[key] = value
+		}
+	}
+	return headers
+}
+
+func rabbitHeaders(headers map[string]string) amqp.Table {
+	if len(headers) == 0 {
+		return nil
+	}
+	table := amqp.Table{}
+	for key, value := range headers {
+		table[key] = value
+	}
+	return table
+}
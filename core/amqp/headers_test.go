@@ -0,0 +1,54 @@
+package amqp
+
+import (
+	"context"
+	"testing"
+)
+
+func testHeadersRoundTrip(t *testing.T, broker Amqp, queue string, deadLetter string) {
+	if err := broker.QueueDeclare(queue, deadLetter); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	messages, err := broker.Messages(context.TODO(), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers := map[string]string{"Lightbyte-Version": "1.0", "Lightbyte-Ext-Tenant": "acme"}
+	if err := PublishWithHeaders(context.TODO(), broker, queue, "first", headers); err != nil {
+		t.Fatalf("publish failed with error %s", err)
+	}
+
+	msg := expectPayload(t, messages, "first")
+	received := MessageHeaders(msg)
+	for key, value := range headers {
+		if received[key] != value {
+			t.Errorf("expected header %s %q, got %q", key, value, received[key])
+		}
+	}
+	msg.Ack(false)
+
+	if err := broker.Publish(context.TODO(), queue, "second"); err != nil {
+		t.Fatalf("publish failed with error %s", err)
+	}
+	msg = expectPayload(t, messages, "second")
+	if received := MessageHeaders(msg); received["Lightbyte-Version"] != "" {
+		t.Errorf("unexpected headers %v", received)
+	}
+	msg.Ack(false)
+}
+
+func TestMemoryHeaders(t *testing.T) {
+	broker := connectMemory(t, memoryUri(t), &MemoryAmqp{})
+	testHeadersRoundTrip(t, broker, "requests", "dead_letters")
+}
+
+func TestNatsHeaders(t *testing.T) {
+	broker := connectNats(t, &NatsJetStreamAmqp{})
+	testHeadersRoundTrip(t, broker, "requests", "dead_letters")
+}
+
+func TestPostgresHeaders(t *testing.T) {
+	broker := connectPostgres(t, &PostgresAmqp{})
+	testHeadersRoundTrip(t, broker, testQueue(t, "requests"), testQueue(t, "dead_letters"))
+}
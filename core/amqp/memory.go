@@ -0,0 +1,378 @@
+package amqp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotDelivered is returned when a message is acknowledged twice, or after its connection was closed.
+var ErrNotDelivered = errors.New("message is not awaiting acknowledgement")
+
+// memoryBrokers are shared by name, so every connection to mem://name in the process uses the same queues.
+var memoryBrokers sync.Map
+
+type memoryBroker struct {
+	mu     sync.Mutex
+	queues map[string]*memoryQueue
+	nextId uint64
+}
+
+type memoryQueue struct {
+	name       string
+	deadLetter string
+	ready      []*memoryMessage
+	// changed is closed and replaced whenever a message becomes ready
+	changed chan struct{}
+}
+
+type memoryMessage struct {
+	id       uint64
+	body     []byte
+	headers  map[string]string
+	priority int
+	// deliveries does not count the deliveries requeued by consumers
+	deliveries int
+	letter     DeadLetter
+}
+
+// MemoryAmqp keeps queues in process memory, it lets the coordinator and workers run in one process
+// without a broker. Queues are consumed competitively, unacknowledged messages are delivered again once
+// nacked with requeue or when their connection is closed, and rejected messages are dead-lettered.
+type MemoryAmqp struct {
+	DeliveryLimit int
+
+	stateNotifier
+	mu     sync.Mutex
+	shared *memoryBroker
+	done   chan struct{}
+	wg     sync.WaitGroup
+	// unacked is guarded by shared.mu
+	unacked map[*AmqpMessageMemoryImpl]struct{}
+}
+
+type AmqpMessageMemoryImpl struct {
+	broker *MemoryAmqp
+	queue  *memoryQueue
+	msg    *memoryMessage
+}
+
+func (m *AmqpMessageMemoryImpl) Ack(multiple bool) error {
+	return m.broker.settle(m, false, "")
+}
+
+func (m *AmqpMessageMemoryImpl) Nack(multiple bool, requeue bool) error {
+	return m.Reject(requeue)
+}
+
+func (m *AmqpMessageMemoryImpl) Reject(requeue bool) error {
+	return m.broker.settle(m, requeue, "rejected")
+}
+
+func (m *AmqpMessageMemoryImpl) Payload() []byte {
+	return m.msg.body
+}
+
+func (m *AmqpMessageMemoryImpl) Headers() map[string]string {
+	headers := map[string]string{}
+	for key, value := range m.msg.headers {
+		headers[key] = value
+	}
+	return headers
+}
+
+func (broker *MemoryAmqp) Connect(ctx context.Context, uri string) error {
+	if broker.DeliveryLimit == 0 {
+		broker.DeliveryLimit = DEFAULT_DELIVERY_LIMIT
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" {
+		return fmt.Errorf("memory broker uri must have the form mem://name")
+	}
+
+	shared, _ := memoryBrokers.LoadOrStore(parsed.Host, &memoryBroker{queues: map[string]*memoryQueue{}})
+
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	broker.shared = shared.(*memoryBroker)
+	broker.done = make(chan struct{})
+	broker.unacked = map[*AmqpMessageMemoryImpl]struct{}{}
+	broker.setState(ConnectionEvent{State: STATE_CONNECTED})
+
+	return nil
+}
+
+func (broker *MemoryAmqp) connection() (*memoryBroker, chan struct{}, error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if broker.shared == nil || broker.connectionState() == STATE_CLOSED {
+		return nil, nil, ErrClosed
+	}
+	return broker.shared, broker.done, nil
+}
+
+// QueueDeclare creates queueName, and its dead-letter queue when missing, and purges it.
+// Messages delivered and not acknowledged yet are kept.
+func (broker *MemoryAmqp) QueueDeclare(queueName string, deadLetterQueue string) error {
+	shared, _, err := broker.connection()
+	if err != nil {
+		return err
+	}
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	queue := shared.queue(queueName)
+	queue.deadLetter = deadLetterQueue
+	queue.ready = nil
+
+	if deadLetterQueue != "" {
+		shared.queue(deadLetterQueue)
+	}
+	return nil
+}
+
+// queue returns queueName, it is created when missing. It is called with shared.mu held.
+func (shared *memoryBroker) queue(queueName string) *memoryQueue {
+	queue, ok := shared.queues[queueName]
+	if !ok {
+		queue = &memoryQueue{name: queueName, changed: make(chan struct{})}
+		shared.queues[queueName] = queue
+	}
+	return queue
+}
+
+// push appends msg after the ready messages of its priority or a higher one, or puts it before the messages of its
+// priority when it is redelivered. It is called with shared.mu held.
+func (queue *memoryQueue) push(msg *memoryMessage, first bool) {
+	at := len(queue.ready)
+	for i, ready := range queue.ready {
+		if ready.priority < msg.priority || (first && ready.priority == msg.priority) {
+			at = i
+			break
+		}
+	}
+	queue.ready = append(queue.ready[:at], append([]*memoryMessage{msg}, queue.ready[at:]...)...)
+	close(queue.changed)
+	queue.changed = make(chan struct{})
+}
+
+// deadLetter moves msg to the dead-letter queue of queue, without a dead-letter queue the message is dropped.
+// It is called with shared.mu held.
+func (shared *memoryBroker) deadLetter(queue *memoryQueue, msg *memoryMessage, reason string) {
+	if queue.deadLetter == "" {
+		return
+	}
+
+	shared.nextId++
+	shared.queue(queue.deadLetter).push(&memoryMessage{
+		id:       shared.nextId,
+		body:     msg.body,
+		headers:  msg.headers,
+		priority: msg.priority,
+		letter: DeadLetter{
+			Queue:          queue.name,
+			Reason:         reason,
+			DeadLetteredAt: time.Now().UTC(),
+			Deliveries:     msg.deliveries,
+			Body:           msg.body,
+		},
+	}, false)
+}
+
+func (broker *MemoryAmqp) settle(m *AmqpMessageMemoryImpl, requeue bool, reason string) error {
+	shared := broker.shared
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	if _, ok := broker.unacked[m]; !ok {
+		return ErrNotDelivered
+	}
+	delete(broker.unacked, m)
+
+	switch {
+	case requeue:
+		m.msg.deliveries--
+		m.queue.push(m.msg, true)
+	case reason != "":
+		shared.deadLetter(m.queue, m.msg, reason)
+	}
+	return nil
+}
+
+// next delivers the first ready message of queue, messages over the delivery limit are dead-lettered instead.
+// Without a ready message it returns a channel closed once there is one.
+func (broker *MemoryAmqp) next(shared *memoryBroker, queue *memoryQueue) (*AmqpMessageMemoryImpl, chan struct{}) {
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	for len(queue.ready) > 0 {
+		msg := queue.ready[0]
+		queue.ready = queue.ready[1:]
+		msg.deliveries++
+
+		if overDeliveryLimit(msg.deliveries, broker.DeliveryLimit) {
+			shared.deadLetter(queue, msg, "delivery_limit")
+			continue
+		}
+
+		delivery := &AmqpMessageMemoryImpl{broker: broker, queue: queue, msg: msg}
+		broker.unacked[delivery] = struct{}{}
+		return delivery, nil
+	}
+	return nil, queue.changed
+}
+
+// release puts back a message which never reached the consumer, it does not count as a delivery.
+func (broker *MemoryAmqp) release(m *AmqpMessageMemoryImpl) {
+	broker.shared.mu.Lock()
+	defer broker.shared.mu.Unlock()
+
+	if _, ok := broker.unacked[m]; ok {
+		delete(broker.unacked, m)
+		m.msg.deliveries--
+		m.queue.push(m.msg, true)
+	}
+}
+
+// Messages consumes queueName until ctx is done or the broker is closed, consumers of a queue
+// receive its messages in turn and each one holds the next message until it is received. Reject messages
+// without requeue to dead-letter them.
+func (broker *MemoryAmqp) Messages(ctx context.Context, queueName string) (<-chan AmqpMessage, error) {
+	shared, done, err := broker.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	shared.mu.Lock()
+	queue, ok := shared.queues[queueName]
+	shared.mu.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownQueue, queueName)
+	}
+
+	result := make(chan AmqpMessage)
+	broker.wg.Add(1)
+	go func() {
+		defer broker.wg.Done()
+		defer close(result)
+
+		for {
+			msg, changed := broker.next(shared, queue)
+			if msg == nil {
+				select {
+				case <-changed:
+					continue
+				case <-ctx.Done():
+					return
+				case <-done:
+					return
+				}
+			}
+
+			select {
+			case result <- msg:
+			case <-ctx.Done():
+				broker.release(msg)
+				return
+			case <-done:
+				broker.release(msg)
+				return
+			}
+		}
+	}()
+
+	return result, nil
+}
+
+func (broker *MemoryAmqp) Publish(ctx context.Context, queueName string, message any) error {
+	return broker.PublishWithHeaders(ctx, queueName, message, nil)
+}
+
+func (broker *MemoryAmqp) PublishWithHeaders(ctx context.Context, queueName string, message any, headers map[string]string) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response")
+	}
+
+	shared, _, err := broker.connection()
+	if err != nil {
+		return err
+	}
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	queue, ok := shared.queues[queueName]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownQueue, queueName)
+	}
+
+	shared.nextId++
+	copied := map[string]string{}
+	for key, value := range headers {
+		copied[key] = value
+	}
+	queue.push(&memoryMessage{id: shared.nextId, body: body, headers: copied, priority: messagePriority(headers)}, false)
+	return nil
+}
+
+// Close stops the consumers of the connection, the messages it did not acknowledge are delivered again.
+func (broker *MemoryAmqp) Close() error {
+	broker.mu.Lock()
+	shared := broker.shared
+	if broker.connectionState() == STATE_CLOSED || broker.done == nil {
+		broker.mu.Unlock()
+		return nil
+	}
+	broker.setState(ConnectionEvent{State: STATE_CLOSED, Error: ErrClosed})
+	close(broker.done)
+	broker.mu.Unlock()
+
+	broker.wg.Wait()
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	unacked := make([]*AmqpMessageMemoryImpl, 0, len(broker.unacked))
+	for m := range broker.unacked {
+		unacked = append(unacked, m)
+	}
+	broker.unacked = map[*AmqpMessageMemoryImpl]struct{}{}
+
+	// requeued in reverse so they keep their publishing order
+	sort.Slice(unacked, func(i, j int) bool { return unacked[i].msg.id > unacked[j].msg.id })
+	for _, m := range unacked {
+		m.queue.push(m.msg, true)
+	}
+	return nil
+}
+
+// DeadLetters copies the ready messages of deadLetterQueue.
+func (broker *MemoryAmqp) DeadLetters(ctx context.Context, deadLetterQueue string, limit int) ([]DeadLetter, error) {
+	shared, _, err := broker.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	shared.mu.Lock()
+	defer shared.mu.Unlock()
+
+	letters := []DeadLetter{}
+	if queue, ok := shared.queues[deadLetterQueue]; ok {
+		for _, msg := range queue.ready[:min(limit, len(queue.ready))] {
+			letters = append(letters, msg.letter)
+		}
+	}
+	return letters, nil
+}
@@ -0,0 +1,259 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// memoryUri returns a broker unique to the test, brokers are shared by every test of the process.
+func memoryUri(t *testing.T) string {
+	return fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+}
+
+func connectMemory(t *testing.T, uri string, broker *MemoryAmqp) *MemoryAmqp {
+	t.Helper()
+
+	if err := broker.Connect(context.TODO(), uri); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+
+	return broker
+}
+
+func expectNoMessage(t *testing.T, messages <-chan AmqpMessage) {
+	t.Helper()
+
+	select {
+	case msg := <-messages:
+		t.Errorf("unexpected message %q", msg.Payload())
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryPublishAndConsume(t *testing.T) {
+	uri := memoryUri(t)
+	broker := connectMemory(t, uri, &MemoryAmqp{})
+
+	if err := broker.QueueDeclare("requests", ""); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	broker.Publish(context.TODO(), "requests", "stale")
+	// declaring the queue again purges it
+	if err := broker.QueueDeclare("requests", ""); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	messages, err := broker.Messages(ctx, "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, payload := range []string{"first", "second"} {
+		if err := broker.Publish(context.TODO(), "requests", payload); err != nil {
+			t.Fatalf("publish failed with error %s", err)
+		}
+	}
+
+	expectPayload(t, messages, "first").Ack(false)
+	msg := expectPayload(t, messages, "second")
+	if err := msg.Ack(false); err != nil {
+		t.Errorf("ack failed with error %s", err)
+	}
+	if err := msg.Ack(false); !errors.Is(err, ErrNotDelivered) {
+		t.Errorf("expected not delivered error, got %v", err)
+	}
+
+	cancel()
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Errorf("unexpected message after cancel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("messages not closed after cancel")
+	}
+}
+
+func TestMemoryBrokersShareQueuesByName(t *testing.T) {
+	uri := memoryUri(t)
+	coordinator := connectMemory(t, uri, &MemoryAmqp{})
+	worker := connectMemory(t, uri, &MemoryAmqp{})
+	other := &MemoryAmqp{}
+	if err := other.Connect(context.TODO(), "mem://other"); err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	if err := coordinator.QueueDeclare("requests", ""); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	if _, err := other.Messages(context.TODO(), "requests"); !errors.Is(err, ErrUnknownQueue) {
+		t.Errorf("expected unknown queue error, got %v", err)
+	}
+
+	first, err := worker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := worker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coordinator.Publish(context.TODO(), "requests", "first")
+	coordinator.Publish(context.TODO(), "requests", "second")
+
+	// consumers compete for messages, each one is delivered once
+	received := map[string]int{}
+	for i := 0; i < 2; i++ {
+		select {
+		case msg := <-first:
+			received[string(msg.Payload())]++
+			msg.Ack(false)
+		case msg := <-second:
+			received[string(msg.Payload())]++
+			msg.Ack(false)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message not received")
+		}
+	}
+	if received[`"first"`] != 1 || received[`"second"`] != 1 {
+		t.Errorf("wrong deliveries %v", received)
+	}
+}
+
+func TestMemoryNackRedelivers(t *testing.T) {
+	uri := memoryUri(t)
+	broker := connectMemory(t, uri, &MemoryAmqp{})
+
+	if err := broker.QueueDeclare("requests", ""); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	messages, err := broker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker.Publish(context.TODO(), "requests", "first")
+	expectPayload(t, messages, "first").Nack(false, true)
+	expectPayload(t, messages, "first").Ack(false)
+	expectNoMessage(t, messages)
+
+	broker.Publish(context.TODO(), "requests", "second")
+	expectPayload(t, messages, "second").Ack(false)
+}
+
+func TestMemoryCloseRedeliversUnacked(t *testing.T) {
+	uri := memoryUri(t)
+	coordinator := connectMemory(t, uri, &MemoryAmqp{})
+	crashing := connectMemory(t, uri, &MemoryAmqp{})
+	events := crashing.NotifyState(make(chan ConnectionEvent, 4))
+
+	if err := coordinator.QueueDeclare("requests", ""); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	messages, err := crashing.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coordinator.Publish(context.TODO(), "requests", "first")
+	coordinator.Publish(context.TODO(), "requests", "second")
+	msg := expectPayload(t, messages, "first")
+	expectPayload(t, messages, "second")
+
+	crashing.Close()
+	expectEvent(t, events, STATE_CLOSED)
+	if crashing.IsConnected() {
+		t.Errorf("broker is connected after close")
+	}
+	if _, ok := <-messages; ok {
+		t.Errorf("unexpected message after close")
+	}
+	if err := msg.Ack(false); !errors.Is(err, ErrNotDelivered) {
+		t.Errorf("expected not delivered error, got %v", err)
+	}
+	if err := crashing.Publish(context.TODO(), "requests", "payload"); err != ErrClosed {
+		t.Errorf("expected closed error, got %v", err)
+	}
+
+	// another worker receives the messages in order
+	worker := connectMemory(t, uri, &MemoryAmqp{})
+	messages, err = worker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, messages, "first").Ack(false)
+	expectPayload(t, messages, "second").Ack(false)
+}
+
+func TestMemoryRejectDeadLetters(t *testing.T) {
+	uri := memoryUri(t)
+	broker := connectMemory(t, uri, &MemoryAmqp{DeliveryLimit: 2})
+
+	if err := broker.QueueDeclare("responses", "dead_letters"); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	// the consumers holding the message are lost with their connection
+	broker.Publish(context.TODO(), "responses", "crashing")
+	for i := 0; i < 2; i++ {
+		consumer := connectMemory(t, uri, &MemoryAmqp{DeliveryLimit: 2})
+		crashed, err := consumer.Messages(context.TODO(), "responses")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectPayload(t, crashed, "crashing")
+		consumer.Close()
+	}
+
+	messages, err := broker.Messages(context.TODO(), "responses")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a requeue is not a lost delivery
+	broker.Publish(context.TODO(), "responses", "malformed")
+	expectPayload(t, messages, "malformed").Nack(false, true)
+	expectPayload(t, messages, "malformed").Nack(false, true)
+	expectPayload(t, messages, "malformed").Reject(false)
+
+	broker.Publish(context.TODO(), "responses", "next")
+	expectPayload(t, messages, "next").Ack(false)
+
+	for i := 0; i < 2; i++ {
+		letters, err := broker.DeadLetters(context.TODO(), "dead_letters", 10)
+		if err != nil {
+			t.Fatalf("failed with error %s", err)
+		}
+		if len(letters) != 2 {
+			t.Fatalf("expected 2 dead letters, got %+v", letters)
+		}
+		if letters[0].Queue != "responses" || letters[0].Reason != "delivery_limit" || letters[0].Deliveries != 3 || letters[0].DeadLetteredAt.IsZero() || string(letters[0].Body) != `"crashing"` {
+			t.Errorf("wrong dead letter %+v", letters[0])
+		}
+		if letters[1].Reason != "rejected" || letters[1].Deliveries != 1 || string(letters[1].Body) != `"malformed"` {
+			t.Errorf("wrong dead letter %+v", letters[1])
+		}
+	}
+}
+
+func TestMemoryUnknownQueue(t *testing.T) {
+	uri := memoryUri(t)
+	broker := connectMemory(t, uri, &MemoryAmqp{})
+
+	if err := broker.Publish(context.TODO(), "missing", "payload"); !errors.Is(err, ErrUnknownQueue) {
+		t.Errorf("expected unknown queue error, got %v", err)
+	}
+	if _, err := broker.Messages(context.TODO(), "missing"); !errors.Is(err, ErrUnknownQueue) {
+		t.Errorf("expected unknown queue error, got %v", err)
+	}
+	if err := (&MemoryAmqp{}).Connect(context.TODO(), "mem:///missing-name"); err == nil {
+		t.Errorf("error is expected")
+	}
+}
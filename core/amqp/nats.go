@@ -0,0 +1,461 @@
+package amqp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const NATS_SUBJECT_PREFIX = "lightbyte.queues."
+
+// NATS_DEAD_LETTER_METADATA is the stream metadata naming the dead-letter queue of a queue.
+const NATS_DEAD_LETTER_METADATA = "lightbyte.dead-letter"
+
+// DEFAULT_ACK_WAIT is the time a consumer has to ack a message before it is redelivered, it bounds
+// the processing time of a batch.
+const DEFAULT_ACK_WAIT = 30 * time.Minute
+
+// Headers of dead-lettered messages, JetStream has no x-death equivalent.
+const (
+	DEAD_LETTER_QUEUE_HEADER      = "Lightbyte-Dead-Letter-Queue"
+	DEAD_LETTER_REASON_HEADER     = "Lightbyte-Dead-Letter-Reason"
+	DEAD_LETTER_TIME_HEADER       = "Lightbyte-Dead-Lettered-At"
+	DEAD_LETTER_DELIVERIES_HEADER = "Lightbyte-Deliveries"
+)
+
+// NatsJetStreamAmqp maps queues to work-queue streams consumed by a durable consumer shared
+// by all workers of the queue. The connection is recovered by the NATS client.
+type NatsJetStreamAmqp struct {
+	Reconnect      ReconnectConfig
+	ConfirmTimeout time.Duration
+	DeliveryLimit  int
+	AckWait        time.Duration
+
+	stateNotifier
+	mu   sync.Mutex
+	conn *nats.Conn
+	js   jetstream.JetStream
+	done chan struct{}
+}
+
+type AmqpMessageNatsImpl struct {
+	msg        jetstream.Msg
+	broker     *NatsJetStreamAmqp
+	queue      string
+	deadLetter string
+}
+
+func (m *AmqpMessageNatsImpl) Ack(multiple bool) error {
+	return m.msg.Ack()
+}
+
+// Nack publishes the message again with requeue, otherwise it is dead-lettered.
+func (m *AmqpMessageNatsImpl) Nack(multiple bool, requeue bool) error {
+	return m.Reject(requeue)
+}
+
+func (m *AmqpMessageNatsImpl) Reject(requeue bool) error {
+	if requeue {
+		return m.broker.requeueMsg(m.msg, m.queue)
+	}
+	return m.broker.deadLetterMsg(m.msg, m.queue, m.deadLetter, "rejected")
+}
+
+func (m *AmqpMessageNatsImpl) Payload() []byte {
+	return m.msg.Data()
+}
+
+func (m *AmqpMessageNatsImpl) Headers() map[string]string {
+	headers := map[string]string{}
+	for key, values := range m.msg.Headers() {
+		if len(values) > 0 {
+			headers[key] = values[0]
+		}
+	}
+	return headers
+}
+
+// natsName replaces the characters which are not allowed in stream names and subject tokens.
+func natsName(queueName string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', '*', '>', '/', '\\', ' ', '\t', '\r', '\n':
+			return '_'
+		}
+		return r
+	}, queueName)
+}
+
+func natsSubject(queueName string) string {
+	return NATS_SUBJECT_PREFIX + natsName(queueName)
+}
+
+func (broker *NatsJetStreamAmqp) Connect(ctx context.Context, uri string) error {
+	if broker.Reconnect == (ReconnectConfig{}) {
+		broker.Reconnect = DefaultReconnectConfig()
+	}
+	if broker.ConfirmTimeout <= 0 {
+		broker.ConfirmTimeout = DEFAULT_CONFIRM_TIMEOUT
+	}
+	if broker.DeliveryLimit == 0 {
+		broker.DeliveryLimit = DEFAULT_DELIVERY_LIMIT
+	}
+	if broker.AckWait <= 0 {
+		broker.AckWait = DEFAULT_ACK_WAIT
+	}
+
+	maxReconnects := broker.Reconnect.MaxAttempts
+	if maxReconnects == 0 {
+		maxReconnects = -1
+	}
+
+	conn, err := nats.Connect(uri,
+		nats.MaxReconnects(maxReconnects),
+		nats.CustomReconnectDelay(broker.Reconnect.backoff),
+		nats.DisconnectErrHandler(func(conn *nats.Conn, err error) {
+			// closing the connection disconnects it too
+			if !conn.IsClosed() {
+				broker.setState(ConnectionEvent{State: STATE_DISCONNECTED, Error: err})
+			}
+		}),
+		nats.ReconnectHandler(func(*nats.Conn) {
+			broker.setState(ConnectionEvent{State: STATE_CONNECTED})
+		}),
+		nats.ClosedHandler(func(conn *nats.Conn) {
+			broker.setState(ConnectionEvent{State: STATE_CLOSED, Error: conn.LastError()})
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("can not connect to nats server: %w", err)
+	}
+
+	js, err := jetstream.New(conn)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("can not open jetstream context: %w", err)
+	}
+
+	broker.mu.Lock()
+	broker.conn = conn
+	broker.js = js
+	broker.done = make(chan struct{})
+	broker.mu.Unlock()
+
+	broker.setState(ConnectionEvent{State: STATE_CONNECTED})
+	return nil
+}
+
+func (broker *NatsJetStreamAmqp) IsConnected() bool {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	return broker.conn != nil && broker.conn.IsConnected()
+}
+
+func (broker *NatsJetStreamAmqp) jetStream() (jetstream.JetStream, chan struct{}, error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if broker.js == nil || broker.conn.IsClosed() {
+		return nil, nil, ErrClosed
+	}
+	return broker.js, broker.done, nil
+}
+
+// QueueDeclare creates or updates the stream of queueName and purges it. Rejected messages
+// are published to the stream of deadLetterQueue, kept for 7 days.
+func (broker *NatsJetStreamAmqp) QueueDeclare(queueName string, deadLetterQueue string) error {
+	js, _, err := broker.jetStream()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), broker.ConfirmTimeout)
+	defer cancel()
+
+	config := jetstream.StreamConfig{
+		Name:      natsName(queueName),
+		Subjects:  []string{natsSubject(queueName)},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+	}
+
+	if deadLetterQueue != "" {
+		_, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+			Name:     natsName(deadLetterQueue),
+			Subjects: []string{natsSubject(deadLetterQueue)},
+			Storage:  jetstream.FileStorage,
+			MaxAge:   RABBITMQ_DEAD_LETTER_EXPIRATION_TTL * time.Millisecond,
+		})
+		if err != nil {
+			return fmt.Errorf("can not declare dead-letter stream: %w", err)
+		}
+		config.Metadata = map[string]string{NATS_DEAD_LETTER_METADATA: deadLetterQueue}
+	}
+
+	stream, err := js.CreateOrUpdateStream(ctx, config)
+	if err != nil {
+		return fmt.Errorf("can not declare stream: %w", err)
+	}
+
+	return stream.Purge(ctx)
+}
+
+func (broker *NatsJetStreamAmqp) Close() error {
+	broker.mu.Lock()
+	conn := broker.conn
+	if broker.done != nil {
+		close(broker.done)
+		broker.done = nil
+	}
+	broker.mu.Unlock()
+
+	if conn != nil {
+		conn.Close()
+	}
+	return nil
+}
+
+// consume returns an iterator over the messages of queueName and its dead-letter queue.
+func (broker *NatsJetStreamAmqp) consume(ctx context.Context, js jetstream.JetStream, queueName string) (jetstream.MessagesContext, string, error) {
+	stream, err := js.Stream(ctx, natsName(queueName))
+	if err != nil {
+		return nil, "", fmt.Errorf("can not find stream: %w", err)
+	}
+
+	consumer, err := stream.CreateOrUpdateConsumer(ctx, jetstream.ConsumerConfig{
+		Durable:   natsName(queueName),
+		AckPolicy: jetstream.AckExplicitPolicy,
+		AckWait:   broker.AckWait,
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("can not create consumer: %w", err)
+	}
+
+	messages, err := consumer.Messages(jetstream.PullMaxMessages(1))
+	if err != nil {
+		return nil, "", fmt.Errorf("can not consume messages from stream: %w", err)
+	}
+
+	return messages, stream.CachedInfo().Config.Metadata[NATS_DEAD_LETTER_METADATA], nil
+}
+
+// Messages consumes queueName until ctx is done or the broker is closed. Unacknowledged messages are
+// redelivered after AckWait until DeliveryLimit is reached. Reject messages without requeue to dead-letter them.
+func (broker *NatsJetStreamAmqp) Messages(ctx context.Context, queueName string) (<-chan AmqpMessage, error) {
+	js, done, err := broker.jetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	messages, deadLetter, err := broker.consume(ctx, js, queueName)
+	if err != nil {
+		return nil, err
+	}
+
+	consumeCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		select {
+		case <-consumeCtx.Done():
+		case <-done:
+			cancel()
+		}
+	}()
+
+	result := make(chan AmqpMessage)
+	go func() {
+		defer close(result)
+		defer cancel()
+
+		for attempt := 0; ; {
+			if messages != nil {
+				attempt = 0
+				stop := context.AfterFunc(consumeCtx, messages.Stop)
+				for {
+					msg, err := messages.Next()
+					if err != nil {
+						break
+					}
+					if broker.overDelivered(msg, queueName, deadLetter) {
+						continue
+					}
+					delivery := &AmqpMessageNatsImpl{msg: msg, broker: broker, queue: queueName, deadLetter: deadLetter}
+					select {
+					case result <- delivery:
+					case <-consumeCtx.Done():
+						delivery.Nack(false, true)
+					}
+				}
+				stop()
+				messages.Stop()
+			}
+
+			if consumeCtx.Err() != nil {
+				return
+			}
+
+			// the consumer was deleted, or consuming it again failed
+			if attempt > 0 && !sleepContext(consumeCtx, broker.Reconnect.backoff(attempt)) {
+				return
+			}
+			attempt++
+
+			messages, deadLetter, _ = broker.consume(consumeCtx, js, queueName)
+		}
+	}()
+
+	return result, nil
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// natsDeliveries counts the deliveries of msg, the ones of the stream message and the lost ones
+// of the messages it was republished from.
+func natsDeliveries(msg jetstream.Msg) int {
+	deliveries, _ := strconv.Atoi(msg.Headers().Get(DELIVERY_COUNT_HEADER))
+	if meta, err := msg.Metadata(); err == nil {
+		return deliveries + int(meta.NumDelivered)
+	}
+	return deliveries + 1
+}
+
+// overDelivered dead-letters msg once it was delivered more than DeliveryLimit times.
+func (broker *NatsJetStreamAmqp) overDelivered(msg jetstream.Msg, queueName string, deadLetter string) bool {
+	if !overDeliveryLimit(natsDeliveries(msg), broker.DeliveryLimit) {
+		return false
+	}
+
+	broker.deadLetterMsg(msg, queueName, deadLetter, "delivery_limit")
+	return true
+}
+
+// requeueMsg publishes msg again with its lost deliveries counted and acks it, a nak would count
+// the delivery as lost. When publishing fails the message is redelivered with a nak.
+func (broker *NatsJetStreamAmqp) requeueMsg(msg jetstream.Msg, queueName string) error {
+	header := nats.Header{}
+	for key, values := range msg.Headers() {
+		header[key] = values
+	}
+	header.Set(DELIVERY_COUNT_HEADER, strconv.Itoa(natsDeliveries(msg)-1))
+
+	if err := broker.publishMsg(context.Background(), &nats.Msg{Subject: natsSubject(queueName), Header: header, Data: msg.Data()}); err != nil {
+		return msg.Nak()
+	}
+	return msg.Ack()
+}
+
+// deadLetterMsg publishes msg to the dead-letter queue and terminates its delivery. Without
+// a dead-letter queue the message is dropped.
+func (broker *NatsJetStreamAmqp) deadLetterMsg(msg jetstream.Msg, queueName string, deadLetter string, reason string) error {
+	if deadLetter != "" {
+		header := nats.Header{}
+		for key, values := range msg.Headers() {
+			header[key] = values
+		}
+		header.Set(DEAD_LETTER_QUEUE_HEADER, queueName)
+		header.Set(DEAD_LETTER_REASON_HEADER, reason)
+		header.Set(DEAD_LETTER_TIME_HEADER, time.Now().UTC().Format(time.RFC3339Nano))
+		header.Set(DEAD_LETTER_DELIVERIES_HEADER, strconv.Itoa(natsDeliveries(msg)))
+
+		if err := broker.publishMsg(context.Background(), &nats.Msg{Subject: natsSubject(deadLetter), Header: header, Data: msg.Data()}); err != nil {
+			msg.Nak()
+			return fmt.Errorf("can not dead-letter message: %w", err)
+		}
+	}
+	return msg.Term()
+}
+
+func (broker *NatsJetStreamAmqp) Publish(ctx context.Context, queueName string, message any) error {
+	return broker.PublishWithHeaders(ctx, queueName, message, nil)
+}
+
+// PublishWithHeaders publishes message like Publish, with headers as NATS message headers.
+func (broker *NatsJetStreamAmqp) PublishWithHeaders(ctx context.Context, queueName string, message any, headers map[string]string) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response")
+	}
+
+	header := nats.Header{}
+	for key, value := range headers {
+		header.Set(key, value)
+	}
+	header.Set("Content-Type", "application/json")
+
+	return broker.publishMsg(ctx, &nats.Msg{Subject: natsSubject(queueName), Header: header, Data: body})
+}
+
+// publishMsg returns once the stream acknowledged msg, or fails with ErrConfirmTimeout.
+func (broker *NatsJetStreamAmqp) publishMsg(ctx context.Context, msg *nats.Msg) error {
+	js, _, err := broker.jetStream()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, broker.ConfirmTimeout, ErrConfirmTimeout)
+	defer cancel()
+
+	if _, err := js.PublishMsg(ctx, msg); err != nil {
+		if errors.Is(context.Cause(ctx), ErrConfirmTimeout) {
+			return ErrConfirmTimeout
+		}
+		return fmt.Errorf("can not publish message: %w", err)
+	}
+	return nil
+}
+
+func newNatsDeadLetter(msg *jetstream.RawStreamMsg) DeadLetter {
+	letter := DeadLetter{
+		Queue:  msg.Header.Get(DEAD_LETTER_QUEUE_HEADER),
+		Reason: msg.Header.Get(DEAD_LETTER_REASON_HEADER),
+		Body:   msg.Data,
+	}
+	letter.DeadLetteredAt, _ = time.Parse(time.RFC3339Nano, msg.Header.Get(DEAD_LETTER_TIME_HEADER))
+	letter.Deliveries, _ = strconv.Atoi(msg.Header.Get(DEAD_LETTER_DELIVERIES_HEADER))
+	return letter
+}
+
+// DeadLetters reads the dead-letter stream by sequence, which does not consume its messages.
+func (broker *NatsJetStreamAmqp) DeadLetters(ctx context.Context, deadLetterQueue string, limit int) ([]DeadLetter, error) {
+	js, _, err := broker.jetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := js.Stream(ctx, natsName(deadLetterQueue))
+	if err != nil {
+		return nil, fmt.Errorf("can not find dead-letter stream: %w", err)
+	}
+
+	letters := []DeadLetter{}
+	state := stream.CachedInfo().State
+	for seq := state.FirstSeq; seq > 0 && seq <= state.LastSeq && len(letters) < limit; seq++ {
+		msg, err := stream.GetMsg(ctx, seq)
+		if errors.Is(err, jetstream.ErrMsgNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("can not read dead-letter stream: %w", err)
+		}
+		letters = append(letters, newNatsDeadLetter(msg))
+	}
+	return letters, nil
+}
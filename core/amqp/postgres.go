@@ -0,0 +1,553 @@
+package amqp
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// POSTGRES_NOTIFY_CHANNEL is notified with the queue name when a message becomes visible.
+const POSTGRES_NOTIFY_CHANNEL = "lightbyte_queues"
+
+// DEFAULT_POLL_INTERVAL bounds the wait for notifications, messages become visible again
+// after their visibility timeout without a notification.
+const DEFAULT_POLL_INTERVAL = 5 * time.Second
+
+// DEFAULT_VISIBILITY_TIMEOUT is the time a claimed message stays hidden from other consumers, a consumer
+// acking it later finds its claim expired.
+const DEFAULT_VISIBILITY_TIMEOUT = 30 * time.Minute
+
+// POSTGRES_QUEUE_SCHEMA is created on Connect, under an advisory lock as concurrent
+// CREATE TABLE IF NOT EXISTS may conflict.
+const POSTGRES_QUEUE_SCHEMA = `
+SELECT pg_advisory_xact_lock(hashtext('lightbyte_queues'));
+
+CREATE TABLE IF NOT EXISTS lightbyte_queues (
+	name        TEXT PRIMARY KEY,
+	dead_letter TEXT,
+	declared_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS lightbyte_queue_messages (
+	id                 BIGSERIAL PRIMARY KEY,
+	queue              TEXT NOT NULL,
+	body               BYTEA NOT NULL,
+	deliveries         INT NOT NULL DEFAULT 0,
+	visible_at         TIMESTAMPTZ NOT NULL DEFAULT now(),
+	created_at         TIMESTAMPTZ NOT NULL DEFAULT now(),
+	dead_letter_queue  TEXT,
+	dead_letter_reason TEXT,
+	dead_lettered_at   TIMESTAMPTZ,
+	expires_at         TIMESTAMPTZ
+);
+
+ALTER TABLE lightbyte_queue_messages ADD COLUMN IF NOT EXISTS headers JSONB;
+ALTER TABLE lightbyte_queue_messages ADD COLUMN IF NOT EXISTS priority SMALLINT NOT NULL DEFAULT 0;
+ALTER TABLE lightbyte_queue_messages ADD COLUMN IF NOT EXISTS requeues INT NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS lightbyte_queue_messages_visible_idx ON lightbyte_queue_messages (queue, visible_at, id);
+CREATE INDEX IF NOT EXISTS lightbyte_queue_messages_priority_idx ON lightbyte_queue_messages (queue, priority DESC, id);
+`
+
+var ErrUnknownQueue = errors.New("queue is not declared")
+
+// ErrLeaseExpired is returned when a message is acknowledged after its visibility timeout,
+// it may have been delivered to another consumer meanwhile.
+var ErrLeaseExpired = errors.New("message visibility timeout expired")
+
+// PostgresAmqp keeps messages in the lightbyte_queue_messages table. Consumers claim the oldest
+// visible message with SELECT ... FOR UPDATE SKIP LOCKED, which hides it for VisibilityTimeout;
+// acknowledged messages are deleted and unacknowledged ones are delivered again once visible.
+type PostgresAmqp struct {
+	Reconnect         ReconnectConfig
+	DeliveryLimit     int
+	VisibilityTimeout time.Duration
+	PollInterval      time.Duration
+
+	stateNotifier
+	mu       sync.Mutex
+	db       *sql.DB
+	listener *pq.Listener
+	done     chan struct{}
+	wakeups  map[string][]chan struct{}
+	wg       sync.WaitGroup
+}
+
+type AmqpMessagePostgresImpl struct {
+	broker     *PostgresAmqp
+	id         int64
+	deliveries int
+	// requeues are the deliveries requeued by consumers, they do not count against the delivery limit
+	requeues   int
+	queue      string
+	deadLetter string
+	body       []byte
+	headers    map[string]string
+}
+
+func (m *AmqpMessagePostgresImpl) Ack(multiple bool) error {
+	return m.broker.exec(`DELETE FROM lightbyte_queue_messages WHERE id = $1 AND deliveries = $2`, m.id, m.deliveries)
+}
+
+// Nack makes the message visible again with requeue, otherwise it is dead-lettered.
+func (m *AmqpMessagePostgresImpl) Nack(multiple bool, requeue bool) error {
+	return m.Reject(requeue)
+}
+
+func (m *AmqpMessagePostgresImpl) Reject(requeue bool) error {
+	if !requeue {
+		return m.broker.deadLetterMsg(m, "rejected")
+	}
+
+	query, args := releaseQuery(m)
+	return m.broker.exec(query, args...)
+}
+
+// releaseQuery makes msg visible again and notifies the consumers of its queue. Like every update
+// of a claimed message, it only matches while the claim of msg is the last delivery.
+func releaseQuery(msg *AmqpMessagePostgresImpl) (string, []any) {
+	return `
+		WITH requeued AS (
+			UPDATE lightbyte_queue_messages SET visible_at = now(), requeues = requeues + 1
+			WHERE id = $1 AND deliveries = $2
+			RETURNING queue
+		)
+		SELECT pg_notify($3, queue) FROM requeued`,
+		[]any{msg.id, msg.deliveries, POSTGRES_NOTIFY_CHANNEL}
+}
+
+func (m *AmqpMessagePostgresImpl) Payload() []byte {
+	return m.body
+}
+
+func (m *AmqpMessagePostgresImpl) Headers() map[string]string {
+	return m.headers
+}
+
+func (broker *PostgresAmqp) Connect(ctx context.Context, uri string) error {
+	if broker.Reconnect == (ReconnectConfig{}) {
+		broker.Reconnect = DefaultReconnectConfig()
+	}
+	if broker.DeliveryLimit == 0 {
+		broker.DeliveryLimit = DEFAULT_DELIVERY_LIMIT
+	}
+	if broker.VisibilityTimeout <= 0 {
+		broker.VisibilityTimeout = DEFAULT_VISIBILITY_TIMEOUT
+	}
+	if broker.PollInterval <= 0 {
+		broker.PollInterval = DEFAULT_POLL_INTERVAL
+	}
+
+	db, err := sql.Open("postgres", uri)
+	if err != nil {
+		return fmt.Errorf("can not connect to postgres: %w", err)
+	}
+	if err := createQueueSchema(ctx, db); err != nil {
+		db.Close()
+		return err
+	}
+
+	listener := pq.NewListener(uri, broker.Reconnect.MinBackoff, broker.Reconnect.MaxBackoff, broker.listenerEvent)
+	if err := listener.Listen(POSTGRES_NOTIFY_CHANNEL); err != nil {
+		listener.Close()
+		db.Close()
+		return fmt.Errorf("can not listen to queue notifications: %w", err)
+	}
+
+	broker.mu.Lock()
+	broker.db = db
+	broker.listener = listener
+	broker.done = make(chan struct{})
+	broker.wakeups = map[string][]chan struct{}{}
+	broker.setState(ConnectionEvent{State: STATE_CONNECTED})
+	broker.mu.Unlock()
+
+	broker.wg.Add(1)
+	go broker.dispatchNotifications(listener)
+
+	return nil
+}
+
+func createQueueSchema(ctx context.Context, db *sql.DB) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("can not connect to postgres: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, POSTGRES_QUEUE_SCHEMA); err != nil {
+		return fmt.Errorf("can not create queue tables: %w", err)
+	}
+	return tx.Commit()
+}
+
+// listenerEvent follows the notification connection, which stands for the database connection.
+func (broker *PostgresAmqp) listenerEvent(event pq.ListenerEventType, err error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if broker.connectionState() == STATE_CLOSED {
+		return
+	}
+
+	switch event {
+	case pq.ListenerEventDisconnected, pq.ListenerEventConnectionAttemptFailed:
+		broker.setState(ConnectionEvent{State: STATE_DISCONNECTED, Error: err})
+	case pq.ListenerEventReconnected:
+		broker.setState(ConnectionEvent{State: STATE_CONNECTED})
+	}
+}
+
+// dispatchNotifications wakes up the consumers of notified queues. Notifications may be lost
+// while reconnecting, so every consumer is woken up on reconnection.
+func (broker *PostgresAmqp) dispatchNotifications(listener *pq.Listener) {
+	defer broker.wg.Done()
+
+	for notification := range listener.NotificationChannel() {
+		broker.mu.Lock()
+		for queue, wakeups := range broker.wakeups {
+			if notification != nil && notification.Extra != queue {
+				continue
+			}
+			for _, wakeup := range wakeups {
+				select {
+				case wakeup <- struct{}{}:
+				default:
+				}
+			}
+		}
+		broker.mu.Unlock()
+	}
+}
+
+func (broker *PostgresAmqp) database() (*sql.DB, chan struct{}, error) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if broker.db == nil || broker.connectionState() == STATE_CLOSED {
+		return nil, nil, ErrClosed
+	}
+	return broker.db, broker.done, nil
+}
+
+func (broker *PostgresAmqp) exec(query string, args ...any) error {
+	db, _, err := broker.database()
+	if err != nil {
+		return err
+	}
+
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return fmt.Errorf("can not update message: %w", err)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// QueueDeclare registers queueName with its dead-letter queue and purges it. Dead letters
+// are kept for 7 days, expired ones are removed whenever a queue is declared.
+func (broker *PostgresAmqp) QueueDeclare(queueName string, deadLetterQueue string) error {
+	db, _, err := broker.database()
+	if err != nil {
+		return err
+	}
+
+	deadLetter := sql.NullString{String: deadLetterQueue, Valid: deadLetterQueue != ""}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("can not declare queue: %w", err)
+	}
+	defer tx.Rollback()
+
+	statements := []struct {
+		query string
+		args  []any
+	}{
+		{`INSERT INTO lightbyte_queues (name, dead_letter) VALUES ($1, $2)
+			ON CONFLICT (name) DO UPDATE SET dead_letter = EXCLUDED.dead_letter, declared_at = now()`, []any{queueName, deadLetter}},
+		{`DELETE FROM lightbyte_queue_messages WHERE queue = $1`, []any{queueName}},
+		{`DELETE FROM lightbyte_queue_messages WHERE expires_at < now()`, nil},
+	}
+	if deadLetter.Valid {
+		statements = append(statements, struct {
+			query string
+			args  []any
+		}{`INSERT INTO lightbyte_queues (name) VALUES ($1) ON CONFLICT (name) DO NOTHING`, []any{deadLetterQueue}})
+	}
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement.query, statement.args...); err != nil {
+			return fmt.Errorf("can not declare queue: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (broker *PostgresAmqp) Close() error {
+	broker.mu.Lock()
+	db, listener := broker.db, broker.listener
+	if broker.connectionState() != STATE_CLOSED && broker.done != nil {
+		broker.setState(ConnectionEvent{State: STATE_CLOSED, Error: ErrClosed})
+		close(broker.done)
+	}
+	broker.mu.Unlock()
+
+	if listener != nil {
+		listener.Close()
+	}
+	broker.wg.Wait()
+
+	if db != nil {
+		if err := db.Close(); err != nil {
+			return fmt.Errorf("can not close postgres connection: %w", err)
+		}
+	}
+	return nil
+}
+
+func (broker *PostgresAmqp) subscribe(queueName string) chan struct{} {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	wakeup := make(chan struct{}, 1)
+	broker.wakeups[queueName] = append(broker.wakeups[queueName], wakeup)
+	return wakeup
+}
+
+func (broker *PostgresAmqp) unsubscribe(queueName string, wakeup chan struct{}) {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	wakeups := broker.wakeups[queueName]
+	for idx, other := range wakeups {
+		if other == wakeup {
+			broker.wakeups[queueName] = append(wakeups[:idx], wakeups[idx+1:]...)
+			break
+		}
+	}
+	if len(broker.wakeups[queueName]) == 0 {
+		delete(broker.wakeups, queueName)
+	}
+}
+
+// claim hides the oldest visible message of the highest priority of queueName for the visibility timeout, it returns nil
+// when there is none. Messages locked by other consumers are skipped.
+func (broker *PostgresAmqp) claim(ctx context.Context, db *sql.DB, queueName string) (*AmqpMessagePostgresImpl, error) {
+	msg := &AmqpMessagePostgresImpl{broker: broker, queue: queueName}
+	var deadLetter sql.NullString
+	var headers []byte
+
+	query, args := claimQuery(queueName, broker.VisibilityTimeout)
+	err := db.QueryRowContext(ctx, query, args...).Scan(&msg.id, &msg.deliveries, &msg.requeues, &msg.body, &headers, &deadLetter)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("can not claim message: %w", err)
+	}
+
+	msg.deadLetter = deadLetter.String
+	// headers which are not an object of strings are ignored, the message is still delivered
+	if headers == nil || json.Unmarshal(headers, &msg.headers) != nil {
+		msg.headers = map[string]string{}
+	}
+	return msg, nil
+}
+
+func claimQuery(queueName string, visibilityTimeout time.Duration) (string, []any) {
+	return `
+		UPDATE lightbyte_queue_messages SET deliveries = deliveries + 1, visible_at = now() + $2::bigint * interval '1 millisecond'
+		WHERE id = (
+			SELECT id FROM lightbyte_queue_messages
+			WHERE queue = $1 AND visible_at <= now()
+			ORDER BY priority DESC, id
+			LIMIT 1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, deliveries, requeues, body, headers, (SELECT dead_letter FROM lightbyte_queues WHERE name = $1)`,
+		[]any{queueName, visibilityTimeout.Milliseconds()}
+}
+
+// Messages consumes queueName until ctx is done or the broker is closed. Unacknowledged messages are
+// delivered again after VisibilityTimeout until DeliveryLimit is reached. Reject messages without
+// requeue to dead-letter them.
+func (broker *PostgresAmqp) Messages(ctx context.Context, queueName string) (<-chan AmqpMessage, error) {
+	db, done, err := broker.database()
+	if err != nil {
+		return nil, err
+	}
+
+	var exists bool
+	if err := db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM lightbyte_queues WHERE name = $1)`, queueName).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("can not find queue: %w", err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownQueue, queueName)
+	}
+
+	consumeCtx, cancel := context.WithCancel(ctx)
+	wakeup := broker.subscribe(queueName)
+
+	result := make(chan AmqpMessage)
+	go func() {
+		defer close(result)
+		defer broker.unsubscribe(queueName, wakeup)
+		defer cancel()
+
+		poll := time.NewTicker(broker.PollInterval)
+		defer poll.Stop()
+
+		for attempt := 0; ; {
+			msg, err := broker.claim(consumeCtx, db, queueName)
+
+			switch {
+			case err != nil:
+				// the database is not reachable, retry with a backoff
+				attempt++
+				if !sleepContext(consumeCtx, broker.Reconnect.backoff(attempt)) {
+					return
+				}
+				continue
+			case msg == nil:
+				attempt = 0
+				select {
+				case <-wakeup:
+				case <-poll.C:
+				case <-consumeCtx.Done():
+					return
+				case <-done:
+					return
+				}
+				continue
+			}
+
+			attempt = 0
+			if overDeliveryLimit(msg.deliveries-msg.requeues, broker.DeliveryLimit) {
+				broker.deadLetterMsg(msg, "delivery_limit")
+				continue
+			}
+
+			select {
+			case result <- msg:
+			case <-consumeCtx.Done():
+				msg.Reject(true)
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return result, nil
+}
+
+// deadLetterMsg moves msg to its dead-letter queue, without a dead-letter queue the message is dropped.
+func (broker *PostgresAmqp) deadLetterMsg(msg *AmqpMessagePostgresImpl, reason string) error {
+	if msg.deadLetter == "" {
+		return broker.exec(`DELETE FROM lightbyte_queue_messages WHERE id = $1 AND deliveries = $2`, msg.id, msg.deliveries)
+	}
+
+	return broker.exec(`
+		UPDATE lightbyte_queue_messages SET
+			queue = $3,
+			visible_at = now(),
+			dead_letter_queue = queue,
+			dead_letter_reason = $4,
+			dead_lettered_at = now(),
+			expires_at = now() + $5::bigint * interval '1 millisecond'
+		WHERE id = $1 AND deliveries = $2`,
+		msg.id, msg.deliveries, msg.deadLetter, reason, RABBITMQ_DEAD_LETTER_EXPIRATION_TTL,
+	)
+}
+
+func (broker *PostgresAmqp) Publish(ctx context.Context, queueName string, message any) error {
+	return broker.PublishWithHeaders(ctx, queueName, message, nil)
+}
+
+// PublishWithHeaders publishes message like Publish, headers are kept in the headers column.
+func (broker *PostgresAmqp) PublishWithHeaders(ctx context.Context, queueName string, message any, headers map[string]string) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response")
+	}
+
+	// pq sends []byte as bytea, jsonb is passed as text
+	var encodedHeaders sql.NullString
+	if len(headers) > 0 {
+		encoded, err := json.Marshal(headers)
+		if err != nil {
+			return fmt.Errorf("failed to marshal headers: %w", err)
+		}
+		encodedHeaders = sql.NullString{String: string(encoded), Valid: true}
+	}
+
+	db, _, err := broker.database()
+	if err != nil {
+		return err
+	}
+
+	// the notification is sent when the transaction commits, once the message is visible
+	rows, err := db.QueryContext(ctx, `
+		WITH published AS (
+			INSERT INTO lightbyte_queue_messages (queue, body, headers, priority)
+			SELECT name, $2, $4::jsonb, $5 FROM lightbyte_queues WHERE name = $1
+			RETURNING queue
+		)
+		SELECT pg_notify($3, queue) FROM published`,
+		queueName, body, POSTGRES_NOTIFY_CHANNEL, encodedHeaders, messagePriority(headers),
+	)
+	if err != nil {
+		return fmt.Errorf("can not publish message: %w", err)
+	}
+	defer rows.Close()
+
+	published := rows.Next()
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("can not publish message: %w", err)
+	}
+	if !published {
+		return fmt.Errorf("%w: %s", ErrUnknownQueue, queueName)
+	}
+	return nil
+}
+
+// DeadLetters selects the oldest rows of deadLetterQueue.
+func (broker *PostgresAmqp) DeadLetters(ctx context.Context, deadLetterQueue string, limit int) ([]DeadLetter, error) {
+	db, _, err := broker.database()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.QueryContext(ctx, `
+		SELECT coalesce(dead_letter_queue, ''), coalesce(dead_letter_reason, ''), coalesce(dead_lettered_at, created_at), deliveries - requeues, body
+		FROM lightbyte_queue_messages
+		WHERE queue = $1
+		ORDER BY id
+		LIMIT $2`,
+		deadLetterQueue, limit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("can not read dead-letter queue: %w", err)
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var letter DeadLetter
+		if err := rows.Scan(&letter.Queue, &letter.Reason, &letter.DeadLetteredAt, &letter.Deliveries, &letter.Body); err != nil {
+			return nil, fmt.Errorf("can not read dead-letter queue: %w", err)
+		}
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
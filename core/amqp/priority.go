@@ -0,0 +1,24 @@
+package amqp
+
+import "strconv"
+
+// MAX_PRIORITY is the highest message priority, queues are declared with it as x-max-priority.
+// Messages without priority have priority 0, the lowest.
+const MAX_PRIORITY = 9
+
+// PRIORITY_HEADER carries the priority of a message to the transports, which deliver the ready
+// messages of a queue by priority and then in publishing order. NATS JetStream ignores it.
+const PRIORITY_HEADER = "Lightbyte-Priority"
+
+// DEFAULT_PREFETCH is the number of unacknowledged messages a RabbitMQ consumer holds. Messages a
+// consumer prefetched are not reordered, so priorities only apply to messages which are still queued.
+const DEFAULT_PREFETCH = 1
+
+// messagePriority returns the priority of headers, clamped to MAX_PRIORITY. Invalid priorities are 0.
+func messagePriority(headers map[string]string) int {
+	priority, err := strconv.Atoi(headers[PRIORITY_HEADER])
+	if err != nil || priority < 0 {
+		return 0
+	}
+	return min(priority, MAX_PRIORITY)
+}
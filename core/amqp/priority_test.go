@@ -0,0 +1,121 @@
+package amqp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func publishPriorities(t *testing.T, broker Amqp, queue string, priorities map[string]int, order []string) {
+	t.Helper()
+
+	for _, payload := range order {
+		headers := map[string]string{PRIORITY_HEADER: fmt.Sprint(priorities[payload])}
+		if err := PublishWithHeaders(context.TODO(), broker, queue, payload, headers); err != nil {
+			t.Fatalf("publish failed with error %s", err)
+		}
+	}
+}
+
+func TestMessagePriority(t *testing.T) {
+	for value, expected := range map[string]int{"": 0, "3": 3, "42": MAX_PRIORITY, "-1": 0, "high": 0} {
+		if priority := messagePriority(map[string]string{PRIORITY_HEADER: value}); priority != expected {
+			t.Errorf("expected priority %d of %q, got %d", expected, value, priority)
+		}
+	}
+}
+
+func TestMemoryPriority(t *testing.T) {
+	broker := connectMemory(t, memoryUri(t), &MemoryAmqp{})
+	if err := broker.QueueDeclare("requests", ""); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	publishPriorities(t, broker, "requests",
+		map[string]int{"backfill-1": 0, "backfill-2": 0, "daily-1": 5, "daily-2": 5, "urgent": 9},
+		[]string{"backfill-1", "daily-1", "backfill-2", "urgent", "daily-2"},
+	)
+
+	messages, err := broker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, messages, "urgent").Ack(false)
+	// a requeued message comes before the messages of its priority
+	expectPayload(t, messages, "daily-1").Nack(false, true)
+	for _, payload := range []string{"daily-1", "daily-2", "backfill-1", "backfill-2"} {
+		expectPayload(t, messages, payload).Ack(false)
+	}
+}
+
+func TestRabbitMqPriority(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+
+	if err := broker.QueueDeclare("requests", "dead_letters"); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	if _, err := broker.Messages(context.TODO(), "requests"); err != nil {
+		t.Fatal(err)
+	}
+	publishPriorities(t, broker, "requests", map[string]int{"daily": 5, "backfill": 0}, []string{"daily", "backfill"})
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if args := server.queueArgs["requests"]; args["x-max-priority"] != MAX_PRIORITY {
+		t.Errorf("wrong queue arguments %v", args)
+	}
+	if len(server.priorities) != 2 || server.priorities[0] != 5 || server.priorities[1] != 0 {
+		t.Errorf("wrong published priorities %v", server.priorities)
+	}
+	if server.prefetch != DEFAULT_PREFETCH {
+		t.Errorf("expected prefetch %d, got %d", DEFAULT_PREFETCH, server.prefetch)
+	}
+}
+
+func TestRabbitMqRedeclaresQueueWithOtherArguments(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+
+	// the queue of a previous version has no priority and no dead-letter queue
+	server.mu.Lock()
+	server.queueArgs["requests"] = amqp.Table{"x-expires": RABBITMQ_QUEUE_EXPIRATION_TTL}
+	server.mu.Unlock()
+	server.queue("requests") <- amqp.Delivery{Body: []byte("stale")}
+
+	if err := broker.QueueDeclare("requests", "dead_letters"); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if len(server.deleted) != 1 || server.deleted[0] != "requests" {
+		t.Errorf("wrong deleted queues %v", server.deleted)
+	}
+	args := server.queueArgs["requests"]
+	if args["x-max-priority"] != MAX_PRIORITY || args["x-dead-letter-exchange"] != DEAD_LETTER_EXCHANGE {
+		t.Errorf("wrong queue arguments %v", args)
+	}
+	if _, ok := server.queues["requests"]; ok {
+		t.Errorf("messages of the deleted queue are kept")
+	}
+}
+
+func TestPostgresPriority(t *testing.T) {
+	broker := connectPostgres(t, &PostgresAmqp{})
+	queue := testQueue(t, "requests")
+	if err := broker.QueueDeclare(queue, ""); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	publishPriorities(t, broker, queue, map[string]int{"backfill": 0, "daily": 5}, []string{"backfill", "daily"})
+
+	messages, err := broker.Messages(context.TODO(), queue)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectPayload(t, messages, "daily").Ack(false)
+	expectPayload(t, messages, "backfill").Ack(false)
+}
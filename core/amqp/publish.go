@@ -0,0 +1,167 @@
+package amqp
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const DEFAULT_PUBLISH_CHANNELS = 4
+const DEFAULT_CONFIRM_TIMEOUT = 10 * time.Second
+
+var (
+	ErrNacked         = errors.New("message nacked by the amqp broker")
+	ErrConfirmTimeout = errors.New("amqp broker did not confirm the message")
+)
+
+type confirmation interface {
+	WaitContext(context.Context) (bool, error)
+}
+
+type rabbitChannel struct {
+	*amqp.Channel
+}
+
+func (ch rabbitChannel) PublishWithDeferredConfirmWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (confirmation, error) {
+	confirm, err := ch.Channel.PublishWithDeferredConfirmWithContext(ctx, exchange, key, mandatory, immediate, msg)
+	if err != nil {
+		return nil, err
+	}
+	return confirm, nil
+}
+
+type publisher struct {
+	conn connection
+	ch   channel
+}
+
+// publisherPool keeps up to size channels in confirm mode open for publishing.
+type publisherPool struct {
+	slots chan struct{}
+
+	mu   sync.Mutex
+	idle []*publisher
+}
+
+func newPublisherPool(size int) *publisherPool {
+	return &publisherPool{slots: make(chan struct{}, size)}
+}
+
+// acquire reuses an idle channel of conn or opens a new one, it waits while size channels are in use.
+func (pool *publisherPool) acquire(ctx context.Context, conn connection) (*publisher, error) {
+	select {
+	case pool.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	pool.mu.Lock()
+	for len(pool.idle) > 0 {
+		idle := pool.idle[len(pool.idle)-1]
+		pool.idle = pool.idle[:len(pool.idle)-1]
+		if idle.conn == conn {
+			pool.mu.Unlock()
+			return idle, nil
+		}
+		// channels of a lost connection are closed already
+		idle.ch.Close()
+	}
+	pool.mu.Unlock()
+
+	ch, err := conn.Channel()
+	if err == nil {
+		if err = ch.Confirm(false); err != nil {
+			ch.Close()
+		}
+	}
+	if err != nil {
+		<-pool.slots
+		return nil, fmt.Errorf("can not open amqp channel: %w", err)
+	}
+
+	return &publisher{conn: conn, ch: ch}, nil
+}
+
+// release returns the channel to the pool, or closes it when its state is unknown after a failure.
+func (pool *publisherPool) release(pub *publisher, healthy bool) {
+	if healthy {
+		pool.mu.Lock()
+		pool.idle = append(pool.idle, pub)
+		pool.mu.Unlock()
+	} else {
+		pub.ch.Close()
+	}
+	<-pool.slots
+}
+
+func (pool *publisherPool) close() {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	for _, idle := range pool.idle {
+		idle.ch.Close()
+	}
+	pool.idle = nil
+}
+
+// Publish returns once the broker confirmed the message. A nack, a confirmation missing
+// after ConfirmTimeout or a connection lost meanwhile is an error, the message may have to be published again.
+func (broker *RabbitMqAmqp) Publish(ctx context.Context, queueName string, message any) error {
+	return broker.PublishWithHeaders(ctx, queueName, message, nil)
+}
+
+// PublishWithHeaders publishes message like Publish, with headers as AMQP message headers and the
+// PRIORITY_HEADER as message priority.
+func (broker *RabbitMqAmqp) PublishWithHeaders(ctx context.Context, queueName string, message any, headers map[string]string) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return fmt.Errorf("failed to marshal response")
+	}
+
+	return broker.publish(ctx, queueName, amqp.Publishing{
+		Headers:      rabbitHeaders(headers),
+		DeliveryMode: amqp.Persistent,
+		Priority:     uint8(messagePriority(headers)),
+		ContentType:  "application/json",
+		Body:         body,
+	})
+}
+
+func (broker *RabbitMqAmqp) publish(ctx context.Context, queueName string, msg amqp.Publishing) error {
+	conn, err := broker.connection(ctx)
+	if err != nil {
+		return err
+	}
+
+	pub, err := broker.publishers.acquire(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	confirm, err := pub.ch.PublishWithDeferredConfirmWithContext(ctx, "", queueName, false, false, msg)
+	if err != nil {
+		broker.publishers.release(pub, false)
+		return fmt.Errorf("failed to publish message to queue %w", err)
+	}
+
+	confirmCtx, cancel := context.WithTimeout(ctx, broker.ConfirmTimeout)
+	defer cancel()
+
+	acked, err := confirm.WaitContext(confirmCtx)
+	broker.publishers.release(pub, err == nil && acked)
+
+	switch {
+	case err != nil && ctx.Err() == nil:
+		return fmt.Errorf("%w within %s on queue %s", ErrConfirmTimeout, broker.ConfirmTimeout, queueName)
+	case err != nil:
+		return err
+	case !acked:
+		return fmt.Errorf("%w on queue %s", ErrNacked, queueName)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPublishReusesChannels(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig, PublishChannels: 2})
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 20)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- broker.Publish(context.TODO(), "responses", fmt.Sprint(i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("publish failed with error %s", err)
+		}
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.published) != 20 {
+		t.Errorf("expected 20 messages, got %d", len(server.published))
+	}
+	if server.openedChans > 2 || server.closedChans != 0 {
+		t.Errorf("%d channels opened, %d closed", server.openedChans, server.closedChans)
+	}
+}
+
+func TestPublishNacked(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+	server.nacks = 1
+
+	if err := broker.Publish(context.TODO(), "responses", "payload"); !errors.Is(err, ErrNacked) {
+		t.Errorf("expected nack error, got %v", err)
+	}
+	if err := broker.Publish(context.TODO(), "responses", "payload"); err != nil {
+		t.Errorf("publish after nack failed with error %s", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	// the channel of the nacked message is not reused
+	if server.openedChans != 2 || server.closedChans != 1 || len(server.published) != 1 {
+		t.Errorf("%d channels opened, %d closed, %d published", server.openedChans, server.closedChans, len(server.published))
+	}
+}
+
+func TestPublishConfirmTimeout(t *testing.T) {
+	server, broker, _ := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig, ConfirmTimeout: 10 * time.Millisecond})
+	server.unconfirmed = 1
+
+	if err := broker.Publish(context.TODO(), "responses", "payload"); !errors.Is(err, ErrConfirmTimeout) {
+		t.Errorf("expected confirm timeout error, got %v", err)
+	}
+
+	server.unconfirmed = 1
+	ctx, cancel := context.WithCancel(context.TODO())
+	cancel()
+	if err := broker.Publish(ctx, "responses", "payload"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancelled error, got %v", err)
+	}
+}
+
+func TestPublishDropsChannelsOfLostConnection(t *testing.T) {
+	server, broker, events := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+	expectEvent(t, events, STATE_CONNECTED)
+
+	if err := broker.Publish(context.TODO(), "responses", "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.drop(0)
+	expectEvent(t, events, STATE_DISCONNECTED)
+	expectEvent(t, events, STATE_CONNECTED)
+
+	if err := broker.Publish(context.TODO(), "responses", "after"); err != nil {
+		t.Fatalf("publish after reconnect failed with error %s", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.openedChans != 2 || server.closedChans != 1 || len(server.published) != 2 {
+		t.Errorf("%d channels opened, %d closed, %d published", server.openedChans, server.closedChans, len(server.published))
+	}
+}
@@ -0,0 +1,297 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrClosed = errors.New("amqp broker connection closed")
+
+type ConnectionState string
+
+const (
+	STATE_CONNECTED    ConnectionState = "CONNECTED"
+	STATE_DISCONNECTED ConnectionState = "DISCONNECTED"
+	STATE_CLOSED       ConnectionState = "CLOSED"
+)
+
+// ConnectionEvent reports a connection state change. Error is the reason the connection was lost,
+// or the failure of the reconnection Attempt.
+type ConnectionEvent struct {
+	State   ConnectionState
+	Attempt int
+	Error   error
+}
+
+type AmqpStateNotifier interface {
+	NotifyState(chan ConnectionEvent) chan ConnectionEvent
+}
+
+// ReconnectConfig sets the delay between reconnection attempts, doubling from MinBackoff up to MaxBackoff.
+// With MaxAttempts 0 the broker reconnects until it is closed.
+type ReconnectConfig struct {
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxAttempts int
+}
+
+func DefaultReconnectConfig() ReconnectConfig {
+	return ReconnectConfig{
+		MinBackoff: 500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+	}
+}
+
+type connection interface {
+	Channel() (channel, error)
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type channel interface {
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueuePurge(name string, noWait bool) (int, error)
+	QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error)
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+	ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Qos(prefetchCount, prefetchSize int, global bool) error
+	ConsumeWithContext(ctx context.Context, queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error)
+	Confirm(noWait bool) error
+	PublishWithDeferredConfirmWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (confirmation, error)
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+type rabbitConnection struct {
+	*amqp.Connection
+}
+
+func (conn rabbitConnection) Channel() (channel, error) {
+	ch, err := conn.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return rabbitChannel{ch}, nil
+}
+
+func dialRabbitMq(uri string) (connection, error) {
+	conn, err := amqp.Dial(uri)
+	if err != nil {
+		return nil, err
+	}
+	return rabbitConnection{conn}, nil
+}
+
+func (config ReconnectConfig) backoff(attempt int) time.Duration {
+	backoff := config.MinBackoff
+	for i := 1; i < attempt && backoff < config.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, config.MaxBackoff)
+}
+
+// stateNotifier keeps the connection state of a broker and sends its changes to the listeners
+// registered with NotifyState. Brokers embed it and call setState on every state change.
+type stateNotifier struct {
+	mu        sync.Mutex
+	state     ConnectionState
+	listeners []chan ConnectionEvent
+}
+
+// NotifyState registers a listener for connection state changes. Events are dropped
+// when the listener is not ready to receive them, so use a buffered channel.
+func (notifier *stateNotifier) NotifyState(listener chan ConnectionEvent) chan ConnectionEvent {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	notifier.listeners = append(notifier.listeners, listener)
+	return listener
+}
+
+func (notifier *stateNotifier) setState(event ConnectionEvent) {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	notifier.state = event.State
+	for _, listener := range notifier.listeners {
+		select {
+		case listener <- event:
+		default:
+		}
+	}
+}
+
+func (notifier *stateNotifier) connectionState() ConnectionState {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	return notifier.state
+}
+
+func (notifier *stateNotifier) IsConnected() bool {
+	return notifier.connectionState() == STATE_CONNECTED
+}
+
+// readyLocked returns a channel closed once the broker is connected or closed, it is called with broker.mu held.
+func (broker *RabbitMqAmqp) readyLocked() chan struct{} {
+	if broker.ready == nil {
+		broker.ready = make(chan struct{})
+	}
+	return broker.ready
+}
+
+// connection waits until the broker is connected.
+func (broker *RabbitMqAmqp) connection(ctx context.Context) (connection, error) {
+	for {
+		broker.mu.Lock()
+		if broker.connectionState() == STATE_CLOSED {
+			broker.mu.Unlock()
+			return nil, ErrClosed
+		}
+		if broker.connectionState() == STATE_CONNECTED {
+			conn := broker.conn
+			broker.mu.Unlock()
+			return conn, nil
+		}
+		ready := broker.readyLocked()
+		broker.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// sleep waits for the backoff delay, it returns false when the broker is closed meanwhile.
+func (broker *RabbitMqAmqp) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-broker.done:
+		return false
+	}
+}
+
+// redeclare declares the queues known to the broker on a new connection. Queues are not purged,
+// requests published while the connection was down are still to be processed.
+func (broker *RabbitMqAmqp) redeclare(conn connection) error {
+	broker.mu.Lock()
+	queues := append([]declaredQueue{}, broker.queues...)
+	broker.mu.Unlock()
+
+	if len(queues) == 0 {
+		return nil
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+
+	for _, queue := range queues {
+		if err := declareQueue(ch, queue); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (broker *RabbitMqAmqp) reconnect() (connection, chan *amqp.Error, error) {
+	for attempt := 1; ; attempt++ {
+		if !broker.sleep(broker.Reconnect.backoff(attempt)) {
+			return nil, nil, ErrClosed
+		}
+
+		conn, err := broker.dial(broker.uri)
+		if err == nil {
+			closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+			if err = broker.redeclare(conn); err == nil {
+				return conn, closed, nil
+			}
+			conn.Close()
+		}
+
+		broker.mu.Lock()
+		broker.setState(ConnectionEvent{State: STATE_DISCONNECTED, Attempt: attempt, Error: err})
+		broker.mu.Unlock()
+
+		if broker.Reconnect.MaxAttempts > 0 && attempt >= broker.Reconnect.MaxAttempts {
+			return nil, nil, err
+		}
+	}
+}
+
+// supervise replaces the connection whenever it is lost, until the broker is closed.
+func (broker *RabbitMqAmqp) supervise(closed chan *amqp.Error) {
+	defer broker.wg.Done()
+
+	for {
+		var reason error
+		select {
+		case <-broker.done:
+			return
+		case amqpErr, ok := <-closed:
+			reason = ErrClosed
+			if ok && amqpErr != nil {
+				reason = amqpErr
+			}
+		}
+
+		broker.mu.Lock()
+		if broker.connectionState() == STATE_CLOSED {
+			broker.mu.Unlock()
+			return
+		}
+		broker.setState(ConnectionEvent{State: STATE_DISCONNECTED, Error: reason})
+		broker.mu.Unlock()
+
+		conn, connClosed, err := broker.reconnect()
+
+		broker.mu.Lock()
+		if errors.Is(err, ErrClosed) || broker.connectionState() == STATE_CLOSED {
+			broker.mu.Unlock()
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			broker.closeLocked(err)
+			broker.mu.Unlock()
+			return
+		}
+
+		broker.conn = conn
+		broker.setState(ConnectionEvent{State: STATE_CONNECTED})
+		close(broker.readyLocked())
+		broker.ready = nil
+		broker.mu.Unlock()
+
+		closed = connClosed
+	}
+}
+
+// closeLocked stops reconnecting and releases waiting consumers and publishers, it is called with broker.mu held.
+func (broker *RabbitMqAmqp) closeLocked(reason error) {
+	if broker.connectionState() == STATE_CLOSED {
+		return
+	}
+
+	broker.setState(ConnectionEvent{State: STATE_CLOSED, Error: reason})
+	close(broker.readyLocked())
+	broker.ready = nil
+	if broker.done != nil {
+		close(broker.done)
+	}
+}
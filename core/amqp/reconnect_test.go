@@ -0,0 +1,609 @@
+package amqp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// fakeServer stands in for RabbitMQ, connections can be dropped and dials fail on demand.
+type fakeServer struct {
+	mu          sync.Mutex
+	conn        *fakeConnection
+	dials       int
+	dialErrors  int
+	queues      map[string]chan amqp.Delivery
+	declared    []string
+	queueArgs   map[string]amqp.Table
+	exchanges   []string
+	bindings    []string
+	purged      []string
+	deleted     []string
+	published   []string
+	priorities  []uint8
+	// rejected are the bodies of the consumed messages rejected without requeue
+	rejected    []string
+	prefetch    int
+	nacks       int
+	unconfirmed int
+	openedChans int
+	closedChans int
+}
+
+type fakeConnection struct {
+	server    *fakeServer
+	dropped   chan struct{}
+	notify    []chan *amqp.Error
+	closeOnce sync.Once
+}
+
+type fakeChannel struct {
+	conn     *fakeConnection
+	unacked  []amqp.Delivery
+	unackedQ []string
+
+	// consumed deliveries without an acknowledger are settled on the channel, like on RabbitMQ
+	mu        sync.Mutex
+	closed    bool
+	tags      uint64
+	consumed  map[uint64]amqp.Delivery
+	consumedQ map[uint64]string
+	notify    []chan *amqp.Error
+}
+
+// fakeAcknowledger records how consumers settled deliveries.
+type fakeAcknowledger struct {
+	mu       sync.Mutex
+	acked    []uint64
+	rejected []uint64
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rejected = append(a.rejected, tag)
+	return nil
+}
+
+func newFakeServer() *fakeServer {
+	return &fakeServer{queues: map[string]chan amqp.Delivery{}, queueArgs: map[string]amqp.Table{}}
+}
+
+func (server *fakeServer) dial(uri string) (connection, error) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	server.dials++
+	if server.dialErrors > 0 {
+		server.dialErrors--
+		return nil, fmt.Errorf("connection refused")
+	}
+	server.conn = &fakeConnection{server: server, dropped: make(chan struct{})}
+	return server.conn, nil
+}
+
+func (server *fakeServer) queue(name string) chan amqp.Delivery {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if _, ok := server.queues[name]; !ok {
+		server.queues[name] = make(chan amqp.Delivery, 10)
+	}
+	return server.queues[name]
+}
+
+// drop closes the current connection like a broker restart, failing the next dials.
+func (server *fakeServer) drop(dialErrors int) {
+	server.mu.Lock()
+	server.dialErrors = dialErrors
+	conn := server.conn
+	server.mu.Unlock()
+
+	conn.close(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker restart"})
+}
+
+func (conn *fakeConnection) close(reason *amqp.Error) {
+	conn.closeOnce.Do(func() {
+		close(conn.dropped)
+		for _, notify := range conn.notify {
+			if reason != nil {
+				notify <- reason
+			}
+			close(notify)
+		}
+	})
+}
+
+func (conn *fakeConnection) Channel() (channel, error) {
+	select {
+	case <-conn.dropped:
+		return nil, amqp.ErrClosed
+	default:
+	}
+
+	conn.server.mu.Lock()
+	defer conn.server.mu.Unlock()
+	conn.server.openedChans++
+	ch := &fakeChannel{conn: conn, consumed: map[uint64]amqp.Delivery{}, consumedQ: map[uint64]string{}}
+	go func() {
+		<-conn.dropped
+		ch.closeNotify()
+	}()
+	return ch, nil
+}
+
+func (conn *fakeConnection) NotifyClose(notify chan *amqp.Error) chan *amqp.Error {
+	conn.notify = append(conn.notify, notify)
+	return notify
+}
+
+func (conn *fakeConnection) Close() error {
+	conn.close(nil)
+	return nil
+}
+
+// QueueDeclare fails like the broker when the queue exists with other arguments, closing the channel.
+func (ch *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	server := ch.conn.server
+	server.mu.Lock()
+	existing, ok := server.queueArgs[name]
+	if ok && !reflect.DeepEqual(existing, args) {
+		server.mu.Unlock()
+		ch.closeNotify()
+		return amqp.Queue{}, &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg"}
+	}
+	server.declared = append(server.declared, name)
+	server.queueArgs[name] = args
+	server.mu.Unlock()
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeChannel) QueueDelete(name string, ifUnused, ifEmpty, noWait bool) (int, error) {
+	ch.mu.Lock()
+	closed := ch.closed
+	ch.mu.Unlock()
+	if closed {
+		return 0, amqp.ErrClosed
+	}
+
+	server := ch.conn.server
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.deleted = append(server.deleted, name)
+	delete(server.queueArgs, name)
+	delete(server.queues, name)
+	return 0, nil
+}
+
+func (ch *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	ch.conn.server.mu.Lock()
+	defer ch.conn.server.mu.Unlock()
+	ch.conn.server.bindings = append(ch.conn.server.bindings, fmt.Sprintf("%s:%s->%s", exchange, key, name))
+	return nil
+}
+
+func (ch *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	ch.conn.server.mu.Lock()
+	defer ch.conn.server.mu.Unlock()
+	ch.conn.server.exchanges = append(ch.conn.server.exchanges, name)
+	return nil
+}
+
+func (ch *fakeChannel) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	select {
+	case delivery := <-ch.conn.server.queue(queue):
+		ch.unacked = append(ch.unacked, delivery)
+		ch.unackedQ = append(ch.unackedQ, queue)
+		return delivery, true, nil
+	default:
+		return amqp.Delivery{}, false, nil
+	}
+}
+
+func (ch *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.conn.server.mu.Lock()
+	defer ch.conn.server.mu.Unlock()
+	ch.conn.server.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *fakeChannel) QueuePurge(name string, noWait bool) (int, error) {
+	ch.conn.server.mu.Lock()
+	defer ch.conn.server.mu.Unlock()
+	ch.conn.server.purged = append(ch.conn.server.purged, name)
+	return 0, nil
+}
+
+func (ch *fakeChannel) ConsumeWithContext(ctx context.Context, queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	source := ch.conn.server.queue(queue)
+	deliveries := make(chan amqp.Delivery)
+
+	go func() {
+		defer close(deliveries)
+		for {
+			select {
+			case delivery := <-source:
+				if delivery.Acknowledger == nil {
+					ch.mu.Lock()
+					ch.tags++
+					delivery.Acknowledger, delivery.DeliveryTag = ch, ch.tags
+					ch.consumed[ch.tags], ch.consumedQ[ch.tags] = delivery, queue
+					ch.mu.Unlock()
+				}
+				select {
+				case deliveries <- delivery:
+				case <-ch.conn.dropped:
+					return
+				}
+			case <-ch.conn.dropped:
+				return
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return deliveries, nil
+}
+
+func (ch *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+type fakeConfirmation struct {
+	ack     bool
+	pending bool
+}
+
+func (confirm fakeConfirmation) WaitContext(ctx context.Context) (bool, error) {
+	if confirm.pending {
+		<-ctx.Done()
+		return false, ctx.Err()
+	}
+	return confirm.ack, nil
+}
+
+func (ch *fakeChannel) PublishWithDeferredConfirmWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) (confirmation, error) {
+	server := ch.conn.server
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	switch {
+	case server.nacks > 0:
+		server.nacks--
+		return fakeConfirmation{ack: false}, nil
+	case server.unconfirmed > 0:
+		server.unconfirmed--
+		return fakeConfirmation{pending: true}, nil
+	}
+	server.published = append(server.published, string(msg.Body))
+	server.priorities = append(server.priorities, msg.Priority)
+	if queue, ok := server.queues[key]; ok {
+		queue <- amqp.Delivery{Headers: msg.Headers, Priority: msg.Priority, Body: msg.Body}
+	}
+	return fakeConfirmation{ack: true}, nil
+}
+
+func (ch *fakeChannel) settle(tag uint64, requeue bool, reject bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	delivery, ok := ch.consumed[tag]
+	if !ok {
+		return fmt.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(ch.consumed, tag)
+	switch {
+	case requeue:
+		delivery.Acknowledger, delivery.Redelivered = nil, true
+		ch.conn.server.queue(ch.consumedQ[tag]) <- delivery
+	case reject:
+		ch.conn.server.mu.Lock()
+		ch.conn.server.rejected = append(ch.conn.server.rejected, string(delivery.Body))
+		ch.conn.server.mu.Unlock()
+	}
+	return nil
+}
+
+func (ch *fakeChannel) Ack(tag uint64, multiple bool) error {
+	return ch.settle(tag, false, false)
+}
+
+func (ch *fakeChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	return ch.settle(tag, requeue, !requeue)
+}
+
+func (ch *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return ch.settle(tag, requeue, !requeue)
+}
+
+func (ch *fakeChannel) NotifyClose(notify chan *amqp.Error) chan *amqp.Error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if ch.closed {
+		close(notify)
+		return notify
+	}
+	ch.notify = append(ch.notify, notify)
+	return notify
+}
+
+func (ch *fakeChannel) closeNotify() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	if !ch.closed {
+		ch.closed = true
+		for _, notify := range ch.notify {
+			close(notify)
+		}
+	}
+}
+
+// Close requeues the messages read by Get and the consumed messages which are not settled,
+// the consumed messages of a channel closed by a dropped connection are not redelivered.
+func (ch *fakeChannel) Close() error {
+	for idx, delivery := range ch.unacked {
+		ch.conn.server.queue(ch.unackedQ[idx]) <- delivery
+	}
+	ch.unacked = nil
+
+	ch.mu.Lock()
+	if !ch.closed {
+		for tag, delivery := range ch.consumed {
+			delivery.Acknowledger, delivery.Redelivered = nil, true
+			ch.conn.server.queue(ch.consumedQ[tag]) <- delivery
+		}
+	}
+	ch.consumed = map[uint64]amqp.Delivery{}
+	ch.mu.Unlock()
+	ch.closeNotify()
+
+	ch.conn.server.mu.Lock()
+	defer ch.conn.server.mu.Unlock()
+	ch.conn.server.closedChans++
+	return nil
+}
+
+var testReconnectConfig = ReconnectConfig{MinBackoff: time.Millisecond, MaxBackoff: 4 * time.Millisecond}
+
+func connectFake(t *testing.T, broker *RabbitMqAmqp) (*fakeServer, *RabbitMqAmqp, chan ConnectionEvent) {
+	server := newFakeServer()
+	broker.dial = server.dial
+	events := broker.NotifyState(make(chan ConnectionEvent, 100))
+
+	if err := broker.Connect(context.TODO(), "amqp://fake"); err != nil {
+		t.Fatalf("connect failed with error %s", err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	return server, broker, events
+}
+
+func expectEvent(t *testing.T, events chan ConnectionEvent, state ConnectionState) ConnectionEvent {
+	select {
+	case event := <-events:
+		if event.State != state {
+			t.Fatalf("expected %s event, got %+v", state, event)
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no %s event", state)
+	}
+	return ConnectionEvent{}
+}
+
+func expectMessage(t *testing.T, messages <-chan AmqpMessage, payload string) {
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			t.Fatalf("messages channel closed, expected %q", payload)
+		}
+		if string(msg.Payload()) != payload {
+			t.Errorf("expected %q, got %q", payload, msg.Payload())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message %q not received", payload)
+	}
+}
+
+func TestMessagesResumeAfterReconnect(t *testing.T) {
+	server, broker, events := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+	expectEvent(t, events, STATE_CONNECTED)
+
+	if err := broker.QueueDeclare("requests", ""); err != nil {
+		t.Fatal(err)
+	}
+	messages, err := broker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.queue("requests") <- amqp.Delivery{Body: []byte("first")}
+	expectMessage(t, messages, "first")
+
+	server.drop(2)
+
+	if event := expectEvent(t, events, STATE_DISCONNECTED); event.Attempt != 0 || event.Error == nil {
+		t.Errorf("wrong connection lost event %+v", event)
+	}
+	for attempt := 1; attempt <= 2; attempt++ {
+		if event := expectEvent(t, events, STATE_DISCONNECTED); event.Attempt != attempt || event.Error == nil {
+			t.Errorf("wrong reconnection event %+v", event)
+		}
+	}
+	expectEvent(t, events, STATE_CONNECTED)
+
+	server.queue("requests") <- amqp.Delivery{Body: []byte("second")}
+	expectMessage(t, messages, "second")
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.dials != 4 || !broker.IsConnected() {
+		t.Errorf("expected 4 dials, got %d", server.dials)
+	}
+	// queues are redeclared without dropping pending requests
+	if len(server.declared) != 2 || len(server.purged) != 1 {
+		t.Errorf("wrong queue declarations %v, purges %v", server.declared, server.purged)
+	}
+}
+
+func TestPublishWaitsForReconnect(t *testing.T) {
+	server, broker, events := connectFake(t, &RabbitMqAmqp{Reconnect: ReconnectConfig{MinBackoff: 20 * time.Millisecond, MaxBackoff: 20 * time.Millisecond}})
+	expectEvent(t, events, STATE_CONNECTED)
+
+	server.drop(1)
+	expectEvent(t, events, STATE_DISCONNECTED)
+	if broker.IsConnected() {
+		t.Errorf("broker reported connected after the connection was lost")
+	}
+
+	if err := broker.Publish(context.TODO(), "responses", "payload"); err != nil {
+		t.Fatalf("publish failed with error %s", err)
+	}
+
+	server.mu.Lock()
+	if len(server.published) != 1 || server.dials != 3 {
+		t.Errorf("wrong publishes %v after %d dials", server.published, server.dials)
+	}
+	server.mu.Unlock()
+
+	expectEvent(t, events, STATE_DISCONNECTED)
+	expectEvent(t, events, STATE_CONNECTED)
+	server.drop(100)
+	expectEvent(t, events, STATE_DISCONNECTED)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 10*time.Millisecond)
+	defer cancel()
+	if err := broker.Publish(ctx, "responses", "payload"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected publish to time out, got %v", err)
+	}
+}
+
+func TestReconnectGivesUp(t *testing.T) {
+	config := testReconnectConfig
+	config.MaxAttempts = 3
+	server, broker, events := connectFake(t, &RabbitMqAmqp{Reconnect: config})
+	expectEvent(t, events, STATE_CONNECTED)
+
+	messages, err := broker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.drop(100)
+	for attempt := 0; attempt <= 3; attempt++ {
+		expectEvent(t, events, STATE_DISCONNECTED)
+	}
+	expectEvent(t, events, STATE_CLOSED)
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Errorf("unexpected message")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("messages channel not closed")
+	}
+
+	if err := broker.Publish(context.TODO(), "responses", "payload"); !errors.Is(err, ErrClosed) {
+		t.Errorf("expected closed error, got %v", err)
+	}
+}
+
+func TestCloseStopsConsumers(t *testing.T) {
+	_, broker, events := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+	expectEvent(t, events, STATE_CONNECTED)
+
+	messages, err := broker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := broker.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, STATE_CLOSED)
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Errorf("unexpected message")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("messages channel not closed")
+	}
+}
+
+func TestCancelledConsumerKeepsChannelUntilDeliveriesSettle(t *testing.T) {
+	server, broker, events := connectFake(t, &RabbitMqAmqp{Reconnect: testReconnectConfig})
+	expectEvent(t, events, STATE_CONNECTED)
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	messages, err := broker.Messages(ctx, "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.queue("requests") <- amqp.Delivery{Body: []byte("in flight")}
+	var held AmqpMessage
+	select {
+	case held = <-messages:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("message not received")
+	}
+
+	// a worker shutting down stops consuming, then finishes the batch it holds
+	cancel()
+	for range messages {
+	}
+	if err := held.Ack(false); err != nil {
+		t.Fatalf("ack of a held delivery failed with error %s", err)
+	}
+
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		server.mu.Lock()
+		closed := server.closedChans
+		server.mu.Unlock()
+		if closed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("consumer channel not closed once its deliveries were settled")
+		}
+	}
+	if requeued := len(server.queue("requests")); requeued != 0 {
+		t.Errorf("acked delivery was requeued %d times", requeued)
+	}
+}
+
+func TestReconnectBackoff(t *testing.T) {
+	config := ReconnectConfig{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+
+	for idx, backoff := range expected {
+		if actual := config.backoff(idx + 1); actual != backoff {
+			t.Errorf("attempt %d: expected %s, got %s", idx+1, backoff, actual)
+		}
+	}
+}
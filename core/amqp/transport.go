@@ -0,0 +1,53 @@
+package amqp
+
+import (
+	"fmt"
+	"net/url"
+)
+
+const (
+	TRANSPORT_RABBITMQ = "rabbitmq"
+	TRANSPORT_NATS     = "nats"
+	TRANSPORT_POSTGRES = "postgres"
+	TRANSPORT_MEMORY   = "memory"
+)
+
+// Transport returns the message transport of uri, selected by its scheme: amqp:// and amqps:// for
+// RabbitMQ, nats:// and tls:// for NATS JetStream, postgres:// and postgresql:// for a Postgres queue table
+// and mem:// for in-process queues.
+func Transport(uri string) (string, error) {
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return "", fmt.Errorf("invalid broker uri: %w", err)
+	}
+
+	switch parsed.Scheme {
+	case "amqp", "amqps":
+		return TRANSPORT_RABBITMQ, nil
+	case "nats", "tls":
+		return TRANSPORT_NATS, nil
+	case "postgres", "postgresql":
+		return TRANSPORT_POSTGRES, nil
+	case "mem":
+		return TRANSPORT_MEMORY, nil
+	}
+	return "", fmt.Errorf("unsupported broker uri scheme %q", parsed.Scheme)
+}
+
+// NewBroker returns the transport of uri with its default settings, connect it with Connect.
+func NewBroker(uri string) (Amqp, error) {
+	transport, err := Transport(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	switch transport {
+	case TRANSPORT_NATS:
+		return &NatsJetStreamAmqp{}, nil
+	case TRANSPORT_POSTGRES:
+		return &PostgresAmqp{}, nil
+	case TRANSPORT_MEMORY:
+		return &MemoryAmqp{}, nil
+	}
+	return &RabbitMqAmqp{}, nil
+}
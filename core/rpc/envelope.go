@@ -0,0 +1,177 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"starbyte.io/core/amqp"
+)
+
+// PROTOCOL_VERSION is the version of the messages published, receivers accept any minor version
+// of their major version and ignore the fields they do not know.
+const PROTOCOL_VERSION = "1.0"
+
+// LEGACY_PROTOCOL_VERSION is assumed for messages published without envelope headers.
+const LEGACY_PROTOCOL_VERSION = "1.0"
+
+// Envelope headers, carried as transport headers next to the JSON message body.
+const (
+	VERSION_HEADER          = "Lightbyte-Protocol-Version"
+	TYPE_HEADER             = "Lightbyte-Message-Type"
+	SENT_AT_HEADER          = "Lightbyte-Sent-At"
+	PRODUCER_HEADER         = "Lightbyte-Producer"
+	EXTENSION_HEADER_PREFIX = "Lightbyte-Ext-"
+)
+
+type MessageType string
+
+const (
+	PROCESS_REQUEST  MessageType = "process_request"
+	PROCESS_RESPONSE MessageType = "process_response"
+	HEARTBEAT        MessageType = "heartbeat"
+)
+
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+// Envelope describes a message, Extensions carries headers receivers may ignore.
+type Envelope struct {
+	Version    string
+	Type       MessageType
+	SentAt     time.Time
+	Producer   string
+	Extensions map[string]string
+}
+
+// Message is a protocol message published with its envelope.
+type Message interface {
+	envelope() Envelope
+	// priority is the transport priority of the message, 0 for the lowest
+	priority() int
+}
+
+func (request ProcessRequest) envelope() Envelope {
+	return request.Envelope.withType(PROCESS_REQUEST)
+}
+
+func (response ProcessResponse) envelope() Envelope {
+	return response.Envelope.withType(PROCESS_RESPONSE)
+}
+
+func (heartbeat Heartbeat) envelope() Envelope {
+	return heartbeat.Envelope.withType(HEARTBEAT)
+}
+
+func (request ProcessRequest) priority() int {
+	return request.Priority
+}
+
+func (response ProcessResponse) priority() int {
+	return 0
+}
+
+func (heartbeat Heartbeat) priority() int {
+	return 0
+}
+
+func (envelope Envelope) withType(messageType MessageType) Envelope {
+	envelope.Type = messageType
+	return envelope
+}
+
+// Headers returns the transport headers of the envelope.
+func (envelope Envelope) Headers() map[string]string {
+	headers := map[string]string{
+		VERSION_HEADER: envelope.Version,
+		TYPE_HEADER:    string(envelope.Type),
+	}
+	if !envelope.SentAt.IsZero() {
+		headers[SENT_AT_HEADER] = envelope.SentAt.UTC().Format(time.RFC3339Nano)
+	}
+	if envelope.Producer != "" {
+		headers[PRODUCER_HEADER] = envelope.Producer
+	}
+	for name, value := range envelope.Extensions {
+		headers[EXTENSION_HEADER_PREFIX+name] = value
+	}
+	return headers
+}
+
+// ParseEnvelope reads the envelope of transport headers. Messages without a version header are
+// legacy messages, they have no type. It fails with ErrUnsupportedVersion for other major versions.
+func ParseEnvelope(headers map[string]string) (Envelope, error) {
+	version, ok := headers[VERSION_HEADER]
+	if !ok {
+		return Envelope{Version: LEGACY_PROTOCOL_VERSION}, nil
+	}
+	if err := CheckVersion(version); err != nil {
+		return Envelope{}, err
+	}
+
+	envelope := Envelope{
+		Version:  version,
+		Type:     MessageType(headers[TYPE_HEADER]),
+		Producer: headers[PRODUCER_HEADER],
+	}
+	if envelope.Type == "" {
+		return envelope, fmt.Errorf("missing %s header", TYPE_HEADER)
+	}
+	if sentAt, ok := headers[SENT_AT_HEADER]; ok {
+		parsed, err := time.Parse(time.RFC3339Nano, sentAt)
+		if err != nil {
+			return envelope, fmt.Errorf("invalid %s header %q", SENT_AT_HEADER, sentAt)
+		}
+		envelope.SentAt = parsed
+	}
+	for key, value := range headers {
+		if name, ok := strings.CutPrefix(key, EXTENSION_HEADER_PREFIX); ok {
+			if envelope.Extensions == nil {
+				envelope.Extensions = map[string]string{}
+			}
+			envelope.Extensions[name] = value
+		}
+	}
+	return envelope, nil
+}
+
+// CheckVersion accepts the versions of the PROTOCOL_VERSION major version.
+func CheckVersion(version string) error {
+	major, _, _ := strings.Cut(version, ".")
+	supported, _, _ := strings.Cut(PROTOCOL_VERSION, ".")
+	if _, err := strconv.Atoi(major); err != nil || major != supported {
+		return fmt.Errorf("%w %q, expected %s.x", ErrUnsupportedVersion, version, supported)
+	}
+	return nil
+}
+
+// Publish publishes message with its envelope, stamped with the protocol version, the current time and producer.
+// Transports without headers receive the bare message, which receivers read as a legacy message.
+// Requests with a priority are published with the amqp.PRIORITY_HEADER.
+func Publish(ctx context.Context, broker amqp.Amqp, queueName string, message Message, producer string) error {
+	envelope := message.envelope()
+	envelope.Version = PROTOCOL_VERSION
+	envelope.SentAt = time.Now().UTC()
+	envelope.Producer = producer
+
+	headers := envelope.Headers()
+	if priority := message.priority(); priority > 0 {
+		headers[amqp.PRIORITY_HEADER] = strconv.Itoa(priority)
+	}
+	return amqp.PublishWithHeaders(ctx, broker, queueName, message, headers)
+}
+
+// openEnvelope parses the envelope of msg and checks it holds a message of messageType.
+func openEnvelope(msg amqp.AmqpMessage, messageType MessageType) (Envelope, error) {
+	envelope, err := ParseEnvelope(amqp.MessageHeaders(msg))
+	if err != nil {
+		return envelope, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+	// legacy messages have no type
+	if envelope.Type != "" && envelope.Type != messageType {
+		return envelope, fmt.Errorf("%w: expected %s message, got %s", ErrMalformedMessage, messageType, envelope.Type)
+	}
+	return envelope, nil
+}
@@ -0,0 +1,133 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/amqp"
+)
+
+type testMessage struct {
+	payload []byte
+	headers map[string]string
+}
+
+func (m *testMessage) Ack(multiple bool) error                { return nil }
+func (m *testMessage) Nack(multiple bool, requeue bool) error { return nil }
+func (m *testMessage) Reject(requeue bool) error              { return nil }
+func (m *testMessage) Payload() []byte                        { return m.payload }
+func (m *testMessage) Headers() map[string]string             { return m.headers }
+
+func newTestMessage(t *testing.T, body any, headers map[string]string) *testMessage {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testMessage{payload: payload, headers: headers}
+}
+
+func TestPublishEnvelope(t *testing.T) {
+	uri := fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+	broker := &amqp.MemoryAmqp{}
+	if err := broker.Connect(context.TODO(), uri); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	broker.QueueDeclare("requests", "")
+
+	messages, err := broker.Messages(context.TODO(), "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request := ProcessRequest{ResourceUri: "mem://test/in", ResultUri: "mem://test/out", CorrelationId: uuid.New()}
+	request.Envelope.Extensions = map[string]string{"Tenant": "acme"}
+	if err := Publish(context.TODO(), broker, "requests", &request, "coordinator/test"); err != nil {
+		t.Fatalf("publish failed with error %s", err)
+	}
+
+	msg := <-messages
+	if strings.Contains(string(msg.Payload()), "AmqpMessage") || strings.Contains(string(msg.Payload()), "Envelope") {
+		t.Errorf("envelope is part of the body %s", msg.Payload())
+	}
+
+	decoded, err := DecodeProcessRequest(msg)
+	if err != nil {
+		t.Fatalf("decode failed with error %s", err)
+	}
+	envelope := decoded.Envelope
+	if envelope.Version != PROTOCOL_VERSION || envelope.Type != PROCESS_REQUEST || envelope.Producer != "coordinator/test" {
+		t.Errorf("wrong envelope %+v", envelope)
+	}
+	if envelope.SentAt.IsZero() || envelope.Extensions["Tenant"] != "acme" {
+		t.Errorf("wrong envelope %+v", envelope)
+	}
+	if decoded.AmqpMessage != msg || decoded.CorrelationId != request.CorrelationId {
+		t.Errorf("wrong request %+v", decoded)
+	}
+	if _, ok := amqp.MessageHeaders(msg)[amqp.PRIORITY_HEADER]; ok {
+		t.Errorf("request without priority published with %s", amqp.PRIORITY_HEADER)
+	}
+
+	request.Priority = 5
+	if err := Publish(context.TODO(), broker, "requests", request, "coordinator/test"); err != nil {
+		t.Fatalf("publish failed with error %s", err)
+	}
+	msg = <-messages
+	if priority := amqp.MessageHeaders(msg)[amqp.PRIORITY_HEADER]; priority != "5" {
+		t.Errorf("expected %s 5, got %q", amqp.PRIORITY_HEADER, priority)
+	}
+	if decoded, err := DecodeProcessRequest(msg); err != nil || decoded.Priority != 5 {
+		t.Errorf("wrong request %+v, error %v", decoded, err)
+	}
+}
+
+func TestDecodeVersions(t *testing.T) {
+	response := ProcessResponse{CorrelationId: uuid.New(), Status: OK, ResultUri: "mem://test/out"}
+
+	tests := []struct {
+		headers map[string]string
+		err     error
+	}{
+		// legacy messages have no envelope
+		{headers: nil},
+		{headers: map[string]string{VERSION_HEADER: "1.0", TYPE_HEADER: "process_response"}},
+		{headers: map[string]string{VERSION_HEADER: "1.7", TYPE_HEADER: "process_response", "Lightbyte-Ext-Unknown": "ignored"}},
+		{headers: map[string]string{VERSION_HEADER: "2.0", TYPE_HEADER: "process_response"}, err: ErrUnsupportedVersion},
+		{headers: map[string]string{VERSION_HEADER: "one", TYPE_HEADER: "process_response"}, err: ErrUnsupportedVersion},
+		{headers: map[string]string{VERSION_HEADER: "1.0"}, err: ErrMalformedMessage},
+		{headers: map[string]string{VERSION_HEADER: "1.0", TYPE_HEADER: "process_request"}, err: ErrMalformedMessage},
+		{headers: map[string]string{VERSION_HEADER: "1.0", TYPE_HEADER: "process_response", SENT_AT_HEADER: "yesterday"}, err: ErrMalformedMessage},
+	}
+
+	for _, test := range tests {
+		_, err := DecodeProcessResponse(newTestMessage(t, response, test.headers))
+		if test.err == nil && err != nil {
+			t.Errorf("headers %v failed with error %s", test.headers, err)
+		}
+		if test.err != nil && (!errors.Is(err, test.err) || !errors.Is(err, ErrMalformedMessage)) {
+			t.Errorf("headers %v: expected error %s, got %v", test.headers, test.err, err)
+		}
+	}
+}
+
+func TestDecodeHeartbeat(t *testing.T) {
+	heartbeat := Heartbeat{StepId: uuid.New(), InstanceId: "worker-1", SentAt: time.Now().UTC()}
+	envelope := Envelope{Version: PROTOCOL_VERSION, Type: HEARTBEAT, Producer: "worker-1"}
+
+	decoded, err := DecodeHeartbeat(newTestMessage(t, heartbeat, envelope.Headers()))
+	if err != nil || decoded.InstanceId != "worker-1" || decoded.Envelope.Producer != "worker-1" {
+		t.Errorf("wrong heartbeat %+v %v", decoded, err)
+	}
+
+	envelope.Type = PROCESS_RESPONSE
+	if _, err := DecodeHeartbeat(newTestMessage(t, heartbeat, envelope.Headers())); !errors.Is(err, ErrMalformedMessage) {
+		t.Errorf("expected malformed message error, got %v", err)
+	}
+}
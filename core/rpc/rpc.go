@@ -1,10 +1,19 @@
 package rpc
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
 	"github.com/google/uuid"
 	"starbyte.io/core/amqp"
+	s3io "starbyte.io/core/s3"
 )
 
+// ErrMalformedMessage is returned for messages which can not be processed, they are dead-lettered.
+var ErrMalformedMessage = errors.New("malformed message")
+
 type ProcessResult string
 
 const (
@@ -14,17 +23,99 @@ const (
 )
 
 type ProcessRequest struct {
-	amqp.AmqpMessage
+	// the delivery and envelope of a decoded message, they are not part of the body
+	amqp.AmqpMessage `json:"-"`
+	Envelope         Envelope `json:"-"`
+
 	ResourceUri   string
 	ResultUri     string
 	Termination   bool
 	CorrelationId uuid.UUID
+	Compression   string            `json:",omitempty"`
+	Format        string            `json:",omitempty"`
+	Schema        map[string]string `json:",omitempty"`
+	// Priority orders the requests queued for a step, from 0 to amqp.MAX_PRIORITY
+	Priority int `json:",omitempty"`
 }
 
 type ProcessResponse struct {
-	amqp.AmqpMessage
-	CorrelationId uuid.UUID
-	Status        ProcessResult
-	ResultUri     string
-	Error         string
+	amqp.AmqpMessage `json:"-"`
+	Envelope         Envelope `json:"-"`
+
+	CorrelationId      uuid.UUID
+	Status             ProcessResult
+	ResultUri          string
+	Error              string
+	SkippedRecords     int            `json:",omitempty"`
+	QuarantinedRecords int            `json:",omitempty"`
+	QuarantineUri      string         `json:",omitempty"`
+	Manifest           *s3io.Manifest `json:",omitempty"`
+}
+
+type Heartbeat struct {
+	Envelope Envelope `json:"-"`
+
+	StepId        uuid.UUID
+	InstanceId    string
+	Version       string
+	CorrelationId *uuid.UUID `json:",omitempty"`
+	SentAt        time.Time
+}
+
+// DecodeProcessRequest decodes msg, it fails with ErrMalformedMessage when the request can not be processed,
+// including requests of another major protocol version.
+func DecodeProcessRequest(msg amqp.AmqpMessage) (ProcessRequest, error) {
+	request := ProcessRequest{AmqpMessage: msg}
+	envelope, err := openEnvelope(msg, PROCESS_REQUEST)
+	if err != nil {
+		return request, err
+	}
+	if err := json.Unmarshal(msg.Payload(), &request); err != nil {
+		return request, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+	if request.CorrelationId == uuid.Nil {
+		return request, fmt.Errorf("%w: missing correlation id", ErrMalformedMessage)
+	}
+	if request.ResultUri == "" && !request.Termination {
+		return request, fmt.Errorf("%w: missing result uri", ErrMalformedMessage)
+	}
+	request.Envelope = envelope
+	return request, nil
+}
+
+// DecodeProcessResponse decodes msg, it fails with ErrMalformedMessage when the response can not be processed,
+// including responses of another major protocol version.
+func DecodeProcessResponse(msg amqp.AmqpMessage) (ProcessResponse, error) {
+	response := ProcessResponse{AmqpMessage: msg}
+	envelope, err := openEnvelope(msg, PROCESS_RESPONSE)
+	if err != nil {
+		return response, err
+	}
+	if err := json.Unmarshal(msg.Payload(), &response); err != nil {
+		return response, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+	if response.CorrelationId == uuid.Nil {
+		return response, fmt.Errorf("%w: missing correlation id", ErrMalformedMessage)
+	}
+	switch response.Status {
+	case OK, ERROR, ALLDONE:
+	default:
+		return response, fmt.Errorf("%w: unknown status %q", ErrMalformedMessage, response.Status)
+	}
+	response.Envelope = envelope
+	return response, nil
+}
+
+// DecodeHeartbeat decodes msg, it fails with ErrMalformedMessage when the heartbeat can not be processed.
+func DecodeHeartbeat(msg amqp.AmqpMessage) (Heartbeat, error) {
+	var heartbeat Heartbeat
+	envelope, err := openEnvelope(msg, HEARTBEAT)
+	if err != nil {
+		return heartbeat, err
+	}
+	if err := json.Unmarshal(msg.Payload(), &heartbeat); err != nil {
+		return heartbeat, fmt.Errorf("%w: %w", ErrMalformedMessage, err)
+	}
+	heartbeat.Envelope = envelope
+	return heartbeat, nil
 }
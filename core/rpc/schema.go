@@ -0,0 +1,23 @@
+package rpc
+
+import (
+	"embed"
+	"fmt"
+)
+
+// Schemas holds the JSON Schemas of the protocol, so workers in other languages can implement it:
+// envelope.schema.json for the envelope headers and <message type>.schema.json for message bodies.
+//
+//go:embed schema/*.schema.json
+var Schemas embed.FS
+
+const ENVELOPE_SCHEMA = "schema/envelope.schema.json"
+
+// BodySchema returns the JSON Schema of the body of messageType messages.
+func BodySchema(messageType MessageType) ([]byte, error) {
+	schema, err := Schemas.ReadFile(fmt.Sprintf("schema/%s.schema.json", messageType))
+	if err != nil {
+		return nil, fmt.Errorf("no schema for %q messages: %w", messageType, err)
+	}
+	return schema, nil
+}
@@ -0,0 +1,123 @@
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	s3io "starbyte.io/core/s3"
+)
+
+func compileSchema(t *testing.T, name string, schema []byte) *jsonschema.Schema {
+	t.Helper()
+
+	compiler := jsonschema.NewCompiler()
+	compiler.AssertFormat = true
+	if err := compiler.AddResource(name, bytes.NewReader(schema)); err != nil {
+		t.Fatal(err)
+	}
+	compiled, err := compiler.Compile(name)
+	if err != nil {
+		t.Fatalf("schema %s does not compile: %s", name, err)
+	}
+	return compiled
+}
+
+// validate checks message, marshalled like it is published, against schema.
+func validate(schema *jsonschema.Schema, message any) error {
+	body, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	var decoded any
+	if err := json.Unmarshal(body, &decoded); err != nil {
+		return err
+	}
+	return schema.Validate(decoded)
+}
+
+func TestBodySchemas(t *testing.T) {
+	correlationId := uuid.New()
+	tests := []struct {
+		messageType MessageType
+		valid       []any
+		invalid     []any
+	}{
+		{
+			messageType: PROCESS_REQUEST,
+			valid: []any{
+				ProcessRequest{ResourceUri: "s3://bucket/in", ResultUri: "s3://bucket/out", CorrelationId: correlationId, Compression: "zstd:3", Format: "parquet", Schema: map[string]string{"id": "int"}},
+				ProcessRequest{Termination: true, CorrelationId: correlationId},
+				ProcessRequest{ResultUri: "s3://bucket/out", CorrelationId: correlationId, Priority: 5},
+			},
+			invalid: []any{
+				ProcessRequest{ResourceUri: "s3://bucket/in", CorrelationId: correlationId},
+				ProcessRequest{ResultUri: "s3://bucket/out", CorrelationId: correlationId, Priority: 10},
+				map[string]any{"ResourceUri": "", "ResultUri": "s3://bucket/out", "Termination": false, "CorrelationId": "not a uuid"},
+			},
+		},
+		{
+			messageType: PROCESS_RESPONSE,
+			valid: []any{
+				ProcessResponse{CorrelationId: correlationId, Status: OK, ResultUri: "s3://bucket/out", SkippedRecords: 1, Manifest: &s3io.Manifest{Records: 3, Codec: s3io.GZIP}},
+				ProcessResponse{CorrelationId: correlationId, Status: ALLDONE},
+			},
+			invalid: []any{
+				ProcessResponse{CorrelationId: correlationId, Status: "DONE"},
+			},
+		},
+		{
+			messageType: HEARTBEAT,
+			valid: []any{
+				Heartbeat{StepId: uuid.New(), InstanceId: "worker-1", CorrelationId: &correlationId, SentAt: time.Now().UTC()},
+			},
+			invalid: []any{
+				map[string]any{"StepId": uuid.New(), "InstanceId": "worker-1", "Version": "", "SentAt": "yesterday"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		raw, err := BodySchema(test.messageType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema := compileSchema(t, string(test.messageType)+".schema.json", raw)
+
+		for _, message := range test.valid {
+			if err := validate(schema, message); err != nil {
+				t.Errorf("%s %+v is not valid: %s", test.messageType, message, err)
+			}
+		}
+		for _, message := range test.invalid {
+			if err := validate(schema, message); err == nil {
+				t.Errorf("%s %+v is valid", test.messageType, message)
+			}
+		}
+	}
+}
+
+func TestEnvelopeSchema(t *testing.T) {
+	raw, err := Schemas.ReadFile(ENVELOPE_SCHEMA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := compileSchema(t, "envelope.schema.json", raw)
+
+	envelope := Envelope{Version: PROTOCOL_VERSION, Type: PROCESS_RESPONSE, SentAt: time.Now(), Producer: "worker-1", Extensions: map[string]string{"Tenant": "acme"}}
+	if err := validate(schema, envelope.Headers()); err != nil {
+		t.Errorf("envelope headers are not valid: %s", err)
+	}
+
+	envelope.Version = "2.0"
+	if err := validate(schema, envelope.Headers()); err == nil {
+		t.Errorf("envelope headers of another major version are valid")
+	}
+
+	if _, err := BodySchema("unknown"); err == nil {
+		t.Errorf("expected error for unknown message type")
+	}
+}
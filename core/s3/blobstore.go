@@ -0,0 +1,137 @@
+package s3io
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotFound          = errors.New("blob not found")
+	ErrUnsupportedScheme = errors.New("unsupported blob uri scheme")
+)
+
+type BlobStore interface {
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	Put(ctx context.Context, key string, reader io.Reader) error
+	Delete(ctx context.Context, key string) error
+}
+
+// MetadataPutter is implemented by stores keeping user metadata with their objects.
+type MetadataPutter interface {
+	PutWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error
+}
+
+// Opener resolves a blob uri into the store holding it and the object key inside that store.
+type Opener func(uri *url.URL) (BlobStore, string, error)
+
+var (
+	openersMu sync.RWMutex
+	openers   = map[string]Opener{}
+)
+
+func init() {
+	Register("s3", openS3)
+	Register("file", openFile)
+	Register("mem", openMem)
+}
+
+// Register makes a blob store available for uris with the given scheme.
+func Register(scheme string, opener Opener) {
+	openersMu.Lock()
+	defer openersMu.Unlock()
+
+	openers[strings.ToLower(scheme)] = opener
+}
+
+func Open(uri string) (BlobStore, string, error) {
+	if UriRegexp.MatchString(uri) {
+		return openLegacyS3(uri)
+	}
+
+	parsed, err := url.Parse(uri)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid blob uri: %w", err)
+	}
+
+	openersMu.RLock()
+	opener, ok := openers[strings.ToLower(parsed.Scheme)]
+	openersMu.RUnlock()
+
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %q", ErrUnsupportedScheme, parsed.Scheme)
+	}
+
+	return opener(parsed)
+}
+
+func Read(ctx context.Context, uri string) (io.ReadCloser, error) {
+	store, key, err := Open(uri)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return decrypt(ctx, reader)
+}
+
+// Write stores the blob, encrypted when a key provider is configured. The key id is
+// kept in the object metadata by stores supporting it.
+func Write(ctx context.Context, uri string, reader io.Reader) error {
+	store, key, err := Open(uri)
+	if err != nil {
+		return err
+	}
+
+	provider := keyProvider()
+	if provider == nil {
+		return store.Put(ctx, key, reader)
+	}
+
+	encrypted, keyId, err := encrypt(ctx, reader, provider)
+	if err != nil {
+		return err
+	}
+
+	if metadataStore, ok := store.(MetadataPutter); ok {
+		err = metadataStore.PutWithMetadata(ctx, key, encrypted, map[string]string{KEY_ID_METADATA: keyId})
+	} else {
+		err = store.Put(ctx, key, encrypted)
+	}
+	// a store failing before it read the whole blob leaves the encryption blocked on the pipe otherwise
+	encrypted.CloseWithError(err)
+	return err
+}
+
+func Delete(ctx context.Context, uri string) error {
+	store, key, err := Open(uri)
+	if err != nil {
+		return err
+	}
+	return store.Delete(ctx, key)
+}
+
+// JoinUri appends name to the base blob uri path, e.g. s3://data?profile=p + batch.cbor -> s3://data/batch.cbor?profile=p.
+func JoinUri(base string, name string) string {
+	path, query, hasQuery := strings.Cut(base, "?")
+	uri := strings.TrimRight(path, "/") + "/" + strings.TrimLeft(name, "/")
+	if hasQuery {
+		uri += "?" + query
+	}
+	return uri
+}
+
+// WithSuffix appends suffix to the blob uri path, keeping the uri query in place.
+func WithSuffix(uri string, suffix string) string {
+	path, query, hasQuery := strings.Cut(uri, "?")
+	if hasQuery {
+		return path + suffix + "?" + query
+	}
+	return path + suffix
+}
@@ -1,7 +1,7 @@
 package s3io
 
 import (
-	"compress/gzip"
+	"bufio"
 	"errors"
 	"io"
 
@@ -9,14 +9,29 @@ import (
 )
 
 type CborReader struct {
-	reader     io.ReadCloser
-	decoder    *cbor.Decoder
-	gzipReader *gzip.Reader
+	reader       io.ReadCloser
+	decoder      *cbor.Decoder
+	codecReader  io.ReadCloser
+	compressed   *digest
+	uncompressed *countingReader
+	records      int64
 }
 
+// NewReader detects the batch codec from its magic header.
 func NewReader(reader io.ReadCloser) (*CborReader, error) {
-	gzipReader, err := gzip.NewReader(reader)
+	return NewCodecReader(reader, "")
+}
+
+// NewCodecReader reads a batch compressed with codec, an empty codec is detected from the stream.
+func NewCodecReader(reader io.ReadCloser, codec Codec) (*CborReader, error) {
+	compressed := newDigest()
+	buffered := bufio.NewReader(&digestReader{Reader: reader, digest: compressed})
+
+	if codec == "" {
+		codec = DetectCodec(buffered)
+	}
 
+	codecReader, err := newCodecReader(codec, buffered)
 	if err != nil {
 		return nil, err
 	}
@@ -25,12 +40,15 @@ func NewReader(reader io.ReadCloser) (*CborReader, error) {
 		TimeTag: cbor.DecTagRequired,
 	}.DecMode()
 
-	decoder := opts.NewDecoder(gzipReader)
+	uncompressed := &countingReader{Reader: codecReader}
+	decoder := opts.NewDecoder(uncompressed)
 
 	return &CborReader{
-		reader:     reader,
-		decoder:    decoder,
-		gzipReader: gzipReader,
+		reader:       reader,
+		decoder:      decoder,
+		codecReader:  codecReader,
+		compressed:   compressed,
+		uncompressed: uncompressed,
 	}, nil
 }
 
@@ -44,9 +62,21 @@ func (reader *CborReader) Read() (any, error) {
 		return nil, err
 	}
 
+	reader.records++
 	return data, err
 }
 
+// Verify compares the batch read so far with the expected manifest.
+// It should be called after Read returned io.EOF.
+func (reader *CborReader) Verify(expected Manifest) error {
+	return expected.Verify(Manifest{
+		Records:          reader.records,
+		UncompressedSize: reader.uncompressed.size,
+		CompressedSize:   reader.compressed.size,
+		Sha256:           reader.compressed.sum(),
+	})
+}
+
 func (reader *CborReader) Close() error {
-	return reader.gzipReader.Close()
+	return errors.Join(reader.codecReader.Close(), reader.reader.Close())
 }
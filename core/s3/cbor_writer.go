@@ -1,36 +1,77 @@
 package s3io
 
 import (
-	"compress/gzip"
 	"io"
 
 	"github.com/fxamacker/cbor/v2"
 )
 
 type CborWriter struct {
-	writer     io.WriteCloser
-	encoder    *cbor.Encoder
-	gzipWriter *gzip.Writer
+	writer       io.WriteCloser
+	encoder      *cbor.Encoder
+	codecWriter  io.WriteCloser
+	compression  Compression
+	compressed   *digest
+	uncompressed *digest
+	records      int64
+	schema       map[string]string
 }
 
 func NewWriter(writer io.WriteCloser) (*CborWriter, error) {
+	return NewCompressedWriter(writer, DefaultCompression)
+}
+
+func NewCompressedWriter(writer io.WriteCloser, compression Compression) (*CborWriter, error) {
 	opts := cbor.CoreDetEncOptions()
 	opts.Time = cbor.TimeRFC3339Nano
 	em, _ := opts.EncMode()
 
-	gzipWriter := gzip.NewWriter(writer)
-	encoder := em.NewEncoder(gzipWriter)
+	compressed := newDigest()
+	uncompressed := newDigest()
+
+	codecWriter, err := compression.newWriter(&digestWriter{Writer: writer, digest: compressed})
+	if err != nil {
+		return nil, err
+	}
+
+	encoder := em.NewEncoder(&digestWriter{Writer: codecWriter, digest: uncompressed})
 	return &CborWriter{
-		writer:     writer,
-		encoder:    encoder,
-		gzipWriter: gzipWriter,
+		writer:       writer,
+		encoder:      encoder,
+		codecWriter:  codecWriter,
+		compression:  compression,
+		compressed:   compressed,
+		uncompressed: uncompressed,
+		schema:       map[string]string{},
 	}, nil
 }
 
 func (writer *CborWriter) Write(data any) error {
-	return writer.encoder.Encode(data)
+	if err := writer.encoder.Encode(data); err != nil {
+		return err
+	}
+
+	writer.records++
+	mergeSchema(writer.schema, data)
+	return nil
 }
 
 func (writer *CborWriter) Close() error {
-	return writer.gzipWriter.Close()
+	return writer.codecWriter.Close()
+}
+
+// Manifest describes the written batch, it is complete only after Close.
+func (writer *CborWriter) Manifest() Manifest {
+	manifest := Manifest{
+		Records:          writer.records,
+		UncompressedSize: writer.uncompressed.size,
+		CompressedSize:   writer.compressed.size,
+		Sha256:           writer.compressed.sum(),
+		Codec:            writer.compression.Codec,
+		Format:           CBOR,
+	}
+	if len(writer.schema) > 0 {
+		manifest.Schema = writer.schema
+	}
+	return manifest
 }
@@ -0,0 +1,169 @@
+package s3io
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+type TransportConfig struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	DialTimeout           time.Duration
+	KeepAlive             time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+func DefaultTransportConfig() TransportConfig {
+	return TransportConfig{
+		MaxIdleConns:          256,
+		MaxIdleConnsPerHost:   16,
+		MaxConnsPerHost:       0,
+		IdleConnTimeout:       90 * time.Second,
+		DialTimeout:           30 * time.Second,
+		KeepAlive:             30 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: 60 * time.Second,
+	}
+}
+
+func newTransport(config TransportConfig) *http.Transport {
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: config.KeepAlive,
+		}).DialContext,
+		MaxIdleConns:          config.MaxIdleConns,
+		MaxIdleConnsPerHost:   config.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       config.MaxConnsPerHost,
+		IdleConnTimeout:       config.IdleConnTimeout,
+		TLSHandshakeTimeout:   config.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: config.ResponseHeaderTimeout,
+		ExpectContinueTimeout: 1 * time.Second,
+		// objects are compressed already, and transparent gzip breaks content length checks
+		DisableCompression: true,
+		TLSClientConfig:    &tls.Config{MinVersion: tls.VersionTLS12},
+	}
+}
+
+type clientKey struct {
+	endpoint string
+	useSSL   bool
+	identity string
+}
+
+// clientCache shares minio clients, and a single pooled http transport,
+// between all reads and writes of the process.
+type clientCache struct {
+	mu        sync.Mutex
+	transport *http.Transport
+	clients   map[clientKey]*minio.Client
+	profiles  map[string]*s3Profile
+
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+type ClientCacheStats struct {
+	Hits    uint64
+	Misses  uint64
+	Clients int
+}
+
+var clients = newClientCache(DefaultTransportConfig())
+
+func newClientCache(config TransportConfig) *clientCache {
+	return &clientCache{
+		transport: newTransport(config),
+		clients:   map[clientKey]*minio.Client{},
+		profiles:  map[string]*s3Profile{},
+	}
+}
+
+// ConfigureTransport replaces the http transport used by s3 clients.
+// Cached clients and resolved profiles are dropped.
+func ConfigureTransport(config TransportConfig) {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	clients.transport.CloseIdleConnections()
+	clients.transport = newTransport(config)
+	clients.clients = map[clientKey]*minio.Client{}
+	clients.profiles = map[string]*s3Profile{}
+}
+
+func ClientCacheStatistics() ClientCacheStats {
+	clients.mu.Lock()
+	defer clients.mu.Unlock()
+
+	return ClientCacheStats{
+		Hits:    clients.hits.Load(),
+		Misses:  clients.misses.Load(),
+		Clients: len(clients.clients),
+	}
+}
+
+func staticIdentity(accessKey string, secretKey string) string {
+	hash := sha256.Sum256([]byte(secretKey))
+	return "static:" + accessKey + ":" + hex.EncodeToString(hash[:])
+}
+
+func profileIdentity(profile *s3Profile) string {
+	if profile.explicit {
+		return "profile:" + profile.name
+	}
+	return "chain:" + profile.name
+}
+
+func (cache *clientCache) client(key clientKey, config s3ClientConfig) (*minio.Client, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if client, ok := cache.clients[key]; ok {
+		cache.hits.Add(1)
+		return client, nil
+	}
+
+	cache.misses.Add(1)
+	client, err := minio.New(config.Endpoint, &minio.Options{
+		Creds:     config.Creds,
+		Secure:    config.UseSSL,
+		Transport: cache.transport,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	cache.clients[key] = client
+	return client, nil
+}
+
+// profile resolves the profile named in a uri once and reuses it afterwards,
+// so its credentials provider is shared by every client built from it.
+func (cache *clientCache) profile(uriProfile string) (*s3Profile, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	if profile, ok := cache.profiles[uriProfile]; ok {
+		return profile, nil
+	}
+
+	profile, err := resolveProfile(uriProfile)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.profiles[uriProfile] = profile
+	return profile, nil
+}
@@ -0,0 +1,197 @@
+package s3io
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+type Codec string
+
+const (
+	NONE   Codec = "none"
+	GZIP   Codec = "gzip"
+	ZSTD   Codec = "zstd"
+	SNAPPY Codec = "snappy"
+	LZ4    Codec = "lz4"
+)
+
+const DEFAULT_COMPRESSION_LEVEL = -1
+
+var DefaultCompression = Compression{Codec: GZIP, Level: DEFAULT_COMPRESSION_LEVEL}
+
+var codecExtensions = map[Codec]string{
+	NONE:   "",
+	GZIP:   ".gz",
+	ZSTD:   ".zst",
+	SNAPPY: ".sz",
+	LZ4:    ".lz4",
+}
+
+var codecMagics = []struct {
+	codec Codec
+	magic []byte
+}{
+	{GZIP, []byte{0x1f, 0x8b}},
+	{ZSTD, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{LZ4, []byte{0x04, 0x22, 0x4d, 0x18}},
+	{SNAPPY, []byte("\xff\x06\x00\x00sNaPpY")},
+}
+
+// Compression is a codec with its level, written as codec[:level], e.g. zstd:3 or gzip:9.
+// Level -1 selects the codec default, snappy has no levels.
+type Compression struct {
+	Codec Codec
+	Level int
+}
+
+func ParseCompression(spec string) (Compression, error) {
+	if spec == "" {
+		return DefaultCompression, nil
+	}
+
+	name, levelSpec, hasLevel := strings.Cut(strings.ToLower(spec), ":")
+	compression := Compression{Codec: Codec(name), Level: DEFAULT_COMPRESSION_LEVEL}
+
+	if _, ok := codecExtensions[compression.Codec]; !ok {
+		return Compression{}, fmt.Errorf("unknown compression codec %q", name)
+	}
+
+	if hasLevel {
+		level, err := strconv.Atoi(levelSpec)
+		if err != nil {
+			return Compression{}, fmt.Errorf("invalid compression level %q", levelSpec)
+		}
+		compression.Level = level
+	}
+
+	return compression, compression.validate()
+}
+
+func (c Compression) validate() error {
+	if c.Level == DEFAULT_COMPRESSION_LEVEL {
+		return nil
+	}
+
+	min, max := 0, 0
+	switch c.Codec {
+	case GZIP:
+		min, max = gzip.HuffmanOnly, gzip.BestCompression
+	case ZSTD:
+		min, max = 1, 22
+	case LZ4:
+		min, max = 0, 9
+	}
+
+	if c.Level < min || c.Level > max {
+		return fmt.Errorf("%s compression level must be between %d and %d", c.Codec, min, max)
+	}
+	return nil
+}
+
+func (c Compression) String() string {
+	if c.Level == DEFAULT_COMPRESSION_LEVEL {
+		return string(c.Codec)
+	}
+	return fmt.Sprintf("%s:%d", c.Codec, c.Level)
+}
+
+func (c Compression) Extension() string {
+	return codecExtensions[c.Codec]
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+func (c Compression) newWriter(writer io.Writer) (io.WriteCloser, error) {
+	switch c.Codec {
+	case NONE:
+		return nopWriteCloser{writer}, nil
+	case GZIP:
+		if c.Level == DEFAULT_COMPRESSION_LEVEL {
+			return gzip.NewWriter(writer), nil
+		}
+		return gzip.NewWriterLevel(writer, c.Level)
+	case ZSTD:
+		level := zstd.SpeedDefault
+		if c.Level != DEFAULT_COMPRESSION_LEVEL {
+			level = zstdLevel(c.Level)
+		}
+		return zstd.NewWriter(writer, zstd.WithEncoderLevel(level))
+	case SNAPPY:
+		return s2.NewWriter(writer, s2.WriterSnappyCompat()), nil
+	case LZ4:
+		lz4Writer := lz4.NewWriter(writer)
+		if c.Level != DEFAULT_COMPRESSION_LEVEL {
+			if err := lz4Writer.Apply(lz4.CompressionLevelOption(lz4Level(c.Level))); err != nil {
+				return nil, err
+			}
+		}
+		return lz4Writer, nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", c.Codec)
+}
+
+func zstdLevel(level int) zstd.EncoderLevel {
+	return zstd.EncoderLevelFromZstd(level)
+}
+
+// lz4Level maps levels 0-9 to lz4 fast and HC compression levels.
+func lz4Level(level int) lz4.CompressionLevel {
+	if level == 0 {
+		return lz4.Fast
+	}
+	return lz4.CompressionLevel(1 << (8 + level))
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (reader zstdReadCloser) Close() error {
+	reader.Decoder.Close()
+	return nil
+}
+
+func newCodecReader(codec Codec, reader io.Reader) (io.ReadCloser, error) {
+	switch codec {
+	case NONE:
+		return io.NopCloser(reader), nil
+	case GZIP:
+		return gzip.NewReader(reader)
+	case ZSTD:
+		decoder, err := zstd.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{decoder}, nil
+	case SNAPPY:
+		return io.NopCloser(s2.NewReader(reader)), nil
+	case LZ4:
+		return io.NopCloser(lz4.NewReader(reader)), nil
+	}
+	return nil, fmt.Errorf("unknown compression codec %q", codec)
+}
+
+// DetectCodec sniffs the codec from the stream magic header. Streams without a known header
+// are treated as uncompressed cbor.
+func DetectCodec(reader *bufio.Reader) Codec {
+	for _, candidate := range codecMagics {
+		header, _ := reader.Peek(len(candidate.magic))
+		if bytes.Equal(header, candidate.magic) {
+			return candidate.codec
+		}
+	}
+	return NONE
+}
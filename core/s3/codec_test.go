@@ -0,0 +1,137 @@
+package s3io
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+var testCompressions = []string{"none", "gzip", "gzip:1", "gzip:9", "zstd", "zstd:1", "zstd:19", "snappy", "lz4", "lz4:9"}
+
+// tradeRecords builds records shaped as the csv reader output of the japan trade statistics stub.
+func tradeRecords(count int) []any {
+	random := rand.New(rand.NewSource(1))
+	countries := []string{"103", "105", "106", "108", "110", "112", "113", "116", "117", "118"}
+
+	records := make([]any, count)
+	for idx := range records {
+		records[idx] = map[string]any{
+			"column0": fmt.Sprintf("%d%02d", 1988+random.Intn(32), 1+random.Intn(12)),
+			"column1": fmt.Sprint(1 + random.Intn(2)),
+			"column2": fmt.Sprintf("%09d", random.Intn(999999999)),
+			"column3": fmt.Sprint(100 + random.Intn(900)),
+			"column4": countries[random.Intn(len(countries))],
+			"column5": fmt.Sprint(random.Intn(100000)),
+			"column6": fmt.Sprint(random.Intn(1000000)),
+			"column7": fmt.Sprint(random.Intn(100000000)),
+		}
+	}
+	return records
+}
+
+func writeCompressed(t testing.TB, compression Compression, records []any) ([]byte, Manifest) {
+	buffer := &bytes.Buffer{}
+	writer, err := NewCompressedWriter(nopWriteCloser{buffer}, compression)
+	if err != nil {
+		t.Fatalf("%s: failed with error %s", compression, err)
+	}
+
+	for _, record := range records {
+		writer.Write(record)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("%s: close failed with error %s", compression, err)
+	}
+	return buffer.Bytes(), writer.Manifest()
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	records := tradeRecords(100)
+
+	for _, spec := range testCompressions {
+		compression, err := ParseCompression(spec)
+		if err != nil {
+			t.Fatalf("%s: failed with error %s", spec, err)
+		}
+
+		content, manifest := writeCompressed(t, compression, records)
+		if manifest.Codec != compression.Codec {
+			t.Errorf("%s: wrong manifest codec %s", spec, manifest.Codec)
+		}
+
+		reader, err := NewReader(io.NopCloser(bytes.NewReader(content)))
+		if err != nil {
+			t.Fatalf("%s: read failed with error %s", spec, err)
+		}
+
+		count := 0
+		for {
+			if _, err := reader.Read(); err != nil {
+				if err != io.EOF {
+					t.Errorf("%s: read failed with error %s", spec, err)
+				}
+				break
+			}
+			count++
+		}
+
+		if count != len(records) {
+			t.Errorf("%s: %d records read", spec, count)
+		}
+		if err := reader.Verify(manifest); err != nil {
+			t.Errorf("%s: %s", spec, err)
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	if compression, _ := ParseCompression(""); compression != DefaultCompression {
+		t.Errorf("gzip is expected by default")
+	}
+
+	if compression, _ := ParseCompression("ZSTD:3"); compression.Codec != ZSTD || compression.Level != 3 || compression.String() != "zstd:3" {
+		t.Errorf("wrong compression %s", compression)
+	}
+
+	for _, spec := range []string{"brotli", "gzip:x", "gzip:10", "zstd:0", "lz4:10"} {
+		if _, err := ParseCompression(spec); err == nil {
+			t.Errorf("%s: error expected", spec)
+		}
+	}
+}
+
+// BenchmarkCodecs compares write and read throughput, reported per uncompressed byte,
+// and the compression ratio of csv derived batches.
+func BenchmarkCodecs(b *testing.B) {
+	records := tradeRecords(10000)
+
+	for _, spec := range testCompressions {
+		compression, _ := ParseCompression(spec)
+		content, manifest := writeCompressed(b, compression, records)
+		ratio := float64(manifest.UncompressedSize) / float64(manifest.CompressedSize)
+
+		b.Run("write/"+spec, func(b *testing.B) {
+			b.SetBytes(manifest.UncompressedSize)
+			b.ReportMetric(ratio, "ratio")
+			for i := 0; i < b.N; i++ {
+				writeCompressed(b, compression, records)
+			}
+		})
+
+		b.Run("read/"+spec, func(b *testing.B) {
+			b.SetBytes(manifest.UncompressedSize)
+			b.ReportMetric(ratio, "ratio")
+			for i := 0; i < b.N; i++ {
+				reader, _ := NewReader(io.NopCloser(bytes.NewReader(content)))
+				for {
+					if _, err := reader.Read(); err != nil {
+						break
+					}
+				}
+				reader.Close()
+			}
+		})
+	}
+}
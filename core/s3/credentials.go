@@ -0,0 +1,159 @@
+package s3io
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"gopkg.in/ini.v1"
+)
+
+const (
+	LIGHTBYTE_S3_PROFILE          = "LIGHTBYTE_S3_PROFILE"
+	LIGHTBYTE_S3_CREDENTIALS_FILE = "LIGHTBYTE_S3_CREDENTIALS_FILE"
+)
+
+const (
+	DEFAULT_S3_PROFILE = "default"
+	PROFILE_QUERY_KEY  = "profile"
+)
+
+// s3Profile is the resolved endpoint and credentials chain used to access s3:// uris.
+type s3Profile struct {
+	name     string
+	explicit bool
+	endpoint string
+	useSSL   bool
+	creds    *credentials.Credentials
+}
+
+func credentialsFile() string {
+	if filename := os.Getenv(LIGHTBYTE_S3_CREDENTIALS_FILE); filename != "" {
+		return filename
+	}
+	if filename := os.Getenv("AWS_SHARED_CREDENTIALS_FILE"); filename != "" {
+		return filename
+	}
+
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".aws", "credentials")
+}
+
+// profileSection returns the profile from the shared credentials file,
+// or nil when the file or the profile does not exist.
+func profileSection(filename string, name string) (*ini.Section, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	file, err := ini.Load(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read s3 credentials file %s: %w", filename, err)
+	}
+
+	section, err := file.GetSection(name)
+	if err != nil {
+		return nil, nil
+	}
+	return section, nil
+}
+
+func parseEndpoint(endpoint string) (string, bool) {
+	if parsed, err := url.Parse(endpoint); err == nil && parsed.Host != "" {
+		return parsed.Host, parsed.Scheme != "http"
+	}
+	return endpoint, true
+}
+
+// resolveProfile builds the s3 access settings for the named profile.
+// A profile named in the uri (s3://bucket/key?profile=name) must exist in the credentials file
+// and only its keys are used. Otherwise credentials are looked up in order:
+// AWS_* and MINIO_* environment variables, the LIGHTBYTE_S3_PROFILE (or AWS_PROFILE) section
+// of the credentials file, and the AWS default chain (web identity, ECS and EC2 instance roles).
+func resolveProfile(uriProfile string) (*s3Profile, error) {
+	name := uriProfile
+	if name == "" {
+		name = os.Getenv(LIGHTBYTE_S3_PROFILE)
+	}
+	if name == "" {
+		name = os.Getenv("AWS_PROFILE")
+	}
+	if name == "" {
+		name = DEFAULT_S3_PROFILE
+	}
+
+	filename := credentialsFile()
+	section, err := profileSection(filename, name)
+	if err != nil {
+		return nil, err
+	}
+	if section == nil && uriProfile != "" {
+		return nil, fmt.Errorf("s3 profile %q is not found in credentials file %q", name, filename)
+	}
+
+	profile := &s3Profile{name: name, explicit: uriProfile != "", endpoint: DEFAULT_S3_ENDPOINT, useSSL: true}
+
+	endpoint := ""
+	if section != nil {
+		endpoint = section.Key("endpoint_url").String()
+	}
+	if endpoint == "" {
+		endpoint = os.Getenv(LIGHTBYTE_S3_ENDPOINT)
+	}
+	if endpoint == "" {
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		profile.endpoint, profile.useSSL = parseEndpoint(endpoint)
+	}
+
+	if value := os.Getenv(LIGHTBYTE_S3_INSECURE); value != "" {
+		insecure, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be a boolean: %w", LIGHTBYTE_S3_INSECURE, err)
+		}
+		profile.useSSL = !insecure
+	}
+
+	fileProvider := &credentials.FileAWSCredentials{Filename: filename, Profile: name}
+	if uriProfile != "" {
+		profile.creds = credentials.New(fileProvider)
+		return profile, nil
+	}
+
+	profile.creds = credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		fileProvider,
+		&credentials.IAM{Client: &http.Client{Transport: http.DefaultTransport}},
+	})
+	return profile, nil
+}
+
+// RedactUri hides the secret key of legacy http(s)://access:secret@host/bucket/key uris
+// so they can be logged.
+func RedactUri(uri string) string {
+	matches := UriRegexp.FindStringSubmatchIndex(uri)
+	if matches == nil {
+		return uri
+	}
+
+	secret := UriRegexp.SubexpIndex("SecretKey")
+	return uri[:matches[2*secret]] + "***" + uri[matches[2*secret+1]:]
+}
+
+// HasInlineCredentials reports whether the uri carries credentials in the legacy format.
+func HasInlineCredentials(uri string) bool {
+	return UriRegexp.MatchString(uri)
+}
@@ -0,0 +1,408 @@
+package s3io
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// KEY_ID_METADATA is the object metadata entry naming the key encryption key of an encrypted blob.
+const KEY_ID_METADATA = "Lightbyte-Key-Id"
+
+const (
+	dataKeySize         = 32
+	encryptionChunkSize = 64 * 1024
+)
+
+// encryptionMagic starts encrypted blobs. 0xff is a cbor break code, so it never starts a plain batch.
+var encryptionMagic = []byte("\xffLBENC\x00\x01")
+
+var (
+	ErrUnknownKey      = errors.New("unknown key encryption key")
+	ErrNoKeyProvider   = errors.New("blob is encrypted but no key provider is configured")
+	ErrCorruptedCipher = errors.New("encrypted blob is corrupted")
+)
+
+// KeyProvider wraps per blob data keys with key encryption keys, it is implemented
+// by the local Keyring and can be implemented by KMS clients.
+type KeyProvider interface {
+	// WrapKey encrypts dataKey with the current key encryption key and returns its id.
+	WrapKey(ctx context.Context, dataKey []byte) (keyId string, wrapped []byte, err error)
+	UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error)
+}
+
+var (
+	keysMu sync.RWMutex
+	keys   KeyProvider
+)
+
+// ConfigureEncryption enables envelope encryption of written blobs with keys from provider,
+// nil disables it. Encrypted blobs are decrypted on read whatever the configuration is,
+// as long as a provider knowing their key is set.
+func ConfigureEncryption(provider KeyProvider) {
+	keysMu.Lock()
+	defer keysMu.Unlock()
+
+	keys = provider
+}
+
+func keyProvider() KeyProvider {
+	keysMu.RLock()
+	defer keysMu.RUnlock()
+
+	return keys
+}
+
+// Keyring is a local set of AES-256 key encryption keys. Its file is a json document:
+//
+//	{"active": "2024-01", "keys": {"2023-06": "<base64 key>", "2024-01": "<base64 key>"}}
+//
+// New blobs use the active key, older keys are kept to read blobs written before a rotation.
+type Keyring struct {
+	active string
+	keys   map[string]cipher.AEAD
+}
+
+type keyringFile struct {
+	Active string
+	Keys   map[string]string
+}
+
+func LoadKeyring(filename string) (*Keyring, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %w", err)
+	}
+
+	file := keyringFile{}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to decode keyring: %w", err)
+	}
+
+	keys := make(map[string][]byte, len(file.Keys))
+	for keyId, encoded := range file.Keys {
+		if keys[keyId], err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			return nil, fmt.Errorf("keyring key %s: %w", keyId, err)
+		}
+	}
+
+	return NewKeyring(file.Active, keys)
+}
+
+func NewKeyring(active string, keys map[string][]byte) (*Keyring, error) {
+	keyring := &Keyring{active: active, keys: make(map[string]cipher.AEAD, len(keys))}
+
+	for keyId, key := range keys {
+		if len(key) != dataKeySize {
+			return nil, fmt.Errorf("keyring key %s must be %d bytes long", keyId, dataKeySize)
+		}
+
+		aead, err := newAead(key)
+		if err != nil {
+			return nil, err
+		}
+		keyring.keys[keyId] = aead
+	}
+
+	if _, ok := keyring.keys[active]; !ok {
+		return nil, fmt.Errorf("keyring active key %q is not defined", active)
+	}
+	return keyring, nil
+}
+
+func (keyring *Keyring) WrapKey(ctx context.Context, dataKey []byte) (string, []byte, error) {
+	aead := keyring.keys[keyring.active]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	return keyring.active, aead.Seal(nonce, nonce, dataKey, []byte(keyring.active)), nil
+}
+
+func (keyring *Keyring) UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error) {
+	aead, ok := keyring.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, keyId)
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrCorruptedCipher
+	}
+
+	nonce, sealed := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	dataKey, err := aead.Open(nil, nonce, sealed, []byte(keyId))
+	if err != nil {
+		return nil, fmt.Errorf("%w: data key: %s", ErrCorruptedCipher, err)
+	}
+	return dataKey, nil
+}
+
+func newAead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypted blobs are a header followed by AES-GCM sealed chunks:
+//
+//	magic | key id length uint16 | key id | wrapped key length uint16 | wrapped key | chunks...
+//
+// Every chunk holds encryptionChunkSize bytes except the last one. Chunk nonces are the chunk
+// sequence number with a final chunk flag, so reordered or truncated blobs fail to decrypt.
+// The header is authenticated as additional data of every chunk.
+func encryptionHeader(keyId string, wrapped []byte) []byte {
+	header := bytes.NewBuffer(append([]byte{}, encryptionMagic...))
+	binary.Write(header, binary.BigEndian, uint16(len(keyId)))
+	header.WriteString(keyId)
+	binary.Write(header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+	return header.Bytes()
+}
+
+func chunkNonce(aead cipher.AEAD, sequence uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-9:], sequence)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+type encryptWriter struct {
+	writer   io.Writer
+	aead     cipher.AEAD
+	header   []byte
+	chunk    []byte
+	sequence uint64
+}
+
+// newEncryptWriter seals data written to it with a fresh data key wrapped by provider.
+// The header is written with the first chunk. Close must be called to write the final chunk,
+// it does not close writer.
+func newEncryptWriter(ctx context.Context, writer io.Writer, provider KeyProvider) (*encryptWriter, string, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, "", err
+	}
+
+	keyId, wrapped, err := provider.WrapKey(ctx, dataKey)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	if len(keyId) > 0xffff || len(wrapped) > 0xffff {
+		return nil, "", fmt.Errorf("wrapped data key of %s is too long", keyId)
+	}
+
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return &encryptWriter{
+		writer: writer,
+		aead:   aead,
+		header: encryptionHeader(keyId, wrapped),
+		chunk:  make([]byte, 0, encryptionChunkSize),
+	}, keyId, nil
+}
+
+func (w *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// a full chunk is sealed only once more data arrives, the last chunk is sealed by Close
+		if len(w.chunk) == encryptionChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.chunk[len(w.chunk):encryptionChunkSize], p)
+		w.chunk = w.chunk[:len(w.chunk)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (w *encryptWriter) seal(final bool) error {
+	if w.sequence == 0 {
+		if _, err := w.writer.Write(w.header); err != nil {
+			return err
+		}
+	}
+
+	sealed := w.aead.Seal(nil, chunkNonce(w.aead, w.sequence, final), w.chunk, w.header)
+	w.sequence++
+	w.chunk = w.chunk[:0]
+
+	_, err := w.writer.Write(sealed)
+	return err
+}
+
+func (w *encryptWriter) Close() error {
+	return w.seal(true)
+}
+
+type decryptReader struct {
+	reader   *bufio.Reader
+	closer   io.Closer
+	aead     cipher.AEAD
+	header   []byte
+	sealed   []byte
+	plain    []byte
+	sequence uint64
+	done     bool
+}
+
+func readHeaderField(reader *bufio.Reader, header *bytes.Buffer) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+
+	field := make([]byte, length)
+	if _, err := io.ReadFull(reader, field); err != nil {
+		return nil, err
+	}
+
+	binary.Write(header, binary.BigEndian, length)
+	header.Write(field)
+	return field, nil
+}
+
+func newDecryptReader(ctx context.Context, reader *bufio.Reader, closer io.Closer, provider KeyProvider) (*decryptReader, error) {
+	if provider == nil {
+		return nil, ErrNoKeyProvider
+	}
+
+	header := bytes.NewBuffer(nil)
+	magic := make([]byte, len(encryptionMagic))
+	if _, err := io.ReadFull(reader, magic); err != nil {
+		return nil, err
+	}
+	header.Write(magic)
+
+	keyId, err := readHeaderField(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptedCipher, err)
+	}
+	wrapped, err := readHeaderField(reader, header)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrCorruptedCipher, err)
+	}
+
+	dataKey, err := provider.UnwrapKey(ctx, string(keyId), wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAead(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		reader: reader,
+		closer: closer,
+		aead:   aead,
+		header: header.Bytes(),
+		sealed: make([]byte, encryptionChunkSize+aead.Overhead()),
+	}, nil
+}
+
+func (r *decryptReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+func (r *decryptReader) open() error {
+	n, err := io.ReadFull(r.reader, r.sealed)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return fmt.Errorf("%w: missing final chunk", ErrCorruptedCipher)
+		}
+		return err
+	}
+
+	final := n < len(r.sealed)
+	if !final {
+		_, err := r.reader.Peek(1)
+		final = errors.Is(err, io.EOF)
+	}
+
+	r.plain, err = r.aead.Open(r.sealed[:0], chunkNonce(r.aead, r.sequence, final), r.sealed[:n], r.header)
+	if err != nil {
+		return fmt.Errorf("%w: chunk %d", ErrCorruptedCipher, r.sequence)
+	}
+
+	r.sequence++
+	r.done = final
+	return nil
+}
+
+func (r *decryptReader) Close() error {
+	return r.closer.Close()
+}
+
+// encrypt seals reader content with a new data key of the configured provider.
+// The key id is returned so it can be stored in the object metadata. The caller closes the
+// returned reader, which stops the encryption when the content was not read to its end.
+func encrypt(ctx context.Context, reader io.Reader, provider KeyProvider) (*io.PipeReader, string, error) {
+	out, in := io.Pipe()
+
+	writer, keyId, err := newEncryptWriter(ctx, in, provider)
+	if err != nil {
+		return nil, "", err
+	}
+
+	go func() {
+		_, err := io.Copy(writer, reader)
+		if err == nil {
+			err = writer.Close()
+		}
+		in.CloseWithError(err)
+	}()
+
+	return out, keyId, nil
+}
+
+// decrypt transparently opens encrypted blobs, other blobs are returned as they are.
+func decrypt(ctx context.Context, reader io.ReadCloser) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+	header, _ := buffered.Peek(len(encryptionMagic))
+	if !bytes.Equal(header, encryptionMagic) {
+		return bufferedReadCloser{Reader: buffered, Closer: reader}, nil
+	}
+
+	decrypted, err := newDecryptReader(ctx, buffered, reader, keyProvider())
+	if err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return decrypted, nil
+}
@@ -0,0 +1,225 @@
+package s3io
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testKey(seed byte) []byte {
+	return bytes.Repeat([]byte{seed}, dataKeySize)
+}
+
+func testKeyring(t *testing.T, active string, keyIds ...string) *Keyring {
+	keys := map[string][]byte{}
+	for idx, keyId := range keyIds {
+		keys[keyId] = testKey(byte(idx + 1))
+	}
+
+	keyring, err := NewKeyring(active, keys)
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	return keyring
+}
+
+func useKeys(t *testing.T, provider KeyProvider) {
+	ConfigureEncryption(provider)
+	t.Cleanup(func() { ConfigureEncryption(nil) })
+}
+
+func readAll(t *testing.T, uri string) ([]byte, error) {
+	reader, err := Read(context.TODO(), uri)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	useKeys(t, testKeyring(t, "k1", "k1"))
+
+	for _, size := range []int{0, 1, encryptionChunkSize - 1, encryptionChunkSize, 3*encryptionChunkSize + 7} {
+		uri := fmt.Sprintf("mem://encryption/%d", size)
+		content := bytes.Repeat([]byte("0123456789"), size/10+1)[:size]
+
+		if err := Write(context.TODO(), uri, bytes.NewReader(content)); err != nil {
+			t.Fatalf("%d: write failed with error %s", size, err)
+		}
+
+		store, _ := memStores.Load("encryption")
+		stored := store.(*memStore).objects[fmt.Sprint(size)]
+		// shorter plaintexts occur in random ciphertext by chance
+		if !bytes.HasPrefix(stored, encryptionMagic) || (size >= 16 && bytes.Contains(stored, content)) {
+			t.Errorf("%d: blob is not encrypted", size)
+		}
+		if keyId := store.(*memStore).metadata[fmt.Sprint(size)][KEY_ID_METADATA]; keyId != "k1" {
+			t.Errorf("%d: wrong key id metadata %q", size, keyId)
+		}
+
+		actual, err := readAll(t, uri)
+		if err != nil {
+			t.Fatalf("%d: read failed with error %s", size, err)
+		}
+		if !bytes.Equal(actual, content) {
+			t.Errorf("%d: content differs after round trip", size)
+		}
+	}
+}
+
+func TestEncryptionKeyRotation(t *testing.T) {
+	uri := "mem://encryption/rotation"
+	useKeys(t, testKeyring(t, "k1", "k1"))
+	if err := Write(context.TODO(), uri, bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+
+	useKeys(t, testKeyring(t, "k2", "k1", "k2"))
+	if actual, err := readAll(t, uri); err != nil || string(actual) != "data" {
+		t.Errorf("rotated keyring read failed: %q %v", actual, err)
+	}
+
+	useKeys(t, testKeyring(t, "k1", "k3", "k1"))
+	if _, err := readAll(t, uri); !errors.Is(err, ErrCorruptedCipher) {
+		t.Errorf("expected corrupted data key error, got %v", err)
+	}
+
+	useKeys(t, testKeyring(t, "k2", "k2"))
+	if _, err := readAll(t, uri); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected unknown key error, got %v", err)
+	}
+
+	ConfigureEncryption(nil)
+	if _, err := readAll(t, uri); !errors.Is(err, ErrNoKeyProvider) {
+		t.Errorf("expected no key provider error, got %v", err)
+	}
+}
+
+func TestEncryptionTampering(t *testing.T) {
+	useKeys(t, testKeyring(t, "k1", "k1"))
+
+	content := bytes.Repeat([]byte("x"), 2*encryptionChunkSize+10)
+	if err := Write(context.TODO(), "mem://tampering/blob", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+
+	store, _ := memStores.Load("tampering")
+	stored := store.(*memStore).objects["blob"]
+
+	chunk := encryptionChunkSize + 16
+	final := len(stored) - 10 - 16
+	header, first, second, last := stored[:final-2*chunk], stored[final-2*chunk:final-chunk], stored[final-chunk:final], stored[final:]
+
+	flipped := bytes.Clone(stored)
+	flipped[len(flipped)-1] ^= 1
+
+	cases := map[string][]byte{
+		"flipped byte":        flipped,
+		"dropped final chunk": stored[:final],
+		"truncated chunk":     stored[:final-100],
+		"reordered chunks":    bytes.Join([][]byte{header, second, first, last}, nil),
+	}
+
+	for name, tampered := range cases {
+		store.(*memStore).objects["blob"] = tampered
+		if _, err := readAll(t, "mem://tampering/blob"); !errors.Is(err, ErrCorruptedCipher) {
+			t.Errorf("%s: expected corrupted cipher error, got %v", name, err)
+		}
+	}
+}
+
+func TestEncryptionReadsPlainBlobs(t *testing.T) {
+	if err := Write(context.TODO(), "mem://encryption/plain", bytes.NewReader([]byte("plain"))); err != nil {
+		t.Fatal(err)
+	}
+
+	useKeys(t, testKeyring(t, "k1", "k1"))
+	if actual, err := readAll(t, "mem://encryption/plain"); err != nil || string(actual) != "plain" {
+		t.Errorf("plain read failed: %q %v", actual, err)
+	}
+}
+
+func TestLoadKeyring(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "keyring.json")
+	content := fmt.Sprintf(`{"active": "k2", "keys": {"k1": %q, "k2": %q}}`,
+		base64.StdEncoding.EncodeToString(testKey(1)), base64.StdEncoding.EncodeToString(testKey(2)))
+	if err := os.WriteFile(filename, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := LoadKeyring(filename)
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	keyId, wrapped, err := keyring.WrapKey(context.TODO(), testKey(9))
+	if err != nil || keyId != "k2" {
+		t.Fatalf("wrap failed: %s %v", keyId, err)
+	}
+	if dataKey, err := keyring.UnwrapKey(context.TODO(), keyId, wrapped); err != nil || !bytes.Equal(dataKey, testKey(9)) {
+		t.Errorf("unwrap failed: %v", err)
+	}
+
+	invalid := []string{
+		`{"active": "k3", "keys": {"k1": "` + base64.StdEncoding.EncodeToString(testKey(1)) + `"}}`,
+		`{"active": "k1", "keys": {"k1": "c2hvcnQ="}}`,
+		`{"active": "k1", "keys": {"k1": "not base64"}}`,
+	}
+	for _, content := range invalid {
+		os.WriteFile(filename, []byte(content), 0o600)
+		if _, err := LoadKeyring(filename); err == nil {
+			t.Errorf("%s: expected error", content)
+		}
+	}
+}
+
+// failingStore fails every write without reading the blob.
+type failingStore struct{}
+
+var errStoreUnavailable = errors.New("store unavailable")
+
+func (failingStore) Get(context.Context, string) (io.ReadCloser, error) { return nil, ErrNotFound }
+func (failingStore) Put(context.Context, string, io.Reader) error       { return errStoreUnavailable }
+func (failingStore) Delete(context.Context, string) error               { return nil }
+
+// writerToSource reports the error which ended copying it, io.Copy hands it the writer.
+type writerToSource struct {
+	data []byte
+	done chan error
+}
+
+func (source *writerToSource) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (source *writerToSource) WriteTo(writer io.Writer) (int64, error) {
+	n, err := writer.Write(source.data)
+	source.done <- err
+	return int64(n), err
+}
+
+func TestEncryptionStopsWhenStoreFails(t *testing.T) {
+	useKeys(t, testKeyring(t, "k1", "k1"))
+	Register("failing", func(uri *url.URL) (BlobStore, string, error) { return failingStore{}, uri.Path, nil })
+
+	source := &writerToSource{data: make([]byte, 2*encryptionChunkSize), done: make(chan error, 1)}
+	if err := Write(context.TODO(), "failing://store/blob", source); !errors.Is(err, errStoreUnavailable) {
+		t.Fatalf("expected the store error, got %v", err)
+	}
+
+	select {
+	case err := <-source.done:
+		if err == nil {
+			t.Errorf("expected the encryption to stop with an error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("encryption still blocked after the store failed")
+	}
+}
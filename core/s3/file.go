@@ -0,0 +1,66 @@
+package s3io
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+)
+
+type fileStore struct{}
+
+func openFile(uri *url.URL) (BlobStore, string, error) {
+	if uri.Host != "" && uri.Host != "localhost" {
+		return nil, "", fmt.Errorf("file uri must reference a local absolute path, got host %q", uri.Host)
+	}
+	if uri.Path == "" {
+		return nil, "", fmt.Errorf("file uri path is empty")
+	}
+
+	return &fileStore{}, filepath.FromSlash(uri.Path), nil
+}
+
+func (store *fileStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return file, err
+}
+
+// Put writes into a temporary file next to the target and renames it,
+// so readers never see a partially written blob.
+func (store *fileStore) Put(ctx context.Context, key string, reader io.Reader) error {
+	dir := filepath.Dir(key)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(key)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, reader); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), key)
+}
+
+func (store *fileStore) Delete(ctx context.Context, key string) error {
+	err := os.Remove(key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,112 @@
+package s3io
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+type Format string
+
+const (
+	CBOR    Format = "cbor"
+	PARQUET Format = "parquet"
+)
+
+var parquetMagic = []byte("PAR1")
+
+type RecordWriter interface {
+	Write(data any) error
+	Close() error
+	// Manifest describes the written batch, it is complete only after Close.
+	Manifest() Manifest
+}
+
+type RecordReader interface {
+	Read() (any, error)
+	// Verify compares the batch read so far with the expected manifest.
+	// It should be called after Read returned io.EOF.
+	Verify(expected Manifest) error
+	Close() error
+}
+
+// BatchOptions selects how batches are written. Schema declares parquet columns as field -> type,
+// with the types of Manifest.Schema, when it is empty the schema is inferred from the first records.
+type BatchOptions struct {
+	Format      Format
+	Compression Compression
+	Schema      map[string]string
+}
+
+var DefaultBatchOptions = BatchOptions{Format: CBOR, Compression: DefaultCompression}
+
+func ParseBatchOptions(format string, compression string, schema map[string]string) (BatchOptions, error) {
+	options := BatchOptions{Format: Format(strings.ToLower(format)), Schema: schema}
+	if options.Format == "" {
+		options.Format = CBOR
+	}
+
+	if options.Format != CBOR && options.Format != PARQUET {
+		return BatchOptions{}, fmt.Errorf("unknown batch format %q", format)
+	}
+
+	var err error
+	if options.Compression, err = ParseCompression(compression); err != nil {
+		return BatchOptions{}, err
+	}
+
+	if options.Format == CBOR && len(schema) > 0 {
+		return BatchOptions{}, fmt.Errorf("batch schema is supported only by %s format", PARQUET)
+	}
+
+	for field, fieldType := range schema {
+		if _, ok := parquetTypes[fieldType]; !ok {
+			return BatchOptions{}, fmt.Errorf("unknown type %q of batch schema field %q", fieldType, field)
+		}
+	}
+
+	return options, nil
+}
+
+// Extension is the batch object name suffix, e.g. .cbor.gz or .parquet.
+// Parquet compresses column pages, so the file itself is not wrapped by the codec.
+func (options BatchOptions) Extension() string {
+	if options.Format == PARQUET {
+		return ".parquet"
+	}
+	return ".cbor" + options.Compression.Extension()
+}
+
+func NewRecordWriter(writer io.WriteCloser, options BatchOptions) (RecordWriter, error) {
+	if options.Format == PARQUET {
+		return NewParquetWriter(writer, options.Compression, options.Schema)
+	}
+	return NewCompressedWriter(writer, options.Compression)
+}
+
+type bufferedReadCloser struct {
+	*bufio.Reader
+	io.Closer
+}
+
+// NewRecordReader reads a batch of the given format and codec, either of them
+// is detected from the stream when empty.
+func NewRecordReader(reader io.ReadCloser, format Format, codec Codec) (RecordReader, error) {
+	if format == "" {
+		buffered := bufio.NewReader(reader)
+		header, _ := buffered.Peek(len(parquetMagic))
+
+		format = CBOR
+		if bytes.Equal(header, parquetMagic) {
+			format = PARQUET
+		}
+		reader = bufferedReadCloser{Reader: buffered, Closer: reader}
+	}
+
+	if format == PARQUET {
+		return NewParquetReader(reader)
+	}
+	return NewCodecReader(reader, codec)
+}
@@ -0,0 +1,189 @@
+package s3io
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"reflect"
+	"time"
+)
+
+const MANIFEST_URI_SUFFIX = ".manifest.json"
+
+var ErrManifestMismatch = errors.New("batch does not match its manifest")
+
+// Manifest describes a written batch. It is stored next to the batch as <uri>.manifest.json.
+// Sha256 and CompressedSize are computed over the stored object bytes.
+type Manifest struct {
+	Records          int64
+	UncompressedSize int64
+	CompressedSize   int64
+	Sha256           string
+	Schema           map[string]string `json:",omitempty"`
+	Codec            Codec             `json:",omitempty"`
+	Format           Format            `json:",omitempty"`
+}
+
+func (expected Manifest) Verify(actual Manifest) error {
+	mismatches := []string{}
+
+	if expected.Records != actual.Records {
+		mismatches = append(mismatches, fmt.Sprintf("records %d != %d", actual.Records, expected.Records))
+	}
+	if expected.CompressedSize != actual.CompressedSize {
+		mismatches = append(mismatches, fmt.Sprintf("compressed size %d != %d", actual.CompressedSize, expected.CompressedSize))
+	}
+	if expected.UncompressedSize != actual.UncompressedSize {
+		mismatches = append(mismatches, fmt.Sprintf("uncompressed size %d != %d", actual.UncompressedSize, expected.UncompressedSize))
+	}
+	if expected.Sha256 != actual.Sha256 {
+		mismatches = append(mismatches, fmt.Sprintf("sha256 %s != %s", actual.Sha256, expected.Sha256))
+	}
+
+	if len(mismatches) > 0 {
+		return fmt.Errorf("%w: %v", ErrManifestMismatch, mismatches)
+	}
+	return nil
+}
+
+func ManifestUri(uri string) string {
+	return WithSuffix(uri, MANIFEST_URI_SUFFIX)
+}
+
+func WriteManifest(ctx context.Context, uri string, manifest Manifest) error {
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return Write(ctx, ManifestUri(uri), bytes.NewReader(content))
+}
+
+// ReadManifest returns the manifest of the batch, or nil for batches written without one.
+func ReadManifest(ctx context.Context, uri string) (*Manifest, error) {
+	reader, err := Read(ctx, ManifestUri(uri))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(reader).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode batch manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+type digest struct {
+	size int64
+	hash hash.Hash
+}
+
+func newDigest() *digest {
+	return &digest{hash: sha256.New()}
+}
+
+func (d *digest) add(p []byte) {
+	d.size += int64(len(p))
+	d.hash.Write(p)
+}
+
+func (d *digest) sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+type digestWriter struct {
+	io.Writer
+	digest *digest
+}
+
+func (w *digestWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.digest.add(p[:n])
+	return n, err
+}
+
+type digestReader struct {
+	io.Reader
+	digest *digest
+}
+
+func (r *digestReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.digest.add(p[:n])
+	return n, err
+}
+
+type countingReader struct {
+	io.Reader
+	size int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.size += int64(n)
+	return n, err
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+func inferType(value any) string {
+	if value == nil {
+		return "null"
+	}
+
+	valueType := reflect.TypeOf(value)
+	if valueType == timeType {
+		return "time"
+	}
+
+	switch valueType.Kind() {
+	case reflect.Bool:
+		return "bool"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "int"
+	case reflect.Float32, reflect.Float64:
+		return "float"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Array:
+		if valueType.Elem().Kind() == reflect.Uint8 {
+			return "bytes"
+		}
+		return "array"
+	case reflect.Map, reflect.Struct:
+		return "map"
+	}
+	return "any"
+}
+
+// mergeSchema adds fields of a map record to schema. Fields seen with different types become "any".
+func mergeSchema(schema map[string]string, record any) {
+	value := reflect.ValueOf(record)
+	if value.Kind() != reflect.Map {
+		return
+	}
+
+	iter := value.MapRange()
+	for iter.Next() {
+		field := fmt.Sprint(iter.Key().Interface())
+		fieldType := inferType(iter.Value().Interface())
+
+		known, ok := schema[field]
+		switch {
+		case !ok || known == "null":
+			schema[field] = fieldType
+		case fieldType != "null" && fieldType != known:
+			schema[field] = "any"
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package s3io
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+)
+
+func writeTestBatch(t *testing.T, records []any) ([]byte, Manifest) {
+	buffer := &bytes.Buffer{}
+	writer, _ := NewWriter(nopWriteCloser{buffer})
+
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatalf("write failed with error %s", err)
+		}
+	}
+	writer.Close()
+
+	return buffer.Bytes(), writer.Manifest()
+}
+
+func readTestBatch(t *testing.T, content []byte) *CborReader {
+	reader, err := NewReader(io.NopCloser(bytes.NewReader(content)))
+	if err != nil {
+		t.Fatalf("read failed with error %s", err)
+	}
+
+	for {
+		if _, err := reader.Read(); err != nil {
+			break
+		}
+	}
+	return reader
+}
+
+func TestManifest(t *testing.T) {
+	content, manifest := writeTestBatch(t, []any{
+		map[string]any{"id": 1, "name": "a", "price": 1.5, "at": time.Now()},
+		map[string]any{"id": 2, "name": nil, "price": 2},
+	})
+
+	if manifest.Records != 2 || manifest.CompressedSize != int64(len(content)) || manifest.UncompressedSize == 0 {
+		t.Errorf("wrong manifest %+v", manifest)
+	}
+
+	expectedSchema := map[string]string{"id": "int", "name": "string", "price": "any", "at": "time"}
+	for field, fieldType := range expectedSchema {
+		if manifest.Schema[field] != fieldType {
+			t.Errorf("wrong schema type of %s: %s", field, manifest.Schema[field])
+		}
+	}
+
+	if err := readTestBatch(t, content).Verify(manifest); err != nil {
+		t.Errorf("verification failed with error %s", err)
+	}
+}
+
+func TestManifestMismatch(t *testing.T) {
+	content, manifest := writeTestBatch(t, []any{"a", "b"})
+	_, other := writeTestBatch(t, []any{"a", "b", "c"})
+
+	if err := readTestBatch(t, content).Verify(other); !errors.Is(err, ErrManifestMismatch) {
+		t.Errorf("manifest mismatch expected, got %v", err)
+	}
+
+	manifest.Sha256 = other.Sha256
+	if err := readTestBatch(t, content).Verify(manifest); !errors.Is(err, ErrManifestMismatch) {
+		t.Errorf("checksum mismatch expected, got %v", err)
+	}
+}
+
+func TestManifestStorage(t *testing.T) {
+	ctx := context.TODO()
+	// the memory store outlives the test, a store of its own keeps the manifest of previous runs out
+	store := fmt.Sprintf("mem://manifest-%d", time.Now().UnixNano())
+	uri := store + "/batch?profile=test"
+
+	if manifest, err := ReadManifest(ctx, uri); manifest != nil || err != nil {
+		t.Errorf("missing manifest must be nil, got %v %v", manifest, err)
+	}
+
+	if err := WriteManifest(ctx, uri, Manifest{Records: 10, Sha256: "abc"}); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	manifest, err := ReadManifest(ctx, uri)
+	if err != nil || manifest.Records != 10 || manifest.Sha256 != "abc" {
+		t.Errorf("wrong manifest %+v", manifest)
+	}
+
+	if ManifestUri(uri) != store+"/batch.manifest.json?profile=test" {
+		t.Errorf("wrong manifest uri %s", ManifestUri(uri))
+	}
+}
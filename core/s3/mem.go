@@ -0,0 +1,69 @@
+package s3io
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// memStore keeps blobs in process memory. Stores are shared by name,
+// so mem://test/a and mem://test/b live in the same store.
+type memStore struct {
+	mu       sync.RWMutex
+	objects  map[string][]byte
+	metadata map[string]map[string]string
+}
+
+var memStores sync.Map
+
+func openMem(uri *url.URL) (BlobStore, string, error) {
+	key := strings.TrimPrefix(uri.Path, "/")
+	if uri.Host == "" || key == "" {
+		return nil, "", fmt.Errorf("mem uri must have the form mem://store/key")
+	}
+
+	store, _ := memStores.LoadOrStore(uri.Host, &memStore{objects: map[string][]byte{}, metadata: map[string]map[string]string{}})
+	return store.(*memStore), key, nil
+}
+
+func (store *memStore) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	content, ok := store.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return io.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (store *memStore) Put(ctx context.Context, key string, reader io.Reader) error {
+	return store.PutWithMetadata(ctx, key, reader, nil)
+}
+
+func (store *memStore) PutWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	store.objects[key] = content
+	store.metadata[key] = metadata
+	return nil
+}
+
+func (store *memStore) Delete(ctx context.Context, key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	delete(store.objects, key)
+	delete(store.metadata, key)
+	return nil
+}
@@ -0,0 +1,500 @@
+package s3io
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+	parquetgzip "github.com/parquet-go/parquet-go/compress/gzip"
+	parquetlz4 "github.com/parquet-go/parquet-go/compress/lz4"
+	parquetzstd "github.com/parquet-go/parquet-go/compress/zstd"
+	"github.com/parquet-go/parquet-go/format"
+	"github.com/segmentio/encoding/thrift"
+)
+
+// PARQUET_SCHEMA_SAMPLE_SIZE is the number of first records buffered to infer the parquet schema.
+const PARQUET_SCHEMA_SAMPLE_SIZE = 100
+
+// PARQUET_ROW_GROUP_SIZE is the number of rows of a row group, the row group being written is kept in memory.
+const PARQUET_ROW_GROUP_SIZE = 10000
+
+const PARQUET_EMPTY_COLUMN = "_empty"
+
+var parquetTypes = map[string]func() parquet.Node{
+	"bool":   func() parquet.Node { return parquet.Leaf(parquet.BooleanType) },
+	"int":    func() parquet.Node { return parquet.Int(64) },
+	"float":  func() parquet.Node { return parquet.Leaf(parquet.DoubleType) },
+	"string": parquet.String,
+	"bytes":  func() parquet.Node { return parquet.Leaf(parquet.ByteArrayType) },
+	"time":   func() parquet.Node { return parquet.Timestamp(parquet.Nanosecond) },
+	"array":  parquet.JSON,
+	"map":    parquet.JSON,
+	"any":    parquet.JSON,
+	// columns only null in the sample take any value later
+	"null": parquet.JSON,
+}
+
+var ErrParquetSchemaMismatch = errors.New("record does not match the parquet batch schema")
+
+func parquetCodec(compression Compression) compress.Codec {
+	switch compression.Codec {
+	case GZIP:
+		if compression.Level != DEFAULT_COMPRESSION_LEVEL {
+			return &parquetgzip.Codec{Level: compression.Level}
+		}
+		return &parquet.Gzip
+	case ZSTD:
+		if compression.Level != DEFAULT_COMPRESSION_LEVEL {
+			return &parquetzstd.Codec{Level: parquetzstd.Level(zstdLevel(compression.Level))}
+		}
+		return &parquet.Zstd
+	case SNAPPY:
+		return &parquet.Snappy
+	case LZ4:
+		if compression.Level != DEFAULT_COMPRESSION_LEVEL {
+			return &parquetlz4.Codec{Level: parquetlz4.Level(lz4Level(compression.Level))}
+		}
+		return &parquet.Lz4Raw
+	}
+	return &parquet.Uncompressed
+}
+
+func parquetSchema(fields map[string]string) *parquet.Schema {
+	group := parquet.Group{}
+	for field, fieldType := range fields {
+		group[field] = parquet.Optional(parquetTypes[fieldType]())
+	}
+	return parquet.NewSchema("batch", group)
+}
+
+// widenParquetType returns the type of a column holding values of known and fieldType.
+func widenParquetType(known string, fieldType string) string {
+	switch {
+	case known == "" || known == "null":
+		return fieldType
+	case fieldType == "null" || fieldType == known:
+		return known
+	case known == "int" && fieldType == "float", known == "float" && fieldType == "int":
+		return "float"
+	}
+	return "any"
+}
+
+func recordFields(record any) (map[string]any, error) {
+	if fields, ok := record.(map[string]any); ok {
+		return fields, nil
+	}
+
+	value := reflect.ValueOf(record)
+	if value.Kind() != reflect.Map {
+		return nil, fmt.Errorf("parquet batches require map records, got %T", record)
+	}
+
+	fields := make(map[string]any, value.Len())
+	iter := value.MapRange()
+	for iter.Next() {
+		fields[fmt.Sprint(iter.Key().Interface())] = iter.Value().Interface()
+	}
+	return fields, nil
+}
+
+// jsonCompatible converts cbor decoded map[any]any values, which encoding/json rejects.
+func jsonCompatible(value any) any {
+	switch typed := value.(type) {
+	case map[any]any:
+		result := make(map[string]any, len(typed))
+		for key, item := range typed {
+			result[fmt.Sprint(key)] = jsonCompatible(item)
+		}
+		return result
+	case map[string]any:
+		result := make(map[string]any, len(typed))
+		for key, item := range typed {
+			result[key] = jsonCompatible(item)
+		}
+		return result
+	case []any:
+		result := make([]any, len(typed))
+		for idx, item := range typed {
+			result[idx] = jsonCompatible(item)
+		}
+		return result
+	}
+	return value
+}
+
+func parquetValue(fieldType string, value any) (parquet.Value, error) {
+	reflected := reflect.ValueOf(value)
+
+	switch fieldType {
+	case "bool":
+		if reflected.Kind() == reflect.Bool {
+			return parquet.BooleanValue(reflected.Bool()), nil
+		}
+	case "int":
+		switch {
+		case reflected.CanInt():
+			return parquet.Int64Value(reflected.Int()), nil
+		case reflected.CanUint() && reflected.Uint() <= math.MaxInt64:
+			return parquet.Int64Value(int64(reflected.Uint())), nil
+		}
+	case "float":
+		switch {
+		case reflected.CanFloat():
+			return parquet.DoubleValue(reflected.Float()), nil
+		case reflected.CanInt():
+			return parquet.DoubleValue(float64(reflected.Int())), nil
+		case reflected.CanUint():
+			return parquet.DoubleValue(float64(reflected.Uint())), nil
+		}
+	case "string":
+		if reflected.Kind() == reflect.String {
+			return parquet.ByteArrayValue([]byte(reflected.String())), nil
+		}
+	case "bytes":
+		if content, ok := value.([]byte); ok {
+			return parquet.ByteArrayValue(content), nil
+		}
+	case "time":
+		if timestamp, ok := value.(time.Time); ok {
+			return parquet.Int64Value(timestamp.UnixNano()), nil
+		}
+	default:
+		content, err := json.Marshal(jsonCompatible(value))
+		if err != nil {
+			return parquet.Value{}, err
+		}
+		return parquet.ByteArrayValue(content), nil
+	}
+
+	return parquet.Value{}, fmt.Errorf("%T value can not be written as %s", value, fieldType)
+}
+
+// ParquetWriter streams row groups of PARQUET_ROW_GROUP_SIZE rows to writer. Without a schema, the
+// schema is inferred from the first PARQUET_SCHEMA_SAMPLE_SIZE records; later records which do not
+// fit it fail with ErrParquetSchemaMismatch, batches with such records need a declared schema.
+type ParquetWriter struct {
+	output      *parquetOutput
+	compression Compression
+	fields      map[string]string
+	inferred    bool
+	sample      []map[string]any
+	parquet     *parquet.Writer
+	columns     []parquet.Field
+	records     int64
+	manifest    Manifest
+}
+
+// parquetOutput digests the written file, and keeps what is written once tail is set
+// to decode the footer from it.
+type parquetOutput struct {
+	digestWriter
+	tail *bytes.Buffer
+}
+
+func (output *parquetOutput) Write(p []byte) (int, error) {
+	if output.tail != nil {
+		output.tail.Write(p)
+	}
+	return output.digestWriter.Write(p)
+}
+
+func NewParquetWriter(writer io.WriteCloser, compression Compression, schema map[string]string) (*ParquetWriter, error) {
+	parquetWriter := &ParquetWriter{
+		output:      &parquetOutput{digestWriter: digestWriter{Writer: writer, digest: newDigest()}},
+		compression: compression,
+	}
+
+	if len(schema) > 0 {
+		parquetWriter.open(schema)
+	}
+	return parquetWriter, nil
+}
+
+func (writer *ParquetWriter) open(fields map[string]string) {
+	schema := parquetSchema(fields)
+
+	writer.fields = fields
+	writer.columns = schema.Fields()
+	writer.parquet = parquet.NewWriter(writer.output, schema,
+		parquet.Compression(parquetCodec(writer.compression)),
+		parquet.MaxRowsPerRowGroup(PARQUET_ROW_GROUP_SIZE),
+	)
+}
+
+func (writer *ParquetWriter) inferSchema() error {
+	fields := map[string]string{}
+	for _, record := range writer.sample {
+		for field, value := range record {
+			fields[field] = widenParquetType(fields[field], inferType(value))
+		}
+	}
+
+	if len(fields) == 0 {
+		if writer.records > 0 {
+			return errors.New("parquet batches require records with at least one field")
+		}
+		// parquet files need at least one column, an empty batch gets a placeholder one
+		fields[PARQUET_EMPTY_COLUMN] = "null"
+	}
+
+	writer.open(fields)
+	writer.inferred = true
+
+	sample := writer.sample
+	writer.sample = nil
+	for _, record := range sample {
+		if err := writer.writeRow(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (writer *ParquetWriter) writeRow(fields map[string]any) error {
+	for field := range fields {
+		if _, ok := writer.fields[field]; !ok {
+			return writer.mismatch(fmt.Errorf("field %q is not in the schema", field))
+		}
+	}
+
+	row := make(parquet.Row, len(writer.columns))
+	for idx, column := range writer.columns {
+		value, ok := fields[column.Name()]
+		if !ok || value == nil {
+			row[idx] = parquet.NullValue().Level(0, 0, idx)
+			continue
+		}
+
+		parquetValue, err := parquetValue(writer.fields[column.Name()], value)
+		if err != nil {
+			return writer.mismatch(fmt.Errorf("field %q: %w", column.Name(), err))
+		}
+		row[idx] = parquetValue.Level(0, 1, idx)
+	}
+
+	_, err := writer.parquet.WriteRows([]parquet.Row{row})
+	return err
+}
+
+func (writer *ParquetWriter) mismatch(err error) error {
+	if writer.inferred {
+		return fmt.Errorf("%w inferred from the first %d records: record %d %w, declare the batch schema",
+			ErrParquetSchemaMismatch, PARQUET_SCHEMA_SAMPLE_SIZE, writer.records, err)
+	}
+	return fmt.Errorf("%w: record %d %w", ErrParquetSchemaMismatch, writer.records, err)
+}
+
+func (writer *ParquetWriter) Write(data any) error {
+	fields, err := recordFields(data)
+	if err != nil {
+		return err
+	}
+	writer.records++
+
+	if writer.parquet == nil {
+		writer.sample = append(writer.sample, fields)
+		if len(writer.sample) < PARQUET_SCHEMA_SAMPLE_SIZE {
+			return nil
+		}
+		return writer.inferSchema()
+	}
+
+	return writer.writeRow(fields)
+}
+
+func (writer *ParquetWriter) Close() error {
+	if writer.parquet == nil {
+		if err := writer.inferSchema(); err != nil {
+			return err
+		}
+	}
+
+	// the last row group, the page index and the footer are written on close
+	writer.output.tail = &bytes.Buffer{}
+	if err := writer.parquet.Close(); err != nil {
+		return err
+	}
+
+	metadata, err := parquetFooter(writer.output.tail.Bytes())
+	if err != nil {
+		return err
+	}
+
+	compressed := writer.output.digest
+	writer.manifest = Manifest{
+		Records:          writer.records,
+		UncompressedSize: parquetRowGroupsSize(metadata.RowGroups),
+		CompressedSize:   compressed.size,
+		Sha256:           compressed.sum(),
+		Codec:            writer.compression.Codec,
+		Format:           PARQUET,
+	}
+	if writer.records > 0 {
+		writer.manifest.Schema = writer.fields
+	}
+	return nil
+}
+
+// parquetFooter decodes the file metadata at the end of tail, which ends the parquet file.
+func parquetFooter(tail []byte) (*format.FileMetaData, error) {
+	if len(tail) < 8 || string(tail[len(tail)-4:]) != "PAR1" {
+		return nil, errors.New("parquet file has no footer")
+	}
+	size := int(binary.LittleEndian.Uint32(tail[len(tail)-8:]))
+	if size > len(tail)-8 {
+		return nil, errors.New("parquet footer is truncated")
+	}
+
+	metadata := &format.FileMetaData{}
+	if err := thrift.Unmarshal(&thrift.CompactProtocol{}, tail[len(tail)-8-size:len(tail)-8], metadata); err != nil {
+		return nil, fmt.Errorf("failed to decode parquet footer: %w", err)
+	}
+	return metadata, nil
+}
+
+func (writer *ParquetWriter) Manifest() Manifest {
+	return writer.manifest
+}
+
+func parquetRowGroupsSize(rowGroups []format.RowGroup) int64 {
+	size := int64(0)
+	for _, rowGroup := range rowGroups {
+		size += rowGroup.TotalByteSize
+	}
+	return size
+}
+
+type parquetColumn struct {
+	name    string
+	convert func(parquet.Value) (any, error)
+}
+
+func newParquetColumn(field parquet.Field) parquetColumn {
+	column := parquetColumn{name: field.Name()}
+	logicalType := field.Type().LogicalType()
+
+	switch {
+	case logicalType != nil && logicalType.UTF8 != nil:
+		column.convert = func(value parquet.Value) (any, error) { return string(value.ByteArray()), nil }
+	case logicalType != nil && logicalType.Json != nil:
+		column.convert = func(value parquet.Value) (any, error) {
+			var result any
+			err := json.Unmarshal(value.ByteArray(), &result)
+			return result, err
+		}
+	case logicalType != nil && logicalType.Timestamp != nil:
+		column.convert = func(value parquet.Value) (any, error) { return time.Unix(0, value.Int64()).UTC(), nil }
+	default:
+		column.convert = func(value parquet.Value) (any, error) {
+			switch value.Kind() {
+			case parquet.Boolean:
+				return value.Boolean(), nil
+			case parquet.Int32:
+				return int64(value.Int32()), nil
+			case parquet.Int64:
+				return value.Int64(), nil
+			case parquet.Float:
+				return float64(value.Float()), nil
+			case parquet.Double:
+				return value.Double(), nil
+			case parquet.ByteArray, parquet.FixedLenByteArray:
+				return bytes.Clone(value.ByteArray()), nil
+			}
+			return nil, fmt.Errorf("unsupported parquet column %s type %s", field.Name(), value.Kind())
+		}
+	}
+
+	return column
+}
+
+// ParquetReader reads flat parquet batches as map[string]any records.
+// The whole object is buffered in memory as parquet is read from its footer.
+type ParquetReader struct {
+	reader     io.ReadCloser
+	file       *parquet.File
+	rows       *parquet.Reader
+	columns    []parquetColumn
+	buffer     []parquet.Row
+	compressed *digest
+	records    int64
+}
+
+func NewParquetReader(reader io.ReadCloser) (*ParquetReader, error) {
+	compressed := newDigest()
+	content, err := io.ReadAll(&digestReader{Reader: reader, digest: compressed})
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := parquet.OpenFile(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open parquet batch: %w", err)
+	}
+
+	columns := []parquetColumn{}
+	for _, field := range file.Schema().Fields() {
+		if !field.Leaf() {
+			return nil, fmt.Errorf("nested parquet column %s is not supported", field.Name())
+		}
+		columns = append(columns, newParquetColumn(field))
+	}
+
+	return &ParquetReader{
+		reader:     reader,
+		file:       file,
+		rows:       parquet.NewReader(file),
+		columns:    columns,
+		buffer:     make([]parquet.Row, 1),
+		compressed: compressed,
+	}, nil
+}
+
+func (reader *ParquetReader) Read() (any, error) {
+	n, err := reader.rows.ReadRows(reader.buffer)
+	if n == 0 {
+		if err == nil || errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+
+	record := make(map[string]any, len(reader.columns))
+	for _, value := range reader.buffer[0] {
+		column := reader.columns[value.Column()]
+		if value.IsNull() {
+			record[column.name] = nil
+			continue
+		}
+
+		converted, err := column.convert(value)
+		if err != nil {
+			return nil, err
+		}
+		record[column.name] = converted
+	}
+
+	reader.records++
+	return record, nil
+}
+
+func (reader *ParquetReader) Verify(expected Manifest) error {
+	return expected.Verify(Manifest{
+		Records:          reader.records,
+		UncompressedSize: parquetRowGroupsSize(reader.file.Metadata().RowGroups),
+		CompressedSize:   reader.compressed.size,
+		Sha256:           reader.compressed.sum(),
+	})
+}
+
+func (reader *ParquetReader) Close() error {
+	return errors.Join(reader.rows.Close(), reader.reader.Close())
+}
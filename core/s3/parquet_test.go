@@ -0,0 +1,290 @@
+package s3io
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeBatch(t testing.TB, options BatchOptions, records []any) ([]byte, Manifest) {
+	buffer := &bytes.Buffer{}
+	writer, err := NewRecordWriter(nopWriteCloser{buffer}, options)
+	if err != nil {
+		t.Fatalf("%s: failed with error %s", options.Format, err)
+	}
+
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatalf("%s: write failed with error %s", options.Format, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatalf("%s: close failed with error %s", options.Format, err)
+	}
+	return buffer.Bytes(), writer.Manifest()
+}
+
+func readBatch(t testing.TB, content []byte, format Format, manifest Manifest) []any {
+	reader, err := NewRecordReader(io.NopCloser(bytes.NewReader(content)), format, "")
+	if err != nil {
+		t.Fatalf("read failed with error %s", err)
+	}
+	defer reader.Close()
+
+	records := []any{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read failed with error %s", err)
+		}
+		records = append(records, record)
+	}
+
+	if err := reader.Verify(manifest); err != nil {
+		t.Errorf("verify failed with error %s", err)
+	}
+	return records
+}
+
+func TestParquetRoundTrip(t *testing.T) {
+	records := tradeRecords(250)
+
+	for _, spec := range testCompressions {
+		options, err := ParseBatchOptions("parquet", spec, nil)
+		if err != nil {
+			t.Fatalf("%s: failed with error %s", spec, err)
+		}
+
+		content, manifest := writeBatch(t, options, records)
+		if manifest.Format != PARQUET || manifest.Codec != options.Compression.Codec {
+			t.Errorf("%s: wrong manifest format %s codec %s", spec, manifest.Format, manifest.Codec)
+		}
+		if manifest.Records != int64(len(records)) {
+			t.Errorf("%s: manifest has %d records", spec, manifest.Records)
+		}
+
+		// the format is sniffed from the parquet magic header
+		actual := readBatch(t, content, "", manifest)
+		if !reflect.DeepEqual(actual, records) {
+			t.Errorf("%s: records differ after round trip", spec)
+		}
+	}
+}
+
+func TestParquetTypes(t *testing.T) {
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 6, time.UTC)
+	records := []any{
+		map[string]any{"b": true, "i": int64(1), "f": 1.5, "s": "a", "raw": []byte{1, 2}, "t": timestamp, "tags": []any{"x", "y"}},
+		map[any]any{"i": uint64(2), "nested": map[any]any{"key": "value"}},
+	}
+
+	content, manifest := writeBatch(t, BatchOptions{Format: PARQUET, Compression: DefaultCompression}, records)
+
+	expectedSchema := map[string]string{
+		"b": "bool", "i": "int", "f": "float", "s": "string", "raw": "bytes", "t": "time", "tags": "array", "nested": "map",
+	}
+	if !reflect.DeepEqual(manifest.Schema, expectedSchema) {
+		t.Errorf("wrong schema %v", manifest.Schema)
+	}
+
+	actual := readBatch(t, content, PARQUET, manifest)
+	expected := []any{
+		map[string]any{"b": true, "i": int64(1), "f": 1.5, "s": "a", "raw": []byte{1, 2}, "t": timestamp, "tags": []any{"x", "y"}, "nested": nil},
+		map[string]any{"b": nil, "i": int64(2), "f": nil, "s": nil, "raw": nil, "t": nil, "tags": nil, "nested": map[string]any{"key": "value"}},
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+}
+
+func TestParquetDeclaredSchema(t *testing.T) {
+	options, err := ParseBatchOptions("parquet", "zstd", map[string]string{"id": "int", "name": "string"})
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	buffer := &bytes.Buffer{}
+	writer, _ := NewRecordWriter(nopWriteCloser{buffer}, options)
+	if err := writer.Write(map[string]any{"id": 1, "name": "a"}); err != nil {
+		t.Errorf("write failed with error %s", err)
+	}
+	if err := writer.Write(map[string]any{"id": "1"}); err == nil {
+		t.Errorf("expected type mismatch error")
+	}
+	if err := writer.Write(map[string]any{"other": 1}); err == nil {
+		t.Errorf("expected unknown field error")
+	}
+}
+
+func TestParseBatchOptions(t *testing.T) {
+	options, err := ParseBatchOptions("", "", nil)
+	if err != nil || !reflect.DeepEqual(options, DefaultBatchOptions) {
+		t.Errorf("expected default options, got %v %v", options, err)
+	}
+	if options.Extension() != ".cbor.gz" {
+		t.Errorf("wrong extension %s", options.Extension())
+	}
+
+	options, _ = ParseBatchOptions("PARQUET", "snappy", nil)
+	if options.Extension() != ".parquet" {
+		t.Errorf("wrong extension %s", options.Extension())
+	}
+
+	invalid := []struct {
+		format string
+		schema map[string]string
+	}{
+		{"avro", nil},
+		{"cbor", map[string]string{"id": "int"}},
+		{"parquet", map[string]string{"id": "decimal"}},
+	}
+	for _, testCase := range invalid {
+		if _, err := ParseBatchOptions(testCase.format, "", testCase.schema); err == nil {
+			t.Errorf("%s %v: expected error", testCase.format, testCase.schema)
+		}
+	}
+}
+
+func TestRecordReaderDetectsCbor(t *testing.T) {
+	records := tradeRecords(10)
+	content, manifest := writeBatch(t, BatchOptions{Format: CBOR, Compression: Compression{Codec: ZSTD, Level: DEFAULT_COMPRESSION_LEVEL}}, records)
+
+	if manifest.Format != CBOR {
+		t.Errorf("wrong manifest format %s", manifest.Format)
+	}
+	if actual := readBatch(t, content, "", manifest); len(actual) != len(records) {
+		t.Errorf("expected %d records, got %d", len(records), len(actual))
+	}
+}
+
+func BenchmarkParquet(b *testing.B) {
+	records := tradeRecords(10000)
+
+	for _, spec := range []string{"none", "snappy", "zstd"} {
+		options, _ := ParseBatchOptions("parquet", spec, nil)
+		b.Run(spec, func(b *testing.B) {
+			var content []byte
+			for i := 0; i < b.N; i++ {
+				content, _ = writeBatch(b, options, records)
+			}
+			b.ReportMetric(float64(len(content)), "bytes")
+		})
+	}
+}
+
+func TestParquetEmptyBatch(t *testing.T) {
+	content, manifest := writeBatch(t, BatchOptions{Format: PARQUET, Compression: DefaultCompression}, nil)
+	if actual := readBatch(t, content, PARQUET, manifest); len(actual) != 0 {
+		t.Errorf("expected no records, got %d", len(actual))
+	}
+}
+
+func TestParquetWidensInferredTypes(t *testing.T) {
+	records := []any{
+		map[string]any{"id": 1, "price": 10, "note": nil},
+		map[string]any{"id": 2, "price": 10.5, "note": nil},
+		// fields missing from the first records are part of the sampled schema
+		map[string]any{"id": 3, "price": 11, "note": nil, "late": "x"},
+	}
+	content, manifest := writeBatch(t, BatchOptions{Format: PARQUET, Compression: DefaultCompression}, records)
+
+	expected := map[string]string{"id": "int", "price": "float", "note": "null", "late": "string"}
+	if !reflect.DeepEqual(manifest.Schema, expected) {
+		t.Errorf("expected schema %v, got %v", expected, manifest.Schema)
+	}
+
+	actual := readBatch(t, content, PARQUET, manifest)
+	if price := actual[0].(map[string]any)["price"]; price != 10.0 {
+		t.Errorf("expected int price widened to 10.0, got %#v", price)
+	}
+	if late := actual[2].(map[string]any)["late"]; late != "x" {
+		t.Errorf("expected late field x, got %#v", late)
+	}
+}
+
+func TestParquetRecordsAfterSample(t *testing.T) {
+	sample := func() []any {
+		records := []any{}
+		for i := 0; i < PARQUET_SCHEMA_SAMPLE_SIZE; i++ {
+			records = append(records, map[string]any{"id": i, "note": nil})
+		}
+		return records
+	}
+
+	// a column only null in the sample is a json column, which takes any value
+	content, manifest := writeBatch(t, BatchOptions{Format: PARQUET, Compression: DefaultCompression},
+		append(sample(), map[string]any{"id": 100, "note": 7}))
+	actual := readBatch(t, content, PARQUET, manifest)
+	if note := actual[PARQUET_SCHEMA_SAMPLE_SIZE].(map[string]any)["note"]; note != 7.0 {
+		t.Errorf("expected note 7, got %#v", note)
+	}
+
+	for _, record := range []map[string]any{
+		{"id": 100, "extra": "x"},
+		{"id": 100.5},
+	} {
+		writer, err := NewParquetWriter(nopWriteCloser{&bytes.Buffer{}}, DefaultCompression, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, previous := range sample() {
+			if err := writer.Write(previous); err != nil {
+				t.Fatalf("write failed with error %s", err)
+			}
+		}
+		if err := writer.Write(record); !errors.Is(err, ErrParquetSchemaMismatch) {
+			t.Errorf("%v: expected schema mismatch, got %v", record, err)
+		}
+	}
+
+	// with a declared schema every record is checked against it
+	writer, _ := NewParquetWriter(nopWriteCloser{&bytes.Buffer{}}, DefaultCompression, map[string]string{"id": "int"})
+	if err := writer.Write(map[string]any{"id": 1, "extra": "x"}); !errors.Is(err, ErrParquetSchemaMismatch) {
+		t.Errorf("expected schema mismatch, got %v", err)
+	}
+}
+
+// countingWriteCloser counts the bytes written to it.
+type countingWriteCloser struct {
+	written int
+}
+
+func (w *countingWriteCloser) Write(p []byte) (int, error) {
+	w.written += len(p)
+	return len(p), nil
+}
+
+func (w *countingWriteCloser) Close() error { return nil }
+
+func TestParquetStreamsRowGroups(t *testing.T) {
+	output := &countingWriteCloser{}
+	writer, err := NewParquetWriter(output, DefaultCompression, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first row group is written once a record of the next one arrives
+	records := tradeRecords(PARQUET_ROW_GROUP_SIZE + 1)
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatalf("write failed with error %s", err)
+		}
+	}
+	if output.written == 0 {
+		t.Errorf("no row group written before close")
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatalf("close failed with error %s", err)
+	}
+	manifest := writer.Manifest()
+	if manifest.Records != int64(len(records)) || manifest.CompressedSize != int64(output.written) || manifest.UncompressedSize == 0 {
+		t.Errorf("wrong manifest %+v, written %d", manifest, output.written)
+	}
+}
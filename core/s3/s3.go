@@ -2,7 +2,11 @@ package s3io
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/url"
+	"strings"
 
 	"regexp"
 
@@ -10,8 +14,16 @@ import (
 	"github.com/minio/minio-go/v7/pkg/credentials"
 )
 
-type s3Client struct {
+const (
+	LIGHTBYTE_S3_ENDPOINT = "LIGHTBYTE_S3_ENDPOINT"
+	LIGHTBYTE_S3_INSECURE = "LIGHTBYTE_S3_INSECURE"
+)
+
+const DEFAULT_S3_ENDPOINT = "s3.amazonaws.com"
+
+type s3Store struct {
 	client *minio.Client
+	bucket string
 }
 
 var UriRegexp = regexp.MustCompile(`(?P<Protocol>http|https)://(?P<AccessKey>.+):(?P<SecretKey>.+)@(?P<Host>[\w+\.]+)(?P<Port>:\d+)?/(?P<Bucket>\w+)/(?P<Object>.*)`)
@@ -20,22 +32,10 @@ type s3ClientConfig struct {
 	Endpoint  string
 	AccessKey string
 	SecretKey string
+	Creds     *credentials.Credentials
 	UseSSL    bool
 }
 
-func newS3Client(config s3ClientConfig) (*s3Client, error) {
-	minioClient, err := minio.New(config.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(config.AccessKey, config.SecretKey, ""),
-		Secure: config.UseSSL,
-	})
-
-	if err != nil {
-		return nil, err
-	}
-
-	return &s3Client{client: minioClient}, nil
-}
-
 func parseFileUri(uri string) (s3ClientConfig, string, string) {
 	matches := UriRegexp.FindStringSubmatch(uri)
 	groups := UriRegexp.SubexpNames()
@@ -68,31 +68,89 @@ func parseFileUri(uri string) (s3ClientConfig, string, string) {
 	}
 
 	s3Conf.Endpoint = host
+	s3Conf.Creds = credentials.NewStaticV4(s3Conf.AccessKey, s3Conf.SecretKey, "")
 	return s3Conf, bucket, object
 }
 
-func Read(ctx context.Context, uri string) (io.ReadCloser, error) {
+// openLegacyS3 opens http(s)://access:secret@host/bucket/object uris.
+func openLegacyS3(uri string) (BlobStore, string, error) {
 	s3Conf, bucket, object := parseFileUri(uri)
-	client, err := newS3Client(s3Conf)
+	client, err := clients.client(clientKey{
+		endpoint: s3Conf.Endpoint,
+		useSSL:   s3Conf.UseSSL,
+		identity: staticIdentity(s3Conf.AccessKey, s3Conf.SecretKey),
+	}, s3Conf)
+	if err != nil {
+		return nil, "", err
+	}
 
+	return &s3Store{client: client, bucket: bucket}, object, nil
+}
+
+// openS3 opens credential-free s3://bucket/object uris, see resolveProfile
+// for the endpoint and credentials lookup.
+func openS3(uri *url.URL) (BlobStore, string, error) {
+	bucket := uri.Host
+	object := strings.TrimPrefix(uri.Path, "/")
+	if bucket == "" || object == "" {
+		return nil, "", fmt.Errorf("s3 uri must have the form s3://bucket/key")
+	}
+
+	profile, err := clients.profile(uri.Query().Get(PROFILE_QUERY_KEY))
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
 
-	obj, err := client.client.GetObject(ctx, bucket, object, minio.GetObjectOptions{})
+	client, err := clients.client(clientKey{
+		endpoint: profile.endpoint,
+		useSSL:   profile.useSSL,
+		identity: profileIdentity(profile),
+	}, s3ClientConfig{
+		Endpoint: profile.endpoint,
+		Creds:    profile.creds,
+		UseSSL:   profile.useSSL,
+	})
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-	return obj, err
+
+	return &s3Store{client: client, bucket: bucket}, object, nil
 }
 
-func Write(ctx context.Context, uri string, reader io.ReadCloser) error {
-	s3Conf, bucket, object := parseFileUri(uri)
-	client, err := newS3Client(s3Conf)
+func isNoSuchKey(err error) bool {
+	var errResp minio.ErrorResponse
+	return errors.As(err, &errResp) && errResp.Code == "NoSuchKey"
+}
 
+func (store *s3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	obj, err := store.client.GetObject(ctx, store.bucket, key, minio.GetObjectOptions{})
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// the first Stat sends the request, so a missing object is reported here instead of on Read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		if isNoSuchKey(err) {
+			return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+func (store *s3Store) Put(ctx context.Context, key string, reader io.Reader) error {
+	return store.PutWithMetadata(ctx, key, reader, nil)
+}
+
+func (store *s3Store) PutWithMetadata(ctx context.Context, key string, reader io.Reader, metadata map[string]string) error {
+	return store.put(ctx, key, reader, minio.PutObjectOptions{UserMetadata: metadata})
+}
+
+func (store *s3Store) Delete(ctx context.Context, key string) error {
+	err := store.client.RemoveObject(ctx, store.bucket, key, minio.RemoveObjectOptions{})
+	if isNoSuchKey(err) {
+		return nil
 	}
-	_, err = client.client.PutObject(ctx, bucket, object, reader, -1, minio.PutObjectOptions{})
 	return err
 }
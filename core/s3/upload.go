@@ -0,0 +1,275 @@
+package s3io
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// MIN_PART_SIZE is the smallest part size accepted by s3 for all parts but the last one.
+const MIN_PART_SIZE = 5 * 1024 * 1024
+
+const abortTimeout = 30 * time.Second
+
+// UploadConfig bounds the memory of s3 uploads to PartSize * Concurrency.
+// Objects smaller than PartSize are sent with a single request.
+type UploadConfig struct {
+	PartSize    int64
+	Concurrency int
+	// MaxRetries is the number of retries of every request after its first attempt,
+	// the delay starts at RetryBackoff and doubles with every retry.
+	MaxRetries   int
+	RetryBackoff time.Duration
+}
+
+func DefaultUploadConfig() UploadConfig {
+	return UploadConfig{
+		PartSize:     16 * 1024 * 1024,
+		Concurrency:  4,
+		MaxRetries:   5,
+		RetryBackoff: 500 * time.Millisecond,
+	}
+}
+
+func (config UploadConfig) validate() error {
+	if config.PartSize < MIN_PART_SIZE {
+		return fmt.Errorf("upload part size must be at least %d bytes", MIN_PART_SIZE)
+	}
+	if config.Concurrency < 1 {
+		return fmt.Errorf("upload concurrency must be at least 1")
+	}
+	if config.MaxRetries < 0 || config.RetryBackoff < 0 {
+		return fmt.Errorf("upload retries and backoff must not be negative")
+	}
+	return nil
+}
+
+type UploadStats struct {
+	Parts   uint64
+	Retries uint64
+	Aborted uint64
+}
+
+var uploads = struct {
+	mu     sync.RWMutex
+	config UploadConfig
+
+	parts   atomic.Uint64
+	retries atomic.Uint64
+	aborted atomic.Uint64
+}{config: DefaultUploadConfig()}
+
+func ConfigureUploads(config UploadConfig) error {
+	if err := config.validate(); err != nil {
+		return err
+	}
+
+	uploads.mu.Lock()
+	defer uploads.mu.Unlock()
+
+	uploads.config = config
+	return nil
+}
+
+func uploadConfig() UploadConfig {
+	uploads.mu.RLock()
+	defer uploads.mu.RUnlock()
+
+	return uploads.config
+}
+
+func UploadStatistics() UploadStats {
+	return UploadStats{
+		Parts:   uploads.parts.Load(),
+		Retries: uploads.retries.Load(),
+		Aborted: uploads.aborted.Load(),
+	}
+}
+
+func isRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	response := minio.ToErrorResponse(err)
+	switch {
+	case response.StatusCode == 0:
+		// network errors, the request may not have reached s3
+		return true
+	case response.StatusCode >= http.StatusInternalServerError:
+		return true
+	case response.StatusCode == http.StatusRequestTimeout || response.StatusCode == http.StatusTooManyRequests:
+		return true
+	}
+	return response.Code == "RequestTimeout" || response.Code == "SlowDown"
+}
+
+func withRetries(ctx context.Context, config UploadConfig, request func() error) error {
+	backoff := config.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := request()
+		if err == nil || attempt >= config.MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		uploads.retries.Add(1)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return errors.Join(err, context.Cause(ctx))
+		}
+		backoff *= 2
+	}
+}
+
+// partReader hides bytes.Reader Seek, minio retries requests with seekable bodies on its own
+// and requests are already retried with the configured backoff.
+type partReader struct {
+	io.Reader
+}
+
+func newPartReader(data []byte) partReader {
+	return partReader{bytes.NewReader(data)}
+}
+
+type multipartUpload struct {
+	store    *s3Store
+	core     minio.Core
+	key      string
+	uploadId string
+	config   UploadConfig
+
+	mu    sync.Mutex
+	parts []minio.CompletePart
+}
+
+func (upload *multipartUpload) uploadPart(ctx context.Context, number int, data []byte) error {
+	var part minio.ObjectPart
+	err := withRetries(ctx, upload.config, func() error {
+		var err error
+		part, err = upload.core.PutObjectPart(ctx, upload.store.bucket, upload.key, upload.uploadId, number,
+			newPartReader(data), int64(len(data)), minio.PutObjectPartOptions{})
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload part %d: %w", number, err)
+	}
+
+	uploads.parts.Add(1)
+
+	upload.mu.Lock()
+	defer upload.mu.Unlock()
+	upload.parts = append(upload.parts, minio.CompletePart{PartNumber: number, ETag: part.ETag})
+	return nil
+}
+
+func (upload *multipartUpload) complete(ctx context.Context) error {
+	sort.Slice(upload.parts, func(i, j int) bool { return upload.parts[i].PartNumber < upload.parts[j].PartNumber })
+
+	return withRetries(ctx, upload.config, func() error {
+		_, err := upload.core.CompleteMultipartUpload(ctx, upload.store.bucket, upload.key, upload.uploadId, upload.parts, minio.PutObjectOptions{})
+		return err
+	})
+}
+
+// abort removes uploaded parts, it runs even when ctx is cancelled.
+func (upload *multipartUpload) abort(ctx context.Context) error {
+	abortCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abortTimeout)
+	defer cancel()
+
+	uploads.aborted.Add(1)
+	return withRetries(abortCtx, upload.config, func() error {
+		return upload.core.AbortMultipartUpload(abortCtx, upload.store.bucket, upload.key, upload.uploadId)
+	})
+}
+
+// put streams reader into the object. The first part is buffered to find out whether a multipart
+// upload is needed, further parts are read while at most Concurrency parts are uploaded.
+func (store *s3Store) put(ctx context.Context, key string, reader io.Reader, options minio.PutObjectOptions) error {
+	config := uploadConfig()
+	core := minio.Core{Client: store.client}
+
+	buffers := make(chan []byte, config.Concurrency)
+	for i := 0; i < config.Concurrency; i++ {
+		buffers <- nil
+	}
+
+	buffer := make([]byte, config.PartSize)
+	n, err := io.ReadFull(reader, buffer)
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return withRetries(ctx, config, func() error {
+			_, err := core.PutObject(ctx, store.bucket, key, newPartReader(buffer[:n]), int64(n), "", "", options)
+			return err
+		})
+	}
+	if err != nil {
+		return err
+	}
+	<-buffers
+
+	uploadId, err := core.NewMultipartUpload(ctx, store.bucket, key, options)
+	if err != nil {
+		return err
+	}
+
+	upload := &multipartUpload{store: store, core: core, key: key, uploadId: uploadId, config: config}
+	uploadCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	wg := &sync.WaitGroup{}
+	for number := 1; ; number++ {
+		wg.Add(1)
+		go func(number int, data []byte) {
+			defer wg.Done()
+			if err := upload.uploadPart(uploadCtx, number, data); err != nil {
+				cancel(err)
+			}
+			buffers <- data[:cap(data)]
+		}(number, buffer[:n])
+
+		if n < len(buffer) {
+			break
+		}
+
+		select {
+		case buffer = <-buffers:
+		case <-uploadCtx.Done():
+		}
+		if uploadCtx.Err() != nil {
+			break
+		}
+
+		if buffer == nil {
+			buffer = make([]byte, config.PartSize)
+		}
+
+		n, err = io.ReadFull(reader, buffer)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			cancel(err)
+			break
+		}
+	}
+
+	wg.Wait()
+
+	err = context.Cause(uploadCtx)
+	if err == nil {
+		err = upload.complete(ctx)
+	}
+	if err != nil {
+		return errors.Join(err, upload.abort(ctx))
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package s3io
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+type fakeUpload struct {
+	key      string
+	metadata http.Header
+	parts    map[int][]byte
+}
+
+// fakeS3 is a minimal path style s3 endpoint for single and multipart uploads, which injects faults.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	metadata map[string]http.Header
+	uploads  map[string]*fakeUpload
+	aborted  []string
+	nextId   int
+
+	// partFaults answers part uploads with the given status codes before accepting them
+	partFaults map[int][]int
+	partGate   chan struct{}
+	inFlight   int
+	partCalls  int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *s3Store) {
+	fake := &fakeS3{
+		objects:    map[string][]byte{},
+		metadata:   map[string]http.Header{},
+		uploads:    map[string]*fakeUpload{},
+		partFaults: map[int][]int{},
+	}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client, err := minio.New(strings.TrimPrefix(server.URL, "http://"), &minio.Options{
+		Creds:  credentials.NewStaticV4("access", "secret", ""),
+		Region: "us-east-1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, &s3Store{client: client, bucket: "bucket"}
+}
+
+func useUploadConfig(t *testing.T, config UploadConfig) {
+	previous := uploadConfig()
+	uploads.mu.Lock()
+	uploads.config = config
+	uploads.mu.Unlock()
+
+	t.Cleanup(func() {
+		uploads.mu.Lock()
+		uploads.config = previous
+		uploads.mu.Unlock()
+	})
+}
+
+// readBody decodes aws-chunked bodies of streaming signed requests.
+func readBody(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Content-Sha256") != "STREAMING-AWS4-HMAC-SHA256-PAYLOAD" {
+		return io.ReadAll(r.Body)
+	}
+
+	body := bufio.NewReader(r.Body)
+	content := []byte{}
+	for {
+		line, err := body.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.ParseInt(strings.SplitN(strings.TrimSpace(line), ";", 2)[0], 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		chunk := make([]byte, size+2)
+		if _, err := io.ReadFull(body, chunk); err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return content, nil
+		}
+		content = append(content, chunk[:size]...)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message></Error>`, code, code)
+}
+
+func (fake *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		fake.initiate(w, r, key)
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		fake.uploadPart(w, r, query)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		fake.complete(w, r, key, query.Get("uploadId"))
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		delete(fake.uploads, query.Get("uploadId"))
+		fake.aborted = append(fake.aborted, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		content, err := readBody(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		fake.objects[key] = content
+		fake.metadata[key] = r.Header.Clone()
+		w.Header().Set("ETag", `"object"`)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (fake *fakeS3) initiate(w http.ResponseWriter, r *http.Request, key string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	fake.nextId++
+	uploadId := fmt.Sprintf("upload-%d", fake.nextId)
+	fake.uploads[uploadId] = &fakeUpload{key: key, metadata: r.Header.Clone(), parts: map[int][]byte{}}
+	fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, uploadId)
+}
+
+func (fake *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values) {
+	number, _ := strconv.Atoi(query.Get("partNumber"))
+
+	fake.mu.Lock()
+	fake.partCalls++
+	faults := fake.partFaults[number]
+	if len(faults) > 0 {
+		fake.partFaults[number] = faults[1:]
+	}
+	fake.inFlight++
+	gate := fake.partGate
+	fake.mu.Unlock()
+
+	defer func() {
+		fake.mu.Lock()
+		fake.inFlight--
+		fake.mu.Unlock()
+	}()
+
+	content, err := readBody(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+
+	if gate != nil {
+		select {
+		case <-gate:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if len(faults) > 0 {
+		writeError(w, faults[0], http.StatusText(faults[0]))
+		return
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	upload, ok := fake.uploads[query.Get("uploadId")]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	upload.parts[number] = content
+	w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, number))
+}
+
+func (fake *fakeS3) complete(w http.ResponseWriter, r *http.Request, key string, uploadId string) {
+	var request struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+
+	upload, ok := fake.uploads[uploadId]
+	if !ok {
+		writeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	content := []byte{}
+	for idx, part := range request.Parts {
+		data, ok := upload.parts[part.PartNumber]
+		if part.PartNumber != idx+1 || !ok || strings.Trim(part.ETag, `"`) != fmt.Sprintf("etag-%d", part.PartNumber) {
+			writeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		content = append(content, data...)
+	}
+
+	delete(fake.uploads, uploadId)
+	fake.objects[key] = content
+	fake.metadata[key] = upload.metadata
+	fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>bucket</Bucket><Key>%s</Key><ETag>"multipart"</ETag></CompleteMultipartUploadResult>`, key)
+}
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for idx := range content {
+		content[idx] = byte(idx % 251)
+	}
+	return content
+}
+
+var testUploadConfig = UploadConfig{PartSize: 1024, Concurrency: 2, MaxRetries: 3, RetryBackoff: time.Millisecond}
+
+func TestUploadSmallObject(t *testing.T) {
+	useUploadConfig(t, testUploadConfig)
+	fake, store := newFakeS3(t)
+
+	content := testContent(1000)
+	if err := store.PutWithMetadata(context.TODO(), "small", bytes.NewReader(content), map[string]string{KEY_ID_METADATA: "k1"}); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	if !bytes.Equal(fake.objects["small"], content) {
+		t.Errorf("wrong object content")
+	}
+	if fake.nextId != 0 {
+		t.Errorf("multipart upload started for a single part object")
+	}
+	if keyId := fake.metadata["small"].Get("X-Amz-Meta-" + KEY_ID_METADATA); keyId != "k1" {
+		t.Errorf("wrong key id metadata %q", keyId)
+	}
+}
+
+func TestUploadMultipart(t *testing.T) {
+	useUploadConfig(t, testUploadConfig)
+	fake, store := newFakeS3(t)
+
+	for _, size := range []int{1024, 1025, 4 * 1024, 10*1024 + 1} {
+		key := fmt.Sprint(size)
+		content := testContent(size)
+		if err := store.PutWithMetadata(context.TODO(), key, bytes.NewReader(content), map[string]string{KEY_ID_METADATA: "k1"}); err != nil {
+			t.Fatalf("%d: failed with error %s", size, err)
+		}
+
+		if !bytes.Equal(fake.objects[key], content) {
+			t.Errorf("%d: wrong object content", size)
+		}
+		if size > 1024 && fake.metadata[key].Get("X-Amz-Meta-"+KEY_ID_METADATA) != "k1" {
+			t.Errorf("%d: metadata missing on multipart upload", size)
+		}
+	}
+
+	if len(fake.uploads) != 0 || len(fake.aborted) != 0 {
+		t.Errorf("unexpected pending %d or aborted %v uploads", len(fake.uploads), fake.aborted)
+	}
+}
+
+func TestUploadRetriesFailedParts(t *testing.T) {
+	useUploadConfig(t, testUploadConfig)
+	fake, store := newFakeS3(t)
+	fake.partFaults[2] = []int{http.StatusInternalServerError, http.StatusServiceUnavailable}
+	fake.partFaults[4] = []int{http.StatusTooManyRequests}
+
+	before := UploadStatistics()
+	content := testContent(5*1024 + 10)
+	if err := store.Put(context.TODO(), "retried", bytes.NewReader(content)); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	if !bytes.Equal(fake.objects["retried"], content) {
+		t.Errorf("wrong object content")
+	}
+	// minio would retry on its own with seekable bodies
+	if fake.partCalls != 6+3 {
+		t.Errorf("expected 9 part requests, got %d", fake.partCalls)
+	}
+	if stats := UploadStatistics(); stats.Retries-before.Retries != 3 || stats.Parts-before.Parts != 6 {
+		t.Errorf("wrong upload statistics %+v", stats)
+	}
+}
+
+func TestUploadAbortsFailedUpload(t *testing.T) {
+	cases := map[string][]int{
+		"retries exhausted": {500, 500, 500, 500},
+		"not retryable":     {http.StatusForbidden},
+	}
+
+	for name, faults := range cases {
+		useUploadConfig(t, testUploadConfig)
+		fake, store := newFakeS3(t)
+		fake.partFaults[3] = faults
+
+		err := store.Put(context.TODO(), "failed", bytes.NewReader(testContent(8*1024)))
+		if err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+		if len(fake.aborted) != 1 || len(fake.uploads) != 0 {
+			t.Errorf("%s: upload was not aborted, pending %d", name, len(fake.uploads))
+		}
+		if _, ok := fake.objects["failed"]; ok {
+			t.Errorf("%s: failed upload was completed", name)
+		}
+		if len(fake.partFaults[3]) != 0 {
+			t.Errorf("%s: wrong number of retries, %d faults left", name, len(fake.partFaults[3]))
+		}
+	}
+}
+
+type sourceReader struct {
+	mu     sync.Mutex
+	reader io.Reader
+	read   int
+}
+
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.mu.Lock()
+	r.read += n
+	r.mu.Unlock()
+	return n, err
+}
+
+func (r *sourceReader) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.read
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not reached")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUploadBoundedMemoryAndCancellation(t *testing.T) {
+	useUploadConfig(t, testUploadConfig)
+	fake, store := newFakeS3(t)
+	fake.partGate = make(chan struct{})
+
+	reader := &sourceReader{reader: bytes.NewReader(testContent(20 * 1024))}
+	ctx, cancel := context.WithCancel(context.TODO())
+	result := make(chan error)
+	go func() {
+		result <- store.Put(ctx, "cancelled", reader)
+	}()
+
+	waitFor(t, func() bool {
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		return fake.inFlight == testUploadConfig.Concurrency
+	})
+	time.Sleep(20 * time.Millisecond)
+
+	// no part is read before a buffer of an uploaded part is released
+	if read := reader.count(); read != testUploadConfig.Concurrency*int(testUploadConfig.PartSize) {
+		t.Errorf("read %d bytes ahead of the upload", read)
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancelled error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("upload not cancelled")
+	}
+
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	if len(fake.aborted) != 1 || len(fake.uploads) != 0 {
+		t.Errorf("cancelled upload was not aborted")
+	}
+}
+
+func TestConfigureUploads(t *testing.T) {
+	useUploadConfig(t, DefaultUploadConfig())
+
+	invalid := []UploadConfig{
+		{PartSize: 1024, Concurrency: 1},
+		{PartSize: MIN_PART_SIZE, Concurrency: 0},
+		{PartSize: MIN_PART_SIZE, Concurrency: 1, MaxRetries: -1},
+	}
+	for _, config := range invalid {
+		if err := ConfigureUploads(config); err == nil {
+			t.Errorf("%+v: expected error", config)
+		}
+	}
+
+	if err := ConfigureUploads(UploadConfig{PartSize: MIN_PART_SIZE, Concurrency: 1}); err != nil || uploadConfig().PartSize != MIN_PART_SIZE {
+		t.Errorf("valid config rejected: %v", err)
+	}
+}
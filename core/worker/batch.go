@@ -29,6 +29,7 @@ L:
 
 			buffer[idx] = data
 			idx++
+			recordsIn.Inc()
 
 			if idx >= batchSize {
 				output <- Batch{Data: buffer}
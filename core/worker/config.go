@@ -1,13 +1,49 @@
 package worker
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+const (
+	LIGHTBYTE_WORKER_CONFIG      = "LIGHTBYTE_WORKER_CONFIG"
+	LIGHTBYTE_WORKER_CONFIG_FILE = "LIGHTBYTE_WORKER_CONFIG_FILE"
 )
 
-const LIGHTBYTE_WORKER_CONFIG = "LIGHTBYTE_WORKER_CONFIG"
+const (
+	CONFIG_FLAG      = "config"
+	CONFIG_FILE_FLAG = "config-file"
+)
+
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+type ConfigError struct {
+	Source string
+	Errors []FieldError
+}
+
+func (e *ConfigError) Error() string {
+	lines := make([]string, len(e.Errors))
+	for idx, fieldErr := range e.Errors {
+		lines[idx] = fmt.Sprintf("%s: %s", fieldErr.Field, fieldErr.Message)
+	}
+	return fmt.Sprintf("invalid %s:\n\t%s", e.Source, strings.Join(lines, "\n\t"))
+}
 
+// Deprecated: use LoadConfig which validates the config against the worker schema.
 func ReadConfigEnvVar(out any) error {
 	config := []byte(os.Getenv(LIGHTBYTE_WORKER_CONFIG))
 
@@ -17,3 +53,233 @@ func ReadConfigEnvVar(out any) error {
 	}
 	return nil
 }
+
+// LoadConfig reads the custom worker config from the process arguments and environment,
+// applies schema defaults, validates it against schema and decodes it into out.
+func LoadConfig(out any, schema []byte) error {
+	return LoadConfigArgs(os.Args[1:], out, schema)
+}
+
+// LoadConfigArgs merges config sources in order of precedence, from lowest to highest:
+// the file from LIGHTBYTE_WORKER_CONFIG_FILE, json from LIGHTBYTE_WORKER_CONFIG,
+// the file from the -config-file flag and json from the -config flag.
+func LoadConfigArgs(args []string, out any, schema []byte) error {
+	flags := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	configJson := flags.String(CONFIG_FLAG, "", "worker config as json")
+	configFile := flags.String(CONFIG_FILE_FLAG, "", "path to the worker config json file")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config := map[string]any{}
+	sources := []struct {
+		name    string
+		content func() ([]byte, error)
+	}{
+		{LIGHTBYTE_WORKER_CONFIG_FILE, func() ([]byte, error) { return readConfigFile(os.Getenv(LIGHTBYTE_WORKER_CONFIG_FILE)) }},
+		{LIGHTBYTE_WORKER_CONFIG, func() ([]byte, error) { return []byte(os.Getenv(LIGHTBYTE_WORKER_CONFIG)), nil }},
+		{"-" + CONFIG_FILE_FLAG, func() ([]byte, error) { return readConfigFile(*configFile) }},
+		{"-" + CONFIG_FLAG, func() ([]byte, error) { return []byte(*configJson), nil }},
+	}
+
+	for _, source := range sources {
+		content, err := source.content()
+		if err != nil {
+			return fmt.Errorf("failed to read worker config from %s: %w", source.name, err)
+		}
+		if len(bytes.TrimSpace(content)) == 0 {
+			continue
+		}
+
+		layer := map[string]any{}
+		if err := json.Unmarshal(content, &layer); err != nil {
+			return fmt.Errorf("failed to parse worker config from %s: %w", source.name, err)
+		}
+		mergeConfig(config, layer)
+	}
+
+	return DecodeConfig(config, out, schema)
+}
+
+// DecodeConfig applies schema defaults to config, validates it and decodes it into out.
+// All invalid fields are reported at once as *ConfigError.
+func DecodeConfig(config map[string]any, out any, schema []byte) error {
+	if schema != nil {
+		compiled, rawSchema, err := compileSchema(schema)
+		if err != nil {
+			return err
+		}
+
+		applyDefaults(rawSchema, config)
+
+		if err := validateConfig(compiled, config); err != nil {
+			return err
+		}
+	}
+
+	content, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, out)
+}
+
+func readConfigFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return os.ReadFile(path)
+}
+
+func mergeConfig(dst map[string]any, src map[string]any) {
+	for key, value := range src {
+		srcMap, srcOk := value.(map[string]any)
+		dstMap, dstOk := dst[key].(map[string]any)
+
+		if srcOk && dstOk {
+			mergeConfig(dstMap, srcMap)
+			continue
+		}
+		dst[key] = value
+	}
+}
+
+func compileSchema(schema []byte) (*jsonschema.Schema, map[string]any, error) {
+	rawSchema := map[string]any{}
+	if err := json.Unmarshal(schema, &rawSchema); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse worker config schema: %w", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("config.schema.json", bytes.NewReader(schema)); err != nil {
+		return nil, nil, err
+	}
+
+	compiled, err := compiler.Compile("config.schema.json")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to compile worker config schema: %w", err)
+	}
+
+	return compiled, rawSchema, nil
+}
+
+func applyDefaults(schema map[string]any, value any) {
+	object, ok := value.(map[string]any)
+	if !ok {
+		return
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	for name, property := range properties {
+		propertySchema, ok := property.(map[string]any)
+		if !ok {
+			continue
+		}
+
+		if _, exists := object[name]; !exists {
+			if defaultValue, hasDefault := propertySchema["default"]; hasDefault {
+				object[name] = defaultValue
+			}
+		}
+		applyDefaults(propertySchema, object[name])
+	}
+
+	if additional, ok := schema["additionalProperties"].(map[string]any); ok {
+		for name, item := range object {
+			if _, declared := properties[name]; !declared {
+				applyDefaults(additional, item)
+			}
+		}
+	}
+}
+
+func validateConfig(schema *jsonschema.Schema, config map[string]any) error {
+	err := schema.Validate(any(config))
+
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+
+	configErr := &ConfigError{Source: "worker config"}
+	collectFieldErrors(validationErr, configErr)
+
+	sort.Slice(configErr.Errors, func(i, j int) bool {
+		return configErr.Errors[i].Field < configErr.Errors[j].Field
+	})
+
+	return configErr
+}
+
+func collectFieldErrors(err *jsonschema.ValidationError, configErr *ConfigError) {
+	if len(err.Causes) == 0 {
+		field := strings.ReplaceAll(strings.TrimPrefix(err.InstanceLocation, "/"), "/", ".")
+		if field == "" {
+			field = "(root)"
+		}
+		configErr.Errors = append(configErr.Errors, FieldError{Field: field, Message: err.Message})
+		return
+	}
+
+	for _, cause := range err.Causes {
+		collectFieldErrors(cause, configErr)
+	}
+}
+
+// envReader reads worker runtime settings from environment variables
+// and collects every invalid one instead of failing on the first.
+type envReader struct {
+	errors []FieldError
+}
+
+func (env *envReader) fail(name string, message string) {
+	env.errors = append(env.errors, FieldError{Field: name, Message: message})
+}
+
+func (env *envReader) string(name string, defaultValue string) string {
+	if value, ok := os.LookupEnv(name); ok && value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func (env *envReader) required(name string) string {
+	value := os.Getenv(name)
+	if value == "" {
+		env.fail(name, "is required")
+	}
+	return value
+}
+
+func (env *envReader) int(name string, defaultValue int, min int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	result, err := strconv.Atoi(value)
+	if err != nil {
+		env.fail(name, fmt.Sprintf("%q is not an integer", value))
+		return defaultValue
+	}
+
+	if result < min {
+		env.fail(name, fmt.Sprintf("must be greater than or equal to %d", min))
+		return defaultValue
+	}
+
+	return result
+}
+
+func (env *envReader) milliseconds(name string, defaultValue int, min int) time.Duration {
+	return time.Millisecond * time.Duration(env.int(name, defaultValue, min))
+}
+
+func (env *envReader) err() error {
+	if len(env.errors) == 0 {
+		return nil
+	}
+	return &ConfigError{Source: "worker environment", Errors: env.errors}
+}
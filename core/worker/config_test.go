@@ -0,0 +1,152 @@
+package worker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"starbyte.io/core/amqp"
+)
+
+var testSchema = []byte(`{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 1},
+		"size": {"type": "integer", "minimum": 1, "default": 10},
+		"nested": {
+			"type": "object",
+			"properties": {"enabled": {"type": "boolean", "default": true}},
+			"default": {}
+		}
+	},
+	"required": ["name"],
+	"additionalProperties": false
+}`)
+
+type testConfig struct {
+	Name   string `json:"name"`
+	Size   int    `json:"size"`
+	Nested struct {
+		Enabled bool `json:"enabled"`
+	} `json:"nested"`
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	t.Setenv(LIGHTBYTE_WORKER_CONFIG, `{"name": "test"}`)
+
+	config := testConfig{}
+	if err := LoadConfigArgs([]string{}, &config, testSchema); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	if config.Name != "test" || config.Size != 10 || !config.Nested.Enabled {
+		t.Errorf("defaults are not applied: %+v", config)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"name": "file", "size": 5, "nested": {"enabled": false}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(LIGHTBYTE_WORKER_CONFIG_FILE, path)
+	t.Setenv(LIGHTBYTE_WORKER_CONFIG, `{"name": "env"}`)
+
+	config := testConfig{}
+	if err := LoadConfigArgs([]string{"-config", `{"size": 7}`}, &config, testSchema); err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+
+	if config.Name != "env" || config.Size != 7 || config.Nested.Enabled {
+		t.Errorf("wrong config sources precedence: %+v", config)
+	}
+}
+
+func TestLoadConfigReportsAllFields(t *testing.T) {
+	t.Setenv(LIGHTBYTE_WORKER_CONFIG, `{"size": 0, "unknown": 1}`)
+
+	config := testConfig{}
+	err := LoadConfigArgs([]string{}, &config, testSchema)
+
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("config error expected, got %v", err)
+	}
+
+	if len(configErr.Errors) != 3 {
+		t.Errorf("expected 3 invalid fields, got %s", configErr)
+	}
+}
+
+func TestEnvReaderReportsAllVariables(t *testing.T) {
+	t.Setenv(LIGHTBYTE_WORKER_AMQP_URI, "")
+	t.Setenv(LIGHTBYTE_WORKER_LISTEN_QUEUE, "requests")
+	t.Setenv(LIGHTBYTE_WORKER_RESPONSE_QUEUE, "responses")
+	t.Setenv(LIGHTBYTE_WORKER_BATCH_SIZE, "zero")
+	t.Setenv(LIGHTBYTE_WORKER_BATCH_TIMEOUT, "0")
+
+	_, err := NewInputWorker(nil)
+
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("config error expected, got %v", err)
+	}
+
+	if len(configErr.Errors) != 3 {
+		t.Errorf("expected 3 invalid variables, got %s", configErr)
+	}
+}
+
+func TestEnvReaderSelectsTransport(t *testing.T) {
+	t.Setenv(LIGHTBYTE_WORKER_NATS_ACK_WAIT, "60000")
+
+	env := &envReader{}
+	broker, ok := newBroker(env, "nats://localhost:4222").(*amqp.NatsJetStreamAmqp)
+	if !ok || broker.AckWait != time.Minute || env.err() != nil {
+		t.Errorf("nats broker expected, got %T %v", broker, env.err())
+	}
+
+	if _, ok := newBroker(env, "postgres://localhost/lightbyte").(*amqp.PostgresAmqp); !ok {
+		t.Errorf("postgres broker expected")
+	}
+
+	if _, ok := newBroker(env, "mem://pipeline").(*amqp.MemoryAmqp); !ok {
+		t.Errorf("memory broker expected")
+	}
+
+	if _, ok := newBroker(env, "amqp://localhost").(*amqp.RabbitMqAmqp); !ok {
+		t.Errorf("rabbitmq broker expected")
+	}
+
+	newBroker(env, "kafka://localhost")
+	if env.err() == nil {
+		t.Errorf("unsupported scheme is not reported")
+	}
+}
+
+func TestEnvReaderRequiresStepIdForHeartbeats(t *testing.T) {
+	t.Setenv(LIGHTBYTE_WORKER_HEARTBEAT_QUEUE, "heartbeats")
+
+	for _, test := range []struct {
+		stepId string
+		valid  bool
+	}{
+		{stepId: "", valid: false},
+		{stepId: "step", valid: false},
+		{stepId: "6ba7b810-9dad-11d1-80b4-00c04fd430c8", valid: true},
+	} {
+		t.Setenv(LIGHTBYTE_WORKER_STEP_ID, test.stepId)
+
+		env := &envReader{}
+		config := readHeartbeatConfig(env)
+		if valid := env.err() == nil; valid != test.valid {
+			t.Errorf("step id %q: expected valid %v, got error %v", test.stepId, test.valid, env.err())
+		}
+		if test.valid && config.stepId.String() != test.stepId {
+			t.Errorf("expected step id %s, got %s", test.stepId, config.stepId)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"log/slog"
+
+	"starbyte.io/core/amqp"
+)
+
+const (
+	LIGHTBYTE_WORKER_AMQP_RECONNECT_BACKOFF      = "LIGHTBYTE_WORKER_AMQP_RECONNECT_BACKOFF"
+	LIGHTBYTE_WORKER_AMQP_RECONNECT_MAX_BACKOFF  = "LIGHTBYTE_WORKER_AMQP_RECONNECT_MAX_BACKOFF"
+	LIGHTBYTE_WORKER_AMQP_RECONNECT_ATTEMPTS     = "LIGHTBYTE_WORKER_AMQP_RECONNECT_ATTEMPTS"
+	LIGHTBYTE_WORKER_AMQP_PUBLISH_CHANNELS       = "LIGHTBYTE_WORKER_AMQP_PUBLISH_CHANNELS"
+	LIGHTBYTE_WORKER_AMQP_CONFIRM_TIMEOUT        = "LIGHTBYTE_WORKER_AMQP_CONFIRM_TIMEOUT"
+	LIGHTBYTE_WORKER_AMQP_DELIVERY_LIMIT         = "LIGHTBYTE_WORKER_AMQP_DELIVERY_LIMIT"
+	LIGHTBYTE_WORKER_AMQP_PREFETCH               = "LIGHTBYTE_WORKER_AMQP_PREFETCH"
+	LIGHTBYTE_WORKER_NATS_ACK_WAIT               = "LIGHTBYTE_WORKER_NATS_ACK_WAIT"
+	LIGHTBYTE_WORKER_POSTGRES_VISIBILITY_TIMEOUT = "LIGHTBYTE_WORKER_POSTGRES_VISIBILITY_TIMEOUT"
+)
+
+// readReconnectConfig reads broker reconnection settings, backoffs are in milliseconds
+// and 0 attempts reconnect until the worker stops.
+func readReconnectConfig(env *envReader) amqp.ReconnectConfig {
+	defaults := amqp.DefaultReconnectConfig()
+
+	return amqp.ReconnectConfig{
+		MinBackoff:  env.milliseconds(LIGHTBYTE_WORKER_AMQP_RECONNECT_BACKOFF, int(defaults.MinBackoff.Milliseconds()), 1),
+		MaxBackoff:  env.milliseconds(LIGHTBYTE_WORKER_AMQP_RECONNECT_MAX_BACKOFF, int(defaults.MaxBackoff.Milliseconds()), 1),
+		MaxAttempts: env.int(LIGHTBYTE_WORKER_AMQP_RECONNECT_ATTEMPTS, defaults.MaxAttempts, 0),
+	}
+}
+
+// newBroker configures the connection to the broker of uri, selected by its scheme. The confirm timeout, NATS ack wait
+// and Postgres visibility timeout are in milliseconds, a negative delivery limit never dead-letters redelivered requests.
+func newBroker(env *envReader, uri string) amqp.Amqp {
+	transport, err := amqp.Transport(uri)
+	if err != nil && uri != "" {
+		env.fail(LIGHTBYTE_WORKER_AMQP_URI, err.Error())
+	}
+
+	reconnect := readReconnectConfig(env)
+	confirmTimeout := env.milliseconds(LIGHTBYTE_WORKER_AMQP_CONFIRM_TIMEOUT, int(amqp.DEFAULT_CONFIRM_TIMEOUT.Milliseconds()), 1)
+	deliveryLimit := env.int(LIGHTBYTE_WORKER_AMQP_DELIVERY_LIMIT, amqp.DEFAULT_DELIVERY_LIMIT, -1)
+
+	switch transport {
+	case amqp.TRANSPORT_NATS:
+		return &amqp.NatsJetStreamAmqp{
+			Reconnect:      reconnect,
+			ConfirmTimeout: confirmTimeout,
+			DeliveryLimit:  deliveryLimit,
+			AckWait:        env.milliseconds(LIGHTBYTE_WORKER_NATS_ACK_WAIT, int(amqp.DEFAULT_ACK_WAIT.Milliseconds()), 1),
+		}
+	case amqp.TRANSPORT_POSTGRES:
+		return &amqp.PostgresAmqp{
+			Reconnect:         reconnect,
+			DeliveryLimit:     deliveryLimit,
+			VisibilityTimeout: env.milliseconds(LIGHTBYTE_WORKER_POSTGRES_VISIBILITY_TIMEOUT, int(amqp.DEFAULT_VISIBILITY_TIMEOUT.Milliseconds()), 1),
+		}
+	case amqp.TRANSPORT_MEMORY:
+		return &amqp.MemoryAmqp{DeliveryLimit: deliveryLimit}
+	}
+
+	return &amqp.RabbitMqAmqp{
+		Reconnect:       reconnect,
+		PublishChannels: env.int(LIGHTBYTE_WORKER_AMQP_PUBLISH_CHANNELS, amqp.DEFAULT_PUBLISH_CHANNELS, 1),
+		ConfirmTimeout:  confirmTimeout,
+		DeliveryLimit:   deliveryLimit,
+		Prefetch:        env.int(LIGHTBYTE_WORKER_AMQP_PREFETCH, amqp.DEFAULT_PREFETCH, 1),
+	}
+}
+
+// watchConnection follows broker connection state changes for readiness, logs and metrics.
+func (worker *BaseWorker) watchConnection(ctx context.Context) {
+	notifier, ok := worker.amqp.(amqp.AmqpStateNotifier)
+	if !ok {
+		return
+	}
+
+	events := notifier.NotifyState(make(chan amqp.ConnectionEvent, 16))
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case event := <-events:
+				worker.state.connected.Store(event.State == amqp.STATE_CONNECTED)
+				amqpConnectionEvents.WithLabelValues(string(event.State)).Inc()
+
+				switch event.State {
+				case amqp.STATE_CONNECTED:
+					slog.Info("connected to amqp broker")
+				case amqp.STATE_DISCONNECTED:
+					slog.Warn("amqp broker connection lost", "Attempt", event.Attempt, "Error", event.Error)
+				case amqp.STATE_CLOSED:
+					slog.Info("amqp broker connection closed", "Error", event.Error)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"starbyte.io/core/amqp"
+)
+
+const LIGHTBYTE_WORKER_HTTP_ADDR = "LIGHTBYTE_WORKER_HTTP_ADDR"
+
+const HTTP_SHUTDOWN_TIMEOUT = 5 * time.Second
+
+type workerState struct {
+	connected atomic.Bool
+	consuming atomic.Bool
+}
+
+func (worker *BaseWorker) isReady() bool {
+	if !worker.state.connected.Load() || !worker.state.consuming.Load() {
+		return false
+	}
+
+	if conn, ok := worker.amqp.(amqp.AmqpConnectionState); ok {
+		return conn.IsConnected()
+	}
+
+	return true
+}
+
+func (worker *BaseWorker) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !worker.isReady() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("not ready"))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok"))
+	})
+
+	mux.Handle("/metrics", promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{}))
+
+	return mux
+}
+
+// serveHealth runs the health and metrics http server until ctx is done.
+// It is a no-op when LIGHTBYTE_WORKER_HTTP_ADDR is not set.
+func (worker *BaseWorker) serveHealth(ctx context.Context) {
+	addr := worker.httpAddr
+	if addr == "" {
+		return
+	}
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           worker.healthHandler(),
+		ReadHeaderTimeout: HTTP_SHUTDOWN_TIMEOUT,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), HTTP_SHUTDOWN_TIMEOUT)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("health server failed", "Addr", addr, "Error", err)
+		}
+	}()
+}
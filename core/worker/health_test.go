@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"starbyte.io/core/amqp"
+	s3io "starbyte.io/core/s3"
+)
+
+func get(t *testing.T, handler http.Handler, path string) (int, string) {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		connected bool
+		consuming bool
+		broker    amqp.Amqp
+		ready     bool
+	}{
+		{name: "starting"},
+		{name: "connected", connected: true},
+		{name: "consuming", connected: true, consuming: true, ready: true},
+		{name: "broker disconnected", connected: true, consuming: true, broker: &amqp.MemoryAmqp{}},
+	} {
+		worker := &BaseWorker{amqp: test.broker}
+		worker.state.connected.Store(test.connected)
+		worker.state.consuming.Store(test.consuming)
+		handler := worker.healthHandler()
+
+		if code, body := get(t, handler, "/healthz"); code != http.StatusOK || body != "ok" {
+			t.Errorf("%s: expected /healthz ok, got %d %q", test.name, code, body)
+		}
+
+		expected := http.StatusServiceUnavailable
+		if test.ready {
+			expected = http.StatusOK
+		}
+		if code, _ := get(t, handler, "/readyz"); code != expected {
+			t.Errorf("%s: expected /readyz %d, got %d", test.name, expected, code)
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	recordsIn.Inc()
+
+	code, body := get(t, (&BaseWorker{}).healthHandler(), "/metrics")
+	if code != http.StatusOK {
+		t.Fatalf("expected /metrics ok, got %d", code)
+	}
+	for _, metric := range []string{"starbyte_worker_records_in_total", "starbyte_worker_s3_clients", "go_goroutines"} {
+		if !strings.Contains(body, metric) {
+			t.Errorf("expected metric %s in %s", metric, body)
+		}
+	}
+}
+
+func TestServeHealthOnConfiguredAddress(t *testing.T) {
+	newTestBroker(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	t.Setenv(LIGHTBYTE_WORKER_HTTP_ADDR, addr)
+
+	worker, err := NewWorker()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	worker.serveHealth(ctx)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(fmt.Sprintf("http://%s/healthz", addr))
+		if err == nil {
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+				t.Errorf("expected /healthz ok, got %d %q", resp.StatusCode, body)
+			}
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("health server not listening on %s: %s", addr, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func s3LatencySum(t *testing.T, operation string) float64 {
+	t.Helper()
+
+	metric := &dto.Metric{}
+	if err := s3Latency.WithLabelValues(operation).(interface{ Write(*dto.Metric) error }).Write(metric); err != nil {
+		t.Fatal(err)
+	}
+	return metric.GetHistogram().GetSampleSum()
+}
+
+func TestS3LatencyExcludesProcessing(t *testing.T) {
+	const processing = 200 * time.Millisecond
+	uri := fmt.Sprintf("mem://%s-%d/batch.cbor", t.Name(), time.Now().UnixNano())
+
+	before := s3LatencySum(t, "write")
+	_, err := writeBatch(context.TODO(), uri, testBatchOptions, func(writer s3io.RecordWriter) error {
+		for i := 0; i < 4; i++ {
+			time.Sleep(processing / 4)
+			if err := writer.Write(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written := s3LatencySum(t, "write") - before; written >= (processing / 2).Seconds() {
+		t.Errorf("write latency %.3fs includes the time producing records", written)
+	}
+
+	before = s3LatencySum(t, "read")
+	ctx, cancel := context.WithCancelCause(context.TODO())
+	defer cancel(nil)
+	input, err := (&BaseWorker{}).ReadInputFile(ctx, cancel, uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range input {
+		time.Sleep(processing / 4)
+	}
+	if read := s3LatencySum(t, "read") - before; read >= (processing / 2).Seconds() {
+		t.Errorf("read latency %.3fs includes the time processing records", read)
+	}
+}
@@ -0,0 +1,113 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/rpc"
+)
+
+const (
+	LIGHTBYTE_WORKER_STEP_ID            = "LIGHTBYTE_WORKER_STEP_ID"
+	LIGHTBYTE_WORKER_INSTANCE_ID        = "LIGHTBYTE_WORKER_INSTANCE_ID"
+	LIGHTBYTE_WORKER_VERSION            = "LIGHTBYTE_WORKER_VERSION"
+	LIGHTBYTE_WORKER_HEARTBEAT_QUEUE    = "LIGHTBYTE_WORKER_HEARTBEAT_QUEUE"
+	LIGHTBYTE_WORKER_HEARTBEAT_INTERVAL = "LIGHTBYTE_WORKER_HEARTBEAT_INTERVAL"
+)
+
+const DEFAULT_HEARTBEAT_INTERVAL = 5000 // 5 seconds
+
+type heartbeatConfig struct {
+	queue      string
+	interval   time.Duration
+	stepId     uuid.UUID
+	instanceId string
+	version    string
+}
+
+func readHeartbeatConfig(env *envReader) heartbeatConfig {
+	config := heartbeatConfig{
+		queue:      env.string(LIGHTBYTE_WORKER_HEARTBEAT_QUEUE, ""),
+		interval:   env.milliseconds(LIGHTBYTE_WORKER_HEARTBEAT_INTERVAL, DEFAULT_HEARTBEAT_INTERVAL, 1),
+		instanceId: env.string(LIGHTBYTE_WORKER_INSTANCE_ID, ""),
+		version:    env.string(LIGHTBYTE_WORKER_VERSION, ""),
+	}
+
+	// the instance id also identifies the worker as producer of its messages
+	if config.instanceId == "" {
+		hostname, _ := os.Hostname()
+		config.instanceId = fmt.Sprintf("%s-%s", hostname, uuid.NewString()[:8])
+	}
+
+	if config.queue == "" {
+		return config
+	}
+
+	stepId, err := uuid.Parse(env.string(LIGHTBYTE_WORKER_STEP_ID, ""))
+	if err != nil {
+		env.fail(LIGHTBYTE_WORKER_STEP_ID, "must be a valid step uuid when heartbeats are enabled")
+	}
+	config.stepId = stepId
+
+	if config.version == "" {
+		config.version = "unknown"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			config.version = info.Main.Version
+		}
+	}
+
+	return config
+}
+
+type currentBatch struct {
+	correlationId atomic.Pointer[uuid.UUID]
+}
+
+func (batch *currentBatch) start(correlationId uuid.UUID) {
+	batch.correlationId.Store(&correlationId)
+}
+
+func (batch *currentBatch) finish() {
+	batch.correlationId.Store(nil)
+}
+
+func (worker *BaseWorker) sendHeartbeat(ctx context.Context) error {
+	return rpc.Publish(ctx, worker.amqp, worker.heartbeat.queue, rpc.Heartbeat{
+		StepId:        worker.heartbeat.stepId,
+		InstanceId:    worker.heartbeat.instanceId,
+		Version:       worker.heartbeat.version,
+		CorrelationId: worker.current.correlationId.Load(),
+		SentAt:        time.Now().UTC(),
+	}, worker.heartbeat.instanceId)
+}
+
+// runHeartbeat publishes heartbeats until ctx is done.
+// It is a no-op when LIGHTBYTE_WORKER_HEARTBEAT_QUEUE is not set.
+func (worker *BaseWorker) runHeartbeat(ctx context.Context) {
+	if worker.heartbeat.queue == "" {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(worker.heartbeat.interval)
+		defer ticker.Stop()
+
+		for {
+			if err := worker.sendHeartbeat(ctx); err != nil && ctx.Err() == nil {
+				slog.Warn("failed to send heartbeat", "Queue", worker.heartbeat.queue, "Error", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
@@ -2,10 +2,9 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"os"
-	"strconv"
+	"log/slog"
 	"sync"
 
 	"starbyte.io/core/rpc"
@@ -19,6 +18,14 @@ const (
 	LIGHTBYTE_WORKER_BATCH_TIMEOUT = "LIGHTBYTE_WORKER_BATCH_TIMEOUT"
 )
 
+const (
+	DEFAULT_BATCH_SIZE    = 1000
+	DEFAULT_BATCH_TIMEOUT = 1000 // 1 second
+)
+
+// ErrBatchNotCommittable stops a committing input whose batch was not reported written, its records are read again after a restart.
+var ErrBatchNotCommittable = errors.New("batch not written, input records can not be committed past it")
+
 type InputWorker struct {
 	*BaseWorker
 	input        sdk.Input
@@ -27,18 +34,13 @@ type InputWorker struct {
 }
 
 func NewInputWorker(input sdk.Input) (*InputWorker, error) {
-	worker, err := NewWorker()
-	if err != nil {
-		return nil, err
-	}
+	env := &envReader{}
+	worker := newWorker(env)
 
-	batchSize, err := strconv.Atoi(os.Getenv(LIGHTBYTE_WORKER_BATCH_SIZE))
-	if err != nil {
-		return nil, err
-	}
+	batchSize := env.int(LIGHTBYTE_WORKER_BATCH_SIZE, DEFAULT_BATCH_SIZE, 1)
+	batchTimeout := env.int(LIGHTBYTE_WORKER_BATCH_TIMEOUT, DEFAULT_BATCH_TIMEOUT, 1)
 
-	batchTimeout, err := strconv.Atoi(os.Getenv(LIGHTBYTE_WORKER_BATCH_TIMEOUT))
-	if err != nil {
+	if err := env.err(); err != nil {
 		return nil, err
 	}
 
@@ -50,101 +52,165 @@ func NewInputWorker(input sdk.Input) (*InputWorker, error) {
 	}, nil
 }
 
-func writeOutput(ctx context.Context, batch Batch, fileUri string) error {
-	out, in := io.Pipe()
-	writeWg := sync.WaitGroup{}
-
-	ctx, cancel := context.WithCancelCause(ctx)
-	writeWg.Add(2)
-	go func() {
-		defer in.Close()
-		defer writeWg.Done()
-
-		cborWriter, err := s3io.NewWriter(in)
-
-		if err != nil {
-			cancel(err)
-		}
-
+func writeOutput(ctx context.Context, batch Batch, fileUri string, options s3io.BatchOptions) (*s3io.Manifest, error) {
+	return writeBatch(ctx, fileUri, options, func(recordWriter s3io.RecordWriter) error {
 		for _, rec := range batch.Data {
-			cborWriter.Write(rec)
+			if err := recordWriter.Write(rec); err != nil {
+				return err
+			}
+			recordsOut.Inc()
 		}
+		return nil
+	})
+}
 
-		cborWriter.Close()
-	}()
-
-	go func() {
-		defer out.Close()
-		defer writeWg.Done()
-
-		err := s3io.Write(ctx, fileUri, out)
-		if err != nil {
-			cancel(err)
-		}
-	}()
-	writeWg.Wait()
+// commit commits the records of a batch to inputs implementing sdk.InputCommitter. A failed commit is
+// logged only, the records are read again after a restart.
+func (worker *InputWorker) commit(ctx context.Context, batch *Batch) {
+	committer, ok := worker.input.(sdk.InputCommitter)
+	if !ok || batch == nil {
+		return
+	}
+	if err := committer.Commit(ctx, batch.Data); err != nil {
+		slog.Error("failed to commit input records", "Records", len(batch.Data), "Error", err)
+	}
+}
 
-	return context.Cause(ctx)
+// reply publishes the response to message, then acknowledges it. A response which is not confirmed requeues
+// the request, it reports whether the response was published.
+func (worker *InputWorker) reply(ctx context.Context, message rpc.ProcessRequest, resp rpc.ProcessResponse) bool {
+	if err := worker.Publish(ctx, resp); err != nil {
+		slog.Error("failed to publish process response", "CorrelationId", message.CorrelationId, "Error", err)
+		message.Nack(false, true)
+		return false
+	}
+	message.Ack(false)
+	return true
 }
 
-func (worker *InputWorker) processMessages(ctx context.Context, messages <-chan rpc.ProcessRequest, batches <-chan Batch) {
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
+// processMessages answers requests with the batches of the input. A batch of a committing input which is not written
+// stops the input with failInput, committing later batches would commit past its records and lose them.
+func (worker *InputWorker) processMessages(ctx context.Context, messages <-chan rpc.ProcessRequest, batches <-chan Batch, inputCtx context.Context, failInput context.CancelCauseFunc) {
+	_, committing := worker.input.(sdk.InputCommitter)
+	// the coordinator requests the next batch only after it recorded the previous one, so the
+	// written batch is committed when the next request arrives
+	var written *Batch
+	// unreported is the batch of a request requeued because its response was not published, it answers the next request
+	var unreported *Batch
 	for message := range messages {
-		batch, ok := <-batches
+		worker.commit(ctx, written)
+		written = nil
+
+		if isShutdown(inputCtx) {
+			message.Nack(false, true)
+			continue
+		}
+
+		batch, ok := Batch{}, true
+		if unreported != nil {
+			batch, unreported = *unreported, nil
+		} else {
+			batch, ok = <-batches
+		}
 		if !ok {
-			message.Ack(false)
-			worker.Publish(ctx, rpc.ProcessResponse{
-				CorrelationId: message.CorrelationId,
-				Status:        rpc.ALLDONE,
-			})
-			cancel()
+			err := context.Cause(inputCtx)
+			switch {
+			case isShutdown(inputCtx):
+				message.Nack(false, true)
+			case err != nil:
+				if !worker.reply(ctx, message, newErrorResponse(message, err)) {
+					continue
+				}
+			default:
+				if !worker.reply(ctx, message, rpc.ProcessResponse{CorrelationId: message.CorrelationId, Status: rpc.ALLDONE}) {
+					continue
+				}
+			}
 			break
 		}
-		err := writeOutput(ctx, batch, message.ResultUri)
+		worker.current.start(message.CorrelationId)
+		options, err := s3io.ParseBatchOptions(message.Format, message.Compression, message.Schema)
+		var manifest *s3io.Manifest
+		if err == nil {
+			manifest, err = writeOutput(ctx, batch, message.ResultUri, options)
+		}
+		worker.current.finish()
+		if ctx.Err() != nil {
+			slog.Warn("batch interrupted by shutdown", "CorrelationId", message.CorrelationId)
+			message.Nack(false, true)
+			break
+		}
+		resp := rpc.ProcessResponse{
+			CorrelationId: message.CorrelationId,
+			ResultUri:     message.ResultUri,
+			Status:        rpc.OK,
+			Manifest:      manifest,
+		}
 		if err != nil {
-			message.Ack(false)
-			worker.Publish(ctx, rpc.ProcessResponse{
-				CorrelationId: message.CorrelationId,
-				Status:        rpc.ERROR,
-				Error:         fmt.Sprintf("%e", err),
-			})
-		} else {
-			message.Ack(false)
-			worker.Publish(ctx, rpc.ProcessResponse{
-				CorrelationId: message.CorrelationId,
-				ResultUri:     message.ResultUri,
-				Status:        rpc.OK,
-			})
+			resp = newErrorResponse(message, err)
+		}
+
+		if !worker.reply(ctx, message, resp) {
+			unreported = &batch
+			continue
+		}
+		batchesProcessed.WithLabelValues(string(resp.Status)).Inc()
+
+		if resp.Status == rpc.OK {
+			written = &batch
+		} else if committing {
+			failInput(fmt.Errorf("%w: %d records of request %s", ErrBatchNotCommittable, len(batch.Data), message.CorrelationId))
+			break
 		}
 	}
 }
 
 func (worker *InputWorker) Run() error {
-	ctx := context.Background()
-	processCtx := context.Background()
+	return worker.RunContext(context.Background())
+}
+
+// RunContext processes requests until ctx is done, which shuts the worker down like SIGTERM.
+func (worker *InputWorker) RunContext(ctx context.Context) error {
+	listenCtx, processCtx, stop := worker.shutdownContexts(ctx)
+	defer stop()
 
-	err := worker.Listen(ctx)
+	err := worker.Listen(processCtx)
 	defer worker.Close()
 	if err != nil {
 		return err
 	}
 
-	messagesCh, err := worker.Messages(ctx)
+	messagesCh, err := worker.Messages(listenCtx)
 	if err != nil {
 		return err
 	}
 
+	inputCtx, cancel := context.WithCancelCause(listenCtx)
+	defer cancel(nil)
+
 	rawInput := make(chan any, 1)
 	batchCh := make(chan Batch, 1)
 
 	wg := &sync.WaitGroup{}
 
-	utils.RunInWg(wg, func() { worker.input.Read(processCtx, rawInput) })
-	utils.RunInWg(wg, func() { ChunkToBatch(processCtx, rawInput, batchCh, worker.batchSize, worker.batchTimeout) })
-	utils.RunInWg(wg, func() { worker.processMessages(ctx, messagesCh, batchCh) })
+	utils.RunInWg(wg, func() {
+		if err := worker.input.Read(inputCtx, rawInput); err != nil {
+			cancel(err)
+		}
+	})
+	utils.RunInWg(wg, func() { ChunkToBatch(inputCtx, rawInput, batchCh, worker.batchSize, worker.batchTimeout) })
+	utils.RunInWg(wg, func() {
+		worker.processMessages(processCtx, messagesCh, batchCh, inputCtx, cancel)
+		cancel(nil)
+		// release input goroutines blocked on batches nobody will request anymore
+		for range batchCh {
+		}
+	})
 
 	wg.Wait()
 
-	return context.Cause(processCtx)
+	if err := context.Cause(inputCtx); err != nil && !isShutdown(inputCtx) && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
 }
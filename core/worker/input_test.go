@@ -0,0 +1,93 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"starbyte.io/core/amqp"
+	"starbyte.io/core/rpc"
+)
+
+// countInput sends count records.
+type countInput struct {
+	count int
+}
+
+func (input countInput) Read(ctx context.Context, output chan<- any) error {
+	defer close(output)
+	for i := 0; i < input.count; i++ {
+		select {
+		case output <- map[string]any{"seq": i}:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+	}
+	return nil
+}
+
+// unconfirmedBroker fails the first failures publishes like a broker which did not confirm them.
+type unconfirmedBroker struct {
+	amqp.Amqp
+	mu       sync.Mutex
+	failures int
+}
+
+func (broker *unconfirmedBroker) Publish(ctx context.Context, queueName string, message any) error {
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+
+	if broker.failures > 0 {
+		broker.failures--
+		return errors.New("publish not confirmed")
+	}
+	return broker.Amqp.Publish(ctx, queueName, message)
+}
+
+func TestInputWorkerRequeuesUnpublishedResponses(t *testing.T) {
+	for _, failures := range []int{0, 1, 3} {
+		broker := newTestBroker(t)
+		t.Setenv(LIGHTBYTE_WORKER_BATCH_SIZE, "2")
+		worker, err := NewInputWorker(countInput{count: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		worker.amqp = &unconfirmedBroker{Amqp: worker.amqp, failures: failures}
+		runWorker(t, worker.RunContext)
+
+		records := int64(0)
+		for i := 0; i < 2; i++ {
+			request := broker.request(t, rpc.ProcessRequest{})
+			resp := broker.response(t)
+			if resp.Status != rpc.OK || resp.CorrelationId != request.CorrelationId {
+				t.Fatalf("%d failures: expected an OK response to %s, got %+v", failures, request.CorrelationId, resp)
+			}
+			records += resp.Manifest.Records
+		}
+		// the batch of a response which was not published answers the redelivered request
+		if records != 4 {
+			t.Errorf("%d failures: expected 4 records, got %d", failures, records)
+		}
+
+		broker.request(t, rpc.ProcessRequest{})
+		if resp := broker.response(t); resp.Status != rpc.ALLDONE {
+			t.Errorf("%d failures: expected ALLDONE, got %+v", failures, resp)
+		}
+	}
+}
+
+func TestInputWorkerRequeuesUnpublishedAllDone(t *testing.T) {
+	broker := newTestBroker(t)
+	worker, err := NewInputWorker(countInput{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	worker.amqp = &unconfirmedBroker{Amqp: worker.amqp, failures: 2}
+	runWorker(t, worker.RunContext)
+
+	broker.request(t, rpc.ProcessRequest{})
+	if resp := broker.response(t); resp.Status != rpc.ALLDONE {
+		t.Errorf("expected ALLDONE, got %+v", resp)
+	}
+}
@@ -0,0 +1,139 @@
+package worker
+
+import (
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	s3io "starbyte.io/core/s3"
+)
+
+const METRICS_NAMESPACE = "starbyte_worker"
+
+var (
+	metricsRegistry = prometheus.NewRegistry()
+
+	batchesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "batches_processed_total",
+		Help:      "Number of processed batches by result status.",
+	}, []string{"status"})
+
+	recordsIn = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "records_in_total",
+		Help:      "Number of records read by the worker.",
+	})
+
+	recordsOut = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "records_out_total",
+		Help:      "Number of records written by the worker.",
+	})
+
+	transformErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "transform_errors_total",
+		Help:      "Number of records failed to transform by applied error policy.",
+	}, []string{"policy"})
+
+	s3Bytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "s3_bytes_total",
+		Help:      "Number of bytes transferred from and to object storage.",
+	}, []string{"operation"})
+
+	s3Latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "s3_duration_seconds",
+		Help:      "Duration of object storage reads and writes.",
+		Buckets:   prometheus.ExponentialBuckets(0.005, 2, 14),
+	}, []string{"operation"})
+
+	s3ClientCacheHits = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "s3_client_cache_hits_total",
+		Help:      "Number of object storage operations which reused a cached client.",
+	}, func() float64 { return float64(s3io.ClientCacheStatistics().Hits) })
+
+	s3ClientCacheMisses = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "s3_client_cache_misses_total",
+		Help:      "Number of object storage clients created.",
+	}, func() float64 { return float64(s3io.ClientCacheStatistics().Misses) })
+
+	s3Clients = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "s3_clients",
+		Help:      "Number of cached object storage clients.",
+	}, func() float64 { return float64(s3io.ClientCacheStatistics().Clients) })
+
+	amqpConnectionEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "amqp_connection_events_total",
+		Help:      "Number of broker connection state changes by state.",
+	}, []string{"state"})
+
+	s3UploadParts = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "s3_upload_parts_total",
+		Help:      "Number of multipart upload parts sent to object storage.",
+	}, func() float64 { return float64(s3io.UploadStatistics().Parts) })
+
+	s3UploadRetries = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "s3_upload_retries_total",
+		Help:      "Number of retried object storage upload requests.",
+	}, func() float64 { return float64(s3io.UploadStatistics().Retries) })
+
+	s3UploadsAborted = prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Name:      "s3_uploads_aborted_total",
+		Help:      "Number of multipart uploads aborted after a failure or cancellation.",
+	}, func() float64 { return float64(s3io.UploadStatistics().Aborted) })
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		batchesProcessed,
+		recordsIn,
+		recordsOut,
+		transformErrors,
+		s3Bytes,
+		s3Latency,
+		s3ClientCacheHits,
+		s3ClientCacheMisses,
+		s3Clients,
+		s3UploadParts,
+		s3UploadRetries,
+		s3UploadsAborted,
+		amqpConnectionEvents,
+	)
+}
+
+// meteredReader counts the bytes transferred and the time spent blocked in Read.
+// Reading an object this is time waiting for storage, feeding a write it is time waiting for records.
+type meteredReader struct {
+	io.ReadCloser
+	operation string
+	blocked   time.Duration
+}
+
+func newMeteredReader(reader io.ReadCloser, operation string) *meteredReader {
+	return &meteredReader{ReadCloser: reader, operation: operation}
+}
+
+func (reader *meteredReader) Read(p []byte) (int, error) {
+	startedAt := time.Now()
+	n, err := reader.ReadCloser.Read(p)
+	reader.blocked += time.Since(startedAt)
+	s3Bytes.WithLabelValues(reader.operation).Add(float64(n))
+	return n, err
+}
+
+func observeS3Latency(operation string, duration time.Duration) {
+	s3Latency.WithLabelValues(operation).Observe(duration.Seconds())
+}
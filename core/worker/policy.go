@@ -0,0 +1,45 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	s3io "starbyte.io/core/s3"
+)
+
+const LIGHTBYTE_WORKER_ERROR_POLICY = "LIGHTBYTE_WORKER_ERROR_POLICY"
+
+const QUARANTINE_URI_SUFFIX = ".quarantine"
+
+type ErrorPolicy string
+
+const (
+	FAIL       ErrorPolicy = "fail"
+	SKIP       ErrorPolicy = "skip"
+	QUARANTINE ErrorPolicy = "quarantine"
+)
+
+var ErrUnknownErrorPolicy = errors.New("unknown record error policy")
+
+type RecordError struct {
+	Record any    `cbor:"record"`
+	Error  string `cbor:"error"`
+}
+
+func ParseErrorPolicy(value string) (ErrorPolicy, error) {
+	policy := ErrorPolicy(strings.ToLower(strings.TrimSpace(value)))
+
+	switch policy {
+	case "":
+		return FAIL, nil
+	case FAIL, SKIP, QUARANTINE:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnknownErrorPolicy, value)
+}
+
+func getQuarantineUri(resultUri string) string {
+	return s3io.WithSuffix(resultUri, QUARANTINE_URI_SUFFIX)
+}
@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/rpc"
+)
+
+func TestParseErrorPolicy(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected ErrorPolicy
+		err      error
+	}{
+		{value: "", expected: FAIL},
+		{value: "fail", expected: FAIL},
+		{value: " Skip ", expected: SKIP},
+		{value: "QUARANTINE", expected: QUARANTINE},
+		{value: "retry", err: ErrUnknownErrorPolicy},
+	} {
+		policy, err := ParseErrorPolicy(test.value)
+		if !errors.Is(err, test.err) || policy != test.expected {
+			t.Errorf("%q: expected %q and error %v, got %q and %v", test.value, test.expected, test.err, policy, err)
+		}
+	}
+}
+
+// rejectingStep fails records starting with "bad".
+type rejectingStep struct{}
+
+func (rejectingStep) Transform(data any) (any, error) {
+	if record, _ := data.(string); strings.HasPrefix(record, "bad") {
+		return nil, fmt.Errorf("rejected %s", record)
+	}
+	return data, nil
+}
+
+func TestProcessMessageErrorPolicies(t *testing.T) {
+	for _, test := range []struct {
+		policy      ErrorPolicy
+		status      rpc.ProcessResult
+		records     int64
+		skipped     int
+		quarantined int
+	}{
+		{policy: FAIL, status: rpc.ERROR},
+		{policy: SKIP, status: rpc.OK, records: 2, skipped: 2},
+		{policy: QUARANTINE, status: rpc.OK, records: 2, quarantined: 2},
+	} {
+		resourceUri := fmt.Sprintf("mem://policy/%s/input.cbor", test.policy)
+		resultUri := fmt.Sprintf("mem://policy/%s/result.cbor", test.policy)
+		writeTestBatch(t, resourceUri, testBatchOptions, "ok-1", "bad-2", "ok-3", "bad-4")
+
+		worker := &StepWorker{BaseWorker: &BaseWorker{}, step: rejectingStep{}, errorPolicy: test.policy}
+		resp := worker.processMessage(context.TODO(), rpc.ProcessRequest{
+			CorrelationId: uuid.New(),
+			ResourceUri:   resourceUri,
+			ResultUri:     resultUri,
+			Compression:   testBatchOptions.Compression.String(),
+		})
+
+		if resp.Status != test.status {
+			t.Fatalf("%s: expected %s response, got %+v", test.policy, test.status, resp)
+		}
+		if test.status == rpc.ERROR {
+			if !strings.Contains(resp.Error, "record transform failed: rejected bad-2") {
+				t.Errorf("%s: wrong error %q", test.policy, resp.Error)
+			}
+			continue
+		}
+
+		if resp.SkippedRecords != test.skipped || resp.QuarantinedRecords != test.quarantined {
+			t.Errorf("%s: expected %d skipped and %d quarantined records, got %+v", test.policy, test.skipped, test.quarantined, resp)
+		}
+		if resp.Manifest == nil || resp.Manifest.Records != test.records {
+			t.Errorf("%s: expected %d records written, got manifest %+v", test.policy, test.records, resp.Manifest)
+		}
+
+		if test.quarantined == 0 {
+			if resp.QuarantineUri != "" {
+				t.Errorf("%s: unexpected quarantine uri %s", test.policy, resp.QuarantineUri)
+			}
+			continue
+		}
+		if expected := "mem://policy/quarantine/result.cbor.quarantine"; resp.QuarantineUri != expected {
+			t.Errorf("%s: expected quarantine uri %s, got %s", test.policy, expected, resp.QuarantineUri)
+		}
+		if count, err := readTestBatch(t, resp.QuarantineUri); err != nil || count != test.quarantined {
+			t.Errorf("%s: expected %d quarantined records, got %d, error %v", test.policy, test.quarantined, count, err)
+		}
+	}
+}
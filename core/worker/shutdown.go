@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const LIGHTBYTE_WORKER_SHUTDOWN_GRACE_PERIOD = "LIGHTBYTE_WORKER_SHUTDOWN_GRACE_PERIOD"
+
+// stays below the default kubernetes terminationGracePeriodSeconds of 30s
+const DEFAULT_SHUTDOWN_GRACE_PERIOD = 25000 // 25 seconds
+
+var (
+	ErrShutdown             = errors.New("worker is shutting down")
+	ErrShutdownGraceExpired = errors.New("worker shutdown grace period expired")
+)
+
+// shutdownContexts returns a listen context which is cancelled as soon as
+// SIGTERM or SIGINT is received, or ctx is done, and a process context which
+// is cancelled once the grace period after the signal has expired.
+func (worker *BaseWorker) shutdownContexts(ctx context.Context) (context.Context, context.Context, func()) {
+	listenCtx, stopListen := context.WithCancelCause(context.Background())
+	processCtx, stopProcess := context.WithCancelCause(context.Background())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Info("shutting down worker", "Signal", sig, "GracePeriod", worker.shutdownGracePeriod)
+			stopListen(ErrShutdown)
+		case <-ctx.Done():
+			slog.Info("shutting down worker", "Cause", context.Cause(ctx), "GracePeriod", worker.shutdownGracePeriod)
+			stopListen(ErrShutdown)
+		case <-processCtx.Done():
+			return
+		}
+
+		timer := time.NewTimer(worker.shutdownGracePeriod)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			stopProcess(ErrShutdownGraceExpired)
+		case <-processCtx.Done():
+		}
+	}()
+
+	return listenCtx, processCtx, func() {
+		signal.Stop(signals)
+		stopListen(nil)
+		stopProcess(nil)
+	}
+}
+
+func isShutdown(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), ErrShutdown)
+}
@@ -0,0 +1,176 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/rpc"
+)
+
+// fakeDelivery records how a request was settled.
+type fakeDelivery struct {
+	mu       sync.Mutex
+	acked    bool
+	requeued bool
+}
+
+func (d *fakeDelivery) Ack(bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.acked = true
+	return nil
+}
+
+func (d *fakeDelivery) Nack(_ bool, requeue bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requeued = requeue
+	return nil
+}
+
+func (d *fakeDelivery) Reject(requeue bool) error { return d.Nack(false, requeue) }
+func (d *fakeDelivery) Payload() []byte           { return nil }
+
+func expectDone(t *testing.T, ctx context.Context, name string, cause error) {
+	t.Helper()
+
+	select {
+	case <-ctx.Done():
+		if !errors.Is(context.Cause(ctx), cause) {
+			t.Errorf("%s: expected cause %v, got %v", name, cause, context.Cause(ctx))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s: not done", name)
+	}
+}
+
+func TestShutdownContexts(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		shutdown func(context.CancelFunc)
+	}{
+		{name: "context", shutdown: func(cancel context.CancelFunc) { cancel() }},
+		{name: "signal", shutdown: func(context.CancelFunc) { syscall.Kill(os.Getpid(), syscall.SIGTERM) }},
+	} {
+		worker := &BaseWorker{shutdownGracePeriod: 100 * time.Millisecond}
+		ctx, cancel := context.WithCancel(context.Background())
+		listenCtx, processCtx, stop := worker.shutdownContexts(ctx)
+
+		if listenCtx.Err() != nil || processCtx.Err() != nil {
+			t.Fatalf("%s: contexts done before shutdown", test.name)
+		}
+		test.shutdown(cancel)
+
+		expectDone(t, listenCtx, test.name+" listen context", ErrShutdown)
+		if !isShutdown(listenCtx) {
+			t.Errorf("%s: listen context is not shut down", test.name)
+		}
+		// batches in flight keep processing during the grace period
+		if processCtx.Err() != nil {
+			t.Errorf("%s: process context done before the grace period expired", test.name)
+		}
+		expectDone(t, processCtx, test.name+" process context", ErrShutdownGraceExpired)
+
+		stop()
+		cancel()
+	}
+}
+
+// slowStep takes delay per record, started is closed once it transforms the first one.
+type slowStep struct {
+	delay   time.Duration
+	started chan struct{}
+	once    sync.Once
+}
+
+func (step *slowStep) Transform(data any) (any, error) {
+	step.once.Do(func() { close(step.started) })
+	time.Sleep(step.delay)
+	return data, nil
+}
+
+func TestStepWorkerRequeuesBatchInterruptedByShutdown(t *testing.T) {
+	broker := newTestBroker(t)
+	t.Setenv(LIGHTBYTE_WORKER_SHUTDOWN_GRACE_PERIOD, "50")
+
+	resourceUri := broker.storageUri + "/input.cbor"
+	writeTestBatch(t, resourceUri, testBatchOptions, "a", "b", "c")
+
+	step := &slowStep{delay: 100 * time.Millisecond, started: make(chan struct{})}
+	worker, err := NewStepWorker(step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdown, stopped := runWorker(t, worker.RunContext)
+
+	request := broker.request(t, rpc.ProcessRequest{ResourceUri: resourceUri, Compression: testBatchOptions.Compression.String()})
+	select {
+	case <-step.started:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("batch not started")
+	}
+	shutdown()
+
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("worker stopped with error %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("worker not stopped after the grace period")
+	}
+	broker.expectNoResponse(t, 100*time.Millisecond)
+
+	// the interrupted request is back in the queue for another worker
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	requests, err := broker.Messages(ctx, "requests")
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-requests:
+		msg.Ack(false)
+		if requeued, err := rpc.DecodeProcessRequest(msg); err != nil || requeued.CorrelationId != request.CorrelationId {
+			t.Errorf("expected the interrupted request %s, got %+v, error %v", request.CorrelationId, requeued, err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("interrupted request was not requeued")
+	}
+}
+
+func TestRequestsDuringShutdownAreRequeued(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		process func(listenCtx context.Context, messages chan rpc.ProcessRequest)
+	}{
+		{name: "step", process: func(listenCtx context.Context, messages chan rpc.ProcessRequest) {
+			worker := &StepWorker{BaseWorker: &BaseWorker{}, step: rejectingStep{}}
+			worker.processMessages(listenCtx, context.TODO(), messages)
+		}},
+		{name: "input", process: func(listenCtx context.Context, messages chan rpc.ProcessRequest) {
+			worker := &InputWorker{BaseWorker: &BaseWorker{}, input: countInput{count: 1}}
+			worker.processMessages(context.TODO(), messages, make(chan Batch), listenCtx, func(error) {})
+		}},
+	} {
+		listenCtx, shutdown := context.WithCancelCause(context.Background())
+		shutdown(ErrShutdown)
+
+		delivery := &fakeDelivery{}
+		messages := make(chan rpc.ProcessRequest, 1)
+		messages <- rpc.ProcessRequest{AmqpMessage: delivery, CorrelationId: uuid.New()}
+		close(messages)
+
+		test.process(listenCtx, messages)
+
+		if delivery.acked || !delivery.requeued {
+			t.Errorf("%s: expected the request requeued, acked %v requeued %v", test.name, delivery.acked, delivery.requeued)
+		}
+	}
+}
@@ -2,103 +2,228 @@ package worker
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
 
 	"starbyte.io/core/rpc"
+	s3io "starbyte.io/core/s3"
 	"starbyte.io/core/utils"
 	"starbyte.io/sdk"
 )
 
 type StepWorker struct {
 	*BaseWorker
-	step sdk.Step
+	step        sdk.Step
+	errorPolicy ErrorPolicy
+}
+
+type processStats struct {
+	skipped     int
+	quarantined []RecordError
 }
 
 func NewStepWorker(step sdk.Step) (*StepWorker, error) {
-	worker, err := NewWorker()
+	env := &envReader{}
+	worker := newWorker(env)
+
+	errorPolicy, err := ParseErrorPolicy(env.string(LIGHTBYTE_WORKER_ERROR_POLICY, ""))
 	if err != nil {
+		env.fail(LIGHTBYTE_WORKER_ERROR_POLICY, err.Error())
+	}
+
+	if err := env.err(); err != nil {
 		return nil, err
 	}
 
 	return &StepWorker{
-		BaseWorker: worker,
-		step:       step,
+		BaseWorker:  worker,
+		step:        step,
+		errorPolicy: errorPolicy,
 	}, nil
 }
 
-func process(ctx context.Context, input <-chan any, results chan<- any, step sdk.Step) {
+func process(ctx context.Context, cancel context.CancelCauseFunc, input <-chan any, results chan<- any, step sdk.Step, policy ErrorPolicy) processStats {
 	defer close(results)
-	ctx, cancel := context.WithCancelCause(ctx)
+	stats := processStats{}
 
 	for data := range input {
 		if context.Cause(ctx) != nil {
-			break
+			// keep draining input so the reader is not blocked on a failed batch
+			continue
 		}
+
 		result, err := step.Transform(data)
 		if err != nil {
-			cancel(err)
+			transformErrors.WithLabelValues(string(policy)).Inc()
+			switch policy {
+			case SKIP:
+				stats.skipped++
+			case QUARANTINE:
+				stats.quarantined = append(stats.quarantined, RecordError{Record: data, Error: err.Error()})
+			default:
+				cancel(fmt.Errorf("record transform failed: %w", err))
+			}
+			continue
+		}
+
+		select {
+		case results <- result:
+		case <-ctx.Done():
 		}
-		results <- result
 	}
+
+	return stats
 }
 
-func (worker *StepWorker) processMessages(ctx context.Context, messages <-chan rpc.ProcessRequest) {
-	for message := range messages {
-		var err error = nil
+func (worker *StepWorker) finishTransform(err error) error {
+	if err != nil {
+		if abort, ok := worker.step.(sdk.StepAbort); ok {
+			return errors.Join(err, abort.AbortTransform(err))
+		}
+	}
+
+	if after, ok := worker.step.(sdk.StepAfter); ok {
+		return errors.Join(err, after.AfterTransform())
+	}
+
+	return err
+}
+
+// writeQuarantine always writes cbor, rejected records do not follow the batch schema.
+func (worker *StepWorker) writeQuarantine(ctx context.Context, records []RecordError, fileUri string, compression s3io.Compression) error {
+	output := make(chan any, 1)
+
+	go func() {
+		defer close(output)
+		for _, record := range records {
+			output <- record
+		}
+	}()
+
+	_, err := worker.WriteOutput(ctx, output, fileUri, s3io.BatchOptions{Format: s3io.CBOR, Compression: compression})
+	return err
+}
+
+func (worker *StepWorker) processMessage(ctx context.Context, message rpc.ProcessRequest) rpc.ProcessResponse {
+	batchCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	worker.current.start(message.CorrelationId)
+	defer worker.current.finish()
 
-		input, err := worker.ReadInputFile(ctx, message.ResourceUri)
+	options, err := s3io.ParseBatchOptions(message.Format, message.Compression, message.Schema)
+	if err != nil {
+		return newErrorResponse(message, err)
+	}
 
-		results := make(chan any, 1)
+	input, err := worker.ReadInputFile(batchCtx, cancel, message.ResourceUri)
+	if err != nil {
+		return newErrorResponse(message, err)
+	}
 
-		if before, ok := worker.step.(sdk.StepBefore); ok {
-			err = before.BeforeTransform()
+	if before, ok := worker.step.(sdk.StepBefore); ok {
+		if err := before.BeforeTransform(); err != nil {
+			cancel(err)
+			return newErrorResponse(message, worker.finishTransform(err))
 		}
+	}
 
-		if err == nil {
-			wg := &sync.WaitGroup{}
+	results := make(chan any, 1)
+	stats := processStats{}
+	var manifest *s3io.Manifest
+	wg := &sync.WaitGroup{}
 
-			utils.RunInWg(wg, func() { process(ctx, input, results, worker.step) })
-			utils.RunInWg(wg, func() { err = worker.WriteOutput(ctx, results, message.ResultUri) })
+	utils.RunInWg(wg, func() { stats = process(batchCtx, cancel, input, results, worker.step, worker.errorPolicy) })
+	utils.RunInWg(wg, func() {
+		var err error
+		if manifest, err = worker.WriteOutput(batchCtx, results, message.ResultUri, options); err != nil {
+			cancel(err)
+		}
+	})
+
+	wg.Wait()
+
+	err = context.Cause(batchCtx)
+	quarantineUri := ""
 
-			wg.Wait()
+	if err == nil && len(stats.quarantined) > 0 {
+		quarantineUri = getQuarantineUri(message.ResultUri)
+		err = worker.writeQuarantine(batchCtx, stats.quarantined, quarantineUri, options.Compression)
+	}
+
+	if err = worker.finishTransform(err); err != nil {
+		return newErrorResponse(message, err)
+	}
+
+	if stats.skipped > 0 || len(stats.quarantined) > 0 {
+		slog.Warn("batch processed with rejected records",
+			"CorrelationId", message.CorrelationId,
+			"Skipped", stats.skipped,
+			"Quarantined", len(stats.quarantined),
+			"QuarantineUri", quarantineUri,
+		)
+	}
+
+	return rpc.ProcessResponse{
+		CorrelationId:      message.CorrelationId,
+		ResultUri:          message.ResultUri,
+		Status:             rpc.OK,
+		SkippedRecords:     stats.skipped,
+		QuarantinedRecords: len(stats.quarantined),
+		QuarantineUri:      quarantineUri,
+		Manifest:           manifest,
+	}
+}
+
+func (worker *StepWorker) processMessages(listenCtx context.Context, ctx context.Context, messages <-chan rpc.ProcessRequest) {
+	for message := range messages {
+		if isShutdown(listenCtx) {
+			message.Nack(false, true)
+			continue
 		}
 
-		if after, ok := worker.step.(sdk.StepAfter); ok {
-			err = after.AfterTransform()
+		resp := worker.processMessage(ctx, message)
+
+		if ctx.Err() != nil {
+			slog.Warn("batch interrupted by shutdown", "CorrelationId", message.CorrelationId)
+			message.Nack(false, true)
+			continue
 		}
-		if err != nil || context.Cause(ctx) != nil {
-			message.Ack(false)
-			worker.Publish(ctx, rpc.ProcessResponse{
-				CorrelationId: message.CorrelationId,
-				Status:        rpc.ERROR,
-				Error:         fmt.Sprintf("%e", err),
-			})
-		} else {
-			message.Ack(false)
-			worker.Publish(ctx, rpc.ProcessResponse{
-				CorrelationId: message.CorrelationId,
-				ResultUri:     message.ResultUri,
-				Status:        rpc.OK,
-			})
+
+		// the request is redelivered when the broker did not confirm the response
+		if err := worker.Publish(ctx, resp); err != nil {
+			slog.Error("failed to publish process response", "CorrelationId", message.CorrelationId, "Error", err)
+			message.Nack(false, true)
+			continue
 		}
+		message.Ack(false)
+		batchesProcessed.WithLabelValues(string(resp.Status)).Inc()
 	}
 }
 
 func (worker *StepWorker) Run() error {
-	ctx := context.Background()
-	err := worker.Listen(ctx)
+	return worker.RunContext(context.Background())
+}
+
+// RunContext processes requests until ctx is done, which shuts the worker down like SIGTERM.
+func (worker *StepWorker) RunContext(ctx context.Context) error {
+	listenCtx, processCtx, stop := worker.shutdownContexts(ctx)
+	defer stop()
+
+	err := worker.Listen(processCtx)
 	defer worker.Close()
 	if err != nil {
 		return err
 	}
 
-	messagesCh, err := worker.Messages(ctx)
+	messagesCh, err := worker.Messages(listenCtx)
 	if err != nil {
 		return err
 	}
 
-	worker.processMessages(ctx, messagesCh)
+	worker.processMessages(listenCtx, processCtx, messagesCh)
 
-	return context.Cause(ctx)
+	return nil
 }
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	s3io "starbyte.io/core/s3"
+)
+
+const (
+	LIGHTBYTE_WORKER_S3_MAX_IDLE_CONNS          = "LIGHTBYTE_WORKER_S3_MAX_IDLE_CONNS"
+	LIGHTBYTE_WORKER_S3_MAX_IDLE_CONNS_PER_HOST = "LIGHTBYTE_WORKER_S3_MAX_IDLE_CONNS_PER_HOST"
+	LIGHTBYTE_WORKER_S3_MAX_CONNS_PER_HOST      = "LIGHTBYTE_WORKER_S3_MAX_CONNS_PER_HOST"
+	LIGHTBYTE_WORKER_S3_IDLE_CONN_TIMEOUT       = "LIGHTBYTE_WORKER_S3_IDLE_CONN_TIMEOUT"
+	LIGHTBYTE_WORKER_S3_DIAL_TIMEOUT            = "LIGHTBYTE_WORKER_S3_DIAL_TIMEOUT"
+	LIGHTBYTE_WORKER_S3_KEEP_ALIVE              = "LIGHTBYTE_WORKER_S3_KEEP_ALIVE"
+	LIGHTBYTE_WORKER_S3_TLS_HANDSHAKE_TIMEOUT   = "LIGHTBYTE_WORKER_S3_TLS_HANDSHAKE_TIMEOUT"
+	LIGHTBYTE_WORKER_S3_RESPONSE_TIMEOUT        = "LIGHTBYTE_WORKER_S3_RESPONSE_TIMEOUT"
+	LIGHTBYTE_WORKER_S3_KEYRING_FILE            = "LIGHTBYTE_WORKER_S3_KEYRING_FILE"
+	LIGHTBYTE_WORKER_S3_PART_SIZE               = "LIGHTBYTE_WORKER_S3_PART_SIZE"
+	LIGHTBYTE_WORKER_S3_UPLOAD_CONCURRENCY      = "LIGHTBYTE_WORKER_S3_UPLOAD_CONCURRENCY"
+	LIGHTBYTE_WORKER_S3_UPLOAD_RETRIES          = "LIGHTBYTE_WORKER_S3_UPLOAD_RETRIES"
+	LIGHTBYTE_WORKER_S3_UPLOAD_RETRY_BACKOFF    = "LIGHTBYTE_WORKER_S3_UPLOAD_RETRY_BACKOFF"
+)
+
+// readTransportConfig reads object storage connection pool settings, timeouts are in milliseconds.
+func readTransportConfig(env *envReader) s3io.TransportConfig {
+	defaults := s3io.DefaultTransportConfig()
+
+	return s3io.TransportConfig{
+		MaxIdleConns:          env.int(LIGHTBYTE_WORKER_S3_MAX_IDLE_CONNS, defaults.MaxIdleConns, 0),
+		MaxIdleConnsPerHost:   env.int(LIGHTBYTE_WORKER_S3_MAX_IDLE_CONNS_PER_HOST, defaults.MaxIdleConnsPerHost, 0),
+		MaxConnsPerHost:       env.int(LIGHTBYTE_WORKER_S3_MAX_CONNS_PER_HOST, defaults.MaxConnsPerHost, 0),
+		IdleConnTimeout:       env.milliseconds(LIGHTBYTE_WORKER_S3_IDLE_CONN_TIMEOUT, int(defaults.IdleConnTimeout.Milliseconds()), 0),
+		DialTimeout:           env.milliseconds(LIGHTBYTE_WORKER_S3_DIAL_TIMEOUT, int(defaults.DialTimeout.Milliseconds()), 0),
+		KeepAlive:             env.milliseconds(LIGHTBYTE_WORKER_S3_KEEP_ALIVE, int(defaults.KeepAlive.Milliseconds()), 0),
+		TLSHandshakeTimeout:   env.milliseconds(LIGHTBYTE_WORKER_S3_TLS_HANDSHAKE_TIMEOUT, int(defaults.TLSHandshakeTimeout.Milliseconds()), 0),
+		ResponseHeaderTimeout: env.milliseconds(LIGHTBYTE_WORKER_S3_RESPONSE_TIMEOUT, int(defaults.ResponseHeaderTimeout.Milliseconds()), 0),
+	}
+}
+
+// readUploadConfig reads multipart upload settings, the part size is in bytes and the backoff in milliseconds.
+func readUploadConfig(env *envReader) s3io.UploadConfig {
+	defaults := s3io.DefaultUploadConfig()
+
+	return s3io.UploadConfig{
+		PartSize:     int64(env.int(LIGHTBYTE_WORKER_S3_PART_SIZE, int(defaults.PartSize), s3io.MIN_PART_SIZE)),
+		Concurrency:  env.int(LIGHTBYTE_WORKER_S3_UPLOAD_CONCURRENCY, defaults.Concurrency, 1),
+		MaxRetries:   env.int(LIGHTBYTE_WORKER_S3_UPLOAD_RETRIES, defaults.MaxRetries, 0),
+		RetryBackoff: env.milliseconds(LIGHTBYTE_WORKER_S3_UPLOAD_RETRY_BACKOFF, int(defaults.RetryBackoff.Milliseconds()), 0),
+	}
+}
+
+// readKeyring loads the key encryption keys of batches, batches are written unencrypted without a keyring.
+func readKeyring(env *envReader) *s3io.Keyring {
+	filename := env.string(LIGHTBYTE_WORKER_S3_KEYRING_FILE, "")
+	if filename == "" {
+		return nil
+	}
+
+	keyring, err := s3io.LoadKeyring(filename)
+	if err != nil {
+		env.fail(LIGHTBYTE_WORKER_S3_KEYRING_FILE, err.Error())
+		return nil
+	}
+	return keyring
+}
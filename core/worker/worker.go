@@ -2,10 +2,11 @@ package worker
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
-	"os"
+	"log/slog"
+	"time"
 
 	"starbyte.io/core/amqp"
 	"starbyte.io/core/rpc"
@@ -20,10 +21,18 @@ const (
 )
 
 type BaseWorker struct {
-	amqpUri       string
-	listenQueue   string
-	responseQueue string
-	amqp          amqp.Amqp
+	amqpUri             string
+	listenQueue         string
+	responseQueue       string
+	amqp                amqp.Amqp
+	shutdownGracePeriod time.Duration
+	httpAddr            string
+	state               workerState
+	heartbeat           heartbeatConfig
+	current             currentBatch
+	transport           s3io.TransportConfig
+	keyring             *s3io.Keyring
+	upload              s3io.UploadConfig
 }
 
 type Worker interface {
@@ -31,41 +40,80 @@ type Worker interface {
 }
 
 func NewWorker() (*BaseWorker, error) {
+	env := &envReader{}
+	worker := newWorker(env)
+
+	if err := env.err(); err != nil {
+		return nil, err
+	}
+
+	return worker, nil
+}
+
+func newWorker(env *envReader) *BaseWorker {
+	amqpUri := env.required(LIGHTBYTE_WORKER_AMQP_URI)
 
 	return &BaseWorker{
-		amqp:          &amqp.RabbitMqAmqp{},
-		amqpUri:       os.Getenv(LIGHTBYTE_WORKER_AMQP_URI),
-		listenQueue:   os.Getenv(LIGHTBYTE_WORKER_LISTEN_QUEUE),
-		responseQueue: os.Getenv(LIGHTBYTE_WORKER_RESPONSE_QUEUE),
-	}, nil
+		amqp:                newBroker(env, amqpUri),
+		amqpUri:             amqpUri,
+		listenQueue:         env.required(LIGHTBYTE_WORKER_LISTEN_QUEUE),
+		responseQueue:       env.required(LIGHTBYTE_WORKER_RESPONSE_QUEUE),
+		shutdownGracePeriod: env.milliseconds(LIGHTBYTE_WORKER_SHUTDOWN_GRACE_PERIOD, DEFAULT_SHUTDOWN_GRACE_PERIOD, 0),
+		httpAddr:            env.string(LIGHTBYTE_WORKER_HTTP_ADDR, ""),
+		heartbeat:           readHeartbeatConfig(env),
+		transport:           readTransportConfig(env),
+		keyring:             readKeyring(env),
+		upload:              readUploadConfig(env),
+	}
 }
 
 func (worker *BaseWorker) Listen(ctx context.Context) error {
-	return worker.amqp.Connect(ctx, worker.amqpUri)
+	worker.serveHealth(ctx)
+	s3io.ConfigureTransport(worker.transport)
+	if err := s3io.ConfigureUploads(worker.upload); err != nil {
+		return err
+	}
+	// without a keyring, a KMS provider configured with s3io.ConfigureEncryption is kept
+	if worker.keyring != nil {
+		s3io.ConfigureEncryption(worker.keyring)
+	}
+
+	worker.watchConnection(ctx)
+	err := worker.amqp.Connect(ctx, worker.amqpUri)
+	worker.state.connected.Store(err == nil)
+
+	if err == nil {
+		worker.runHeartbeat(ctx)
+	}
+
+	return err
 }
 
 func (worker *BaseWorker) Close() error {
+	worker.state.connected.Store(false)
 	return worker.amqp.Close()
 }
 
 func (worker *BaseWorker) Messages(ctx context.Context) (chan rpc.ProcessRequest, error) {
 	resultCh := make(chan rpc.ProcessRequest, 1)
 	messages, err := worker.amqp.Messages(ctx, worker.listenQueue)
-
-	_, cancel := context.WithCancelCause(ctx)
 	if err != nil {
 		return nil, err
 	}
 
+	worker.state.consuming.Store(true)
+
 	go func() {
+		defer close(resultCh)
+		defer worker.state.consuming.Store(false)
+
 		for msg := range messages {
-			var rpcMsg rpc.ProcessRequest
-			err := json.Unmarshal(msg.Payload(), &rpcMsg)
+			rpcMsg, err := rpc.DecodeProcessRequest(msg)
 			if err != nil {
-				cancel(err)
-				return
+				slog.Error("dead-lettering process request", "Queue", worker.listenQueue, "Error", err)
+				msg.Reject(false)
+				continue
 			}
-			rpcMsg.AmqpMessage = msg
 			resultCh <- rpcMsg
 		}
 	}()
@@ -74,18 +122,42 @@ func (worker *BaseWorker) Messages(ctx context.Context) (chan rpc.ProcessRequest
 }
 
 func (worker *BaseWorker) Publish(ctx context.Context, resp rpc.ProcessResponse) error {
-	return worker.amqp.Publish(ctx, worker.responseQueue, resp)
+	return rpc.Publish(ctx, worker.amqp, worker.responseQueue, resp, worker.heartbeat.instanceId)
 }
 
-func (worker *BaseWorker) ReadInputFile(ctx context.Context, fileUri string) (chan any, error) {
+func newErrorResponse(message rpc.ProcessRequest, err error) rpc.ProcessResponse {
+	return rpc.ProcessResponse{
+		CorrelationId: message.CorrelationId,
+		Status:        rpc.ERROR,
+		Error:         err.Error(),
+	}
+}
+
+// ReadInputFile streams records of the batch. Read failures, and batches which do not match
+// their manifest, cancel ctx with the cause after the records read so far are sent.
+func (worker *BaseWorker) ReadInputFile(ctx context.Context, cancel context.CancelCauseFunc, fileUri string) (chan any, error) {
+	startedAt := time.Now()
+	manifest, err := s3io.ReadManifest(ctx, fileUri)
+	if err != nil {
+		return nil, err
+	}
+
 	fileStream, err := s3io.Read(ctx, fileUri)
 
 	if err != nil {
 		return nil, err
 	}
+	opened := time.Since(startedAt)
+	stream := newMeteredReader(fileStream, "read")
+
+	format, codec := s3io.Format(""), s3io.Codec("")
+	if manifest != nil {
+		format, codec = manifest.Format, manifest.Codec
+	}
 
-	cborReader, err := s3io.NewReader(fileStream)
+	recordReader, err := s3io.NewRecordReader(stream, format, codec)
 	if err != nil {
+		fileStream.Close()
 		return nil, err
 	}
 
@@ -93,32 +165,92 @@ func (worker *BaseWorker) ReadInputFile(ctx context.Context, fileUri string) (ch
 
 	go func() {
 		defer close(output)
-		for record, err := cborReader.Read(); !errors.Is(err, io.EOF); record, err = cborReader.Read() {
-			if errors.Is(context.Cause(ctx), context.Canceled) {
+		defer recordReader.Close()
+		// time sending records downstream is processing, not storage
+		defer func() { observeS3Latency("read", opened+stream.blocked) }()
+
+		for {
+			record, err := recordReader.Read()
+			if errors.Is(err, io.EOF) {
 				break
 			}
-			output <- record
+			if err != nil {
+				slog.Error("failed to read input record", "Uri", s3io.RedactUri(fileUri), "Error", err)
+				cancel(fmt.Errorf("failed to read input batch: %w", err))
+				return
+			}
+
+			select {
+			case output <- record:
+				recordsIn.Inc()
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if manifest == nil {
+			return
+		}
+		if err := recordReader.Verify(*manifest); err != nil {
+			slog.Error("input batch is corrupted", "Uri", s3io.RedactUri(fileUri), "Error", err)
+			cancel(err)
 		}
 	}()
 
 	return output, nil
 }
 
-func (worker *BaseWorker) WriteOutput(ctx context.Context, output chan any, fileUri string) error {
+// writeBatch writes records as a batch to fileUri followed by its manifest.
+func writeBatch(ctx context.Context, fileUri string, options s3io.BatchOptions, write func(s3io.RecordWriter) error) (*s3io.Manifest, error) {
 	out, in := io.Pipe()
-	defer out.Close()
+	manifestCh := make(chan s3io.Manifest, 1)
 
-	go func() {
-		defer in.Close()
-
-		cborWriter, _ := s3io.NewWriter(in)
+	recordWriter, err := s3io.NewRecordWriter(in, options)
+	if err != nil {
+		return nil, err
+	}
 
-		for record := range utils.ReadChannelWithContext(ctx, output) {
-			cborWriter.Write(record)
+	go func() {
+		err := write(recordWriter)
+		if closeErr := recordWriter.Close(); err == nil {
+			err = closeErr
 		}
 
-		cborWriter.Close()
+		manifestCh <- recordWriter.Manifest()
+		in.CloseWithError(err)
 	}()
 
-	return s3io.Write(ctx, fileUri, out)
+	reader := newMeteredReader(out, "write")
+	defer reader.Close()
+
+	// the store waiting on the pipe for records is processing, not storage
+	startedAt := time.Now()
+	err = s3io.Write(ctx, fileUri, reader)
+	written := time.Since(startedAt) - reader.blocked
+	if err != nil {
+		observeS3Latency("write", written)
+		return nil, err
+	}
+
+	manifest := <-manifestCh
+	startedAt = time.Now()
+	err = s3io.WriteManifest(ctx, fileUri, manifest)
+	observeS3Latency("write", written+time.Since(startedAt))
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
+
+func (worker *BaseWorker) WriteOutput(ctx context.Context, output chan any, fileUri string, options s3io.BatchOptions) (*s3io.Manifest, error) {
+	return writeBatch(ctx, fileUri, options, func(recordWriter s3io.RecordWriter) error {
+		for record := range utils.ReadChannelWithContext(ctx, output) {
+			if err := recordWriter.Write(record); err != nil {
+				return err
+			}
+			recordsOut.Inc()
+		}
+		return nil
+	})
 }
@@ -0,0 +1,226 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/core/amqp"
+	"starbyte.io/core/rpc"
+	s3io "starbyte.io/core/s3"
+)
+
+var testBatchOptions = s3io.BatchOptions{Format: s3io.CBOR, Compression: s3io.Compression{Codec: s3io.ZSTD, Level: 3}}
+
+func writeTestBatch(t *testing.T, uri string, options s3io.BatchOptions, records ...any) *s3io.Manifest {
+	worker := &BaseWorker{}
+	output := make(chan any, len(records))
+	for _, record := range records {
+		output <- record
+	}
+	close(output)
+
+	manifest, err := worker.WriteOutput(context.TODO(), output, uri, options)
+	if err != nil {
+		t.Fatalf("write failed with error %s", err)
+	}
+	return manifest
+}
+
+func readTestBatch(t *testing.T, uri string) (int, error) {
+	worker := &BaseWorker{}
+	ctx, cancel := context.WithCancelCause(context.TODO())
+	defer cancel(nil)
+
+	input, err := worker.ReadInputFile(ctx, cancel, uri)
+	if err != nil {
+		t.Fatalf("read failed with error %s", err)
+	}
+
+	count := 0
+	for range input {
+		count++
+	}
+	return count, context.Cause(ctx)
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	uri := "mem://worker/batch.cbor.tar.gz"
+	manifest := writeTestBatch(t, uri, testBatchOptions, "a", "b", "c")
+
+	if manifest.Records != 3 {
+		t.Errorf("wrong manifest records %d", manifest.Records)
+	}
+
+	count, err := readTestBatch(t, uri)
+	if err != nil || count != 3 {
+		t.Errorf("wrong batch read: %d records, error %v", count, err)
+	}
+}
+
+func TestParquetBatchRoundTrip(t *testing.T) {
+	uri := "mem://worker/batch.parquet"
+	options := s3io.BatchOptions{Format: s3io.PARQUET, Compression: s3io.Compression{Codec: s3io.SNAPPY}}
+	manifest := writeTestBatch(t, uri, options, map[string]any{"id": 1}, map[string]any{"id": 2})
+
+	if manifest.Format != s3io.PARQUET || manifest.Schema["id"] != "int" {
+		t.Errorf("wrong manifest %v", manifest)
+	}
+
+	count, err := readTestBatch(t, uri)
+	if err != nil || count != 2 {
+		t.Errorf("wrong batch read: %d records, error %v", count, err)
+	}
+}
+
+func TestEncryptedBatchRoundTrip(t *testing.T) {
+	keyring := filepath.Join(t.TempDir(), "keyring.json")
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{7}, 32))
+	if err := os.WriteFile(keyring, []byte(`{"active": "k1", "keys": {"k1": "`+key+`"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv(LIGHTBYTE_WORKER_S3_KEYRING_FILE, keyring)
+
+	env := &envReader{}
+	worker := &BaseWorker{keyring: readKeyring(env)}
+	if err := env.err(); err != nil || worker.keyring == nil {
+		t.Fatalf("keyring load failed with error %v", err)
+	}
+
+	s3io.ConfigureEncryption(worker.keyring)
+	defer s3io.ConfigureEncryption(nil)
+
+	uri := "mem://worker/encrypted.cbor.gz"
+	manifest := writeTestBatch(t, uri, testBatchOptions, "a", "b")
+
+	count, err := readTestBatch(t, uri)
+	if err != nil || count != 2 {
+		t.Errorf("wrong batch read: %d records, error %v", count, err)
+	}
+
+	s3io.ConfigureEncryption(nil)
+	if _, err := s3io.Read(context.TODO(), uri); !errors.Is(err, s3io.ErrNoKeyProvider) {
+		t.Errorf("expected encrypted batch, got %v", err)
+	}
+	if manifest.Records != 2 {
+		t.Errorf("wrong manifest records %d", manifest.Records)
+	}
+}
+
+func TestBatchManifestMismatch(t *testing.T) {
+	uri := "mem://worker/corrupted.cbor.tar.gz"
+	manifest := writeTestBatch(t, uri, testBatchOptions, "a", "b")
+
+	manifest.Records = 5
+	if err := s3io.WriteManifest(context.TODO(), uri, *manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readTestBatch(t, uri); !errors.Is(err, s3io.ErrManifestMismatch) {
+		t.Errorf("manifest mismatch expected, got %v", err)
+	}
+}
+
+// testBroker is an in-memory broker with the request and response queues of a worker, the worker environment points to it.
+type testBroker struct {
+	amqp.Amqp
+	storageUri string
+	responses  <-chan amqp.AmqpMessage
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+
+	uri := fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+	broker := &amqp.MemoryAmqp{}
+	if err := broker.Connect(context.TODO(), uri); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { broker.Close() })
+	for _, queue := range []string{"requests", "responses"} {
+		if err := broker.QueueDeclare(queue, "dead_letters"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	responses, err := broker.Messages(ctx, "responses")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(LIGHTBYTE_WORKER_AMQP_URI, uri)
+	t.Setenv(LIGHTBYTE_WORKER_LISTEN_QUEUE, "requests")
+	t.Setenv(LIGHTBYTE_WORKER_RESPONSE_QUEUE, "responses")
+	return &testBroker{Amqp: broker, storageUri: fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano()), responses: responses}
+}
+
+// request publishes a request of a new batch of the test storage.
+func (broker *testBroker) request(t *testing.T, request rpc.ProcessRequest) rpc.ProcessRequest {
+	t.Helper()
+
+	if request.CorrelationId == uuid.Nil {
+		request.CorrelationId = uuid.New()
+	}
+	if request.ResultUri == "" {
+		request.ResultUri = s3io.JoinUri(broker.storageUri, request.CorrelationId.String()+".cbor")
+	}
+	if err := rpc.Publish(context.TODO(), broker, "requests", &request, "test"); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+// response returns the next response, acknowledged.
+func (broker *testBroker) response(t *testing.T) rpc.ProcessResponse {
+	t.Helper()
+
+	select {
+	case msg := <-broker.responses:
+		msg.Ack(false)
+		resp, err := rpc.DecodeProcessResponse(msg)
+		if err != nil {
+			t.Fatalf("invalid response %s", err)
+		}
+		return resp
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no response")
+	}
+	return rpc.ProcessResponse{}
+}
+
+// expectNoResponse fails when a response arrives within wait.
+func (broker *testBroker) expectNoResponse(t *testing.T, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case msg := <-broker.responses:
+		resp, _ := rpc.DecodeProcessResponse(msg)
+		t.Fatalf("unexpected response %+v", resp)
+	case <-time.After(wait):
+	}
+}
+
+// runWorker runs worker until the test ends or the returned cancel is called, the returned channel receives its result.
+func runWorker(t *testing.T, run func(context.Context) error) (context.CancelFunc, chan error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		stopped <- run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return cancel, stopped
+}
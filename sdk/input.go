@@ -3,5 +3,11 @@ package sdk
 import "context"
 
 type Input interface {
-	Read(context.Context, chan<- any)
+	Read(context.Context, chan<- any) error
+}
+
+// InputCommitter is implemented by inputs which acknowledge records to their source, e.g. commit consumer
+// offsets. Commit is called with the records of a batch once the coordinator recorded the batch.
+type InputCommitter interface {
+	Commit(ctx context.Context, records []any) error
 }
@@ -11,3 +11,7 @@ type StepBefore interface {
 type StepAfter interface {
 	AfterTransform() error
 }
+
+type StepAbort interface {
+	AbortTransform(error) error
+}
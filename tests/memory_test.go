@@ -0,0 +1,312 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"starbyte.io/coordinator/db"
+	"starbyte.io/coordinator/pipeline"
+	"starbyte.io/core/amqp"
+	s3io "starbyte.io/core/s3"
+	"starbyte.io/core/utils"
+	"starbyte.io/core/worker"
+	"starbyte.io/sdk"
+
+	csv "starbyte.io/workers/csvreader/worker"
+	extractor "starbyte.io/workers/extractor/step"
+)
+
+const MEMORY_PIPELINE_TIMEOUT = 30 * time.Second
+
+// memoryPipeline reads a csv file with the csv reader and extracts two of its columns.
+func memoryPipeline(fileUri string) *db.Pipeline {
+	return &db.Pipeline{
+		Id:   uuid.New(),
+		Name: "memory",
+		Steps: db.StepConf{
+			"input": {
+				Id:            uuid.New(),
+				Name:          "input",
+				RuntimeConfig: db.RuntimeConfig{BatchSize: 2, MaxRetries: 3},
+				Config:        csv.CsvReaderConfig{FileUri: fileUri, HasHeader: true, Delimiter: ","},
+			},
+			"extract": {
+				Id:            uuid.New(),
+				Name:          "extract",
+				Input:         "input",
+				RuntimeConfig: db.RuntimeConfig{MaxRetries: 3},
+				Config: extractor.ExtractorConfig{Columns: map[string]extractor.ExtractField{
+					"country": {JsonPath: ".country", CastTo: "str"},
+					"value":   {JsonPath: ".value", CastTo: "int"},
+				}},
+			},
+		},
+	}
+}
+
+// declareQueues lets workers consume before the coordinator runs, the coordinator declares them again before publishing.
+func declareQueues(broker amqp.Amqp, p *db.Pipeline) error {
+	for _, step := range p.Steps {
+		for _, queue := range []string{step.GetReqQueueName(), step.GetRespQueueName()} {
+			if err := broker.QueueDeclare(queue, step.GetDeadLetterQueueName()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func setWorkerEnv(t *testing.T, brokerUri string, step db.Step) {
+	t.Setenv(worker.LIGHTBYTE_WORKER_AMQP_URI, brokerUri)
+	t.Setenv(worker.LIGHTBYTE_WORKER_LISTEN_QUEUE, step.GetReqQueueName())
+	t.Setenv(worker.LIGHTBYTE_WORKER_RESPONSE_QUEUE, step.GetRespQueueName())
+}
+
+// TestMemoryPipeline runs the coordinator with a csv reader and two extractor workers in the
+// test process, on the in-memory broker, blob store and repository.
+func TestMemoryPipeline(t *testing.T) {
+	runMemoryPipeline(t, func(*pipeline.PipelineExecutor) {}, nil)
+}
+
+// TestMemoryPipelineScheduled runs the pipeline with a prioritized run admitted one attempt at a time.
+func TestMemoryPipelineScheduled(t *testing.T) {
+	scheduler := pipeline.NewScheduler(1)
+	runMemoryPipeline(t, func(coordinator *pipeline.PipelineExecutor) {
+		coordinator.SetScheduler(scheduler)
+		if err := coordinator.SetPriority(5); err != nil {
+			t.Fatal(err)
+		}
+	}, nil)
+
+	if scheduler.InFlight() != 0 {
+		t.Errorf("expected no attempt in flight after the run, got %d", scheduler.InFlight())
+	}
+}
+
+// committingInput records the commits of the batches of its input.
+type committingInput struct {
+	sdk.Input
+	commit func(records []any)
+}
+
+func (input committingInput) Commit(_ context.Context, records []any) error {
+	input.commit(records)
+	return nil
+}
+
+// TestMemoryPipelineCommitsInput checks every record of the input is committed, each batch once the coordinator recorded it.
+func TestMemoryPipelineCommitsInput(t *testing.T) {
+	committedRecords, committedBatches := 0, 0
+	runMemoryPipeline(t, func(*pipeline.PipelineExecutor) {}, func(input sdk.Input, repository *db.MemoryRepository) sdk.Input {
+		return committingInput{Input: input, commit: func(records []any) {
+			committedRecords += len(records)
+			committedBatches++
+			if recorded := len(repository.Batches()); recorded < committedBatches {
+				t.Errorf("batch %d committed before the coordinator recorded it, %d batches recorded", committedBatches, recorded)
+			}
+		}}
+	})
+
+	if committedRecords != 9 {
+		t.Errorf("expected 9 records committed, got %d", committedRecords)
+	}
+}
+
+// writeMemoryInput writes a csv file of rows to storageUri and returns its uri.
+func writeMemoryInput(t *testing.T, storageUri string, rows int) string {
+	t.Helper()
+
+	lines := []string{"country,value"}
+	for i := 0; i < rows; i++ {
+		lines = append(lines, fmt.Sprintf("JP%d,%d", i, i*100))
+	}
+	fileUri := s3io.JoinUri(storageUri, "input.csv")
+	if err := s3io.Write(context.TODO(), fileUri, strings.NewReader(strings.Join(lines, "\n"))); err != nil {
+		t.Fatal(err)
+	}
+	return fileUri
+}
+
+// failingRepository fails recording the status of attempts.
+type failingRepository struct {
+	*db.MemoryRepository
+	err error
+}
+
+func (repo failingRepository) SetBatchProcessStatus(uuid.UUID, string, string) (bool, error) {
+	return false, repo.err
+}
+
+// TestMemoryPipelineRepositoryError checks Run stops and returns the error of a failed repository call instead of waiting for completion.
+func TestMemoryPipelineRepositoryError(t *testing.T) {
+	brokerUri := fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+	storageUri := fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+
+	p := memoryPipeline(writeMemoryInput(t, storageUri, 3))
+	repositoryErr := errors.New("repository unavailable")
+	repository := failingRepository{MemoryRepository: db.NewMemoryRepository(p), err: repositoryErr}
+
+	broker, _ := amqp.NewBroker(brokerUri)
+	if err := broker.Connect(context.TODO(), brokerUri); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	if err := declareQueues(broker, p); err != nil {
+		t.Fatal(err)
+	}
+
+	coordinator, err := pipeline.NewExecutor(p, broker, storageUri, repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := p.Steps["input"]
+	setWorkerEnv(t, brokerUri, input)
+	reader, err := worker.NewInputWorker(csv.CsvReader{Config: input.Config.(csv.CsvReaderConfig)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, stopWorker := context.WithCancel(context.Background())
+	wg := &sync.WaitGroup{}
+	utils.RunInWg(wg, func() { reader.RunContext(ctx) })
+	defer func() {
+		stopWorker()
+		wg.Wait()
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- coordinator.Run() }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, repositoryErr) {
+			t.Errorf("expected the repository error, got %v", err)
+		}
+	case <-time.After(MEMORY_PIPELINE_TIMEOUT):
+		t.Fatalf("run not stopped after %s", MEMORY_PIPELINE_TIMEOUT)
+	}
+}
+
+// runMemoryPipeline runs memoryPipeline, configure is called before the coordinator runs and wrapInput, unless nil,
+// wraps the csv reader.
+func runMemoryPipeline(t *testing.T, configure func(*pipeline.PipelineExecutor), wrapInput func(sdk.Input, *db.MemoryRepository) sdk.Input) {
+	brokerUri := fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+	storageUri := fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+
+	const rows = 9
+	p := memoryPipeline(writeMemoryInput(t, storageUri, rows))
+	repository := db.NewMemoryRepository(p)
+
+	broker, _ := amqp.NewBroker(brokerUri)
+	if err := broker.Connect(context.TODO(), brokerUri); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	if err := declareQueues(broker, p); err != nil {
+		t.Fatal(err)
+	}
+
+	coordinator, err := pipeline.NewExecutor(p, broker, storageUri, repository)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configure(coordinator)
+
+	input := p.Steps["input"]
+	setWorkerEnv(t, brokerUri, input)
+	t.Setenv(worker.LIGHTBYTE_WORKER_BATCH_SIZE, fmt.Sprint(input.RuntimeConfig.BatchSize))
+	var inputReader sdk.Input = csv.CsvReader{Config: input.Config.(csv.CsvReaderConfig)}
+	if wrapInput != nil {
+		inputReader = wrapInput(inputReader, repository)
+	}
+	reader, err := worker.NewInputWorker(inputReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	extract := p.Steps["extract"]
+	config := extract.Config.(extractor.ExtractorConfig)
+	parsers, err := extractor.BuildParser(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setWorkerEnv(t, brokerUri, extract)
+	extractors := []*worker.StepWorker{}
+	for i := 0; i < 2; i++ {
+		step, err := worker.NewStepWorker(extractor.Extractor{Parsers: parsers})
+		if err != nil {
+			t.Fatal(err)
+		}
+		extractors = append(extractors, step)
+	}
+
+	ctx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, 4)
+	utils.RunInWg(wg, func() { errs <- reader.RunContext(ctx) })
+	for _, step := range extractors {
+		step := step
+		utils.RunInWg(wg, func() { errs <- step.RunContext(ctx) })
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- coordinator.Run() }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("coordinator failed with error %s", err)
+		}
+	case <-time.After(MEMORY_PIPELINE_TIMEOUT):
+		t.Fatalf("pipeline not complete after %s", MEMORY_PIPELINE_TIMEOUT)
+	}
+
+	stopWorkers()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("worker failed with error %s", err)
+		}
+	}
+
+	succeeded := map[uuid.UUID]bool{}
+	for _, attempt := range repository.Attempts() {
+		if attempt.FinishedAt.IsZero() || attempt.State != "OK" {
+			t.Errorf("attempt not successful %+v", attempt)
+		}
+		succeeded[attempt.BatchId] = true
+	}
+
+	records := int64(0)
+	for _, batch := range repository.Batches() {
+		if !succeeded[batch.BatchId] {
+			t.Errorf("batch not processed %+v", batch)
+		}
+		if batch.StepToId == extract.Id && batch.RecordCount != nil {
+			records += *batch.RecordCount
+		}
+	}
+	if records != rows {
+		t.Errorf("expected %d records extracted, got %d", rows, records)
+	}
+
+	letters, err := coordinator.DeadLetters(context.TODO(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for step, stepLetters := range letters {
+		if len(stepLetters) > 0 {
+			t.Errorf("step %s dead-lettered %+v", step, stepLetters)
+		}
+	}
+}
@@ -10,7 +10,10 @@ import (
 
 func main() {
 	customConfig := w.NewCsvReaderConfig()
-	worker.ReadConfigEnvVar(&customConfig)
+	if err := worker.LoadConfig(&customConfig, w.ConfigSchema); err != nil {
+		log.Fatal(err)
+	}
+
 	worker, err := worker.NewInputWorker(
 		w.CsvReader{Config: customConfig},
 	)
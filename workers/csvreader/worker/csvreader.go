@@ -2,6 +2,7 @@ package worker
 
 import (
 	"context"
+	_ "embed"
 	"encoding/csv"
 	"errors"
 	"fmt"
@@ -10,6 +11,9 @@ import (
 	s3io "starbyte.io/core/s3"
 )
 
+//go:embed config.schema.json
+var ConfigSchema []byte
+
 type CsvReaderConfig struct {
 	HasHeader bool   `json:"has_header,omitempty" mapstructure:"has_header"`
 	Delimiter string `json:"delimiter,omitempty"  mapstructure:"delimiter"`
@@ -39,25 +43,26 @@ func mapRecordToHeader(record []string, header []string) (map[string]string, err
 	return value, nil
 }
 
-func (input CsvReader) Read(ctx context.Context, output chan<- any) {
+func (input CsvReader) Read(ctx context.Context, output chan<- any) error {
 	var csvHeader []string = nil
 	defer close(output)
 
-	ctx, cancel := context.WithCancelCause(ctx)
-
 	hasHeader := input.Config.HasHeader
 
 	reader, err := s3io.Read(ctx, input.Config.FileUri)
 
 	if err != nil {
-		cancel(err)
-		return
+		return err
 	}
+	defer reader.Close()
 
 	csvReader := csv.NewReader(reader)
 	csvReader.LazyQuotes = true
 	csvReader.TrimLeadingSpace = true
 	csvReader.FieldsPerRecord = -1
+	if delimiter := []rune(input.Config.Delimiter); len(delimiter) == 1 {
+		csvReader.Comma = delimiter[0]
+	}
 
 	for {
 		record, err := csvReader.Read()
@@ -74,20 +79,22 @@ func (input CsvReader) Read(ctx context.Context, output chan<- any) {
 		}
 
 		if err == io.EOF {
-			break
+			return nil
 		}
 
 		if err != nil {
-			cancel(err)
-			break
+			return err
 		}
 
 		mappedRecord, err := mapRecordToHeader(record, csvHeader)
 		if err != nil {
-			cancel(err)
-			break
+			return err
 		}
-		output <- mappedRecord
 
+		select {
+		case output <- mappedRecord:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
 	}
 }
@@ -9,7 +9,10 @@ import (
 
 func main() {
 	customConfig := &extractor.ExtractorConfig{}
-	worker.ReadConfigEnvVar(&customConfig)
+	if err := worker.LoadConfig(customConfig, extractor.ConfigSchema); err != nil {
+		log.Fatal(err)
+	}
+
 	parsers, err := extractor.BuildParser(customConfig)
 	if err != nil {
 		log.Fatal(err)
@@ -1,5 +1,10 @@
 package extractor
 
+import _ "embed"
+
+//go:embed config.schema.json
+var ConfigSchema []byte
+
 type ExtractField struct {
 	CastTo     string `json:"cast_to"  mapstructure:"cast_to"`
 	JsonPath   string `json:"json_path"  mapstructure:"json_path"`
@@ -1,7 +1,7 @@
 package extractor
 
 import (
-	"log"
+	"fmt"
 )
 
 type Extractor struct {
@@ -18,15 +18,19 @@ func remapMap(data map[any]any) map[string]any {
 
 func (step Extractor) Transform(data any) (any, error) {
 	res := map[string]any{}
+	record, ok := data.(map[any]any)
+	if !ok {
+		return nil, fmt.Errorf("unexpected record type %T", data)
+	}
+
 	for col, parse := range step.Parsers {
 		var val any
 		var err error
 
-		val, err = RunJsonPathAndCast(parse, remapMap(data.(map[any]any)))
+		val, err = RunJsonPathAndCast(parse, remapMap(record))
 
 		if err != nil {
-			log.Fatal(err)
-			return nil, err
+			return nil, fmt.Errorf("column %s: %w", col, err)
 		}
 		res[col] = val
 	}
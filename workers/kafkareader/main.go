@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+
+	_ "github.com/joho/godotenv/autoload"
+	"starbyte.io/core/worker"
+	w "starbyte.io/workers/kafkareader/worker"
+)
+
+func main() {
+	if err := run(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run returns errors instead of exiting, so the reader is closed before main exits.
+func run() error {
+	customConfig := w.NewKafkaReaderConfig()
+	if err := worker.LoadConfig(&customConfig, w.ConfigSchema); err != nil {
+		return err
+	}
+
+	reader, err := w.NewKafkaReader(customConfig)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	worker, err := worker.NewInputWorker(reader)
+
+	if err != nil {
+		return err
+	}
+	return worker.Run()
+}
@@ -0,0 +1,211 @@
+package worker
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+//go:embed config.schema.json
+var ConfigSchema []byte
+
+const (
+	START_OFFSET_EARLIEST = "earliest"
+	START_OFFSET_LATEST   = "latest"
+)
+
+const (
+	VALUE_FORMAT_STRING = "string"
+	VALUE_FORMAT_JSON   = "json"
+)
+
+type KafkaReaderConfig struct {
+	Brokers []string `json:"brokers" mapstructure:"brokers"`
+	Topics  []string `json:"topics" mapstructure:"topics"`
+	Group   string   `json:"group" mapstructure:"group"`
+	// StartOffset is where the group starts reading partitions it has no committed offset of
+	StartOffset string `json:"start_offset,omitempty" mapstructure:"start_offset"`
+	ValueFormat string `json:"value_format,omitempty" mapstructure:"value_format"`
+	// IdleTimeout in milliseconds ends the input once no record was fetched for that long, 0 reads until shutdown
+	IdleTimeout int `json:"idle_timeout,omitempty" mapstructure:"idle_timeout"`
+}
+
+func NewKafkaReaderConfig() KafkaReaderConfig {
+	return KafkaReaderConfig{
+		StartOffset: START_OFFSET_EARLIEST,
+		ValueFormat: VALUE_FORMAT_STRING,
+	}
+}
+
+// ErrInvalidRecord is returned by Commit for records without the topic, partition and offset the reader read them with.
+var ErrInvalidRecord = errors.New("record without kafka topic, partition and offset")
+
+// client is the part of *kgo.Client the reader uses.
+type client interface {
+	PollFetches(ctx context.Context) kgo.Fetches
+	CommitOffsetsSync(ctx context.Context, offsets map[string]map[int32]kgo.EpochOffset, onDone func(*kgo.Client, *kmsg.OffsetCommitRequest, *kmsg.OffsetCommitResponse, error))
+	Close()
+}
+
+// KafkaReader reads the records of topics as a consumer group member. Offsets are not committed
+// automatically, the input worker commits the records of a batch once the coordinator recorded it,
+// so records of batches lost in a crash are read again.
+type KafkaReader struct {
+	Config KafkaReaderConfig
+	client client
+}
+
+func NewKafkaReader(config KafkaReaderConfig) (*KafkaReader, error) {
+	offset := kgo.NewOffset().AtStart()
+	if config.StartOffset == START_OFFSET_LATEST {
+		offset = kgo.NewOffset().AtEnd()
+	}
+
+	client, err := kgo.NewClient(
+		kgo.SeedBrokers(config.Brokers...),
+		kgo.ConsumerGroup(config.Group),
+		kgo.ConsumeTopics(config.Topics...),
+		kgo.ConsumeResetOffset(offset),
+		kgo.DisableAutoCommit(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("kafka client: %w", err)
+	}
+	return &KafkaReader{Config: config, client: client}, nil
+}
+
+func (input *KafkaReader) Close() {
+	input.client.Close()
+}
+
+func (input *KafkaReader) mapRecord(record *kgo.Record) (map[string]any, error) {
+	headers := map[string]string{}
+	for _, header := range record.Headers {
+		headers[header.Key] = string(header.Value)
+	}
+
+	var value any = string(record.Value)
+	if input.Config.ValueFormat == VALUE_FORMAT_JSON {
+		if err := json.Unmarshal(record.Value, &value); err != nil {
+			return nil, fmt.Errorf("record %s/%d@%d: %w", record.Topic, record.Partition, record.Offset, err)
+		}
+	}
+
+	return map[string]any{
+		"topic":     record.Topic,
+		"partition": record.Partition,
+		"offset":    record.Offset,
+		"key":       string(record.Key),
+		"value":     value,
+		"timestamp": record.Timestamp.UnixMilli(),
+		"headers":   headers,
+	}, nil
+}
+
+// poll returns the next fetches, or none once the idle timeout passed.
+func (input *KafkaReader) poll(ctx context.Context) (kgo.Fetches, error) {
+	pollCtx := ctx
+	if input.Config.IdleTimeout > 0 {
+		var cancel context.CancelFunc
+		pollCtx, cancel = context.WithTimeout(ctx, time.Duration(input.Config.IdleTimeout)*time.Millisecond)
+		defer cancel()
+	}
+
+	fetches := input.client.PollFetches(pollCtx)
+	for _, fetchErr := range fetches.Errors() {
+		switch {
+		case ctx.Err() != nil:
+			return nil, context.Cause(ctx)
+		case errors.Is(fetchErr.Err, context.DeadlineExceeded), errors.Is(fetchErr.Err, context.Canceled):
+		case errors.Is(fetchErr.Err, kgo.ErrClientClosed):
+			return nil, fetchErr.Err
+		default:
+			return nil, fmt.Errorf("fetch %s/%d: %w", fetchErr.Topic, fetchErr.Partition, fetchErr.Err)
+		}
+	}
+	return fetches, nil
+}
+
+func (input *KafkaReader) Read(ctx context.Context, output chan<- any) error {
+	defer close(output)
+
+	for {
+		fetches, err := input.poll(ctx)
+		if err != nil {
+			return err
+		}
+		if fetches.NumRecords() == 0 {
+			if input.Config.IdleTimeout > 0 {
+				return nil
+			}
+			continue
+		}
+
+		records := []any{}
+		for iter := fetches.RecordIter(); !iter.Done(); {
+			record, err := input.mapRecord(iter.Next())
+			if err != nil {
+				return err
+			}
+			records = append(records, record)
+		}
+
+		for _, record := range records {
+			select {
+			case output <- record:
+			case <-ctx.Done():
+				return context.Cause(ctx)
+			}
+		}
+	}
+}
+
+// Commit commits the offsets following the records, per partition.
+func (input *KafkaReader) Commit(ctx context.Context, records []any) error {
+	offsets := map[string]map[int32]kgo.EpochOffset{}
+	for _, item := range records {
+		record, ok := item.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%w: %T", ErrInvalidRecord, item)
+		}
+		topic, topicOk := record["topic"].(string)
+		partition, partitionOk := record["partition"].(int32)
+		offset, offsetOk := record["offset"].(int64)
+		if !topicOk || !partitionOk || !offsetOk {
+			return fmt.Errorf("%w: %v", ErrInvalidRecord, record)
+		}
+
+		if offsets[topic] == nil {
+			offsets[topic] = map[int32]kgo.EpochOffset{}
+		}
+		if committed, ok := offsets[topic][partition]; !ok || committed.Offset <= offset {
+			offsets[topic][partition] = kgo.EpochOffset{Epoch: -1, Offset: offset + 1}
+		}
+	}
+	if len(offsets) == 0 {
+		return nil
+	}
+
+	var commitErr error
+	input.client.CommitOffsetsSync(ctx, offsets, func(_ *kgo.Client, _ *kmsg.OffsetCommitRequest, resp *kmsg.OffsetCommitResponse, err error) {
+		if err != nil {
+			commitErr = err
+			return
+		}
+		for _, topic := range resp.Topics {
+			for _, partition := range topic.Partitions {
+				if err := kerr.ErrorForCode(partition.ErrorCode); err != nil {
+					commitErr = errors.Join(commitErr, fmt.Errorf("commit %s/%d: %w", topic.Topic, partition.Partition, err))
+				}
+			}
+		}
+	})
+	return commitErr
+}
@@ -0,0 +1,359 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"starbyte.io/core/amqp"
+	"starbyte.io/core/rpc"
+	"starbyte.io/core/worker"
+)
+
+// LIGHTBYTE_TEST_KAFKA_BROKERS are the comma separated brokers of the Kafka tests, which are skipped without it.
+const LIGHTBYTE_TEST_KAFKA_BROKERS = "LIGHTBYTE_TEST_KAFKA_BROKERS"
+
+// fakeClient returns its fetches one poll at a time, then waits for the poll context like kgo.
+type fakeClient struct {
+	mu        sync.Mutex
+	fetches   []kgo.Fetches
+	committed []map[string]map[int32]kgo.EpochOffset
+	// commitErrorCode is returned for every committed partition
+	commitErrorCode int16
+}
+
+func (client *fakeClient) PollFetches(ctx context.Context) kgo.Fetches {
+	client.mu.Lock()
+	if len(client.fetches) > 0 {
+		fetches := client.fetches[0]
+		client.fetches = client.fetches[1:]
+		client.mu.Unlock()
+		return fetches
+	}
+	client.mu.Unlock()
+	<-ctx.Done()
+	return kgo.NewErrFetch(ctx.Err())
+}
+
+func (client *fakeClient) CommitOffsetsSync(ctx context.Context, offsets map[string]map[int32]kgo.EpochOffset, onDone func(*kgo.Client, *kmsg.OffsetCommitRequest, *kmsg.OffsetCommitResponse, error)) {
+	client.mu.Lock()
+	client.committed = append(client.committed, offsets)
+	client.mu.Unlock()
+
+	resp := kmsg.NewPtrOffsetCommitResponse()
+	for topic, partitions := range offsets {
+		respTopic := kmsg.NewOffsetCommitResponseTopic()
+		respTopic.Topic = topic
+		for partition := range partitions {
+			respPartition := kmsg.NewOffsetCommitResponseTopicPartition()
+			respPartition.Partition = partition
+			respPartition.ErrorCode = client.commitErrorCode
+			respTopic.Partitions = append(respTopic.Partitions, respPartition)
+		}
+		resp.Topics = append(resp.Topics, respTopic)
+	}
+	onDone(nil, nil, resp, nil)
+}
+
+func (client *fakeClient) Close() {}
+
+func fetchOf(topic string, partition int32, values ...string) kgo.Fetches {
+	records := []*kgo.Record{}
+	for i, value := range values {
+		records = append(records, &kgo.Record{
+			Topic:     topic,
+			Partition: partition,
+			Offset:    int64(i),
+			Key:       []byte(fmt.Sprint("key", i)),
+			Value:     []byte(value),
+			Headers:   []kgo.RecordHeader{{Key: "source", Value: []byte("test")}},
+			Timestamp: time.UnixMilli(1700000000000),
+		})
+	}
+	return kgo.Fetches{{Topics: []kgo.FetchTopic{{Topic: topic, Partitions: []kgo.FetchPartition{{Partition: partition, Records: records}}}}}}
+}
+
+func readAll(t *testing.T, input *KafkaReader) []any {
+	t.Helper()
+
+	output := make(chan any, 100)
+	if err := input.Read(context.TODO(), output); err != nil {
+		t.Fatalf("read failed with error %s", err)
+	}
+	records := []any{}
+	for record := range output {
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config := NewKafkaReaderConfig()
+	err := worker.DecodeConfig(map[string]any{"brokers": []any{"localhost:9092"}, "topics": []any{"events"}, "group": "lightbyte"}, &config, ConfigSchema)
+	if err != nil {
+		t.Fatalf("failed with error %s", err)
+	}
+	if config.StartOffset != START_OFFSET_EARLIEST || config.ValueFormat != VALUE_FORMAT_STRING || config.IdleTimeout != 0 {
+		t.Errorf("wrong defaults %+v", config)
+	}
+	if len(config.Brokers) != 1 || len(config.Topics) != 1 || config.Group != "lightbyte" {
+		t.Errorf("wrong config %+v", config)
+	}
+
+	if err := worker.DecodeConfig(map[string]any{"topics": []any{"events"}}, &config, ConfigSchema); err == nil {
+		t.Errorf("expected an error without brokers and group")
+	}
+}
+
+func TestReadRecords(t *testing.T) {
+	input := &KafkaReader{
+		Config: KafkaReaderConfig{ValueFormat: VALUE_FORMAT_JSON, IdleTimeout: 10},
+		client: &fakeClient{fetches: []kgo.Fetches{fetchOf("events", 0, `{"country":"JP"}`, `{"country":"FR"}`), fetchOf("events", 1, `{"country":"DE"}`)}},
+	}
+
+	records := readAll(t, input)
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, got %d", len(records))
+	}
+
+	record := records[1].(map[string]any)
+	if value, ok := record["value"].(map[string]any); !ok || value["country"] != "FR" {
+		t.Errorf("wrong value %v", record["value"])
+	}
+	if record["topic"] != "events" || record["partition"] != int32(0) || record["offset"] != int64(1) || record["key"] != "key1" {
+		t.Errorf("wrong record %v", record)
+	}
+	if record["timestamp"] != int64(1700000000000) || record["headers"].(map[string]string)["source"] != "test" {
+		t.Errorf("wrong record metadata %v", record)
+	}
+}
+
+func TestReadInvalidJson(t *testing.T) {
+	input := &KafkaReader{
+		Config: KafkaReaderConfig{ValueFormat: VALUE_FORMAT_JSON, IdleTimeout: 10},
+		client: &fakeClient{fetches: []kgo.Fetches{fetchOf("events", 0, "not json")}},
+	}
+
+	if err := input.Read(context.TODO(), make(chan any, 10)); err == nil {
+		t.Errorf("expected an error of an invalid json value")
+	}
+}
+
+func TestReadFetchError(t *testing.T) {
+	input := &KafkaReader{client: &fakeClient{fetches: []kgo.Fetches{kgo.NewErrFetch(kerr.TopicAuthorizationFailed)}}}
+
+	if err := input.Read(context.TODO(), make(chan any, 10)); !errors.Is(err, kerr.TopicAuthorizationFailed) {
+		t.Errorf("expected the fetch error, got %v", err)
+	}
+}
+
+func TestReadUntilCancelled(t *testing.T) {
+	input := &KafkaReader{client: &fakeClient{fetches: []kgo.Fetches{fetchOf("events", 0, "a")}}}
+
+	ctx, cancel := context.WithCancel(context.TODO())
+	output := make(chan any, 10)
+	done := make(chan error, 1)
+	go func() { done <- input.Read(ctx, output) }()
+
+	if record := <-output; record.(map[string]any)["value"] != "a" {
+		t.Errorf("wrong record %v", record)
+	}
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected cancellation, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("read not stopped by cancellation")
+	}
+}
+
+func TestCommitOffsets(t *testing.T) {
+	client := &fakeClient{fetches: []kgo.Fetches{fetchOf("events", 0, "a", "b", "c"), fetchOf("events", 1, "d")}}
+	input := &KafkaReader{Config: KafkaReaderConfig{IdleTimeout: 10}, client: client}
+
+	records := readAll(t, input)
+	// records of a batch are not ordered by offset when the batch spans fetches
+	records[0], records[2] = records[2], records[0]
+	if err := input.Commit(context.TODO(), records); err != nil {
+		t.Fatalf("commit failed with error %s", err)
+	}
+
+	if len(client.committed) != 1 {
+		t.Fatalf("expected 1 commit, got %d", len(client.committed))
+	}
+	offsets := client.committed[0]["events"]
+	if offsets[0].Offset != 3 || offsets[1].Offset != 1 {
+		t.Errorf("expected the offsets following the records, got %v", offsets)
+	}
+
+	if err := input.Commit(context.TODO(), nil); err != nil || len(client.committed) != 1 {
+		t.Errorf("expected no commit without records, got %v", err)
+	}
+}
+
+func TestCommitInvalidRecords(t *testing.T) {
+	client := &fakeClient{}
+	input := &KafkaReader{client: client}
+
+	for _, record := range []any{
+		"value",
+		map[string]any{"topic": "events", "offset": int64(1)},
+		map[string]any{"topic": "events", "partition": int32(0), "offset": float64(1)},
+		map[any]any{"topic": "events", "partition": int32(0), "offset": int64(1)},
+	} {
+		if err := input.Commit(context.TODO(), []any{record}); !errors.Is(err, ErrInvalidRecord) {
+			t.Errorf("expected an invalid record error of %v, got %v", record, err)
+		}
+	}
+	if len(client.committed) != 0 {
+		t.Errorf("expected no commit of invalid records, got %v", client.committed)
+	}
+}
+
+func TestCommitError(t *testing.T) {
+	client := &fakeClient{fetches: []kgo.Fetches{fetchOf("events", 0, "a")}, commitErrorCode: kerr.RebalanceInProgress.Code}
+	input := &KafkaReader{Config: KafkaReaderConfig{IdleTimeout: 10}, client: client}
+
+	if err := input.Commit(context.TODO(), readAll(t, input)); !errors.Is(err, kerr.RebalanceInProgress) {
+		t.Errorf("expected the partition error, got %v", err)
+	}
+}
+
+// TestWorkerStopsAfterUnwrittenBatch runs the input worker with a batch which fails to be written between two batches,
+// no offset past the failed batch is committed and the worker stops so its records are read again.
+func TestWorkerStopsAfterUnwrittenBatch(t *testing.T) {
+	brokerUri := fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+	storageUri := fmt.Sprintf("mem://%s-%d", t.Name(), time.Now().UnixNano())
+	broker, _ := amqp.NewBroker(brokerUri)
+	if err := broker.Connect(context.TODO(), brokerUri); err != nil {
+		t.Fatal(err)
+	}
+	defer broker.Close()
+	for _, queue := range []string{"requests", "responses"} {
+		if err := broker.QueueDeclare(queue, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Setenv(worker.LIGHTBYTE_WORKER_AMQP_URI, brokerUri)
+	t.Setenv(worker.LIGHTBYTE_WORKER_LISTEN_QUEUE, "requests")
+	t.Setenv(worker.LIGHTBYTE_WORKER_RESPONSE_QUEUE, "responses")
+	t.Setenv(worker.LIGHTBYTE_WORKER_BATCH_SIZE, "2")
+	client := &fakeClient{fetches: []kgo.Fetches{fetchOf("events", 0, "a", "b", "c", "d", "e", "f")}}
+	input, err := worker.NewInputWorker(&KafkaReader{client: client})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() { stopped <- input.RunContext(ctx) }()
+
+	responses, err := broker.Messages(ctx, "responses")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request := func(resultUri string, expected rpc.ProcessResult) {
+		t.Helper()
+		if err := rpc.Publish(ctx, broker, "requests", &rpc.ProcessRequest{CorrelationId: uuid.New(), ResultUri: resultUri}, "test"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-responses:
+			msg.Ack(false)
+			if resp, err := rpc.DecodeProcessResponse(msg); err != nil || resp.Status != expected {
+				t.Fatalf("expected a %s response, got %+v, error %v", expected, resp, err)
+			}
+		case <-ctx.Done():
+			t.Fatalf("no response to the request of %s", resultUri)
+		}
+	}
+
+	request(storageUri+"/first.cbor", rpc.OK)
+	request("unsupported://second", rpc.ERROR)
+
+	select {
+	case err := <-stopped:
+		if !errors.Is(err, worker.ErrBatchNotCommittable) {
+			t.Errorf("expected the worker to stop with an uncommittable batch, got %v", err)
+		}
+	case <-ctx.Done():
+		t.Fatalf("worker not stopped after the unwritten batch")
+	}
+
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if len(client.committed) != 1 || client.committed[0]["events"][0].Offset != 2 {
+		t.Errorf("expected only the first batch committed, got %v", client.committed)
+	}
+}
+
+// TestKafkaCommittedOffsets reads a topic of a broker with a group, commits part of it and reads the rest with a new member.
+func TestKafkaCommittedOffsets(t *testing.T) {
+	brokers := os.Getenv(LIGHTBYTE_TEST_KAFKA_BROKERS)
+	if brokers == "" {
+		t.Skipf("%s is not set", LIGHTBYTE_TEST_KAFKA_BROKERS)
+	}
+
+	topic := fmt.Sprintf("lightbyte_test_%d", time.Now().UnixNano())
+	producer, err := kgo.NewClient(kgo.SeedBrokers(strings.Split(brokers, ",")...), kgo.AllowAutoTopicCreation())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer producer.Close()
+	for i := 0; i < 6; i++ {
+		record := &kgo.Record{Topic: topic, Value: []byte(fmt.Sprintf(`{"seq":%d}`, i))}
+		if err := producer.ProduceSync(context.TODO(), record).FirstErr(); err != nil {
+			t.Fatalf("produce failed with error %s", err)
+		}
+	}
+
+	config := KafkaReaderConfig{
+		Brokers:     strings.Split(brokers, ","),
+		Topics:      []string{topic},
+		Group:       topic,
+		StartOffset: START_OFFSET_EARLIEST,
+		ValueFormat: VALUE_FORMAT_JSON,
+		IdleTimeout: 5000,
+	}
+
+	first, err := NewKafkaReader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readAll(t, first)
+	if len(records) != 6 {
+		t.Fatalf("expected 6 records, got %d", len(records))
+	}
+	if err := first.Commit(context.TODO(), records[:4]); err != nil {
+		t.Fatalf("commit failed with error %s", err)
+	}
+	first.Close()
+
+	second, err := NewKafkaReader(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	records = readAll(t, second)
+	if len(records) != 2 {
+		t.Fatalf("expected the 2 uncommitted records, got %d", len(records))
+	}
+	if seq := records[0].(map[string]any)["value"].(map[string]any)["seq"]; seq != float64(4) {
+		t.Errorf("expected the first uncommitted record, got seq %v", seq)
+	}
+}
@@ -9,7 +9,9 @@ import (
 
 func main() {
 	customConfig := w.Config{}
-	worker.ReadConfigEnvVar(&customConfig)
+	if err := worker.LoadConfig(&customConfig, w.ConfigSchema); err != nil {
+		log.Fatal(err)
+	}
 
 	sink := w.NewPgsqlCopySink(customConfig)
 	worker, err := worker.NewStepWorker(
@@ -2,20 +2,25 @@ package worker
 
 import (
 	"database/sql"
+	_ "embed"
+	"errors"
 	"fmt"
 	"strings"
 
 	"github.com/lib/pq"
 )
 
+//go:embed config.schema.json
+var ConfigSchema []byte
+
 type Config struct {
-	User     string   `mapstructure:"user"`
-	Password string   `mapstructure:"password"`
-	Host     string   `mapstructure:"host"`
-	Port     int      `mapstructure:"port"`
-	Dbname   string   `mapstructure:"db_name"`
-	Table    string   `mapstructure:"table"`
-	Columns  []string `mapstructure:"columns"`
+	User     string   `json:"user" mapstructure:"user"`
+	Password string   `json:"password" mapstructure:"password"`
+	Host     string   `json:"host" mapstructure:"host"`
+	Port     int      `json:"port" mapstructure:"port"`
+	Dbname   string   `json:"db_name" mapstructure:"db_name"`
+	Table    string   `json:"table" mapstructure:"table"`
+	Columns  []string `json:"columns" mapstructure:"columns"`
 }
 
 type PgsqlCopySink struct {
@@ -90,6 +95,26 @@ func (p *PgsqlCopySink) AfterTransform() error {
 	return p.Db.Close()
 }
 
+func (p *PgsqlCopySink) AbortTransform(cause error) error {
+	var err error = nil
+
+	if p.Stmt != nil {
+		err = errors.Join(err, p.Stmt.Close())
+	}
+
+	if p.Txn != nil {
+		err = errors.Join(err, p.Txn.Rollback())
+	}
+
+	if p.Db != nil {
+		err = errors.Join(err, p.Db.Close())
+	}
+
+	p.Stmt, p.Txn, p.Db = nil, nil, nil
+
+	return err
+}
+
 func (p PgsqlCopySink) Transform(data any) (any, error) {
 	inputData := make([]any, len(p.Config.Columns))
 	for idx, columnName := range p.Config.Columns {